@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+// accessRuleOptions is an access rule that may be set in the configuration file
+type accessRuleOptions struct {
+	Name       string   `mapstructure:"name"`
+	Action     string   `mapstructure:"action"`
+	Realms     []string `mapstructure:"realms"`
+	Types      []string `mapstructure:"types"`
+	Networks   []string `mapstructure:"networks"`
+	Identities []string `mapstructure:"identities"`
+}
+
+// accessRules returns the default action and the rules from the "access-rules" section of the
+// configuration file
+func accessRules() (proxy.AccessAction, []proxy.AccessRule, error) {
+	var options []accessRuleOptions
+	if err := viper.UnmarshalKey("access-rules", &options); err != nil {
+		return "", nil, err
+	}
+
+	rules := make([]proxy.AccessRule, 0, len(options))
+	for _, o := range options {
+		rule := proxy.AccessRule{
+			Name:       o.Name,
+			Action:     proxy.AccessAction(o.Action),
+			Realms:     o.Realms,
+			Networks:   o.Networks,
+			Identities: o.Identities,
+		}
+		for _, t := range o.Types {
+			rule.Types = append(rule.Types, proxy.MessageType(t))
+		}
+		rules = append(rules, rule)
+	}
+
+	return proxy.AccessAction(viper.GetString("access-default")), rules, nil
+}
+
+// accessOption returns the option to apply the access rules from the configuration file
+func accessOption() proxy.Option {
+	return func(k *proxy.KerberosProxy) error {
+		defaultAction, rules, err := accessRules()
+		if err != nil {
+			return err
+		}
+
+		return k.SetAccessRules(defaultAction, rules)
+	}
+}
+
+// authzOption returns the option to ask the external authorization webhook about each request
+func authzOption() proxy.Option {
+	return func(k *proxy.KerberosProxy) error {
+		a, err := proxy.NewWebhookAuthorizer(proxy.WebhookConfig{
+			URL:      viper.GetString("authz-url"),
+			CacheTTL: viper.GetDuration("authz-cache-ttl"),
+			Client:   &http.Client{Timeout: viper.GetDuration("authz-timeout")},
+		})
+		if err != nil {
+			return err
+		}
+
+		return proxy.WithAuthorizer(a)(k)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// benchFlags adds the command line flags used by the bench subcommand
+func benchFlags(fs *pflag.FlagSet) {
+	fs.Int("requests", 100, "Total number of requests to send")
+	fs.Int("concurrency", 10, "Number of requests to send in parallel")
+}
+
+// runBench sends the configured number of AS-REQs for the principal through the KDC proxy and
+// reports the throughput and latency percentiles. Both AS-REP and KRB-ERROR replies count as
+// successful round trips.
+func runBench(w io.Writer) error {
+	n, concurrency := viper.GetInt("requests"), viper.GetInt("concurrency")
+	if n < 1 || concurrency < 1 {
+		return fmt.Errorf("requests and concurrency must be at least 1")
+	}
+
+	body, err := testBody(viper.GetString("principal"))
+	if err != nil {
+		return err
+	}
+
+	send, err := newRequester(principalRealm(viper.GetString("principal")))
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, n)
+		errs      int
+		wg        sync.WaitGroup
+	)
+	jobs := make(chan struct{})
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				t := time.Now()
+				status, _, err := send(body)
+				d := time.Since(t)
+
+				mu.Lock()
+				if err != nil || status != http.StatusOK {
+					errs++
+				} else {
+					latencies = append(latencies, d)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(w, "requests: %d, errors: %d, elapsed: %s, rate: %.1f req/s\n", n, errs, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Fprintf(w, "latency p50: %s, p95: %s, p99: %s\n", percentile(latencies, 50), percentile(latencies, 95), percentile(latencies, 99))
+	}
+
+	if errs == n {
+		return fmt.Errorf("all requests failed")
+	}
+
+	return nil
+}
+
+// percentile returns the p-th percentile of the sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// newRootCommand returns the kdcproxy command and its subcommands, which all share the same
+// configuration flags, environment variables and configuration file
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:          "kdcproxy",
+		Short:        "Kerberos KDC Proxy (MS-KKDCP) service",
+		Version:      getVersionInfo().Version,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return loadConfig(cmd.Flags())
+		},
+		// running without a subcommand serves as before subcommands were added
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return serve()
+		},
+	}
+	root.SetVersionTemplate(getVersionInfo().String() + "\n")
+	addFlags(root.PersistentFlags())
+
+	root.AddCommand(
+		&cobra.Command{
+			Use:   "serve",
+			Short: "Run the KDC proxy service",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return serve()
+			},
+		},
+		&cobra.Command{
+			Use:   "check",
+			Short: "Validate the configuration without starting the service",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				return runCheck(cmd)
+			},
+		},
+		&cobra.Command{
+			Use:   "version",
+			Short: "Print the version",
+			Args:  cobra.NoArgs,
+			Run: func(cmd *cobra.Command, args []string) {
+				fmt.Fprintln(cmd.OutOrStdout(), getVersionInfo())
+			},
+		},
+		newTestCommand(),
+		newBenchCommand(),
+		newHealthcheckCommand(),
+		newConfigCommand(),
+		newEnvCommand(root),
+	)
+
+	return root
+}
+
+func newTestCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test",
+		Short: "Request a TGT through the KDC proxy to verify it end-to-end",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := runTest(cmd.OutOrStdout()); err != nil {
+				return fmt.Errorf("test failed: %w", err)
+			}
+
+			return nil
+		},
+	}
+	testFlags(cmd.Flags())
+
+	return cmd
+}
+
+func newBenchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the latency and throughput of AS-REQ round trips through the KDC proxy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBench(cmd.OutOrStdout())
+		},
+	}
+	testFlags(cmd.Flags())
+	benchFlags(cmd.Flags())
+
+	return cmd
+}
+
+func newHealthcheckCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "healthcheck",
+		Short: "Probe the health endpoint of a local instance",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := runHealthcheck(cmd.OutOrStdout()); err != nil {
+				return fmt.Errorf("unhealthy: %w", err)
+			}
+
+			return nil
+		},
+	}
+	healthcheckFlags(cmd.Flags())
+
+	return cmd
+}
+
+func newConfigCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "dump",
+		Short: "Print the effective krb5 configuration as YAML",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := dumpConfig(cmd.OutOrStdout()); err != nil {
+				return fmt.Errorf("could not dump config: %w", err)
+			}
+
+			return nil
+		},
+	})
+
+	return cmd
+}
+
+func newEnvCommand(root *cobra.Command) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "env",
+		Short: "List the environment variables that may be used instead of command line flags",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			markdown, _ := cmd.Flags().GetBool("markdown")
+
+			return listEnv(cmd.OutOrStdout(), root, markdown)
+		},
+	}
+	cmd.Flags().Bool("markdown", false, "Output as a Markdown table")
+
+	return cmd
+}
+
+// envName returns the environment variable for a flag
+func envName(flag string) string {
+	return "KDC_PROXY_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// listEnv writes the environment variable, default and usage of the flags of root and its
+// subcommands, excluding deprecated flags
+func listEnv(w io.Writer, root *cobra.Command, markdown bool) error {
+	flags := make(map[string]*pflag.Flag)
+	var walk func(cmd *cobra.Command)
+	walk = func(cmd *cobra.Command) {
+		cmd.LocalFlags().VisitAll(func(f *pflag.Flag) {
+			if f.Deprecated == "" && f.Name != "help" && f.Name != "version" && f.Name != "markdown" {
+				flags[f.Name] = f
+			}
+		})
+		for _, c := range cmd.Commands() {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if markdown {
+		fmt.Fprintln(w, "| Flag | Environment Variable | Default | Description |")
+		fmt.Fprintln(w, "|------|----------------------|---------|-------------|")
+		for _, name := range names {
+			f := flags[name]
+			fmt.Fprintf(w, "| --%s | %s | %s | %s |\n", name, envName(name), envDefault(f), f.Usage)
+		}
+
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VARIABLE\tDEFAULT\tDESCRIPTION")
+	for _, name := range names {
+		f := flags[name]
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", envName(name), envDefault(f), f.Usage)
+	}
+
+	return tw.Flush()
+}
+
+// envDefault returns the default of a flag as it would be set in the environment
+func envDefault(f *pflag.Flag) string {
+	if f.Value.Type() == "stringSlice" {
+		return strings.Trim(f.DefValue, "[]")
+	}
+
+	return f.DefValue
+}
+
+// runCheck sets up the service from the current configuration, without listening, and reports
+// the realms it will proxy for
+func runCheck(cmd *cobra.Command) error {
+	if _, err := newLogger(); err != nil {
+		return err
+	}
+	logger, err := consoleLogger()
+	if err != nil {
+		return err
+	}
+
+	svc, err := newService(logger)
+	if err != nil {
+		return err
+	}
+
+	w := cmd.OutOrStdout()
+	realms := svc.proxy.Krb5Config().Realms
+	sort.Slice(realms, func(i, j int) bool { return realms[i].Realm < realms[j].Realm })
+	for _, r := range realms {
+		kdcs := "(discovered via DNS)"
+		if len(r.KDC) > 0 {
+			kdcs = strings.Join(r.KDC, ", ")
+		}
+		fmt.Fprintf(w, "realm %s: %s\n", r.Realm, kdcs)
+	}
+	if len(svc.tenants) > 0 {
+		fmt.Fprintf(w, "%d tenants\n", len(svc.tenants))
+	}
+	fmt.Fprintln(w, "configuration is valid")
+
+	return nil
+}
+
+// consoleLogger returns a logger at the configured level that writes to stderr, for subcommands
+// whose output is on stdout
+func consoleLogger() (zerolog.Logger, error) {
+	level, err := zerolog.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return zerolog.Nop(), fmt.Errorf("invalid log level: %s", viper.GetString("log-level"))
+	}
+
+	return zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).Level(level).With().Timestamp().Logger(), nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/andrewheberle/kdcproxy/pkg/server"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// addFlags adds the configuration flags shared by all commands to fs
+func addFlags(fs *pflag.FlagSet) {
+	fs.String("config", "", "Path to configuration file (YAML, TOML or JSON)")
+	fs.StringSlice("listen", []string{"127.0.0.1:8080"}, "Service listen address, which may be repeated")
+	fs.String("metrics-listen", "", "Plain HTTP listen address, such as on an internal interface, for /metrics and /stats, which otherwise require --admin-token")
+	fs.String("cert", "", "TLS certificate")
+	fs.String("key", "", "TLS key")
+	fs.String("client-ca", "", "CA bundle used to verify client certificates, which are then required")
+	fs.String("jwt-jwks-url", "", "URL of the JSON Web Key Set used to verify JWT bearer tokens, which are then required")
+	fs.String("jwt-issuer", "", "Issuer JWT bearer tokens must be issued by")
+	fs.String("jwt-audience", "", "Audience JWT bearer tokens must be issued for")
+	fs.String("vault-addr", "", "Vault address to fetch the TLS certificate from instead of --cert and --key (default $VAULT_ADDR)")
+	fs.String("vault-token", "", "Vault token (default $VAULT_TOKEN)")
+	fs.String("vault-path", "", "Vault KV v2 secret or PKI issue path of the TLS certificate")
+	fs.String("vault-common-name", "", "Common name of the certificate to issue when --vault-path is a PKI issue path")
+	fs.Duration("vault-ttl", 0, "TTL of certificates issued by the Vault PKI secrets engine")
+	fs.String("tls-min-version", "1.2", "Minimum TLS version accepted (1.2 or 1.3)")
+	fs.Duration("hsts-max-age", server.DefaultHSTSMaxAge, "Max-age of the Strict-Transport-Security header sent over TLS (negative to disable)")
+	fs.Bool("security-headers", true, "Add security hardening headers to responses")
+	fs.Bool("tls-fingerprints", false, "Log a fingerprint of the TLS client hello of each connection")
+	fs.String("krb5conf", "", "Path to krb5.conf, or a colon separated list of files to merge as with KRB5_CONFIG")
+	fs.String("krb5conf-dir", "", "Directory of krb5.conf drop-in files merged with --krb5conf, which take precedence")
+	fs.String("krb5conf-data", "", "Contents of krb5.conf, used instead of --krb5conf")
+	fs.StringSlice("kdc", nil, "KDC for a realm as REALM=host:port, used instead of the krb5.conf or DNS for the realm, which may be repeated")
+	fs.StringSlice("allowed-realms", nil, "Realms that requests may be forwarded for (default all)")
+	fs.StringSlice("denied-realms", nil, "Realms that requests will not be forwarded for")
+	fs.String("access-default", string(proxy.AccessAllow), "Action for requests that match no access rule from the configuration file (allow or deny)")
+	fs.String("authz-url", "", "URL of an external authorization webhook asked whether each request may be forwarded")
+	fs.Duration("authz-cache-ttl", proxy.DefaultAuthzCacheTTL, "Time decisions from the authorization webhook are cached for (negative to disable)")
+	fs.Duration("authz-timeout", proxy.DefaultAuthzTimeout, "Timeout for requests to the authorization webhook")
+	fs.Bool("krb5conf-watch", false, "Reload krb5.conf automatically when it changes")
+	fs.String("kdc-strategy", proxy.StrategyOrdered, "KDC selection strategy (ordered, random or round-robin)")
+	fs.String("ad-site", "", "Active Directory site whose domain controllers are tried first when KDC's are looked up via DNS")
+	fs.Bool("dc-ping", false, "Send a CLDAP ping to KDC's so domain controllers confirmed to be running a KDC for the realm, in --ad-site, are tried first")
+	fs.Duration("dc-ping-timeout", proxy.DefaultDCPingTimeout, "Time to wait for replies to CLDAP pings")
+	fs.StringSlice("protocols", []string{"udp", "tcp"}, "Protocols used to contact KDC's in the order they are tried")
+	fs.Int("udp-preference-limit", -1, "Message size in bytes above which TCP is tried before UDP to contact the KDC, 1 for TCP only (-1 to use krb5.conf)")
+	fs.Duration("read-timeout", time.Second*30, "Maximum duration for reading an entire request")
+	fs.Duration("write-timeout", time.Second*30, "Maximum duration before timing out writes of a response")
+	fs.Duration("read-header-timeout", server.DefaultReadHeaderTimeout, "Maximum duration for reading request headers")
+	fs.Duration("body-timeout", server.DefaultBodyTimeout, "Maximum duration for reading a request body")
+	fs.Int("max-conns-per-ip", 0, "Maximum concurrent connections from a single client IP, such as 100 when clients connect directly (0 for no limit)")
+	fs.Duration("drain-delay", 0, "Time to keep serving requests after SIGTERM while reporting not ready, before shutting down")
+	fs.String("probe-response", server.ProbeReject, "Response to GET and HEAD requests to the KDC Proxy endpoints (reject, status or redirect)")
+	fs.Duration("shutdown-timeout", server.DefaultShutdownTimeout, "Time allowed for in-flight requests to complete on shutdown")
+	fs.Duration("kdc-timeout", proxy.DefaultTimeout, "Timeout for each exchange with a KDC")
+	fs.Duration("kdc-udp-timeout", 0, "Timeout for each exchange with a KDC over UDP (0 to use --kdc-timeout)")
+	fs.Duration("kdc-tcp-timeout", 0, "Timeout for each exchange with a KDC over TCP (0 to use --kdc-timeout)")
+	fs.Int("max-response-size", proxy.DefaultMaxResponseSize, "Maximum size in bytes of a response from a KDC")
+	fs.Duration("kdc-prewarm", 0, "Keep a pre-established TCP connection to each KDC, replaced after this idle time (0 to disable)")
+	fs.String("timeout-header", "", "Request header, such as "+proxy.DefaultTimeoutHeader+", with a client timeout that limits the time spent forwarding")
+	fs.Duration("timeout-header-max", time.Second*10, "Maximum timeout accepted from the timeout header")
+	fs.Int("kdc-max-kdcs", 0, "Maximum number of different KDC's tried for each request (0 for no limit)")
+	fs.Int("kdc-max-attempts", 0, "Maximum number of KDC exchanges, over all protocols, for each request (0 for no limit)")
+	fs.Bool("kdc-fast-open", false, "Use TCP Fast Open for connections to KDC's where supported by the OS (ignored with --kdc-prewarm)")
+	fs.Duration("kdc-hold-down", 0, "Try a KDC after all others for this long after it fails (0 to disable)")
+	fs.Duration("kdc-affinity", 0, "Send requests from a client to the KDC that answered its last AS exchange for this long afterwards (0 to disable)")
+	fs.Duration("kdc-hedge-delay", 0, "Also send a request to the next KDC when the first has not answered within this delay (0 to disable)")
+	fs.Bool("kdc-adaptive", false, "Try KDC's that fail intermittently after the others, based on a moving average of failures")
+	fs.StringSlice("slo", nil, "Latency objective as target:threshold, such as 95%:500ms, to export SLO metrics for, which may be repeated")
+	fs.StringSlice("status-codes", nil, "HTTP status code for a class of failure as class=code, such as upstream-unavailable=502, which may be repeated")
+	fs.StringSlice("peers", nil, "Base URLs of other instances to share KDC health with")
+	fs.String("peer-secret", "", "Shared secret used to authenticate KDC health sharing between peers")
+	fs.Int("rate-limit", proxy.DefaultRateLimit, "Requests per second to the KDC allowed")
+	fs.Int("rate-burst", 0, "Requests to the KDC allowed in a burst above the rate limit (0 for the same as the rate limit)")
+	fs.Int("rate", proxy.DefaultRateLimit, "Requests per second to the KDC allowed")
+	fs.MarkDeprecated("rate", "use --rate-limit instead")
+	fs.Int("max-inflight", proxy.DefaultMaxInFlight, "Maximum number of requests processed concurrently (0 for no limit)")
+	fs.Int("fair-queue", 0, "Maximum number of requests forwarded to KDCs concurrently, with further requests queued and each realm served in turn (0 to disable)")
+	fs.Int("fair-queue-depth", 0, "Maximum number of requests queued per realm when --fair-queue is set (0 for no limit)")
+	fs.Int("ban-threshold", 0, "Number of client errors within the ban window before a client is banned (0 to disable)")
+	fs.Duration("ban-window", time.Minute, "Window over which client errors are counted")
+	fs.Duration("ban-duration", time.Minute*10, "Duration a client is banned for")
+	fs.Int("client-quota", 0, "Maximum requests per second from each client, identified by client certificate or IP address (0 to disable)")
+	fs.Int("client-quota-burst", 0, "Maximum burst of requests from each client (0 to use --client-quota)")
+	fs.Bool("client-metrics", false, "Enable per client metrics")
+	fs.Int("client-metrics-limit", 1000, "Maximum number of distinct clients tracked by per client metrics")
+	fs.Duration("dedupe-window", 0, "Serve duplicate requests received within this window with the original response (0 to disable)")
+	fs.Bool("diagnostic-headers", false, "Add X-KdcProxy-* response headers showing which KDC answered")
+	fs.Bool("dry-run", false, "Validate requests and return a synthetic KRB-ERROR without contacting a KDC")
+	fs.Float64("fault-latency-percent", 0, "Percentage of KDC exchanges delayed by --fault-latency, to rehearse degraded KDC's")
+	fs.Duration("fault-latency", time.Second, "Latency added to KDC exchanges selected by --fault-latency-percent")
+	fs.Float64("fault-drop-percent", 0, "Percentage of KDC exchanges dropped so they time out, to rehearse degraded KDC's")
+	fs.Float64("fault-truncate-percent", 0, "Percentage of KDC exchanges failed as if the reply was truncated, to rehearse degraded KDC's")
+	fs.String("capture-dir", "", "Directory to write captured requests and responses to for troubleshooting")
+	fs.String("dump-messages", "", "Log each Kerberos request and response at debug level as hex or base64 (disabled when empty)")
+	fs.Int("dump-max-bytes", proxy.DefaultDumpMaxBytes, "Maximum number of bytes of each Kerberos message logged by --dump-messages")
+	fs.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export traces to (host:port)")
+	fs.Bool("otlp-insecure", false, "Disable TLS when exporting traces")
+	fs.String("log-format", "json", "Log output format (json or console)")
+	fs.String("log-level", "info", "Log level (debug, info, warn or error)")
+	fs.String("admin-token", "", "Bearer token required to change the log level at runtime via /admin/loglevel, view recent errors via /admin/errors, stream requests via /admin/tail and change rate limits via /admin/ratelimit, view the configuration via /admin/config and, without --metrics-listen, view /metrics and /stats (disabled when empty)")
+	fs.Int("recent-errors", proxy.DefaultRecentErrors, "Number of recent forwarding errors kept for /admin/errors")
+	fs.Int("access-log-sample", 1, "Log 1 in N successful requests (errors are always logged)")
+	fs.String("siem-address", "", "Syslog address to send audit events to a SIEM, such as udp://siem.example.com:514")
+	fs.String("siem-format", server.SIEMFormatCEF, "Format of audit events sent to the SIEM (cef or leef)")
+	fs.String("audit-sink", "", "Core NATS subject, such as nats://nats.example.com:4222/kdcproxy.audit or nats+tls:// to require TLS, or Kafka topic via a Kafka REST Proxy, such as kafka-rest+https://kafka-rest.example.com/kdcproxy-audit, to publish an event for each KDC exchange to")
+}
+
+// loadConfig merges the parsed command line flags in fs with environment variables and any
+// configuration file
+func loadConfig(fs *pflag.FlagSet) error {
+	// viper setup
+	viper.SetEnvPrefix("kdc_proxy")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
+	if err := viper.BindPFlags(fs); err != nil {
+		return err
+	}
+
+	// load config file if provided, which has lower precedence than flags and environment variables
+	if config := viper.GetString("config"); config != "" {
+		viper.SetConfigFile(config)
+		if err := viper.ReadInConfig(); err != nil {
+			return fmt.Errorf("could not read config file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// listenAddrs returns the configured listen addresses, which may be repeated or comma separated
+func listenAddrs() []string {
+	var addrs []string
+	for _, v := range viper.GetStringSlice("listen") {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
+}
+
+// rateLimit returns the configured rate limit, using the deprecated "rate" setting when
+// "rate-limit" is not set
+func rateLimit() int {
+	if !viper.IsSet("rate-limit") && viper.IsSet("rate") {
+		return viper.GetInt("rate")
+	}
+
+	return viper.GetInt("rate-limit")
+}
+
+// jwtConfig returns the configuration to require JWT bearer tokens, or nil when no key set is
+// configured
+func jwtConfig() *server.JWTConfig {
+	if viper.GetString("jwt-jwks-url") == "" {
+		return nil
+	}
+
+	return &server.JWTConfig{
+		Issuer:   viper.GetString("jwt-issuer"),
+		Audience: viper.GetString("jwt-audience"),
+		JWKSURL:  viper.GetString("jwt-jwks-url"),
+	}
+}
+
+// sloOption returns the option to export metrics for the latency objectives
+func sloOption() proxy.Option {
+	return func(k *proxy.KerberosProxy) error {
+		var objectives []proxy.LatencyObjective
+		for _, v := range viper.GetStringSlice("slo") {
+			o, err := proxy.ParseLatencyObjective(v)
+			if err != nil {
+				return fmt.Errorf("invalid latency objective %q: %w", v, err)
+			}
+			objectives = append(objectives, o)
+		}
+
+		return proxy.WithLatencyObjectives(objectives...)(k)
+	}
+}
+
+// statusCodesOption returns the option to change the HTTP status codes returned for classes of failure
+func statusCodesOption() proxy.Option {
+	return func(k *proxy.KerberosProxy) error {
+		codes := make(map[string]int)
+		for _, v := range viper.GetStringSlice("status-codes") {
+			failure, code, ok := strings.Cut(v, "=")
+			n, err := strconv.Atoi(strings.TrimSpace(code))
+			if !ok || err != nil {
+				return fmt.Errorf("invalid status code %q, expected class=code", v)
+			}
+			codes[strings.TrimSpace(failure)] = n
+		}
+
+		return proxy.WithStatusCodes(codes)(k)
+	}
+}
+
+// krb5Option returns the option to configure the proxy from either the inline krb5 configuration
+// or the krb5.conf files, along with any KDC's given by --kdc
+func krb5Option() proxy.Option {
+	return func(k *proxy.KerberosProxy) error {
+		kdcs, err := staticKDCs(viper.GetStringSlice("kdc"))
+		if err != nil {
+			return err
+		}
+		for realm, list := range kdcs {
+			if err := proxy.WithKDCs(realm, list...)(k); err != nil {
+				return err
+			}
+		}
+
+		return loadKrb5(k)
+	}
+}
+
+// staticKDCs parses KDC's given as REALM=host:port into the KDC's of each realm
+func staticKDCs(values []string) (map[string][]string, error) {
+	kdcs := make(map[string][]string)
+	for _, v := range values {
+		realm, kdc, ok := strings.Cut(v, "=")
+		realm, kdc = strings.TrimSpace(realm), strings.TrimSpace(kdc)
+		if !ok || realm == "" || kdc == "" {
+			return nil, fmt.Errorf("invalid kdc %q, expected REALM=host:port", v)
+		}
+		kdcs[realm] = append(kdcs[realm], kdc)
+	}
+
+	return kdcs, nil
+}
+
+// loadKrb5 loads the inline krb5 configuration, or otherwise the krb5.conf files, into k
+func loadKrb5(k *proxy.KerberosProxy) error {
+	cfg, err := parseKrb5()
+	if err != nil {
+		return err
+	}
+	k.SetKrb5Config(cfg)
+
+	return nil
+}
+
+// parseKrb5 parses the inline krb5 configuration, or otherwise the krb5.conf files
+func parseKrb5() (*krb5config.Config, error) {
+	if data := viper.GetString("krb5conf-data"); data != "" {
+		return proxy.ParseConfigFromReader(strings.NewReader(data))
+	}
+
+	files, err := krb5Files()
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy.ParseConfigs(files...)
+}
+
+// krb5Files returns the krb5.conf files to load, with those in the drop-in directory first so they
+// take precedence over the main krb5.conf. The main krb5.conf may be a list of files as with
+// KRB5_CONFIG, of which those that exist are merged.
+func krb5Files() ([]string, error) {
+	var files []string
+	if dir := viper.GetString("krb5conf-dir"); dir != "" {
+		var err error
+		if files, err = proxy.ConfigDirFiles(dir); err != nil {
+			return nil, err
+		}
+	}
+	if list := viper.GetString("krb5conf"); list != "" {
+		configs, err := proxy.ConfigPathFiles(list)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, configs...)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// adminConfigPath is the endpoint that returns the effective configuration, which requires the
+// admin token
+const adminConfigPath = "/admin/config"
+
+// redacted replaces the value of any sensitive setting
+const redacted = "REDACTED"
+
+// sensitive settings are those whose name contains any of these words
+var sensitive = []string{"token", "secret", "password"}
+
+// effectiveConfig returns the fully merged configuration along with the parsed krb5 configuration
+func effectiveConfig(cfg *krb5config.Config) map[string]interface{} {
+	return withKrb5(currentSettings(), cfg)
+}
+
+// currentSettings returns the fully merged configuration with sensitive values redacted
+func currentSettings() map[string]interface{} {
+	settings := viper.AllSettings()
+	delete(settings, "version")
+	sanitise(settings)
+
+	// realm names contain dots so are split by viper into nested keys
+	delete(settings, "realms")
+	if configs, err := realmConfigs(); err == nil && len(configs) > 0 {
+		realms := make(map[string]interface{}, len(configs))
+		for realm, c := range configs {
+			realms[strings.ToUpper(realm)] = map[string]interface{}{
+				"timeout":          c.Timeout.String(),
+				"udp-timeout":      c.UDPTimeout.String(),
+				"tcp-timeout":      c.TCPTimeout.String(),
+				"rate":             c.RateLimit,
+				"protocols":        c.Protocols,
+				"max-message-size": c.MaxMessageSize,
+				"strategy":         c.Strategy,
+				"site":             c.Site,
+			}
+		}
+		settings["realms"] = realms
+	}
+
+	return settings
+}
+
+// withKrb5 returns a copy of settings along with the parsed krb5 configuration
+func withKrb5(settings map[string]interface{}, cfg *krb5config.Config) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings)+1)
+	for key, value := range settings {
+		out[key] = value
+	}
+
+	realms := make(map[string]interface{}, len(cfg.Realms))
+	for _, r := range cfg.Realms {
+		realms[r.Realm] = map[string]interface{}{
+			"kdc":            r.KDC,
+			"admin_server":   r.AdminServer,
+			"default_domain": r.DefaultDomain,
+		}
+	}
+
+	out["krb5"] = map[string]interface{}{
+		"libdefaults": map[string]interface{}{
+			"default_realm":        cfg.LibDefaults.DefaultRealm,
+			"dns_lookup_kdc":       cfg.LibDefaults.DNSLookupKDC,
+			"udp_preference_limit": cfg.LibDefaults.UDPPreferenceLimit,
+		},
+		"realms":       realms,
+		"domain_realm": cfg.DomainRealm,
+	}
+
+	return out
+}
+
+// sanitise replaces the values of sensitive settings, removes any credentials from URLs and
+// formats durations in place
+func sanitise(settings map[string]interface{}) {
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			sanitise(v)
+			continue
+		case time.Duration:
+			settings[key] = v.String()
+		case string:
+			settings[key] = stripUserinfo(v)
+		case []string:
+			stripped := make([]string, len(v))
+			for i, s := range v {
+				stripped[i] = stripUserinfo(s)
+			}
+			settings[key] = stripped
+		case []interface{}:
+			stripped := make([]interface{}, len(v))
+			for i, e := range v {
+				if s, ok := e.(string); ok {
+					e = stripUserinfo(s)
+				}
+				stripped[i] = e
+			}
+			settings[key] = stripped
+		}
+
+		for _, word := range sensitive {
+			if strings.Contains(strings.ToLower(key), word) && value != "" {
+				settings[key] = redacted
+				break
+			}
+		}
+	}
+}
+
+// stripUserinfo removes the user name and password from s when it is a URL, such as the NATS
+// credentials of an audit sink
+func stripUserinfo(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+
+	return u.String()
+}
+
+// dumpConfig writes the effective configuration as YAML
+func dumpConfig(w io.Writer) error {
+	k, err := proxy.NewKdcProxy(
+		krb5Option(),
+		proxy.WithRegistry(prometheus.NewRegistry()),
+	)
+	if err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+
+	return enc.Encode(effectiveConfig(k.Krb5Config()))
+}
+
+// configSnapshot is the effective configuration as of the last load or reload, so it can be served
+// without reading viper while a reload changes it
+type configSnapshot struct {
+	settings atomic.Pointer[map[string]interface{}]
+}
+
+// newConfigSnapshot returns a snapshot of the current configuration
+func newConfigSnapshot() *configSnapshot {
+	c := &configSnapshot{}
+	c.update()
+
+	return c
+}
+
+// update takes a new snapshot of the current configuration, which must not be called while
+// viper is being changed
+func (c *configSnapshot) update() {
+	settings := currentSettings()
+	c.settings.Store(&settings)
+}
+
+// configHandler returns the snapshot of the configuration along with the current krb5
+// configuration as JSON
+func configHandler(k *proxy.KerberosProxy, snapshot *configSnapshot) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withKrb5(*snapshot.settings.Load(), k.Krb5Config()))
+	})
+}
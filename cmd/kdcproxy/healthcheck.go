@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// healthcheckFlags adds the command line flags used by the healthcheck subcommand
+func healthcheckFlags(fs *pflag.FlagSet) {
+	fs.String("health-path", "/healthz", "Endpoint of the local instance to probe (/healthz or /readyz)")
+	fs.Duration("health-timeout", time.Second*5, "Timeout for the health check")
+}
+
+// runHealthcheck probes the health endpoint of the instance listening on the first configured
+// address and returns an error unless it responds with 200 OK
+func runHealthcheck(w io.Writer) error {
+	addrs := listenAddrs()
+	if len(addrs) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+
+	host, port, err := net.SplitHostPort(addrs[0])
+	if err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+
+	// probe over loopback when listening on all addresses
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	scheme := "http"
+	if (viper.GetString("cert") != "" && viper.GetString("key") != "") || viper.GetString("vault-path") != "" {
+		scheme = "https"
+	}
+	url := scheme + "://" + net.JoinHostPort(host, port) + viper.GetString("health-path")
+
+	client := &http.Client{
+		Timeout: viper.GetDuration("health-timeout"),
+		Transport: &http.Transport{
+			// the certificate will not be valid for the loopback address
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	fmt.Fprintf(w, "%s returned %s\n", url, resp.Status)
+
+	return nil
+}
@@ -2,133 +2,361 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/andrewheberle/kdcproxy/pkg/proxy"
-	"github.com/cloudflare/certinel/fswatcher"
-	"github.com/justinas/alice"
+	"github.com/andrewheberle/kdcproxy/pkg/server"
 	"github.com/oklog/run"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/diode"
-	"github.com/rs/zerolog/hlog"
-	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 func main() {
-	// command line flags
-	pflag.String("listen", "127.0.0.1:8080", "Service listen address")
-	pflag.String("cert", "", "TLS certificate")
-	pflag.String("key", "", "TLS key")
-	pflag.String("krb5conf", "", "Path to krb5.conf")
-	pflag.Int("rate", proxy.DefaultRateLimit, "Requests per second to the KDC allowed")
-	pflag.Parse()
-
-	// viper setup
-	viper.SetEnvPrefix("kdc_proxy")
-	viper.AutomaticEnv()
-	viper.BindPFlags(pflag.CommandLine)
-
-	// logging
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// newLogger returns a logger using the configured log level and format
+func newLogger() (zerolog.Logger, error) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	logwriter := diode.NewWriter(os.Stdout, 1000, 0, func(missed int) {
+	level, err := zerolog.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return zerolog.Nop(), fmt.Errorf("invalid log level: %s", viper.GetString("log-level"))
+	}
+	zerolog.SetGlobalLevel(level)
+	var out io.Writer
+	switch viper.GetString("log-format") {
+	case "json":
+		out = os.Stdout
+	case "console":
+		out = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	default:
+		return zerolog.Nop(), fmt.Errorf("invalid log format: %s", viper.GetString("log-format"))
+	}
+	logwriter := diode.NewWriter(out, 1000, 0, func(missed int) {
 		fmt.Printf("Dropped %d messages\n", missed)
 	})
-	logger := zerolog.New(logwriter).With().Timestamp().Logger()
-
-	// set up middelware chain for logging
-	c := alice.New()
-	c = c.Append(hlog.NewHandler(logger))
-	c = c.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-		hlog.FromRequest(r).Info().
-			Int("status", status).
-			Int("size", size).
-			Dur("duration", duration).
-			Send()
-	}))
-	c = c.Append(hlog.URLHandler("url"))
-	c = c.Append(hlog.MethodHandler("method"))
-	c = c.Append(hlog.RemoteAddrHandler("ip"))
-	c = c.Append(hlog.UserAgentHandler("user_agent"))
-	c = c.Append(hlog.RefererHandler("referer"))
-	c = c.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
+
+	return zerolog.New(logwriter).With().Timestamp().Logger(), nil
+}
+
+// service is the kdc proxy, any tenants and the server in front of them
+type service struct {
+	proxy   *proxy.KerberosProxy
+	tenants map[string]*proxy.KerberosProxy
+	server  *server.Server
+	config  *configSnapshot
+}
+
+// newService sets up the service from the current configuration without starting it
+func newService(logger zerolog.Logger) (*service, error) {
+	// share kdc health with peers
+	var peers *server.PeerShare
+	var peerOpts []proxy.Option
+	if len(viper.GetStringSlice("peers")) > 0 {
+		var err error
+		peers, err = server.NewPeerShare(viper.GetStringSlice("peers"), viper.GetString("peer-secret"), logger)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up peers: %w", err)
+		}
+		peerOpts = append(peerOpts, proxy.WithHealthShare(peers))
+	}
 
 	// set up kdc proxy
-	k, err := proxy.InitKdcProxyWithConfigAndLimit(viper.GetString("krb5conf"), viper.GetInt("rate"))
+	k, err := newProxy(logger, peerOpts...)
 	if err != nil {
-		logger.Fatal().Err(err).Msg("could not set up kdc proxy")
+		return nil, fmt.Errorf("could not set up kdc proxy: %w", err)
+	}
+	tenants, err := newTenants(logger)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up kdc proxy: %w", err)
 	}
-
-	// add to http service
-	http.Handle("/KdcProxy", c.ThenFunc(k.Handler))
-	http.Handle("/metrics", k.Metrics())
 
 	// set up server
-	srv := http.Server{
-		Addr:         viper.GetString("listen"),
-		ReadTimeout:  time.Second * 30,
-		WriteTimeout: time.Second * 30,
+	tlsVersion, err := server.ParseTLSVersion(viper.GetString("tls-min-version"))
+	if err != nil {
+		return nil, fmt.Errorf("could not set up server: %w", err)
+	}
+	var certificates server.CertificateSource
+	if viper.GetString("vault-path") != "" {
+		certificates, err = server.NewVaultSource(context.Background(), server.VaultConfig{
+			Address:    viper.GetString("vault-addr"),
+			Token:      viper.GetString("vault-token"),
+			Path:       viper.GetString("vault-path"),
+			CommonName: viper.GetString("vault-common-name"),
+			TTL:        viper.GetDuration("vault-ttl"),
+			Logger:     logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch certificate from vault: %w", err)
+		}
+	}
+	var auditSink server.AuditSink
+	if address := viper.GetString("audit-sink"); address != "" {
+		if auditSink, err = server.NewAuditSink(address); err != nil {
+			return nil, fmt.Errorf("could not set up audit sink: %w", err)
+		}
+	}
+	config := newConfigSnapshot()
+	addrs := listenAddrs()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	srv, err := server.NewServer(server.Config{
+		Proxy:                  k,
+		Certificates:           certificates,
+		Listen:                 addrs[0],
+		AdditionalListen:       addrs[1:],
+		MetricsListen:          viper.GetString("metrics-listen"),
+		CertFile:               viper.GetString("cert"),
+		KeyFile:                viper.GetString("key"),
+		ClientCAFile:           viper.GetString("client-ca"),
+		ReadTimeout:            viper.GetDuration("read-timeout"),
+		WriteTimeout:           viper.GetDuration("write-timeout"),
+		ReadHeaderTimeout:      viper.GetDuration("read-header-timeout"),
+		BodyTimeout:            viper.GetDuration("body-timeout"),
+		MaxConnsPerIP:          viper.GetInt("max-conns-per-ip"),
+		DrainDelay:             viper.GetDuration("drain-delay"),
+		ShutdownTimeout:        viper.GetDuration("shutdown-timeout"),
+		Logger:                 logger,
+		AccessLogSample:        viper.GetInt("access-log-sample"),
+		BanThreshold:           viper.GetInt("ban-threshold"),
+		BanWindow:              viper.GetDuration("ban-window"),
+		BanDuration:            viper.GetDuration("ban-duration"),
+		TLSMinVersion:          tlsVersion,
+		HSTSMaxAge:             viper.GetDuration("hsts-max-age"),
+		DisableSecurityHeaders: !viper.GetBool("security-headers"),
+		TLSFingerprints:        viper.GetBool("tls-fingerprints"),
+		JWT:                    jwtConfig(),
+		ClientQuota:            viper.GetInt("client-quota"),
+		ClientQuotaBurst:       viper.GetInt("client-quota-burst"),
+		ClientMetrics:          viper.GetBool("client-metrics"),
+		ClientMetricsLimit:     viper.GetInt("client-metrics-limit"),
+		SIEMAddress:            viper.GetString("siem-address"),
+		SIEMFormat:             viper.GetString("siem-format"),
+		AuditSink:              auditSink,
+		Version:                getVersionInfo().Version,
+		Tenants:                tenants,
+		Peers:                  peers,
+		AdminToken:             viper.GetString("admin-token"),
+		ProbeResponse:          viper.GetString("probe-response"),
+		Handlers: map[string]http.Handler{
+			"/version": http.HandlerFunc(versionHandler),
+		},
+		AdminHandlers: map[string]http.Handler{
+			adminConfigPath: configHandler(k, config),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not set up server: %w", err)
 	}
 
-	// run group
-	g := run.Group{}
+	return &service{proxy: k, tenants: tenants, server: srv, config: config}, nil
+}
 
-	// start server
-	if viper.GetString("cert") != "" && viper.GetString("key") != "" {
-		// logging about command line
-		logger.Info().
-			Str("cert", viper.GetString("cert")).
-			Str("key", viper.GetString("key")).
-			Msg("setting up tls server")
+// serve runs the KDC proxy service until it is interrupted
+func serve() error {
+	logger, err := newLogger()
+	if err != nil {
+		return err
+	}
 
-		certctx, certcancel := context.WithCancel(context.Background())
+	svc, err := newService(logger)
+	if err != nil {
+		logger.Fatal().Err(err).Send()
+	}
+	k, tenants, srv := svc.proxy, svc.tenants, svc.server
 
-		certinel, err := fswatcher.New(viper.GetString("cert"), viper.GetString("key"))
+	// tracing
+	shutdownTracing := func(context.Context) error { return nil }
+	if viper.GetString("otlp-endpoint") != "" {
+		shutdownTracing, err = initTracing(context.Background(), viper.GetString("otlp-endpoint"), viper.GetBool("otlp-insecure"))
 		if err != nil {
-			logger.Fatal().Err(err).Msg("unable to read server certificate")
+			logger.Fatal().Err(err).Msg("could not set up tracing")
 		}
+	}
+	if err := registerBuildInfo(k.Registerer()); err != nil {
+		logger.Fatal().Err(err).Msg("could not register metrics")
+	}
 
-		// add certinel
-		g.Add(func() error {
-			return certinel.Start(certctx)
-		}, func(err error) {
-			certcancel()
-		})
+	// run group
+	g := run.Group{}
 
-		// add TLS enabled server
-		g.Add(func() error {
-			return srv.ListenAndServeTLS("", "")
-		}, func(err error) {
-			go func() {
-				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-				srv.Shutdown(ctx)
-				cancel()
-			}()
-		})
+	// shut down on SIGINT or SIGTERM
+	g.Add(run.SignalHandler(context.Background(), os.Interrupt, syscall.SIGTERM))
 
-	} else {
-		// logging about command line
-		logger.Info().
-			Msg("setting up server")
+	// reload configuration on SIGHUP
+	reloadctx, reloadcancel := context.WithCancel(context.Background())
+	g.Add(func() error {
+		return reloadOnSignal(reloadctx, k, tenants, svc.config, logger)
+	}, func(err error) {
+		reloadcancel()
+	})
 
-		// add non-TLS enabled server
+	// reload krb5.conf when it changes
+	files, err := krb5Files()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("could not list krb5.conf files")
+	}
+	if viper.GetBool("krb5conf-watch") && len(files) > 0 && viper.GetString("krb5conf-data") == "" {
+		watchctx, watchcancel := context.WithCancel(context.Background())
 		g.Add(func() error {
-			return srv.ListenAndServe()
+			return k.WatchConfigs(watchctx, files...)
 		}, func(err error) {
-			go func() {
-				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-				srv.Shutdown(ctx)
-				cancel()
-			}()
+			watchcancel()
 		})
 	}
 
+	// start server
+	srvctx, srvcancel := context.WithCancel(context.Background())
+	g.Add(func() error {
+		return srv.Run(srvctx)
+	}, func(err error) {
+		srvcancel()
+	})
+
 	// start run group
-	if err := g.Run(); err != nil {
+	err = g.Run()
+	var sigErr run.SignalError
+	if errors.As(err, &sigErr) {
+		logger.Info().Str("signal", sigErr.Signal.String()).Msg("shut down")
+		err = nil
+	}
+
+	// flush any pending spans
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownTracing(ctx)
+	cancel()
+
+	if err != nil {
 		logger.Fatal().Err(err).Send()
 	}
+
+	return nil
+}
+
+// newProxy sets up the kdc proxy from the current configuration along with any extra options
+func newProxy(logger zerolog.Logger, extra ...proxy.Option) (*proxy.KerberosProxy, error) {
+	// per-realm settings
+	realms, err := realmConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse realm configuration: %w", err)
+	}
+
+	opts := append(proxyOptions(logger),
+		krb5Option(),
+		accessOption(),
+		proxy.WithLimit(rateLimit()),
+		proxy.WithBurst(viper.GetInt("rate-burst")),
+		proxy.WithAllowedRealms(viper.GetStringSlice("allowed-realms")...),
+		proxy.WithDeniedRealms(viper.GetStringSlice("denied-realms")...),
+	)
+	for realm, config := range realms {
+		opts = append(opts, proxy.WithRealmConfig(realm, config))
+	}
+
+	// metrics are labelled by tenant when tenants are configured
+	tenants, err := tenantConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse tenant configuration: %w", err)
+	}
+	if len(tenants) > 0 {
+		opts = append(opts, proxy.WithRegistry(tenantRegistry("")))
+	}
+
+	return proxy.NewKdcProxy(append(opts, extra...)...)
+}
+
+// proxyOptions returns the options shared by the kdc proxy and any tenants
+func proxyOptions(logger zerolog.Logger) []proxy.Option {
+	opts := []proxy.Option{
+		proxy.WithMaxInFlight(viper.GetInt("max-inflight")),
+		proxy.WithFairQueue(viper.GetInt("fair-queue"), viper.GetInt("fair-queue-depth")),
+		proxy.WithTimeout(viper.GetDuration("kdc-timeout")),
+		proxy.WithUDPTimeout(viper.GetDuration("kdc-udp-timeout")),
+		proxy.WithTCPTimeout(viper.GetDuration("kdc-tcp-timeout")),
+		proxy.WithLogger(newSlogLogger(logger)),
+		proxy.WithProtocols(viper.GetStringSlice("protocols")...),
+		proxy.WithStrategy(viper.GetString("kdc-strategy")),
+		proxy.WithSite(viper.GetString("ad-site")),
+		proxy.WithMaxKDCs(viper.GetInt("kdc-max-kdcs")),
+		proxy.WithMaxAttempts(viper.GetInt("kdc-max-attempts")),
+		proxy.WithRecentErrors(viper.GetInt("recent-errors")),
+		sloOption(),
+		statusCodesOption(),
+	}
+	if limit := viper.GetInt("udp-preference-limit"); limit >= 0 {
+		opts = append(opts, proxy.WithUDPPreferenceLimit(limit))
+	}
+	if d := viper.GetDuration("kdc-hold-down"); d > 0 {
+		opts = append(opts, proxy.WithHoldDown(d))
+	}
+	if window := viper.GetDuration("kdc-affinity"); window > 0 {
+		opts = append(opts, proxy.WithAffinity(window))
+	}
+	if delay := viper.GetDuration("kdc-hedge-delay"); delay > 0 {
+		opts = append(opts, proxy.WithHedging(delay))
+	}
+	if viper.GetBool("kdc-adaptive") {
+		opts = append(opts, proxy.WithAdaptiveOrdering())
+	}
+	if viper.GetBool("dc-ping") {
+		opts = append(opts, proxy.WithDCPing(viper.GetDuration("dc-ping-timeout")))
+	}
+	if idle := viper.GetDuration("kdc-prewarm"); idle > 0 {
+		t := proxy.NewWarmTransport(idle)
+		t.MaxResponseSize = viper.GetInt("max-response-size")
+		opts = append(opts, proxy.WithTransport(t))
+	} else {
+		opts = append(opts, proxy.WithTransport(&proxy.NetTransport{
+			MaxResponseSize: viper.GetInt("max-response-size"),
+			FastOpen:        viper.GetBool("kdc-fast-open"),
+		}))
+	}
+	if viper.GetString("authz-url") != "" {
+		opts = append(opts, authzOption())
+	}
+	if window := viper.GetDuration("dedupe-window"); window > 0 {
+		opts = append(opts, proxy.WithDedupe(window))
+	}
+	if header := viper.GetString("timeout-header"); header != "" {
+		opts = append(opts, proxy.WithTimeoutHeader(header, viper.GetDuration("timeout-header-max")))
+	}
+	if viper.GetBool("diagnostic-headers") {
+		opts = append(opts, proxy.WithDiagnosticHeaders())
+	}
+	if viper.GetBool("dry-run") {
+		opts = append(opts, proxy.WithDryRun())
+	}
+	faults := proxy.FaultInjection{
+		LatencyPercent:  viper.GetFloat64("fault-latency-percent"),
+		Latency:         viper.GetDuration("fault-latency"),
+		DropPercent:     viper.GetFloat64("fault-drop-percent"),
+		TruncatePercent: viper.GetFloat64("fault-truncate-percent"),
+	}
+	if faults.LatencyPercent > 0 || faults.DropPercent > 0 || faults.TruncatePercent > 0 {
+		logger.Warn().
+			Float64("latency_percent", faults.LatencyPercent).
+			Dur("latency", faults.Latency).
+			Float64("drop_percent", faults.DropPercent).
+			Float64("truncate_percent", faults.TruncatePercent).
+			Msg("fault injection is enabled, exchanges with KDC's will fail deliberately")
+		opts = append(opts, proxy.WithFaultInjection(faults))
+	}
+	if dir := viper.GetString("capture-dir"); dir != "" {
+		opts = append(opts, proxy.WithCapture(dir))
+	}
+	if format := viper.GetString("dump-messages"); format != "" {
+		opts = append(opts, proxy.WithMessageDump(format, viper.GetInt("dump-max-bytes")))
+	}
+
+	return opts
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/spf13/viper"
+)
+
+// realmOptions are the per-realm settings that may be set in the configuration file
+type realmOptions struct {
+	Timeout        time.Duration `mapstructure:"timeout"`
+	UDPTimeout     time.Duration `mapstructure:"udp-timeout"`
+	TCPTimeout     time.Duration `mapstructure:"tcp-timeout"`
+	Rate           int           `mapstructure:"rate"`
+	Protocols      []string      `mapstructure:"protocols"`
+	MaxMessageSize int           `mapstructure:"max-message-size"`
+	Strategy       string        `mapstructure:"strategy"`
+	MaxKDCs        int           `mapstructure:"max-kdcs"`
+	MaxAttempts    int           `mapstructure:"max-attempts"`
+	Site           string        `mapstructure:"site"`
+}
+
+// realmConfigs returns the per-realm settings from the "realms" section of the configuration file
+func realmConfigs() (map[string]proxy.RealmConfig, error) {
+	var realms map[string]realmOptions
+	if err := viper.UnmarshalKey("realms", &realms); err != nil {
+		return nil, err
+	}
+
+	return toRealmConfigs(realms), nil
+}
+
+// toRealmConfigs converts per-realm settings from the configuration file to proxy.RealmConfig's
+func toRealmConfigs(realms map[string]realmOptions) map[string]proxy.RealmConfig {
+	configs := make(map[string]proxy.RealmConfig, len(realms))
+	for realm, o := range realms {
+		configs[realm] = proxy.RealmConfig{
+			Timeout:        o.Timeout,
+			UDPTimeout:     o.UDPTimeout,
+			TCPTimeout:     o.TCPTimeout,
+			RateLimit:      o.Rate,
+			Protocols:      o.Protocols,
+			MaxMessageSize: o.MaxMessageSize,
+			Strategy:       o.Strategy,
+			MaxKDCs:        o.MaxKDCs,
+			MaxAttempts:    o.MaxAttempts,
+			Site:           o.Site,
+		}
+	}
+
+	return configs
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// reload re-reads the configuration file and krb5.conf and applies any changed settings. All of the
+// configuration is parsed and validated before any of it is applied, so an invalid configuration
+// leaves the kdc proxy and tenants unchanged.
+func reload(k *proxy.KerberosProxy, tenants map[string]*proxy.KerberosProxy) error {
+	if viper.ConfigFileUsed() != "" {
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	level, err := zerolog.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return err
+	}
+
+	c, err := reloadConfig()
+	if err != nil {
+		return err
+	}
+	apply, err := k.PrepareReload(c)
+	if err != nil {
+		return err
+	}
+
+	applyTenants, err := prepareTenants(tenants, c)
+	if err != nil {
+		return err
+	}
+
+	apply()
+	applyTenants()
+	zerolog.SetGlobalLevel(level)
+
+	return nil
+}
+
+// reloadConfig returns the reloadable configuration of the kdc proxy from the current configuration
+func reloadConfig() (proxy.ReloadConfig, error) {
+	krb5, err := parseKrb5()
+	if err != nil {
+		return proxy.ReloadConfig{}, err
+	}
+	realms, err := realmConfigs()
+	if err != nil {
+		return proxy.ReloadConfig{}, err
+	}
+	defaultAction, rules, err := accessRules()
+	if err != nil {
+		return proxy.ReloadConfig{}, err
+	}
+
+	return proxy.ReloadConfig{
+		Krb5:          krb5,
+		RateLimit:     rateLimit(),
+		RateBurst:     viper.GetInt("rate-burst"),
+		Realms:        realms,
+		AllowedRealms: viper.GetStringSlice("allowed-realms"),
+		DeniedRealms:  viper.GetStringSlice("denied-realms"),
+		AccessDefault: defaultAction,
+		AccessRules:   rules,
+	}, nil
+}
+
+// reloadOnSignal reloads the configuration each time SIGHUP is received until ctx is cancelled
+func reloadOnSignal(ctx context.Context, k *proxy.KerberosProxy, tenants map[string]*proxy.KerberosProxy, config *configSnapshot, logger zerolog.Logger) error {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-c:
+			if err := reload(k, tenants); err != nil {
+				logger.Error().Err(err).Msg("could not reload configuration")
+				continue
+			}
+			config.update()
+			logger.Info().Msg("reloaded configuration")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+func TestReload(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	newProxy := func() *proxy.KerberosProxy {
+		k, err := proxy.NewKdcProxy(
+			proxy.WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+			proxy.WithRegistry(prometheus.NewRegistry()),
+			proxy.WithLimit(10),
+		)
+		if err != nil {
+			t.Fatalf("NewKdcProxy() error = %v", err)
+		}
+
+		return k
+	}
+
+	tests := []struct {
+		name      string
+		protocols []string
+		wantErr   bool
+	}{
+		{"tenant invalid", []string{"sctp"}, true},
+		{"valid", []string{"tcp"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			viper.Set("log-level", "info")
+			viper.Set("krb5conf-data", "[realms]\n OTHER.COM = {\n  kdc = kdc.other.com:88\n }\n")
+			viper.Set("rate-limit", 20)
+			viper.Set("denied-realms", []string{"EXAMPLE.COM"})
+			viper.Set("tenants", map[string]interface{}{
+				"acme": map[string]interface{}{
+					"realms": map[string]interface{}{
+						"other.com": map[string]interface{}{"protocols": tt.protocols},
+					},
+				},
+			})
+
+			k, tenant := newProxy(), newProxy()
+			krb5, tenantKrb5 := k.Krb5Config(), tenant.Krb5Config()
+
+			err := reload(k, map[string]*proxy.KerberosProxy{"acme": tenant})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// nothing is applied unless the whole configuration is valid
+			changed := !tt.wantErr
+			if got := k.Krb5Config() != krb5; got != changed {
+				t.Errorf("krb5 configuration changed = %v, want %v", got, changed)
+			}
+			if got := k.RateLimits().Limit != 10; got != changed {
+				t.Errorf("rate limit changed = %v, want %v", got, changed)
+			}
+			if got := tenant.Krb5Config() != tenantKrb5; got != changed {
+				t.Errorf("tenant krb5 configuration changed = %v, want %v", got, changed)
+			}
+		})
+	}
+}
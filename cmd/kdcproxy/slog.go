@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/rs/zerolog"
+)
+
+// zerologHandler is a slog.Handler that writes records to a zerolog.Logger
+type zerologHandler struct {
+	logger zerolog.Logger
+	group  string
+}
+
+func newSlogLogger(logger zerolog.Logger) *slog.Logger {
+	return slog.New(&zerologHandler{logger: logger})
+}
+
+func (h *zerologHandler) Enabled(_ context.Context, level slog.Level) bool {
+	l := zerologLevel(level)
+	return l >= h.logger.GetLevel() && l >= zerolog.GlobalLevel()
+}
+
+func (h *zerologHandler) Handle(_ context.Context, r slog.Record) error {
+	e := h.logger.WithLevel(zerologLevel(r.Level))
+	r.Attrs(func(a slog.Attr) bool {
+		e = addAttr(e, h.group, a)
+		return true
+	})
+	e.Msg(r.Message)
+
+	return nil
+}
+
+func (h *zerologHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ctx := h.logger.With()
+	for _, a := range attrs {
+		ctx = ctx.Interface(h.key(a.Key), a.Value.Resolve().Any())
+	}
+
+	return &zerologHandler{logger: ctx.Logger(), group: h.group}
+}
+
+func (h *zerologHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return &zerologHandler{logger: h.logger, group: h.key(name)}
+}
+
+func (h *zerologHandler) key(k string) string {
+	if h.group == "" {
+		return k
+	}
+
+	return h.group + "." + k
+}
+
+func addAttr(e *zerolog.Event, group string, a slog.Attr) *zerolog.Event {
+	key := a.Key
+	if group != "" {
+		key = group + "." + key
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return e.Str(key, v.String())
+	case slog.KindInt64:
+		return e.Int64(key, v.Int64())
+	case slog.KindUint64:
+		return e.Uint64(key, v.Uint64())
+	case slog.KindFloat64:
+		return e.Float64(key, v.Float64())
+	case slog.KindBool:
+		return e.Bool(key, v.Bool())
+	case slog.KindDuration:
+		return e.Dur(key, v.Duration())
+	case slog.KindTime:
+		return e.Time(key, v.Time())
+	case slog.KindGroup:
+		// groups with an empty key are inlined
+		if a.Key == "" {
+			key = group
+		}
+		for _, ga := range v.Group() {
+			e = addAttr(e, key, ga)
+		}
+		return e
+	default:
+		if err, ok := v.Any().(error); ok {
+			return e.AnErr(key, err)
+		}
+		return e.Interface(key, v.Any())
+	}
+}
+
+func zerologLevel(level slog.Level) zerolog.Level {
+	switch {
+	case level >= slog.LevelError:
+		return zerolog.ErrorLevel
+	case level >= slog.LevelWarn:
+		return zerolog.WarnLevel
+	case level >= slog.LevelInfo:
+		return zerolog.InfoLevel
+	default:
+		return zerolog.DebugLevel
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+// tenantOptions are the per-tenant settings that may be set in the configuration file
+type tenantOptions struct {
+	AllowedRealms []string                `mapstructure:"allowed-realms"`
+	DeniedRealms  []string                `mapstructure:"denied-realms"`
+	Rate          int                     `mapstructure:"rate"`
+	Burst         int                     `mapstructure:"burst"`
+	Krb5conf      string                  `mapstructure:"krb5conf"`
+	Krb5confData  string                  `mapstructure:"krb5conf-data"`
+	Realms        map[string]realmOptions `mapstructure:"realms"`
+}
+
+// tenantConfigs returns the per-tenant settings from the "tenants" section of the configuration file
+func tenantConfigs() (map[string]tenantOptions, error) {
+	var tenants map[string]tenantOptions
+	if err := viper.UnmarshalKey("tenants", &tenants); err != nil {
+		return nil, err
+	}
+
+	for name := range tenants {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+	}
+
+	return tenants, nil
+}
+
+// rate returns the rate limit of the tenant, which defaults to the global rate limit
+func (o tenantOptions) rate() int {
+	if o.Rate > 0 {
+		return o.Rate
+	}
+
+	return rateLimit()
+}
+
+// burst returns the rate limit burst of the tenant, which defaults to the global burst unless the
+// tenant has its own rate limit
+func (o tenantOptions) burst() int {
+	if o.Burst > 0 || o.Rate > 0 {
+		return o.Burst
+	}
+
+	return viper.GetInt("rate-burst")
+}
+
+// krb5Option returns the option to load the krb5 configuration of the tenant, which defaults to the
+// global krb5 configuration
+func (o tenantOptions) krb5Option() proxy.Option {
+	if o.Krb5confData != "" {
+		return proxy.WithKrb5ConfString(o.Krb5confData)
+	}
+	if o.Krb5conf != "" {
+		return func(k *proxy.KerberosProxy) error {
+			files, err := proxy.ConfigPathFiles(o.Krb5conf)
+			if err != nil {
+				return err
+			}
+			return k.LoadConfigs(files...)
+		}
+	}
+
+	return krb5Option()
+}
+
+// parseKrb5 parses the krb5 configuration of the tenant, which defaults to the global krb5
+// configuration
+func (o tenantOptions) parseKrb5() (*krb5config.Config, error) {
+	if o.Krb5confData != "" {
+		return proxy.ParseConfigFromReader(strings.NewReader(o.Krb5confData))
+	}
+	if o.Krb5conf != "" {
+		files, err := proxy.ConfigPathFiles(o.Krb5conf)
+		if err != nil {
+			return nil, err
+		}
+		return proxy.ParseConfigs(files...)
+	}
+
+	return parseKrb5()
+}
+
+// tenantRegistry returns a registry that labels metrics with the tenant name. When tenants are
+// configured the metrics of the default endpoint have an empty tenant label, as a metric must always
+// be registered with the same labels.
+func tenantRegistry(name string) prometheus.Registerer {
+	return prometheus.WrapRegistererWith(prometheus.Labels{"tenant": name}, prometheus.DefaultRegisterer)
+}
+
+// newTenants sets up a kdc proxy for each tenant from the current configuration
+func newTenants(logger zerolog.Logger) (map[string]*proxy.KerberosProxy, error) {
+	tenants, err := tenantConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse tenant configuration: %w", err)
+	}
+
+	proxies := make(map[string]*proxy.KerberosProxy, len(tenants))
+	for name, o := range tenants {
+		tenantLogger := logger.With().Str("tenant", name).Logger()
+
+		opts := append(proxyOptions(tenantLogger),
+			o.krb5Option(),
+			accessOption(),
+			proxy.WithLimit(o.rate()),
+			proxy.WithBurst(o.burst()),
+			proxy.WithAllowedRealms(o.AllowedRealms...),
+			proxy.WithDeniedRealms(o.DeniedRealms...),
+			proxy.WithRegistry(tenantRegistry(name)),
+		)
+		for realm, config := range toRealmConfigs(o.Realms) {
+			opts = append(opts, proxy.WithRealmConfig(realm, config))
+		}
+
+		k, err := proxy.NewKdcProxy(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up tenant %s: %w", name, err)
+		}
+		proxies[name] = k
+	}
+
+	return proxies, nil
+}
+
+// prepareTenants validates the current configuration of each tenant, which otherwise shares the
+// access rules of global, and returns a function that applies it to all of them. Tenants that have
+// been added or removed require a restart.
+func prepareTenants(proxies map[string]*proxy.KerberosProxy, global proxy.ReloadConfig) (func(), error) {
+	tenants, err := tenantConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	var applies []func()
+	for name, k := range proxies {
+		o, ok := tenants[name]
+		if !ok {
+			continue
+		}
+
+		c := global
+		if c.Krb5, err = o.parseKrb5(); err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		c.RateLimit, c.RateBurst = o.rate(), o.burst()
+		c.Realms = toRealmConfigs(o.Realms)
+		c.AllowedRealms, c.DeniedRealms = o.AllowedRealms, o.DeniedRealms
+
+		apply, err := k.PrepareReload(c)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		applies = append(applies, apply)
+	}
+
+	return func() {
+		for _, apply := range applies {
+			apply()
+		}
+	}, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// testFlags adds the command line flags used by the test subcommand
+func testFlags(fs *pflag.FlagSet) {
+	fs.String("principal", "", "Principal to request a TGT for (user@REALM)")
+	fs.String("url", "", "URL of a running KDC proxy to test, otherwise the request is handled in-process")
+	fs.Bool("discover", false, "Discover the KDC proxy URL for the realm of the principal from DNS URI records instead of --url")
+	fs.Bool("insecure", false, "Skip verification of the KDC proxy TLS certificate")
+	fs.Duration("test-timeout", time.Second*10, "Timeout for the test request")
+}
+
+// runTest sends an AS-REQ for the configured principal through the KDC proxy and reports whether a
+// valid AS-REP or KRB-ERROR was returned
+func runTest(w io.Writer) error {
+	body, err := testBody(viper.GetString("principal"))
+	if err != nil {
+		return err
+	}
+
+	send, err := newRequester(principalRealm(viper.GetString("principal")))
+	if err != nil {
+		return err
+	}
+
+	// send request
+	start := time.Now()
+	status, data, err := send(body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("proxy returned %d %s: %s", status, http.StatusText(status), strings.TrimSpace(string(data)))
+	}
+
+	// check reply
+	m, err := proxy.DecodeKdcProxyMessage(data)
+	if err != nil {
+		return fmt.Errorf("invalid reply: %w", err)
+	}
+
+	switch m.Type {
+	case proxy.MessageTypeASRep:
+		fmt.Fprintf(w, "received AS-REP for %s in %s\n", m.ClientPrincipal, time.Since(start).Round(time.Millisecond))
+	case proxy.MessageTypeKRBError:
+		krbError := messages.KRBError{}
+		if err := krbError.Unmarshal(m.KerbMessage[4:]); err != nil {
+			return fmt.Errorf("invalid KRB-ERROR: %w", err)
+		}
+		fmt.Fprintf(w, "received KRB-ERROR from %s in %s: %s\n", krbError.Realm, time.Since(start).Round(time.Millisecond), errorcode.Lookup(krbError.ErrorCode))
+	default:
+		return fmt.Errorf("unexpected reply type %s", m.Type)
+	}
+
+	return nil
+}
+
+// testBody returns a KDC-PROXY-MESSAGE containing an AS-REQ for principal
+func testBody(principal string) ([]byte, error) {
+	user, realm, ok := strings.Cut(principal, "@")
+	if !ok || user == "" || realm == "" {
+		return nil, fmt.Errorf("principal must be in the form user@REALM")
+	}
+
+	asReq, err := messages.NewASReqForTGT(realm, krb5config.New(), types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user))
+	if err != nil {
+		return nil, fmt.Errorf("could not create AS-REQ: %w", err)
+	}
+	b, err := asReq.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal AS-REQ: %w", err)
+	}
+	body, err := proxy.EncodeKdcProxyMessage(&proxy.KdcProxyMsg{
+		KerbMessage:  append(proxy.MarshalKerbLength(len(b)), b...),
+		TargetDomain: realm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode request: %w", err)
+	}
+
+	return body, nil
+}
+
+// requester sends a KDC-PROXY-MESSAGE and returns the status and body of the response
+type requester func(body []byte) (int, []byte, error)
+
+// principalRealm returns the realm of principal, or an empty string if it has none
+func principalRealm(principal string) string {
+	_, realm, _ := strings.Cut(principal, "@")
+
+	return realm
+}
+
+// newRequester returns a requester that sends to the KDC proxy at the configured URL, the URL
+// discovered for realm or, when neither is set, to an in-process proxy
+func newRequester(realm string) (requester, error) {
+	url := viper.GetString("url")
+	if viper.GetBool("discover") {
+		ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("test-timeout"))
+		defer cancel()
+
+		urls, err := proxy.DiscoverKdcProxy(ctx, realm)
+		if err != nil {
+			return nil, err
+		}
+		url = urls[0]
+	}
+
+	// loopback through an in-process proxy
+	if url == "" {
+		logger, err := consoleLogger()
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := newProxy(logger)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up kdc proxy: %w", err)
+		}
+
+		return func(body []byte) (int, []byte, error) {
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+			k.Handler(rec, req)
+
+			return rec.Code, rec.Body.Bytes(), nil
+		}, nil
+	}
+
+	client := &http.Client{
+		Timeout: viper.GetDuration("test-timeout"),
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: viper.GetBool("insecure")},
+		},
+	}
+
+	return func(body []byte) (int, []byte, error) {
+		resp, err := client.Post(url, "application/kerberos", bytes.NewReader(body))
+		if err != nil {
+			return 0, nil, fmt.Errorf("request failed: %w", err)
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 128*1024))
+		if err != nil {
+			return 0, nil, fmt.Errorf("could not read response: %w", err)
+		}
+
+		return resp.StatusCode, data, nil
+	}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Build metadata, set at build time via:
+//
+//	-ldflags "-X main.version=v1.2.3 -X main.commit=abcdef -X main.date=2024-01-01T00:00:00Z"
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// versionInfo is the build metadata returned by the version endpoint
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+// getVersionInfo returns the build metadata, falling back to the module version and VCS details
+// recorded by the Go toolchain for builds without ldflags, such as via "go install"
+func getVersionInfo() versionInfo {
+	v := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if v.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v.Version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && v.Commit == "unknown":
+			v.Commit = s.Value
+		case s.Key == "vcs.time" && v.Date == "unknown":
+			v.Date = s.Value
+		}
+	}
+
+	return v
+}
+
+func (v versionInfo) String() string {
+	return "kdcproxy " + v.Version + " (commit: " + v.Commit + ", built: " + v.Date + ", " + v.GoVersion + ")"
+}
+
+// registerBuildInfo exports the build metadata as a metric registered with reg
+func registerBuildInfo(reg prometheus.Registerer) error {
+	v := getVersionInfo()
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kdc_proxy_build_info",
+		Help: "Build information for the KDC Proxy",
+		ConstLabels: prometheus.Labels{
+			"version":    v.Version,
+			"commit":     v.Commit,
+			"build_date": v.Date,
+		},
+	})
+	if err := reg.Register(info); err != nil {
+		return fmt.Errorf("unable to register build info: %w", err)
+	}
+	info.Set(1)
+
+	return nil
+}
+
+// versionHandler returns the build metadata as JSON
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getVersionInfo())
+}
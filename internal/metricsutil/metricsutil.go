@@ -0,0 +1,44 @@
+// Package metricsutil provides helpers shared by the packages that register Prometheus metrics.
+package metricsutil
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Registrar registers collectors, keeping the first error so a set of collectors can be built
+// before checking whether they were all registered
+type Registrar struct {
+	reg prometheus.Registerer
+	err error
+}
+
+// NewRegistrar returns a Registrar that registers collectors with reg
+func NewRegistrar(reg prometheus.Registerer) *Registrar {
+	return &Registrar{reg: reg}
+}
+
+// Err returns the first error registering a collector, if any
+func (r *Registrar) Err() error {
+	return r.err
+}
+
+// Register adds the collector to the registry, returning the existing collector if an identical one
+// was already registered so multiple proxies and servers can share a registry
+func Register[T prometheus.Collector](r *Registrar, c T) T {
+	if err := r.reg.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+		if r.err == nil {
+			r.err = fmt.Errorf("unable to register metrics: %w", err)
+		}
+	}
+
+	return c
+}
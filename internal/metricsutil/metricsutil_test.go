@@ -0,0 +1,34 @@
+package metricsutil
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	opts := prometheus.CounterOpts{Name: "test_total", Help: "Test counter"}
+	r := NewRegistrar(reg)
+	first := Register(r, prometheus.NewCounter(opts))
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err() = %v, want nil", err)
+	}
+
+	// an identical collector is shared
+	r = NewRegistrar(reg)
+	if second := Register(r, prometheus.NewCounter(opts)); second != first {
+		t.Error("Register() did not return the existing collector")
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err() = %v, want nil", err)
+	}
+
+	// a conflicting collector is an error
+	r = NewRegistrar(reg)
+	Register(r, prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_total", Help: "Test gauge"}))
+	if r.Err() == nil {
+		t.Error("Err() = nil, want error")
+	}
+}
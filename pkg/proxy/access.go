@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// AccessAction is the decision made by an AccessRule
+type AccessAction string
+
+// Access rule actions
+const (
+	AccessAllow AccessAction = "allow"
+	AccessDeny  AccessAction = "deny"
+)
+
+// defaultAccessRule is the rule name used in metrics and logs when no rule matches
+const defaultAccessRule = "default"
+
+// AccessRule allows or denies forwarding requests that match all of its non-empty conditions
+type AccessRule struct {
+	// Name identifies the rule in logs and metrics, which defaults to its position such as "rule 1"
+	Name string
+
+	// Action is taken when the rule matches
+	Action AccessAction
+
+	// Realms the rule applies to, matched case-insensitively
+	Realms []string
+
+	// Types of Kerberos message the rule applies to, such as MessageTypeASReq
+	Types []MessageType
+
+	// Networks the client address must be within, as CIDR ranges or single IP addresses
+	Networks []string
+
+	// Identities the client certificate identity must match, as patterns supported by path.Match such
+	// as "*.devices.example.com"
+	Identities []string
+}
+
+// Client is the client that made a request, as used by access rules and an Authorizer
+type Client struct {
+	// IP is the address of the client
+	IP string `json:"ip"`
+
+	// Identity is the identity of the client certificate, if one was presented, as returned by
+	// CertificateIdentity
+	Identity string `json:"identity,omitempty"`
+}
+
+// CertificateIdentity returns the identity of a client certificate, which is its common name or its
+// first subject alternative name if it has no common name
+func CertificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+
+	return ""
+}
+
+// ContextWithClient returns a copy of ctx carrying the client that made the request, for access rules
+// to be applied by Forward. Requests to Handler use the client of the HTTP request.
+func ContextWithClient(ctx context.Context, c Client) context.Context {
+	return context.WithValue(ctx, clientKey, c)
+}
+
+// ClientFromContext returns the client carried by ctx, if any
+func ClientFromContext(ctx context.Context) (Client, bool) {
+	c, ok := ctx.Value(clientKey).(Client)
+
+	return c, ok
+}
+
+// requestClient returns the client that made r
+func requestClient(r *http.Request) Client {
+	c := Client{IP: r.RemoteAddr}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		c.IP = host
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		c.Identity = CertificateIdentity(r.TLS.PeerCertificates[0])
+	}
+
+	return c
+}
+
+// accessRule is an AccessRule prepared for matching
+type accessRule struct {
+	name       string
+	action     AccessAction
+	realms     map[string]bool
+	types      map[MessageType]bool
+	networks   []netip.Prefix
+	identities []string
+}
+
+// accessPolicy is an ordered list of rules where the first matching rule decides whether a request
+// is forwarded
+type accessPolicy struct {
+	rules         []accessRule
+	defaultAction AccessAction
+}
+
+// newAccessPolicy validates and prepares the rules, where defaultAction applies when no rule matches
+// and defaults to AccessAllow
+func newAccessPolicy(defaultAction AccessAction, rules []AccessRule) (*accessPolicy, error) {
+	if defaultAction == "" {
+		defaultAction = AccessAllow
+	}
+	if defaultAction != AccessAllow && defaultAction != AccessDeny {
+		return nil, fmt.Errorf("invalid default access action %q", defaultAction)
+	}
+
+	p := &accessPolicy{defaultAction: defaultAction, rules: make([]accessRule, 0, len(rules))}
+	for i, r := range rules {
+		rule := accessRule{name: r.Name, action: r.Action, identities: r.Identities}
+		if rule.name == "" {
+			rule.name = "rule " + strconv.Itoa(i+1)
+		}
+		if rule.action != AccessAllow && rule.action != AccessDeny {
+			return nil, fmt.Errorf("%s: invalid action %q", rule.name, r.Action)
+		}
+		if len(r.Realms) > 0 {
+			rule.realms = make(map[string]bool, len(r.Realms))
+			for _, realm := range r.Realms {
+				rule.realms[strings.ToUpper(realm)] = true
+			}
+		}
+		if len(r.Types) > 0 {
+			rule.types = make(map[MessageType]bool, len(r.Types))
+			for _, t := range r.Types {
+				rule.types[t] = true
+			}
+		}
+		for _, n := range r.Networks {
+			prefix, err := parseNetwork(n)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid network %q: %w", rule.name, n, err)
+			}
+			rule.networks = append(rule.networks, prefix)
+		}
+		for _, pattern := range r.Identities {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid identity pattern %q: %w", rule.name, pattern, err)
+			}
+		}
+		p.rules = append(p.rules, rule)
+	}
+
+	return p, nil
+}
+
+// parseNetwork parses a CIDR range or a single IP address
+func parseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// decide returns the action for a request and the name of the rule that matched
+func (p *accessPolicy) decide(realm string, t MessageType, c Client) (AccessAction, string) {
+	var addr netip.Addr
+	if a, err := netip.ParseAddr(c.IP); err == nil {
+		addr = a.Unmap()
+	}
+
+	for _, r := range p.rules {
+		if r.matches(strings.ToUpper(realm), t, addr, c.Identity) {
+			return r.action, r.name
+		}
+	}
+
+	return p.defaultAction, defaultAccessRule
+}
+
+// matches returns true if the request meets every condition of the rule
+func (r *accessRule) matches(realm string, t MessageType, addr netip.Addr, identity string) bool {
+	if r.realms != nil && !r.realms[realm] {
+		return false
+	}
+	if r.types != nil && !r.types[t] {
+		return false
+	}
+	if len(r.networks) > 0 && !containsAddr(r.networks, addr) {
+		return false
+	}
+	if len(r.identities) > 0 && !matchesAny(r.identities, identity) {
+		return false
+	}
+
+	return true
+}
+
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, n := range networks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAny(patterns []string, identity string) bool {
+	if identity == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, identity); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetAccessRules atomically replaces the access rules, which are evaluated in order with the first
+// matching rule deciding whether a request is forwarded and defaultAction applying when none match.
+// No rules and a default of AccessAllow (or empty) forwards all requests.
+func (k *KerberosProxy) SetAccessRules(defaultAction AccessAction, rules []AccessRule) error {
+	p, err := accessRules(defaultAction, rules)
+	if err != nil {
+		return err
+	}
+	k.access.Store(p)
+
+	return nil
+}
+
+// accessRules returns the access policy of the rules, which is nil when all requests are forwarded
+func accessRules(defaultAction AccessAction, rules []AccessRule) (*accessPolicy, error) {
+	p, err := newAccessPolicy(defaultAction, rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.rules) == 0 && p.defaultAction == AccessAllow {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+// checkAccess returns ErrAccessDenied if the access rules do not allow msg to be forwarded for c,
+// logging and counting the decision
+func (k *KerberosProxy) checkAccess(ctx context.Context, msg *KdcProxyMsg, c Client) error {
+	p := k.access.Load()
+	if p == nil {
+		return nil
+	}
+
+	t := requestType(msg.KerbMessage[4:])
+	action, rule := p.decide(msg.TargetDomain, t, c)
+	k.metrics.accessDecisions.WithLabelValues(rule, string(action)).Inc()
+
+	if action == AccessDeny {
+		k.log(ctx).InfoContext(ctx, "access denied", "realm", msg.TargetDomain, "type", t, "ip", c.IP, "identity", c.Identity, "rule", rule)
+		return fmt.Errorf("%w by %s", ErrAccessDenied, rule)
+	}
+	k.log(ctx).DebugContext(ctx, "access allowed", "realm", msg.TargetDomain, "type", t, "ip", c.IP, "identity", c.Identity, "rule", rule)
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	// only the VPN may request tickets from EXAMPLE.COM with a password, while managed devices may
+	// do anything and nothing may use LEGACY.COM
+	p, err := newAccessPolicy(AccessAllow, []AccessRule{
+		{Name: "devices", Action: AccessAllow, Identities: []string{"*.devices.example.com"}},
+		{Name: "vpn", Action: AccessAllow, Realms: []string{"example.com"}, Types: []MessageType{MessageTypeASReq}, Networks: []string{"10.8.0.0/16", "192.0.2.1"}},
+		{Name: "as-req", Action: AccessDeny, Realms: []string{"EXAMPLE.COM"}, Types: []MessageType{MessageTypeASReq}},
+		{Action: AccessDeny, Realms: []string{"LEGACY.COM"}},
+	})
+	if err != nil {
+		t.Fatalf("newAccessPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		realm      string
+		t          MessageType
+		client     Client
+		wantAction AccessAction
+		wantRule   string
+	}{
+		{"vpn as-req", "EXAMPLE.COM", MessageTypeASReq, Client{IP: "10.8.1.2"}, AccessAllow, "vpn"},
+		{"single address", "EXAMPLE.COM", MessageTypeASReq, Client{IP: "192.0.2.1"}, AccessAllow, "vpn"},
+		{"ipv4 mapped address", "EXAMPLE.COM", MessageTypeASReq, Client{IP: "::ffff:10.8.1.2"}, AccessAllow, "vpn"},
+		{"internet as-req", "EXAMPLE.COM", MessageTypeASReq, Client{IP: "203.0.113.1"}, AccessDeny, "as-req"},
+		{"internet tgs-req", "EXAMPLE.COM", MessageTypeTGSReq, Client{IP: "203.0.113.1"}, AccessAllow, "default"},
+		{"device", "EXAMPLE.COM", MessageTypeASReq, Client{IP: "203.0.113.1", Identity: "laptop.devices.example.com"}, AccessAllow, "devices"},
+		{"other identity", "EXAMPLE.COM", MessageTypeASReq, Client{IP: "203.0.113.1", Identity: "laptop.example.com"}, AccessDeny, "as-req"},
+		{"unnamed rule", "legacy.com", MessageTypeTGSReq, Client{IP: "10.8.1.2"}, AccessDeny, "rule 4"},
+		{"no client", "EXAMPLE.COM", MessageTypeASReq, Client{}, AccessDeny, "as-req"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action, rule := p.decide(tt.realm, tt.t, tt.client)
+			if action != tt.wantAction || rule != tt.wantRule {
+				t.Errorf("decide() = %s, %s, want %s, %s", action, rule, tt.wantAction, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestNewAccessPolicyInvalid(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultAction AccessAction
+		rule          AccessRule
+	}{
+		{"default action", "maybe", AccessRule{Action: AccessAllow}},
+		{"action", AccessAllow, AccessRule{Action: "permit"}},
+		{"network", AccessAllow, AccessRule{Action: AccessAllow, Networks: []string{"10.0.0.0/33"}}},
+		{"address", AccessAllow, AccessRule{Action: AccessAllow, Networks: []string{"vpn"}}},
+		{"identity", AccessAllow, AccessRule{Action: AccessAllow, Identities: []string{"["}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newAccessPolicy(tt.defaultAction, []AccessRule{tt.rule}); err == nil {
+				t.Error("newAccessPolicy() did not return an error")
+			}
+		})
+	}
+}
+
+func TestAccessRules(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+	reg := prometheus.NewRegistry()
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(reg),
+		WithTransport(transport),
+		WithAccessRules(AccessDeny,
+			AccessRule{Name: "vpn", Action: AccessAllow, Networks: []string{"10.8.0.0/16"}},
+			AccessRule{Name: "device", Action: AccessAllow, Identities: []string{"*.devices.example.com"}},
+		),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	device := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "laptop.devices.example.com"}}}}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        *tls.ConnectionState
+		want       int
+	}{
+		{"vpn", "10.8.0.1:1234", nil, http.StatusOK},
+		{"internet", "203.0.113.1:1234", nil, http.StatusForbidden},
+		{"device", "203.0.113.1:1234", device, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+			req.RemoteAddr = tt.remoteAddr
+			req.TLS = tt.tls
+			w := httptest.NewRecorder()
+			k.Handler(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Handler() status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	if got := testutil.ToFloat64(k.metrics.accessDecisions.WithLabelValues("default", "deny")); got != 1 {
+		t.Errorf("default deny decisions = %v, want 1", got)
+	}
+	if got := len(transport.kdcs); got != 2 {
+		t.Errorf("transport exchanges = %d, want 2", got)
+	}
+
+	// Forward uses the client from the context
+	req := testASReq(t)
+	msg := &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}
+	if _, err := k.Forward(context.Background(), msg); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Forward() without client error = %v, want %v", err, ErrAccessDenied)
+	}
+	if _, err := k.Forward(ContextWithClient(context.Background(), Client{IP: "10.8.0.1"}), msg); err != nil {
+		t.Errorf("Forward() from vpn error = %v", err)
+	}
+
+	// removing the rules allows everything
+	if err := k.SetAccessRules(AccessAllow, nil); err != nil {
+		t.Fatalf("SetAccessRules() error = %v", err)
+	}
+	if _, err := k.Forward(context.Background(), msg); err != nil {
+		t.Errorf("Forward() without rules error = %v", err)
+	}
+}
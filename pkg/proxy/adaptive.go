@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Adaptive ordering settings
+const (
+	// adaptiveAlpha is the weight given to each exchange in the moving average of failures, so that
+	// roughly the last 1/adaptiveAlpha exchanges with a KDC are reflected
+	adaptiveAlpha = 0.2
+
+	// adaptiveThreshold is the failure score above which a KDC is demoted
+	adaptiveThreshold = 0.3
+
+	// adaptiveProbeEvery is how often a demoted KDC keeps its place, so that it is still tried and
+	// promoted again once it recovers
+	adaptiveProbeEvery = 20
+)
+
+// adaptive tracks an exponentially weighted moving average of failures for each KDC, demoting those
+// that fail intermittently so they stop adding latency to every request
+type adaptive struct {
+	scores *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	kdcs map[kdcKey]*kdcScore
+}
+
+// kdcScore is the failure score of a KDC and the number of times it has been demoted
+type kdcScore struct {
+	failures float64
+	demoted  uint64
+}
+
+func newAdaptive(scores *prometheus.GaugeVec) *adaptive {
+	return &adaptive{scores: scores, kdcs: make(map[kdcKey]*kdcScore)}
+}
+
+// exchange records the result of an exchange with a KDC
+func (a *adaptive) exchange(kdc, proto string, err error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	s, ok := a.kdcs[kdcKey{kdc, proto}]
+	if !ok {
+		s = &kdcScore{}
+		a.kdcs[kdcKey{kdc, proto}] = s
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	s.failures = s.failures*(1-adaptiveAlpha) + failed*adaptiveAlpha
+	score := s.failures
+	a.mu.Unlock()
+
+	a.scores.WithLabelValues(kdc, proto).Set(score)
+}
+
+// order returns kdcs with those whose failure score is above adaptiveThreshold moved to the end, in
+// order of their score, otherwise keeping their order. Every adaptiveProbeEvery times a KDC is
+// demoted it keeps its place instead.
+func (a *adaptive) order(kdcs []string, proto string) []string {
+	if a == nil {
+		return kdcs
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ordered := make([]string, 0, len(kdcs))
+	var demoted []string
+	scores := make(map[string]float64)
+	for _, kdc := range kdcs {
+		s, ok := a.kdcs[kdcKey{kdc, proto}]
+		if !ok || s.failures <= adaptiveThreshold {
+			ordered = append(ordered, kdc)
+			continue
+		}
+
+		s.demoted++
+		if s.demoted%adaptiveProbeEvery == 0 {
+			ordered = append(ordered, kdc)
+			continue
+		}
+		demoted = append(demoted, kdc)
+		scores[kdc] = s.failures
+	}
+
+	sort.SliceStable(demoted, func(i, j int) bool {
+		return scores[demoted[i]] < scores[demoted[j]]
+	})
+
+	return append(ordered, demoted...)
+}
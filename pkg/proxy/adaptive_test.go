@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAdaptiveOrder(t *testing.T) {
+	scores := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "scores"}, []string{"kdc", "proto"})
+	a := newAdaptive(scores)
+	kdcs := []string{"flaky:88", "down:88", "good:88"}
+	failed := errors.New("timeout")
+
+	// a single failure is not enough to demote a kdc
+	a.exchange("flaky:88", protoUdp, failed)
+	if got := a.order(kdcs, protoUdp); !reflect.DeepEqual(got, kdcs) {
+		t.Errorf("order() after one failure = %v, want %v", got, kdcs)
+	}
+
+	// but intermittent failures are, after any that fail less often
+	for i := 0; i < 10; i++ {
+		a.exchange("down:88", protoUdp, failed)
+		a.exchange("good:88", protoUdp, nil)
+		if i%2 == 0 {
+			a.exchange("flaky:88", protoUdp, failed)
+		} else {
+			a.exchange("flaky:88", protoUdp, nil)
+		}
+	}
+	want := []string{"good:88", "flaky:88", "down:88"}
+	if got := a.order(kdcs, protoUdp); !reflect.DeepEqual(got, want) {
+		t.Errorf("order() = %v, want %v", got, want)
+	}
+	if got := testutil.ToFloat64(scores.WithLabelValues("good:88", protoUdp)); got != 0 {
+		t.Errorf("good score = %v, want 0", got)
+	}
+
+	// scores are kept per protocol
+	if got := a.order(kdcs, protoTcp); !reflect.DeepEqual(got, kdcs) {
+		t.Errorf("order() for tcp = %v, want %v", got, kdcs)
+	}
+
+	// demoted kdcs are still probed
+	probed := 0
+	for i := 0; i < adaptiveProbeEvery*2; i++ {
+		if got := a.order(kdcs, protoUdp); got[len(got)-1] != "down:88" {
+			probed++
+		}
+	}
+	if probed != 2 {
+		t.Errorf("down kdc probed %d times, want 2", probed)
+	}
+
+	// and promoted again once they recover
+	for i := 0; i < 10; i++ {
+		a.exchange("down:88", protoUdp, nil)
+	}
+	if got := a.order([]string{"down:88", "good:88"}, protoUdp); got[0] != "down:88" {
+		t.Errorf("order() after recovery = %v", got)
+	}
+}
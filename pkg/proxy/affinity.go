@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// affinity pins a client to the KDC that answered its last AS exchange for a realm, so follow-up TGS
+// requests reach a domain controller that already has any state changed by the AS exchange, such as
+// a password change or account unlock, without waiting for replication
+type affinity struct {
+	window time.Duration
+	hits   prometheus.Counter
+
+	mu        sync.Mutex
+	pins      map[affinityKey]affinityPin
+	lastSweep time.Time
+}
+
+type affinityKey struct {
+	client string
+	realm  string
+}
+
+type affinityPin struct {
+	kdc     string
+	expires time.Time
+}
+
+func newAffinity(window time.Duration, hits prometheus.Counter) *affinity {
+	return &affinity{window: window, hits: hits, pins: make(map[affinityKey]affinityPin)}
+}
+
+// key identifies a client by its certificate identity, or its IP address without one
+func (c Client) key() string {
+	if c.Identity != "" {
+		return c.Identity
+	}
+
+	return c.IP
+}
+
+// record pins the client to kdc for realm
+func (a *affinity) record(c Client, realm, kdc string, now time.Time) {
+	if a == nil || c.key() == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// remove expired pins
+	if now.Sub(a.lastSweep) > a.window {
+		a.lastSweep = now
+		for key, pin := range a.pins {
+			if now.After(pin.expires) {
+				delete(a.pins, key)
+			}
+		}
+	}
+
+	a.pins[affinityKey{c.key(), realm}] = affinityPin{kdc: kdc, expires: now.Add(a.window)}
+}
+
+// order returns kdcs with the KDC the client is pinned to for realm first, otherwise keeping their order
+func (a *affinity) order(c Client, realm string, kdcs []string, now time.Time) []string {
+	if a == nil || c.key() == "" {
+		return kdcs
+	}
+
+	a.mu.Lock()
+	pin, ok := a.pins[affinityKey{c.key(), realm}]
+	a.mu.Unlock()
+	if !ok || now.After(pin.expires) {
+		return kdcs
+	}
+
+	for i, kdc := range kdcs {
+		if kdc != pin.kdc {
+			continue
+		}
+		a.hits.Inc()
+		if i == 0 {
+			return kdcs
+		}
+
+		ordered := make([]string, 0, len(kdcs))
+		ordered = append(ordered, kdc)
+		ordered = append(ordered, kdcs[:i]...)
+
+		return append(ordered, kdcs[i+1:]...)
+	}
+
+	return kdcs
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAffinity(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc1.example.com:88\n  kdc = kdc2.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithStrategy(StrategyRoundRobin),
+		WithProtocols(protoTcp),
+		WithAffinity(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	message := func(kerb []byte) *KdcProxyMsg {
+		return &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(kerb)), kerb...), TargetDomain: "EXAMPLE.COM"}
+	}
+	forward := func(client Client, msg *KdcProxyMsg) {
+		t.Helper()
+		if _, err := k.Forward(ContextWithClient(context.Background(), client), msg); err != nil {
+			t.Fatalf("Forward() error = %v", err)
+		}
+	}
+	laptop := Client{IP: "192.0.2.1", Identity: "laptop.example.com"}
+	phone := Client{IP: "192.0.2.1"}
+
+	// the as exchange pins the laptop to the kdc that answered, so its follow-up requests go there
+	// rather than the next kdc in turn, while other clients are unaffected
+	forward(laptop, message(testASReq(t)))
+	forward(phone, message(reply))
+	forward(phone, message(reply))
+	forward(laptop, message(reply))
+
+	want := []string{"tcp/kdc1.example.com:88", "tcp/kdc2.example.com:88", "tcp/kdc1.example.com:88", "tcp/kdc1.example.com:88"}
+	if !reflect.DeepEqual(transport.kdcs, want) {
+		t.Errorf("transport exchanges = %v, want %v", transport.kdcs, want)
+	}
+	if got := testutil.ToFloat64(k.metrics.affinityHits); got != 1 {
+		t.Errorf("affinity hits = %v, want 1", got)
+	}
+}
+
+func TestAffinityExpiry(t *testing.T) {
+	a := newAffinity(time.Minute, prometheus.NewCounter(prometheus.CounterOpts{Name: "hits"}))
+	kdcs := []string{"kdc1:88", "kdc2:88"}
+	now := time.Now()
+
+	a.record(Client{IP: "192.0.2.1"}, "EXAMPLE.COM", "kdc2:88", now)
+	if got := a.order(Client{IP: "192.0.2.1"}, "EXAMPLE.COM", kdcs, now); !reflect.DeepEqual(got, []string{"kdc2:88", "kdc1:88"}) {
+		t.Errorf("order() = %v", got)
+	}
+	if got := a.order(Client{IP: "192.0.2.1"}, "EXAMPLE.COM", kdcs, now.Add(2*time.Minute)); !reflect.DeepEqual(got, kdcs) {
+		t.Errorf("order() after window = %v, want %v", got, kdcs)
+	}
+
+	// expired pins are removed
+	a.record(Client{IP: "192.0.2.2"}, "EXAMPLE.COM", "kdc1:88", now.Add(2*time.Minute))
+	if _, ok := a.pins[affinityKey{"192.0.2.1", "EXAMPLE.COM"}]; ok {
+		t.Error("expired pin was not removed")
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for the webhook authorizer
+const (
+	DefaultAuthzTimeout    = 2 * time.Second
+	DefaultAuthzCacheTTL   = time.Minute
+	DefaultAuthzCacheLimit = 10000
+)
+
+// AuthzRequest describes a request to be authorized before it is forwarded
+type AuthzRequest struct {
+	Client Client      `json:"client"`
+	Realm  string      `json:"realm"`
+	Type   MessageType `json:"type"`
+}
+
+// Authorizer decides whether a request may be forwarded. A request that is not allowed receives
+// 403 Forbidden, while an error means no decision could be made so the request is not forwarded
+// and receives 503 Service Unavailable (FailureAuthzUnavailable) with a Retry-After header.
+type Authorizer interface {
+	Authorize(ctx context.Context, req AuthzRequest) (bool, error)
+}
+
+// WebhookConfig configures a WebhookAuthorizer
+type WebhookConfig struct {
+	// URL the authorization requests are POSTed to
+	URL string
+
+	// CacheTTL is how long decisions are cached for, which defaults to DefaultAuthzCacheTTL. A
+	// negative value disables caching.
+	CacheTTL time.Duration
+
+	// CacheLimit is the maximum number of cached decisions, which defaults to DefaultAuthzCacheLimit
+	CacheLimit int
+
+	// Client is the HTTP client used to call the webhook, which defaults to a client with a timeout
+	// of DefaultAuthzTimeout
+	Client *http.Client
+}
+
+// WebhookAuthorizer is an Authorizer that asks an external HTTP service. Each request is POSTed as a
+// JSON encoded AuthzRequest and the service responds with 200 OK and a JSON body such as
+// {"allow": true}. Decisions are cached briefly so the service is not called for every request.
+type WebhookAuthorizer struct {
+	cfg WebhookConfig
+
+	mu        sync.Mutex
+	cache     map[AuthzRequest]authzDecision
+	lastSweep time.Time
+}
+
+// authzDecision is a cached decision
+type authzDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// authzResponse is the response from the webhook
+type authzResponse struct {
+	Allow bool `json:"allow"`
+}
+
+// NewWebhookAuthorizer returns a WebhookAuthorizer for the provided configuration
+func NewWebhookAuthorizer(cfg WebhookConfig) (*WebhookAuthorizer, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("authorization webhook url is required")
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = DefaultAuthzCacheTTL
+	}
+	if cfg.CacheLimit <= 0 {
+		cfg.CacheLimit = DefaultAuthzCacheLimit
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: DefaultAuthzTimeout}
+	}
+
+	return &WebhookAuthorizer{cfg: cfg, cache: make(map[AuthzRequest]authzDecision)}, nil
+}
+
+// Authorize returns the cached decision for req or asks the webhook
+func (a *WebhookAuthorizer) Authorize(ctx context.Context, req AuthzRequest) (bool, error) {
+	if allow, ok := a.cached(req, time.Now()); ok {
+		return allow, nil
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.cfg.Client.Do(r)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("authorization webhook returned %s", resp.Status)
+	}
+
+	var decision authzResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("invalid authorization webhook response: %w", err)
+	}
+	a.store(req, decision.Allow, time.Now())
+
+	return decision.Allow, nil
+}
+
+// cached returns the decision for req if it has not expired
+func (a *WebhookAuthorizer) cached(req AuthzRequest, now time.Time) (bool, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	d, ok := a.cache[req]
+	if !ok || now.After(d.expires) {
+		return false, false
+	}
+
+	return d.allow, true
+}
+
+// store caches the decision for req, removing expired decisions and making room when the cache is full
+func (a *WebhookAuthorizer) store(req AuthzRequest, allow bool, now time.Time) {
+	if a.cfg.CacheTTL < 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cache) >= a.cfg.CacheLimit || now.Sub(a.lastSweep) > a.cfg.CacheTTL {
+		a.lastSweep = now
+		for r, d := range a.cache {
+			if now.After(d.expires) {
+				delete(a.cache, r)
+			}
+		}
+
+		// drop an arbitrary decision if every one is still current
+		for r := range a.cache {
+			if len(a.cache) < a.cfg.CacheLimit {
+				break
+			}
+			delete(a.cache, r)
+		}
+	}
+
+	a.cache[req] = authzDecision{allow: allow, expires: now.Add(a.cfg.CacheTTL)}
+}
+
+// authorize returns ErrAccessDenied if the authorizer denies forwarding msg for c, or an error if it
+// could not make a decision
+func (k *KerberosProxy) authorize(ctx context.Context, msg *KdcProxyMsg, c Client) error {
+	if k.authorizer == nil {
+		return nil
+	}
+
+	req := AuthzRequest{Client: c, Realm: msg.TargetDomain, Type: requestType(msg.KerbMessage[4:])}
+	allow, err := k.authorizer.Authorize(ctx, req)
+	if err != nil {
+		k.metrics.authzDecisions.WithLabelValues("error").Inc()
+		k.log(ctx).WarnContext(ctx, "authorization failed", "realm", req.Realm, "type", req.Type, "ip", c.IP, "identity", c.Identity, "error", err)
+		return fmt.Errorf("%w: %w", errAuthzUnavailable, err)
+	}
+	if !allow {
+		k.metrics.authzDecisions.WithLabelValues(string(AccessDeny)).Inc()
+		k.log(ctx).InfoContext(ctx, "access denied by authorizer", "realm", req.Realm, "type", req.Type, "ip", c.IP, "identity", c.Identity)
+		return fmt.Errorf("%w by authorizer", ErrAccessDenied)
+	}
+	k.metrics.authzDecisions.WithLabelValues(string(AccessAllow)).Inc()
+
+	return nil
+}
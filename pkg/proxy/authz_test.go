@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testAuthzServer returns a webhook that allows clients from 10.8.0.1 and counts the calls made
+func testAuthzServer(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		var req AuthzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Realm != "EXAMPLE.COM" || req.Type != MessageTypeASReq {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]bool{"allow": req.Client.IP == "10.8.0.1"})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL, &calls
+}
+
+func TestWebhookAuthorizer(t *testing.T) {
+	if _, err := NewWebhookAuthorizer(WebhookConfig{}); err == nil {
+		t.Error("NewWebhookAuthorizer() without url did not return an error")
+	}
+
+	url, calls := testAuthzServer(t)
+	a, err := NewWebhookAuthorizer(WebhookConfig{URL: url})
+	if err != nil {
+		t.Fatalf("NewWebhookAuthorizer() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		ip        string
+		want      bool
+		wantCalls int64
+	}{
+		{"allowed", "10.8.0.1", true, 1},
+		{"allowed cached", "10.8.0.1", true, 1},
+		{"denied", "203.0.113.1", false, 2},
+		{"denied cached", "203.0.113.1", false, 2},
+	}
+	for _, tt := range tests {
+		req := AuthzRequest{Client: Client{IP: tt.ip}, Realm: "EXAMPLE.COM", Type: MessageTypeASReq}
+		got, err := a.Authorize(context.Background(), req)
+		if err != nil {
+			t.Fatalf("%s: Authorize() error = %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Authorize() = %v, want %v", tt.name, got, tt.want)
+		}
+		if calls.Load() != tt.wantCalls {
+			t.Errorf("%s: webhook calls = %d, want %d", tt.name, calls.Load(), tt.wantCalls)
+		}
+	}
+
+	// errors are not cached
+	req := AuthzRequest{Client: Client{IP: "10.8.0.1"}, Realm: "OTHER.COM", Type: MessageTypeASReq}
+	for i := 0; i < 2; i++ {
+		if _, err := a.Authorize(context.Background(), req); err == nil {
+			t.Error("Authorize() with webhook error did not return an error")
+		}
+	}
+	if calls.Load() != 4 {
+		t.Errorf("webhook calls = %d, want 4", calls.Load())
+	}
+}
+
+func TestWebhookAuthorizerCache(t *testing.T) {
+	a, err := NewWebhookAuthorizer(WebhookConfig{URL: "http://127.0.0.1:0", CacheTTL: time.Minute, CacheLimit: 2})
+	if err != nil {
+		t.Fatalf("NewWebhookAuthorizer() error = %v", err)
+	}
+
+	now := time.Now()
+	first := AuthzRequest{Client: Client{IP: "192.0.2.1"}}
+	second := AuthzRequest{Client: Client{IP: "192.0.2.2"}}
+	third := AuthzRequest{Client: Client{IP: "192.0.2.3"}}
+	a.store(first, true, now)
+	a.store(second, false, now)
+
+	if allow, ok := a.cached(second, now); !ok || allow {
+		t.Errorf("cached() = %v, %v, want false, true", allow, ok)
+	}
+	if _, ok := a.cached(first, now.Add(2*time.Minute)); ok {
+		t.Error("cached() returned an expired decision")
+	}
+
+	a.store(third, true, now)
+	if len(a.cache) != 2 {
+		t.Errorf("cache size = %d, want the limit of 2", len(a.cache))
+	}
+	if _, ok := a.cached(third, now); !ok {
+		t.Error("cached() did not return the latest decision")
+	}
+}
+
+// errAuthorizer fails every request
+type errAuthorizer struct{}
+
+func (errAuthorizer) Authorize(ctx context.Context, req AuthzRequest) (bool, error) {
+	return false, errors.New("unreachable")
+}
+
+func TestWithAuthorizer(t *testing.T) {
+	if _, err := NewKdcProxy(WithAuthorizer(nil)); err == nil {
+		t.Error("WithAuthorizer(nil) did not return an error")
+	}
+
+	url, _ := testAuthzServer(t)
+	a, err := NewWebhookAuthorizer(WebhookConfig{URL: url})
+	if err != nil {
+		t.Fatalf("NewWebhookAuthorizer() error = %v", err)
+	}
+
+	reply := testKRBError(t)
+	newProxy := func(a Authorizer) *KerberosProxy {
+		k, err := NewKdcProxy(
+			WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+			WithRegistry(prometheus.NewRegistry()),
+			WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+			WithAuthorizer(a),
+		)
+		if err != nil {
+			t.Fatalf("NewKdcProxy() error = %v", err)
+		}
+		return k
+	}
+	k := newProxy(a)
+	failing := newProxy(errAuthorizer{})
+
+	tests := []struct {
+		name       string
+		k          *KerberosProxy
+		remoteAddr string
+		want       int
+	}{
+		{"allowed", k, "10.8.0.1:1234", http.StatusOK},
+		{"denied", k, "203.0.113.1:1234", http.StatusForbidden},
+		{"authorizer error", failing, "10.8.0.1:1234", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			tt.k.Handler(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Handler() status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	for decision, want := range map[string]float64{"allow": 1, "deny": 1} {
+		if got := testutil.ToFloat64(k.metrics.authzDecisions.WithLabelValues(decision)); got != want {
+			t.Errorf("%s decisions = %v, want %v", decision, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// benchTransport returns a fixed response without recording exchanges
+type benchTransport struct {
+	resp []byte
+}
+
+func (b *benchTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	return b.resp, nil
+}
+
+func BenchmarkHandler(b *testing.B) {
+	reply := testKRBError(b)
+	body := testProxyMessage(b, testASReq(b), "EXAMPLE.COM")
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&benchTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+		WithLimit(math.MaxInt32),
+	)
+	if err != nil {
+		b.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		k.Handler(w, req)
+
+		if w.Code != http.StatusOK {
+			b.Fatalf("Handler() status = %v, want %v", w.Code, http.StatusOK)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	k := &KerberosProxy{}
+	data := testProxyMessage(b, testASReq(b), "EXAMPLE.COM")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := k.decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	k := &KerberosProxy{}
+	reply := testKRBError(b)
+	data := append(MarshalKerbLength(len(reply)), reply...)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := k.encode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalKerbLength(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		MarshalKerbLength(i)
+	}
+}
+
+func BenchmarkUnmarshalKerbLength(b *testing.B) {
+	data := MarshalKerbLength(1234)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := UnmarshalKerbLength(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
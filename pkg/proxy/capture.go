@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// captureRecord is the metadata written alongside each captured exchange
+type captureRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Realm     string    `json:"realm"`
+	Request   string    `json:"request"`
+	Response  string    `json:"response,omitempty"`
+	Duration  float64   `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// capture writes requests and upstream responses to a directory
+type capture struct {
+	dir string
+	seq atomic.Uint64
+}
+
+// interceptor returns an Interceptor that captures each exchange. Failure to write a capture is
+// logged and does not affect the request.
+func (c *capture) interceptor(k *KerberosProxy) Interceptor {
+	return func(next ForwardFunc) ForwardFunc {
+		return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+			start := time.Now()
+			resp, err := next(ctx, msg)
+
+			if werr := c.write(ctx, start, msg, resp, err); werr != nil {
+				k.log(ctx).WarnContext(ctx, "unable to write capture", "error", werr)
+			}
+
+			return resp, err
+		}
+	}
+}
+
+// write saves the request and response as raw DER, without the leading 4-byte length, along with
+// a JSON file of metadata
+func (c *capture) write(ctx context.Context, start time.Time, msg *KdcProxyMsg, resp []byte, ferr error) error {
+	base := fmt.Sprintf("%s-%06d", start.UTC().Format("20060102T150405.000000000"), c.seq.Add(1))
+
+	record := captureRecord{
+		Time:     start,
+		Realm:    msg.TargetDomain,
+		Request:  base + ".req.der",
+		Duration: time.Since(start).Seconds(),
+	}
+	if id, ok := RequestIDFromContext(ctx); ok {
+		record.RequestID = id
+	}
+	if ferr != nil {
+		record.Error = ferr.Error()
+	}
+
+	if err := os.WriteFile(filepath.Join(c.dir, record.Request), msg.KerbMessage[4:], 0o600); err != nil {
+		return err
+	}
+
+	if len(resp) >= 4 {
+		record.Response = base + ".rep.der"
+		if err := os.WriteFile(filepath.Join(c.dir, record.Response), resp[4:], 0o600); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(c.dir, base+".json"), b, 0o600)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWithCapture(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "capture")
+	reply := testKRBError(t)
+	req := testASReq(t)
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+		WithCapture(dir),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	ctx := ContextWithRequestID(context.Background(), "abc123")
+	if _, err := k.Forward(ctx, &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("capture metadata files = %v, want 1", files)
+	}
+
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record captureRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	if record.RequestID != "abc123" || record.Realm != "EXAMPLE.COM" || record.Error != "" {
+		t.Errorf("capture record = %+v", record)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(dir, record.Request)); err != nil || !bytes.Equal(got, req) {
+		t.Errorf("captured request = %x, %v, want %x", got, err, req)
+	}
+
+	if got, err := os.ReadFile(filepath.Join(dir, record.Response)); err != nil || !bytes.Equal(got, reply) {
+		t.Errorf("captured response = %x, %v, want %x", got, err, reply)
+	}
+}
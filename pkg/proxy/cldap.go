@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for pinging domain controllers
+const (
+	DefaultDCPingTimeout = time.Second
+	DefaultDCPingTTL     = 5 * time.Minute
+)
+
+// Netlogon response values from MS-ADTS 6.3.1
+const (
+	netlogonSAMLogonResponseEx = 23
+	netlogonSAMUserUnknownEx   = 25
+	netlogonKDCFlag            = 0x20
+
+	// netlogonNtVer requests a NETLOGON_SAM_LOGON_RESPONSE_EX (NETLOGON_NT_VERSION_5 | NETLOGON_NT_VERSION_5EX)
+	netlogonNtVer = 0x6
+)
+
+// dcPingResult is the outcome of pinging a domain controller
+type dcPingResult string
+
+const (
+	dcPingOK          dcPingResult = "ok"
+	dcPingOtherSite   dcPingResult = "other_site"
+	dcPingWrongDomain dcPingResult = "wrong_domain"
+	dcPingNotKDC      dcPingResult = "not_kdc"
+	dcPingError       dcPingResult = "error"
+)
+
+// netlogonResponse is the part of a NETLOGON_SAM_LOGON_RESPONSE_EX used to select domain controllers
+type netlogonResponse struct {
+	flags      uint32
+	dnsDomain  string
+	dnsHost    string
+	dcSite     string
+	clientSite string
+}
+
+// dcPinger sends a CLDAP "LDAP ping", as used by the Windows DC locator, to candidate KDC's so those
+// that are alive and are domain controllers running a KDC for the realm, in the preferred site, are
+// tried first. Results are cached for ttl.
+type dcPinger struct {
+	timeout time.Duration
+	ttl     time.Duration
+	port    string
+	pings   *prometheus.CounterVec
+
+	mu    sync.Mutex
+	cache map[dcPingKey]dcPingEntry
+}
+
+type dcPingKey struct {
+	host   string
+	domain string
+}
+
+type dcPingEntry struct {
+	resp    *netlogonResponse
+	err     error
+	expires time.Time
+}
+
+func newDCPinger(timeout time.Duration, pings *prometheus.CounterVec) *dcPinger {
+	if timeout <= 0 {
+		timeout = DefaultDCPingTimeout
+	}
+
+	return &dcPinger{
+		timeout: timeout,
+		ttl:     DefaultDCPingTTL,
+		port:    "389",
+		pings:   pings,
+		cache:   make(map[dcPingKey]dcPingEntry),
+	}
+}
+
+// order returns kdcs with those that answered the ping as a KDC for realm in site first, then those
+// in other sites, then the rest, otherwise keeping their order. KDC's that did not answer are still
+// tried as the ping may be blocked or the KDC may not be a domain controller.
+func (p *dcPinger) order(ctx context.Context, realm, site string, kdcs []string) []string {
+	if p == nil || len(kdcs) == 0 {
+		return kdcs
+	}
+
+	domain := strings.ToLower(realm)
+	results := p.ping(ctx, domain, kdcs)
+
+	rank := func(kdc string) int {
+		switch judgeDCPing(results[kdc], domain, site) {
+		case dcPingOK:
+			return 0
+		case dcPingOtherSite:
+			return 1
+		}
+		return 2
+	}
+	ordered := append([]string(nil), kdcs...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rank(ordered[i]) < rank(ordered[j])
+	})
+
+	return ordered
+}
+
+// ping returns the cached response of each kdc, pinging those without one concurrently
+func (p *dcPinger) ping(ctx context.Context, domain string, kdcs []string) map[string]dcPingEntry {
+	now := time.Now()
+	results := make(map[string]dcPingEntry, len(kdcs))
+	var missing []string
+
+	p.mu.Lock()
+	for _, kdc := range kdcs {
+		if e, ok := p.cache[dcPingKey{kdcHost(kdc), domain}]; ok && now.Before(e.expires) {
+			results[kdc] = e
+			continue
+		}
+		missing = append(missing, kdc)
+	}
+	p.mu.Unlock()
+
+	if len(missing) == 0 {
+		return results
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, kdc := range missing {
+		wg.Add(1)
+		go func(kdc string) {
+			defer wg.Done()
+
+			resp, err := cldapPing(ctx, net.JoinHostPort(kdcHost(kdc), p.port), domain)
+			e := dcPingEntry{resp: resp, err: err, expires: now.Add(p.ttl)}
+
+			mu.Lock()
+			results[kdc] = e
+			mu.Unlock()
+		}(kdc)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	for _, kdc := range missing {
+		e := results[kdc]
+		p.cache[dcPingKey{kdcHost(kdc), domain}] = e
+		p.pings.WithLabelValues(string(judgeDCPing(e, domain, ""))).Inc()
+	}
+	p.mu.Unlock()
+
+	return results
+}
+
+// judgeDCPing returns whether a ping response shows the domain controller serves domain in site
+func judgeDCPing(e dcPingEntry, domain, site string) dcPingResult {
+	switch {
+	case e.err != nil || e.resp == nil:
+		return dcPingError
+	case !strings.EqualFold(e.resp.dnsDomain, domain):
+		return dcPingWrongDomain
+	case e.resp.flags&netlogonKDCFlag == 0:
+		return dcPingNotKDC
+	case site != "" && !strings.EqualFold(e.resp.dcSite, site):
+		return dcPingOtherSite
+	}
+
+	return dcPingOK
+}
+
+// kdcHost returns the host of a KDC address
+func kdcHost(kdc string) string {
+	if host, _, err := net.SplitHostPort(kdc); err == nil {
+		return host
+	}
+
+	return kdc
+}
+
+// cldapPing sends an LDAP ping for domain over UDP to addr and returns the Netlogon response
+func cldapPing(ctx context.Context, addr, domain string) (*netlogonResponse, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id := byte(rand.Intn(127) + 1)
+	if _, err := conn.Write(ldapPingRequest(id, domain)); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 64*1024)
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLDAPPingResponse(b[:n], id)
+}
+
+// ldapPingRequest returns a CLDAP search of the rootDSE for the Netlogon attribute, as described by
+// MS-ADTS 6.3.3
+func ldapPingRequest(id byte, domain string) []byte {
+	equal := func(attr string, value []byte) []byte {
+		return ber(0xa3, ber(0x04, []byte(attr)), ber(0x04, value))
+	}
+	ntVer := binary.LittleEndian.AppendUint32(nil, netlogonNtVer)
+
+	search := ber(0x63,
+		ber(0x04, nil),       // baseObject
+		ber(0x0a, []byte{0}), // scope: baseObject
+		ber(0x0a, []byte{0}), // derefAliases: never
+		ber(0x02, []byte{0}), // sizeLimit
+		ber(0x02, []byte{0}), // timeLimit
+		ber(0x01, []byte{0}), // typesOnly
+		ber(0xa0, equal("DnsDomain", []byte(domain)), equal("NtVer", ntVer)),
+		ber(0x30, ber(0x04, []byte("Netlogon"))),
+	)
+
+	return ber(0x30, ber(0x02, []byte{id}), search)
+}
+
+// parseLDAPPingResponse returns the Netlogon response from the SearchResultEntry of an LDAP ping
+func parseLDAPPingResponse(b []byte, id byte) (*netlogonResponse, error) {
+	_, msg, _, err := berNext(b)
+	if err != nil {
+		return nil, err
+	}
+	_, msgID, op, err := berNext(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgID) != 1 || msgID[0] != id {
+		return nil, errors.New("mismatched ldap message id")
+	}
+	tag, entry, _, err := berNext(op)
+	if err != nil {
+		return nil, err
+	}
+	if tag != 0x64 {
+		return nil, errors.New("no netlogon response")
+	}
+
+	// skip the object name
+	_, _, rest, err := berNext(entry)
+	if err != nil {
+		return nil, err
+	}
+	_, attrs, _, err := berNext(rest)
+	if err != nil {
+		return nil, err
+	}
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = berNext(attrs); err != nil {
+			return nil, err
+		}
+		_, name, vals, err := berNext(attr)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.EqualFold(string(name), "Netlogon") {
+			continue
+		}
+		_, set, _, err := berNext(vals)
+		if err != nil {
+			return nil, err
+		}
+		_, value, _, err := berNext(set)
+		if err != nil {
+			return nil, err
+		}
+
+		return parseNetlogon(value)
+	}
+
+	return nil, errors.New("no netlogon response")
+}
+
+// parseNetlogon parses a NETLOGON_SAM_LOGON_RESPONSE_EX from MS-ADTS 6.3.1.9
+func parseNetlogon(b []byte) (*netlogonResponse, error) {
+	if len(b) < 24 {
+		return nil, errors.New("netlogon response too short")
+	}
+	if op := binary.LittleEndian.Uint16(b[0:2]); op != netlogonSAMLogonResponseEx && op != netlogonSAMUserUnknownEx {
+		return nil, fmt.Errorf("unsupported netlogon response opcode %d", op)
+	}
+
+	// forest, domain, host, netbios domain, netbios computer, user, dc site and client site
+	names := make([]string, 8)
+	off := 24
+	for i := range names {
+		var err error
+		if names[i], off, err = netlogonName(b, off); err != nil {
+			return nil, err
+		}
+	}
+
+	return &netlogonResponse{
+		flags:      binary.LittleEndian.Uint32(b[4:8]),
+		dnsDomain:  names[1],
+		dnsHost:    names[2],
+		dcSite:     names[6],
+		clientSite: names[7],
+	}, nil
+}
+
+// netlogonName reads a name compressed as in RFC 1035 at off, returning it and the offset of the
+// following field
+func netlogonName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for hops := 0; ; {
+		if off >= len(b) {
+			return "", 0, errors.New("truncated netlogon name")
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) || hops >= 16 {
+				return "", 0, errors.New("invalid netlogon name pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = (l&0x3f)<<8 | int(b[off+1])
+			hops++
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errors.New("truncated netlogon name")
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// ber returns a BER element with the provided single byte tag
+func ber(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		b = append(b, c...)
+	}
+
+	return b
+}
+
+// berNext returns the tag and content of the first BER element of b and the bytes following it.
+// Unlike encoding/asn1 lengths need not be minimal, as Active Directory does not send them that way.
+func berNext(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated ber element")
+	}
+	tag, l := b[0], int(b[1])
+	b = b[2:]
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 || len(b) < n {
+			return 0, nil, nil, errors.New("invalid ber length")
+		}
+		l = 0
+		for _, c := range b[:n] {
+			l = l<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if l < 0 || l > len(b) {
+		return 0, nil, nil, errors.New("truncated ber element")
+	}
+
+	return tag, b[:l], b[l:], nil
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// berLong returns a BER element using a four byte length, as sent by Active Directory
+func berLong(tag byte, content ...[]byte) []byte {
+	var b []byte
+	for _, c := range content {
+		b = append(b, c...)
+	}
+
+	return append(binary.BigEndian.AppendUint32([]byte{tag, 0x84}, uint32(len(b))), b...)
+}
+
+// testNetlogon returns a NETLOGON_SAM_LOGON_RESPONSE_EX for a domain controller of example.com in site
+func testNetlogon(flags uint32, site string) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, netlogonSAMLogonResponseEx)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, flags)
+	b = append(b, make([]byte, 16)...)
+	b = append(b, "\x07example\x03com\x00"...) // forest at offset 24
+	b = append(b, 0xc0, 24)                    // domain
+	b = append(b, "\x03dc1\xc0\x18"...)        // host
+	b = append(b, "\x07EXAMPLE\x00\x03DC1\x00\x00"...)
+	b = append(b, byte(len(site)))
+	b = append(b, site+"\x00"...)
+	b = append(b, "\x05Perth\x00"...)
+
+	return b
+}
+
+// testCLDAPServer answers LDAP pings on addr with the provided Netlogon response and returns its address
+func testCLDAPServer(t *testing.T, addr string, netlogon []byte) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			_, msg, _, err := berNext(b[:n])
+			if err != nil {
+				continue
+			}
+			_, id, _, err := berNext(msg)
+			if err != nil {
+				continue
+			}
+
+			entry := berLong(0x30, berLong(0x02, id), berLong(0x64,
+				berLong(0x04, nil),
+				berLong(0x30, berLong(0x30, berLong(0x04, []byte("netlogon")), berLong(0x31, berLong(0x04, netlogon)))),
+			))
+			done := berLong(0x30, berLong(0x02, id), berLong(0x65, ber(0x0a, []byte{0}), ber(0x04, nil), ber(0x04, nil)))
+			conn.WriteTo(append(entry, done...), from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestParseLDAPPing(t *testing.T) {
+	resp, err := parseNetlogon(testNetlogon(netlogonKDCFlag, "Sydney"))
+	if err != nil {
+		t.Fatalf("parseNetlogon() error = %v", err)
+	}
+	want := &netlogonResponse{flags: netlogonKDCFlag, dnsDomain: "example.com", dnsHost: "dc1.example.com", dcSite: "Sydney", clientSite: "Perth"}
+	if !reflect.DeepEqual(resp, want) {
+		t.Errorf("parseNetlogon() = %+v, want %+v", resp, want)
+	}
+
+	// pointers must not loop forever
+	loop := append(testNetlogon(0, "")[:24], 0xc0, 24)
+	if _, err := parseNetlogon(loop); err == nil {
+		t.Error("parseNetlogon() with a pointer loop did not return an error")
+	}
+
+	// the request is well formed
+	_, msg, rest, err := berNext(ldapPingRequest(7, "example.com"))
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("berNext() error = %v, rest = %d", err, len(rest))
+	}
+	_, id, op, err := berNext(msg)
+	if err != nil || !reflect.DeepEqual(id, []byte{7}) || op[0] != 0x63 {
+		t.Errorf("request = % x", msg)
+	}
+}
+
+func TestDCPing(t *testing.T) {
+	sydney := testCLDAPServer(t, "127.0.0.2:0", testNetlogon(netlogonKDCFlag, "Sydney"))
+	_, port, _ := net.SplitHostPort(sydney)
+	testCLDAPServer(t, "127.0.0.3:"+port, testNetlogon(netlogonKDCFlag, "Perth"))
+	testCLDAPServer(t, "127.0.0.4:"+port, testNetlogon(0, "Perth"))
+
+	pings := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "pings"}, []string{"result"})
+	p := newDCPinger(0, pings)
+	p.port = port
+
+	// 127.0.0.5 does not answer and 127.0.0.4 is not running a kdc
+	kdcs := []string{"127.0.0.5:88", "127.0.0.4:88", "127.0.0.2:88", "127.0.0.3:88"}
+	tests := []struct {
+		name  string
+		realm string
+		site  string
+		want  []string
+	}{
+		{"site", "EXAMPLE.COM", "Perth", []string{"127.0.0.3:88", "127.0.0.2:88", "127.0.0.5:88", "127.0.0.4:88"}},
+		{"no site", "EXAMPLE.COM", "", []string{"127.0.0.2:88", "127.0.0.3:88", "127.0.0.5:88", "127.0.0.4:88"}},
+		{"wrong domain", "OTHER.COM", "", kdcs},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.order(context.Background(), tt.realm, tt.site, kdcs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// each domain controller is pinged once per domain
+	for result, want := range map[dcPingResult]float64{dcPingOK: 2, dcPingNotKDC: 1, dcPingWrongDomain: 3, dcPingError: 2} {
+		if got := testutil.ToFloat64(pings.WithLabelValues(string(result))); got != want {
+			t.Errorf("%s pings = %v, want %v", result, got, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// conformanceFixture describes a stored KKDCP exchange in testdata/conformance. The request is the
+// HTTP body sent by the client and the response is the HTTP body it accepts, from which the reply
+// returned by the KDC is taken. Fixtures for other clients are added by saving the request and
+// response bodies of an exchange, for example from an intercepting HTTPS proxy, with a JSON file.
+type conformanceFixture struct {
+	Client      string `json:"client"`
+	Description string `json:"description"`
+	Realm       string `json:"realm"`
+	Request     string `json:"request"`
+	Response    string `json:"response"`
+}
+
+func TestConformance(t *testing.T) {
+	dir := filepath.Join("testdata", "conformance")
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no conformance fixtures found: %v", err)
+	}
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".json"), func(t *testing.T) {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f conformanceFixture
+			if err := json.Unmarshal(b, &f); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			t.Logf("%s: %s", f.Client, f.Description)
+
+			req, err := os.ReadFile(filepath.Join(dir, f.Request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := os.ReadFile(filepath.Join(dir, f.Response))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the kdc answers with the reply carried by the stored response
+			var sent, reply KdcProxyMsg
+			if _, err := asn1.Unmarshal(req, &sent); err != nil {
+				t.Fatalf("invalid request fixture: %v", err)
+			}
+			if _, err := asn1.Unmarshal(resp, &reply); err != nil {
+				t.Fatalf("invalid response fixture: %v", err)
+			}
+			transport := &mockTransport{resp: reply.KerbMessage}
+
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[realms]\n "+f.Realm+" = {\n  kdc = kdc.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(transport),
+				WithProtocols("tcp"),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			k.Handler(w, httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(req)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			// the kerberos message is forwarded unchanged to a kdc for the realm
+			if len(transport.kdcs) != 1 || transport.kdcs[0] != "tcp/kdc.example.com:88" {
+				t.Errorf("kdcs = %v", transport.kdcs)
+			}
+			if !bytes.Equal(transport.req, sent.KerbMessage) {
+				t.Errorf("forwarded %x, want %x", transport.req, sent.KerbMessage)
+			}
+
+			// the response is framed exactly as the client expects
+			if !bytes.Equal(w.Body.Bytes(), resp) {
+				t.Errorf("response = %x, want %x", w.Body.Bytes(), resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	diagnosticsKey
+	clientKey
+	attemptsKey
+	attemptLogKey
+)
+
+// ContextWithRequestID returns a copy of ctx carrying the provided request ID, which is included
+// in all log messages for the request
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, if any
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey).(string)
+
+	return id, ok && id != ""
+}
+
+// log returns the logger to use for the request associated with ctx
+func (k *KerberosProxy) log(ctx context.Context) *slog.Logger {
+	if id, ok := RequestIDFromContext(ctx); ok {
+		return k.logger.With("req_id", id)
+	}
+
+	return k.logger
+}
+
+// contextWithAttempts returns a copy of ctx that numbers the KDC exchanges for a request
+func contextWithAttempts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, attemptsKey, new(atomic.Int64))
+}
+
+// nextAttempt returns the number of the next KDC exchange for the request associated with ctx,
+// starting from 1, or 0 if exchanges are not numbered
+func nextAttempt(ctx context.Context) int64 {
+	if n, ok := ctx.Value(attemptsKey).(*atomic.Int64); ok {
+		return n.Add(1)
+	}
+
+	return 0
+}
+
+// contextWithAttemptLog returns a copy of ctx carrying the logger for a KDC exchange, so the
+// transport can log each phase of the exchange with the request and attempt
+func contextWithAttemptLog(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, attemptLogKey, logger)
+}
+
+// attemptLog returns the logger for the KDC exchange associated with ctx
+func attemptLog(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(attemptLogKey).(*slog.Logger); ok {
+		return logger
+	}
+
+	return discardLogger
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRequestIDFromContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		want   string
+		wantOk bool
+	}{
+		{"no request id", context.Background(), "", false},
+		{"empty request id", ContextWithRequestID(context.Background(), ""), "", false},
+		{"request id", ContextWithRequestID(context.Background(), "abc123"), "abc123", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := RequestIDFromContext(tt.ctx)
+			if ok != tt.wantOk {
+				t.Errorf("RequestIDFromContext() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if got != tt.want {
+				t.Errorf("RequestIDFromContext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultTimeoutHeader is the request header conventionally used to pass a deadline hint
+const DefaultTimeoutHeader = "X-Request-Timeout"
+
+// deadlineHint bounds forwarding by the time remaining that a client or load balancer passes in a
+// request header, so no work is done on requests that have already been abandoned
+type deadlineHint struct {
+	header string
+	max    time.Duration
+}
+
+// timeout returns the timeout from the hint header of r clamped to the maximum, or false if the
+// header is missing or invalid. The value is either a number of seconds or a duration such as
+// "1500ms".
+func (d *deadlineHint) timeout(r *http.Request) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+
+	v := r.Header.Get(d.header)
+	if v == "" {
+		return 0, false
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		timeout = time.Duration(secs * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, false
+	}
+
+	return min(timeout, d.max), true
+}
+
+// context returns ctx with the deadline from the hint header of r applied, if any
+func (d *deadlineHint) context(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, ok := d.timeout(r)
+	if !ok {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
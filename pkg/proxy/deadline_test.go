@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDeadlineHintTimeout(t *testing.T) {
+	d := &deadlineHint{header: DefaultTimeoutHeader, max: 5 * time.Second}
+
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"missing", "", 0, false},
+		{"seconds", "1.5", 1500 * time.Millisecond, true},
+		{"duration", "250ms", 250 * time.Millisecond, true},
+		{"clamped", "60", 5 * time.Second, true},
+		{"zero", "0", 0, false},
+		{"negative", "-1s", 0, false},
+		{"invalid", "soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/KdcProxy", nil)
+			if tt.value != "" {
+				r.Header.Set("x-request-timeout", tt.value)
+			}
+			got, ok := d.timeout(r)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("timeout() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+// deadlineTransport records the deadline of the context of each exchange
+type deadlineTransport struct {
+	remaining time.Duration
+}
+
+func (d *deadlineTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	d.remaining = time.Until(deadline)
+
+	return nil, context.DeadlineExceeded
+}
+
+func TestWithTimeoutHeader(t *testing.T) {
+	if _, err := NewKdcProxy(WithTimeoutHeader("", time.Second)); err == nil {
+		t.Error("WithTimeoutHeader() with no header did not return an error")
+	}
+	if _, err := NewKdcProxy(WithTimeoutHeader(DefaultTimeoutHeader, 0)); err == nil {
+		t.Error("WithTimeoutHeader() with no maximum did not return an error")
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		max   time.Duration
+	}{
+		{"hint", "0.1", 200 * time.Millisecond},
+		{"no hint", "", DefaultTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &deadlineTransport{}
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(transport),
+				WithProtocols(protoTcp),
+				WithTimeoutHeader(DefaultTimeoutHeader, time.Minute),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+			if tt.value != "" {
+				req.Header.Set(DefaultTimeoutHeader, tt.value)
+			}
+			k.Handler(httptest.NewRecorder(), req)
+
+			if transport.remaining <= 0 || transport.remaining > tt.max {
+				t.Errorf("remaining time for exchange = %v, want up to %v", transport.remaining, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// dedupeCall is a request that is in-flight or was recently answered
+type dedupeCall struct {
+	done chan struct{}
+	resp []byte
+	err  error
+
+	// abandoned is set when the caller of the original request gave up before it completed
+	abandoned bool
+}
+
+// dedupe detects retransmissions of the same Kerberos message, such as those sent by clients that
+// retry as they would over UDP, and serves them the result of the original request
+type dedupe struct {
+	window time.Duration
+	mu     sync.Mutex
+	calls  map[[sha256.Size]byte]*dedupeCall
+}
+
+func newDedupe(window time.Duration) *dedupe {
+	return &dedupe{
+		window: window,
+		calls:  make(map[[sha256.Size]byte]*dedupeCall),
+	}
+}
+
+// interceptor returns an Interceptor that joins duplicate requests to the original while it is
+// in-flight and serves its response for the window after it completes. Errors are not kept once the
+// original request completes so a retry is able to succeed, and duplicates joined to a request that
+// its caller abandoned are forwarded again rather than failing with the error of that caller.
+func (d *dedupe) interceptor(k *KerberosProxy) Interceptor {
+	return func(next ForwardFunc) ForwardFunc {
+		return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+			h := sha256.New()
+			h.Write([]byte(msg.TargetDomain))
+			h.Write([]byte{0})
+			h.Write(msg.KerbMessage)
+			var key [sha256.Size]byte
+			h.Sum(key[:0])
+
+			for {
+				d.mu.Lock()
+				c, ok := d.calls[key]
+				if !ok {
+					break
+				}
+				d.mu.Unlock()
+				k.metrics.duplicates.Inc()
+				k.log(ctx).DebugContext(ctx, "duplicate request", "realm", msg.TargetDomain)
+
+				select {
+				case <-c.done:
+					if !c.abandoned {
+						return c.resp, c.err
+					}
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			c := &dedupeCall{done: make(chan struct{})}
+			d.calls[key] = c
+			d.mu.Unlock()
+
+			c.resp, c.err = next(ctx, msg)
+			c.abandoned = c.err != nil && ctx.Err() != nil
+
+			// errors are forgotten before waiters are released so any retry is forwarded again
+			if c.err != nil {
+				d.forget(key, c)
+			} else {
+				time.AfterFunc(d.window, func() { d.forget(key, c) })
+			}
+			close(c.done)
+
+			return c.resp, c.err
+		}
+	}
+}
+
+// forget removes the call for key if it has not already been replaced
+func (d *dedupe) forget(key [sha256.Size]byte, c *dedupeCall) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.calls[key] == c {
+		delete(d.calls, key)
+	}
+}
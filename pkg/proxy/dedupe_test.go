@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatedTransport blocks each exchange until release is closed
+type gatedTransport struct {
+	resp    []byte
+	release chan struct{}
+	calls   atomic.Int64
+}
+
+func (g *gatedTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	g.calls.Add(1)
+	<-g.release
+
+	return g.resp, nil
+}
+
+func TestWithDedupe(t *testing.T) {
+	if _, err := NewKdcProxy(WithDedupe(-time.Second)); err == nil {
+		t.Errorf("WithDedupe(-1s) did not return an error")
+	}
+
+	reply := testKRBError(t)
+	req := testASReq(t)
+	transport := &gatedTransport{resp: append(MarshalKerbLength(len(reply)), reply...), release: make(chan struct{})}
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithDedupe(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	forward := func(kerb []byte) ([]byte, error) {
+		return k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(kerb)), kerb...), TargetDomain: "EXAMPLE.COM"})
+	}
+
+	// concurrent duplicates are joined to the in-flight request
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := forward(req)
+			if err != nil || !bytes.Equal(resp[4:], reply) {
+				t.Errorf("Forward() = %x, %v", resp, err)
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(k.metrics.duplicates) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("duplicate requests were not joined")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(transport.release)
+	wg.Wait()
+
+	// a duplicate within the window is served from the completed request
+	if _, err := forward(req); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+
+	if got := transport.calls.Load(); got != 1 {
+		t.Errorf("transport exchanges = %v, want 1", got)
+	}
+
+	// a different message is forwarded
+	if _, err := forward(append(append([]byte{}, req...), 0)); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+
+	if got := transport.calls.Load(); got != 2 {
+		t.Errorf("transport exchanges = %v, want 2", got)
+	}
+
+	if got := testutil.ToFloat64(k.metrics.duplicates); got != 3 {
+		t.Errorf("duplicates = %v, want 3", got)
+	}
+}
+
+// abandonedTransport blocks the first exchange until it is cancelled and answers the rest
+type abandonedTransport struct {
+	resp  []byte
+	calls atomic.Int64
+}
+
+func (a *abandonedTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	if a.calls.Add(1) == 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return a.resp, nil
+}
+
+func TestDedupeAbandoned(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+	transport := &abandonedTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithProtocols(protoTcp),
+		WithDedupe(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	forward := func(ctx context.Context) ([]byte, error) {
+		return k.Forward(ctx, &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"})
+	}
+	wait := func(what string, done func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// the original request is abandoned by its caller while a duplicate waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	original := make(chan error, 1)
+	go func() {
+		_, err := forward(ctx)
+		original <- err
+	}()
+	wait("the original request", func() bool { return transport.calls.Load() == 1 })
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	duplicate := make(chan result, 1)
+	go func() {
+		resp, err := forward(context.Background())
+		duplicate <- result{resp, err}
+	}()
+	wait("the duplicate request", func() bool { return testutil.ToFloat64(k.metrics.duplicates) == 1 })
+	cancel()
+
+	if err := <-original; !errors.Is(err, context.Canceled) {
+		t.Errorf("original Forward() error = %v, want %v", err, context.Canceled)
+	}
+
+	// the duplicate is forwarded again instead of sharing the error of the abandoned request
+	r := <-duplicate
+	if r.err != nil || !bytes.Equal(r.resp[4:], reply) {
+		t.Errorf("duplicate Forward() = %x, %v", r.resp, r.err)
+	}
+	if got := transport.calls.Load(); got != 2 {
+		t.Errorf("transport exchanges = %v, want 2", got)
+	}
+}
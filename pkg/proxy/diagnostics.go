@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// ForwardInfo describes how a request was forwarded
+type ForwardInfo struct {
+	// Realm is the realm the request was forwarded for
+	Realm string
+	// Type is the type of Kerberos message forwarded
+	Type MessageType
+	// KDC is the address of the KDC that answered, if any
+	KDC string
+	// Proto is the protocol used to contact the KDC that answered
+	Proto string
+	// Attempts is the number of exchanges with KDC's, including those that failed
+	Attempts int
+	// Failure is the class of failure, such as FailureMalformed, when the request was rejected
+	// or could not be forwarded
+	Failure string
+}
+
+// ContextWithForwardInfo returns a copy of ctx that records how the request it is used for is
+// forwarded, along with a function returning what has been recorded, such as for access logs
+func ContextWithForwardInfo(ctx context.Context) (context.Context, func() ForwardInfo) {
+	d := &diagnostics{}
+
+	return context.WithValue(ctx, diagnosticsKey, d), d.info
+}
+
+// ForwardInfoFromContext returns what has been recorded so far about the request ctx is used for,
+// which is only available when ctx, or a context it was derived from, came from
+// ContextWithForwardInfo
+func ForwardInfoFromContext(ctx context.Context) (ForwardInfo, bool) {
+	d := diagnosticsFromContext(ctx)
+	if d == nil {
+		return ForwardInfo{}, false
+	}
+
+	return d.info(), true
+}
+
+// diagnostics records how a request was forwarded for the diagnostic response headers and
+// ForwardInfo
+type diagnostics struct {
+	mu       sync.Mutex
+	realm    string
+	typ      MessageType
+	kdc      string
+	proto    string
+	attempts int
+	failure  string
+}
+
+// diagnosticsFromContext returns the diagnostics carried by ctx, which is nil unless diagnostic
+// headers are enabled or the caller used ContextWithForwardInfo
+func diagnosticsFromContext(ctx context.Context) *diagnostics {
+	d, _ := ctx.Value(diagnosticsKey).(*diagnostics)
+
+	return d
+}
+
+// forwarding records the realm and message type of a request being forwarded
+func (d *diagnostics) forwarding(realm string, typ MessageType) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.realm = realm
+	d.typ = typ
+}
+
+// exchange records an attempt to contact a KDC and the KDC that answered
+func (d *diagnostics) exchange(kdc, proto string, err error) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attempts++
+	if err == nil {
+		d.kdc = kdc
+		d.proto = proto
+	}
+}
+
+// failed records the class of failure of the request
+func (d *diagnostics) failed(failure string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.failure = failure
+}
+
+// info returns what has been recorded
+func (d *diagnostics) info() ForwardInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return ForwardInfo{Realm: d.realm, Type: d.typ, KDC: d.kdc, Proto: d.proto, Attempts: d.attempts, Failure: d.failure}
+}
+
+// setHeaders adds the diagnostic headers to h
+func (d *diagnostics) setHeaders(h http.Header, realm string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h.Set("X-KdcProxy-Realm", realm)
+	h.Set("X-KdcProxy-Attempts", strconv.Itoa(d.attempts))
+	if d.kdc != "" {
+		h.Set("X-KdcProxy-Kdc", d.kdc)
+		h.Set("X-KdcProxy-Protocol", d.proto)
+	}
+}
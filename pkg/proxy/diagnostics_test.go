@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWithDiagnosticHeaders(t *testing.T) {
+	reply := testKRBError(t)
+
+	tests := []struct {
+		name string
+		opts []Option
+		want map[string]string
+	}{
+		{"disabled", nil, map[string]string{
+			"X-KdcProxy-Realm":    "",
+			"X-KdcProxy-Kdc":      "",
+			"X-KdcProxy-Attempts": "",
+		}},
+		{"enabled", []Option{WithDiagnosticHeaders()}, map[string]string{
+			"X-KdcProxy-Realm":    "EXAMPLE.COM",
+			"X-KdcProxy-Kdc":      "kdc.example.com:88",
+			"X-KdcProxy-Protocol": "udp",
+			"X-KdcProxy-Attempts": "1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{
+				WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+			}, tt.opts...)
+			k, err := NewKdcProxy(opts...)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+			w := httptest.NewRecorder()
+			k.Handler(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Handler() status = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			for header, want := range tt.want {
+				if got := w.Header().Get(header); got != want {
+					t.Errorf("header %s = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}
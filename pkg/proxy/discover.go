@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultDiscoveryTimeout is the time allowed for each DNS query made by a Discoverer
+const DefaultDiscoveryTimeout = 5 * time.Second
+
+// Endpoint transports
+const (
+	TransportKKDCP = "kkdcp"
+	TransportTCP   = "tcp"
+	TransportUDP   = "udp"
+)
+
+// typeURI is the DNS URI resource record type from RFC 7553
+const typeURI dnsmessage.Type = 256
+
+// Endpoint is a way of reaching the KDC's of a realm
+type Endpoint struct {
+	// Transport is TransportKKDCP for a KDC Proxy, or TransportTCP or TransportUDP for a KDC
+	Transport string
+
+	// Address is the URL of a KDC Proxy or the host:port of a KDC
+	Address string
+
+	// Primary is true when the record marks the KDC as the primary KDC of the realm
+	Primary bool
+}
+
+// Discoverer locates the KDC Proxies and KDC's of a realm using DNS. The "_kerberos.REALM" URI
+// records used by MIT Kerberos are preferred, such as:
+//
+//	_kerberos.EXAMPLE.COM. IN URI 10 1 "krb5srv:m:kkdcp:https://kdcproxy.example.com/KdcProxy"
+//
+// When a realm has no URI records the "_kerberos._tcp.REALM" and "_kerberos._udp.REALM" SRV records
+// published by Active Directory are used instead, which only locate KDC's.
+type Discoverer struct {
+	// Servers are the DNS servers queried as host:port, which default to the nameservers in
+	// /etc/resolv.conf
+	Servers []string
+
+	// Timeout is the time allowed for each query, which defaults to DefaultDiscoveryTimeout
+	Timeout time.Duration
+}
+
+// DiscoverKdcProxy returns the URLs of the KDC Proxies of realm using the default Discoverer, in the
+// order they should be tried
+func DiscoverKdcProxy(ctx context.Context, realm string) ([]string, error) {
+	endpoints, err := (&Discoverer{}).Discover(ctx, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, e := range endpoints {
+		if e.Transport == TransportKKDCP {
+			urls = append(urls, e.Address)
+		}
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no kdc proxy found for %s", realm)
+	}
+
+	return urls, nil
+}
+
+// Discover returns the endpoints of realm in the order they should be tried
+func (d *Discoverer) Discover(ctx context.Context, realm string) ([]Endpoint, error) {
+	if realm == "" {
+		return nil, errors.New("realm is required")
+	}
+
+	servers := d.Servers
+	if len(servers) == 0 {
+		servers = systemNameservers()
+	}
+
+	records, uriErr := d.lookupURI(ctx, servers, "_kerberos."+realm)
+	if uriErr == nil && len(records) > 0 {
+		var endpoints []Endpoint
+		for _, r := range orderURIRecords(records) {
+			e, err := parseKrb5srv(r.target)
+			if err != nil {
+				continue
+			}
+			endpoints = append(endpoints, e)
+		}
+		if len(endpoints) > 0 {
+			return endpoints, nil
+		}
+	}
+
+	// fall back to the srv records used by active directory
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{Timeout: d.timeout()}).DialContext(ctx, network, servers[0])
+	}}
+	var endpoints []Endpoint
+	var srvErr error
+	for _, transport := range []string{TransportTCP, TransportUDP} {
+		_, srvs, err := resolver.LookupSRV(ctx, "kerberos", transport, realm)
+		if dnsErr := (*net.DNSError)(nil); errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+		if err != nil {
+			srvErr = err
+			continue
+		}
+		for _, srv := range srvs {
+			endpoints = append(endpoints, Endpoint{
+				Transport: transport,
+				Address:   net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))),
+			})
+		}
+	}
+	if len(endpoints) > 0 {
+		return endpoints, nil
+	}
+
+	if err := errors.Join(uriErr, srvErr); err != nil {
+		return nil, fmt.Errorf("could not discover endpoints for %s: %w", realm, err)
+	}
+
+	return nil, fmt.Errorf("no endpoints found for %s", realm)
+}
+
+func (d *Discoverer) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+
+	return DefaultDiscoveryTimeout
+}
+
+// uriRecord is a DNS URI resource record
+type uriRecord struct {
+	priority uint16
+	weight   uint16
+	target   string
+}
+
+// lookupURI queries each server in turn for the URI records of name, returning no records and no
+// error if the name does not exist
+func (d *Discoverer) lookupURI(ctx context.Context, servers []string, name string) ([]uriRecord, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: typeURI, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, server := range servers {
+		resp, err := d.exchange(ctx, TransportUDP, server, query)
+		if err == nil && resp.Header.Truncated {
+			resp, err = d.exchange(ctx, TransportTCP, server, query)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.Header.ID != id {
+			errs = append(errs, fmt.Errorf("%s: mismatched dns response id", server))
+			continue
+		}
+
+		switch resp.Header.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, nil
+		default:
+			errs = append(errs, fmt.Errorf("%s: dns query failed: %s", server, resp.Header.RCode))
+			continue
+		}
+
+		var records []uriRecord
+		for _, a := range resp.Answers {
+			body, ok := a.Body.(*dnsmessage.UnknownResource)
+			if a.Header.Type != typeURI || !ok || len(body.Data) < 5 {
+				continue
+			}
+			records = append(records, uriRecord{
+				priority: binary.BigEndian.Uint16(body.Data[0:2]),
+				weight:   binary.BigEndian.Uint16(body.Data[2:4]),
+				target:   string(body.Data[4:]),
+			})
+		}
+
+		return records, nil
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// exchange sends a DNS query to server over UDP or TCP and returns the response
+func (d *Discoverer) exchange(ctx context.Context, network, server string, query []byte) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var b []byte
+	if network == TransportTCP {
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		b = make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		b = make([]byte, 4096)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		return nil, fmt.Errorf("%s: invalid dns response: %w", server, err)
+	}
+
+	return &msg, nil
+}
+
+// orderURIRecords orders records by priority, then randomly weighted by weight as described by
+// RFC 7553
+func orderURIRecords(records []uriRecord) []uriRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].priority < records[j].priority
+	})
+
+	ordered := make([]uriRecord, 0, len(records))
+	for start := 0; start < len(records); {
+		end := start
+		for end < len(records) && records[end].priority == records[start].priority {
+			end++
+		}
+
+		group := append([]uriRecord(nil), records[start:end]...)
+		for len(group) > 0 {
+			total := 0
+			for _, r := range group {
+				total += int(r.weight)
+			}
+			i := 0
+			if total > 0 {
+				n := rand.Intn(total)
+				for ; i < len(group)-1; i++ {
+					if n < int(group[i].weight) {
+						break
+					}
+					n -= int(group[i].weight)
+				}
+			}
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+		start = end
+	}
+
+	return ordered
+}
+
+// parseKrb5srv parses the target of a URI record in the form "krb5srv:flags:transport:residual" used
+// by MIT Kerberos
+func parseKrb5srv(target string) (Endpoint, error) {
+	parts := strings.SplitN(target, ":", 4)
+	if len(parts) != 4 || !strings.EqualFold(parts[0], "krb5srv") || parts[3] == "" {
+		return Endpoint{}, fmt.Errorf("invalid krb5srv uri %q", target)
+	}
+
+	e := Endpoint{
+		Transport: strings.ToLower(parts[2]),
+		Address:   parts[3],
+		Primary:   strings.ContainsAny(parts[1], "mM"),
+	}
+	switch e.Transport {
+	case TransportKKDCP:
+		if !strings.Contains(e.Address, "://") {
+			e.Address = "https://" + e.Address
+		}
+	case TransportTCP, TransportUDP:
+		if _, _, err := net.SplitHostPort(e.Address); err != nil {
+			e.Address = net.JoinHostPort(e.Address, "88")
+		}
+	default:
+		return Endpoint{}, fmt.Errorf("unsupported transport %q", parts[2])
+	}
+
+	return e, nil
+}
+
+// systemNameservers returns the nameservers in /etc/resolv.conf, or the local resolver if there
+// are none
+func systemNameservers() []string {
+	var servers []string
+	if b, err := os.ReadFile("/etc/resolv.conf"); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+
+	return servers
+}
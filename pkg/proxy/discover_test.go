@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer answers URI and SRV queries over UDP from the provided records, keyed by lower case
+// name, and returns its address
+func testDNSServer(t *testing.T, uris map[string][]string, srvs map[string][]dnsmessage.SRVResource) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(b[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			q := query.Questions[0]
+			name := strings.ToLower(q.Name.String())
+
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.Header.ID, Response: true},
+				Questions: query.Questions,
+			}
+			switch q.Type {
+			case typeURI:
+				for _, target := range uris[name] {
+					data := binary.BigEndian.AppendUint16(nil, 10)
+					data = binary.BigEndian.AppendUint16(data, 1)
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: typeURI, Class: dnsmessage.ClassINET},
+						Body:   &dnsmessage.UnknownResource{Type: typeURI, Data: append(data, target...)},
+					})
+				}
+			case dnsmessage.TypeSRV:
+				for _, srv := range srvs[name] {
+					srv := srv
+					resp.Answers = append(resp.Answers, dnsmessage.Resource{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+						Body:   &srv,
+					})
+				}
+			}
+			if len(resp.Answers) == 0 {
+				resp.Header.RCode = dnsmessage.RCodeNameError
+			}
+
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestDiscover(t *testing.T) {
+	server := testDNSServer(t,
+		map[string][]string{
+			"_kerberos.example.com.": {
+				"krb5srv:m:kkdcp:https://kdcproxy.example.com/KdcProxy",
+				"krb5srv::tcp:kdc1.example.com",
+				"krb5srv::udp:kdc1.example.com:8888",
+				"krb5srv::carrier-pigeon:kdc1.example.com",
+			},
+		},
+		map[string][]dnsmessage.SRVResource{
+			"_kerberos._tcp.ad.example.com.": {{Priority: 0, Weight: 100, Port: 88, Target: dnsmessage.MustNewName("dc1.ad.example.com.")}},
+		},
+	)
+	d := &Discoverer{Servers: []string{server}}
+
+	tests := []struct {
+		name    string
+		realm   string
+		want    []Endpoint
+		wantErr bool
+	}{
+		{"uri", "EXAMPLE.COM", []Endpoint{
+			{Transport: TransportKKDCP, Address: "https://kdcproxy.example.com/KdcProxy", Primary: true},
+			{Transport: TransportTCP, Address: "kdc1.example.com:88"},
+			{Transport: TransportUDP, Address: "kdc1.example.com:8888"},
+		}, false},
+		{"srv", "AD.EXAMPLE.COM", []Endpoint{
+			{Transport: TransportTCP, Address: "dc1.ad.example.com:88"},
+		}, false},
+		{"none", "MISSING.EXAMPLE.COM", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.Discover(context.Background(), tt.realm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Discover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// records of equal priority and weight may be returned in any order
+			if !tt.wantErr && !sameEndpoints(got, tt.want) {
+				t.Errorf("Discover() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func sameEndpoints(a, b []Endpoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[Endpoint]int)
+	for _, e := range a {
+		seen[e]++
+	}
+	for _, e := range b {
+		seen[e]--
+	}
+	for _, n := range seen {
+		if n != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestOrderURIRecords(t *testing.T) {
+	records := []uriRecord{
+		{priority: 20, weight: 1, target: "backup"},
+		{priority: 10, weight: 0, target: "never"},
+		{priority: 10, weight: 100, target: "primary"},
+	}
+
+	// a weight of 0 is only chosen once the weighted records are exhausted
+	for i := 0; i < 10; i++ {
+		got := orderURIRecords(append([]uriRecord(nil), records...))
+		var targets []string
+		for _, r := range got {
+			targets = append(targets, r.target)
+		}
+		if want := []string{"primary", "never", "backup"}; !reflect.DeepEqual(targets, want) {
+			t.Fatalf("orderURIRecords() = %v, want %v", targets, want)
+		}
+	}
+}
+
+func TestParseKrb5srv(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    Endpoint
+		wantErr bool
+	}{
+		{"krb5srv:m:kkdcp:https://kdcproxy.example.com/KdcProxy", Endpoint{Transport: TransportKKDCP, Address: "https://kdcproxy.example.com/KdcProxy", Primary: true}, false},
+		{"krb5srv::kkdcp:kdcproxy.example.com/KdcProxy", Endpoint{Transport: TransportKKDCP, Address: "https://kdcproxy.example.com/KdcProxy"}, false},
+		{"KRB5SRV::TCP:[2001:db8::1]:750", Endpoint{Transport: TransportTCP, Address: "[2001:db8::1]:750"}, false},
+		{"krb5srv::udp:kdc.example.com", Endpoint{Transport: TransportUDP, Address: "kdc.example.com:88"}, false},
+		{"https://kdcproxy.example.com/KdcProxy", Endpoint{}, true},
+		{"krb5srv::tcp:", Endpoint{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			got, err := parseKrb5srv(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKrb5srv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseKrb5srv() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Formats of Kerberos messages logged by WithMessageDump
+const (
+	DumpFormatHex    = "hex"
+	DumpFormatBase64 = "base64"
+)
+
+// DefaultDumpMaxBytes is the default number of bytes of each message logged by WithMessageDump
+const DefaultDumpMaxBytes = 4096
+
+// dump logs the Kerberos request and response of each exchange for protocol debugging
+type dump struct {
+	format string
+	max    int
+}
+
+// interceptor returns an Interceptor that logs the inner Kerberos messages at debug level
+func (d *dump) interceptor(k *KerberosProxy) Interceptor {
+	return func(next ForwardFunc) ForwardFunc {
+		return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+			log := k.log(ctx)
+			log.DebugContext(ctx, "kerberos request", "realm", msg.TargetDomain, "size", len(msg.KerbMessage)-4, "dump", d.encode(msg.KerbMessage[4:]))
+
+			resp, err := next(ctx, msg)
+			if len(resp) >= 4 {
+				log.DebugContext(ctx, "kerberos response", "realm", msg.TargetDomain, "size", len(resp)-4, "dump", d.encode(resp[4:]))
+			}
+
+			return resp, err
+		}
+	}
+}
+
+// encode returns up to max bytes of b in the configured format, noting any truncation
+func (d *dump) encode(b []byte) string {
+	truncated := len(b) > d.max
+	if truncated {
+		b = b[:d.max]
+	}
+
+	var s string
+	if d.format == DumpFormatBase64 {
+		s = base64.StdEncoding.EncodeToString(b)
+	} else {
+		s = hex.EncodeToString(b)
+	}
+
+	if truncated {
+		s += fmt.Sprintf("...(truncated at %d bytes)", d.max)
+	}
+
+	return s
+}
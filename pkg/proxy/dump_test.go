@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDumpEncode(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		max    int
+		want   string
+	}{
+		{"hex", DumpFormatHex, 10, "6a0102"},
+		{"base64", DumpFormatBase64, 10, "agEC"},
+		{"truncated", DumpFormatHex, 2, "6a01...(truncated at 2 bytes)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &dump{format: tt.format, max: tt.max}
+			if got := d.encode([]byte{0x6a, 0x01, 0x02}); got != tt.want {
+				t.Errorf("encode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMessageDump(t *testing.T) {
+	if _, err := NewKdcProxy(WithMessageDump("binary", 0)); err == nil {
+		t.Error("WithMessageDump(binary) did not return an error")
+	}
+
+	var buf bytes.Buffer
+	reply := testKRBError(t)
+	req := testASReq(t)
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+		WithLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+		WithMessageDump(DumpFormatHex, 0),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	if _, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+
+	for _, want := range []string{"dump=" + hex.EncodeToString(req), "dump=" + hex.EncodeToString(reply)} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log missing %s:\n%s", want, buf.String())
+		}
+	}
+}
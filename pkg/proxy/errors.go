@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Errors returned by the proxy, which may be wrapped with further detail so should be checked
+// using errors.Is
+var (
+	// ErrMalformedMessage is returned when a message could not be decoded or is not a valid request
+	ErrMalformedMessage = errors.New("malformed message")
+	// ErrRealmNotAllowed is returned when forwarding for a realm is not permitted
+	ErrRealmNotAllowed = errors.New("realm not allowed")
+	// ErrAccessDenied is returned when the access rules do not permit forwarding a request
+	ErrAccessDenied = errors.New("access denied")
+	// ErrNoKDCFound is returned when no KDC's could be found for a realm
+	ErrNoKDCFound = errors.New("no kdcs found")
+	// ErrUpstreamTimeout is returned when KDC's were found but the last attempt to contact one timed out
+	ErrUpstreamTimeout = errors.New("timeout contacting kdc")
+	// ErrUpstreamUnavailable is returned when KDC's were found but none returned a valid response
+	ErrUpstreamUnavailable = errors.New("no kdc available")
+)
+
+var (
+	errAuthzUnavailable = errors.New("authorization unavailable")
+	errShortWrite       = errors.New("short write to kdc")
+	errInvalidReply     = errors.New("reply message was not valid")
+	errReplyTooLarge    = errors.New("reply message too large")
+)
+
+// Classes of upstream error used for metrics
+const (
+	errorTypeDNS         = "dns"
+	errorTypeRefused     = "connection_refused"
+	errorTypeTimeout     = "timeout"
+	errorTypeShortWrite  = "short_write"
+	errorTypeBadResponse = "bad_response"
+	errorTypeOther       = "other"
+)
+
+// classifyError returns the class of an error from an exchange with a KDC
+func classifyError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorTypeDNS
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errorTypeRefused
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorTypeTimeout
+	}
+
+	if errors.Is(err, errShortWrite) {
+		return errorTypeShortWrite
+	}
+
+	if errors.Is(err, errInvalidReply) || errors.Is(err, errReplyTooLarge) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorTypeBadResponse
+	}
+
+	return errorTypeOther
+}
+
+// Classes of failure of the KDC Proxy handler whose HTTP status code can be changed using
+// WithStatusCodes, as load balancers decide whether to retry or mark a backend unhealthy from it
+const (
+	// FailureMethodNotAllowed is a request not using POST, by default 405 Method Not Allowed
+	FailureMethodNotAllowed = "method-not-allowed"
+	// FailureUnauthorized is a request that failed the authentication of the handler, by default 401 Unauthorized
+	FailureUnauthorized = "unauthorized"
+	// FailureLengthRequired is a request without a content length, by default 411 Length Required
+	FailureLengthRequired = "length-required"
+	// FailureMalformed is a request that could not be read or decoded, by default 400 Bad Request
+	FailureMalformed = "malformed"
+	// FailureTooLarge is a request over the size limit, by default 413 Request Entity Too Large
+	FailureTooLarge = "too-large"
+	// FailureRealmDenied is a request for a realm that is not allowed, by default 403 Forbidden
+	FailureRealmDenied = "realm-denied"
+	// FailureAccessDenied is a request denied by the access rules or authorizer, by default 403 Forbidden
+	FailureAccessDenied = "access-denied"
+	// FailureRateLimited is a request over a rate limit, by default 429 Too Many Requests
+	FailureRateLimited = "rate-limited"
+	// FailureOverloaded is a request rejected as too many are in-flight or queued, by default 503 Service Unavailable
+	FailureOverloaded = "overloaded"
+	// FailureAuthzUnavailable is a request that could not be authorized, by default 503 Service Unavailable
+	FailureAuthzUnavailable = "authz-unavailable"
+	// FailureNoKDC is a request for a realm without any KDC's found, by default 503 Service Unavailable
+	FailureNoKDC = "no-kdc"
+	// FailureUpstreamTimeout is a request where the last KDC tried timed out, by default 503 Service Unavailable
+	FailureUpstreamTimeout = "upstream-timeout"
+	// FailureUpstreamUnavailable is a request that no KDC answered, by default 503 Service Unavailable
+	FailureUpstreamUnavailable = "upstream-unavailable"
+	// FailureInternal is a reply that could not be encoded, by default 500 Internal Server Error
+	FailureInternal = "internal"
+)
+
+// defaultStatusCodes are the HTTP status codes returned for each class of failure
+var defaultStatusCodes = map[string]int{
+	FailureMethodNotAllowed:    http.StatusMethodNotAllowed,
+	FailureUnauthorized:        http.StatusUnauthorized,
+	FailureLengthRequired:      http.StatusLengthRequired,
+	FailureMalformed:           http.StatusBadRequest,
+	FailureTooLarge:            http.StatusRequestEntityTooLarge,
+	FailureRealmDenied:         http.StatusForbidden,
+	FailureAccessDenied:        http.StatusForbidden,
+	FailureRateLimited:         http.StatusTooManyRequests,
+	FailureOverloaded:          http.StatusServiceUnavailable,
+	FailureAuthzUnavailable:    http.StatusServiceUnavailable,
+	FailureNoKDC:               http.StatusServiceUnavailable,
+	FailureUpstreamTimeout:     http.StatusServiceUnavailable,
+	FailureUpstreamUnavailable: http.StatusServiceUnavailable,
+	FailureInternal:            http.StatusInternalServerError,
+}
+
+// forwardFailure returns the class of failure for an error from forwarding a request
+func forwardFailure(err error) string {
+	switch {
+	case errors.Is(err, ErrRealmNotAllowed):
+		return FailureRealmDenied
+	case errors.Is(err, ErrNoKDCFound):
+		return FailureNoKDC
+	case errors.Is(err, ErrUpstreamTimeout):
+		return FailureUpstreamTimeout
+	}
+
+	return FailureUpstreamUnavailable
+}
+
+// fail sends the HTTP error response for a class of failure, recording the class in the
+// ForwardInfo of the request and counting the status code actually sent. The message is replaced
+// by the standard status text when the status code has been changed from the default. A
+// Retry-After of retryAfter, or DefaultRetryAfter when zero, is only sent with a 429 or 503.
+func (k *KerberosProxy) fail(ctx context.Context, w http.ResponseWriter, failure, message string, retryAfter time.Duration) {
+	code, ok := k.statusCodes[failure]
+	if !ok {
+		code = defaultStatusCodes[failure]
+	} else {
+		message = http.StatusText(code)
+	}
+
+	diagnosticsFromContext(ctx).failed(failure)
+	k.metrics.response(code).Inc()
+	if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+		if retryAfter == 0 {
+			retryAfter = DefaultRetryAfter
+		}
+		setRetryAfter(w.Header(), retryAfter)
+	}
+
+	http.Error(w, message, code)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "kdc.example.com"}}, errorTypeDNS},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, errorTypeRefused},
+		{"timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, errorTypeTimeout},
+		{"short write", errShortWrite, errorTypeShortWrite},
+		{"invalid reply", errInvalidReply, errorTypeBadResponse},
+		{"reply too large", fmt.Errorf("%w: 1 bytes", errReplyTooLarge), errorTypeBadResponse},
+		{"truncated", io.ErrUnexpectedEOF, errorTypeBadResponse},
+		{"other", fmt.Errorf("something else"), errorTypeOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyError(tt.err); got != tt.want {
+				t.Errorf("classifyError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		denied      string
+		err         error
+		wantCode    int
+		wantBody    string
+		wantFailure string
+		wantRetry   bool
+	}{
+		{"realm denied", "EXAMPLE.COM", nil, http.StatusNotFound, "Not Found", FailureRealmDenied, false},
+		{"upstream unavailable", "", errors.New("unreachable"), http.StatusBadGateway, "Bad Gateway", FailureUpstreamUnavailable, false},
+		{"upstream timeout", "", os.ErrDeadlineExceeded, http.StatusServiceUnavailable, "Service unavailable", FailureUpstreamTimeout, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(&mockTransport{err: tt.err}),
+				WithDeniedRealms(tt.denied),
+				WithStatusCodes(map[string]int{FailureRealmDenied: http.StatusNotFound, FailureUpstreamUnavailable: http.StatusBadGateway}),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			ctx, info := ContextWithForwardInfo(context.Background())
+			r := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM"))).WithContext(ctx)
+			w := httptest.NewRecorder()
+			k.Handler(w, r)
+			if w.Code != tt.wantCode || strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("Handler() = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if got := info().Failure; got != tt.wantFailure {
+				t.Errorf("ForwardInfo().Failure = %q, want %q", got, tt.wantFailure)
+			}
+			if got := w.Header().Get("Retry-After") != ""; got != tt.wantRetry {
+				t.Errorf("Retry-After sent = %v, want %v", got, tt.wantRetry)
+			}
+			if got := testutil.ToFloat64(k.metrics.response(tt.wantCode)); got != 1 {
+				t.Errorf("responses with status %d = %v, want 1", tt.wantCode, got)
+			}
+			if tt.wantCode != http.StatusServiceUnavailable {
+				if got := testutil.ToFloat64(k.metrics.httpRespServiceUnavailable); got != 0 {
+					t.Errorf("responses with status 503 = %v, want 0", got)
+				}
+			}
+		})
+	}
+
+	for _, codes := range []map[string]int{{"unknown": 500}, {FailureNoKDC: 200}} {
+		if _, err := NewKdcProxy(WithRegistry(prometheus.NewRegistry()), WithStatusCodes(codes)); err == nil {
+			t.Errorf("NewKdcProxy() with status codes %v did not return an error", codes)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errQueueFull is returned when a realm already has the maximum number of requests waiting
+var errQueueFull = errors.New("queue full")
+
+// fairQueue limits the number of requests forwarded at once. When every slot is in use requests wait
+// in a queue per realm and the queues are served in turn, so a burst of requests for one realm cannot
+// starve the others.
+type fairQueue struct {
+	depth   int
+	waiting prometheus.Gauge
+
+	mu     sync.Mutex
+	free   int
+	queues map[string][]chan struct{}
+	// ring is the realms with waiting requests in the order they are served
+	ring []string
+	next int
+}
+
+// newFairQueue returns a fairQueue allowing concurrency requests at once with up to depth waiting
+// per realm, where a depth of 0 is unlimited. The number of waiting requests is reported via waiting.
+func newFairQueue(concurrency, depth int, waiting prometheus.Gauge) *fairQueue {
+	return &fairQueue{
+		depth:   depth,
+		waiting: waiting,
+		free:    concurrency,
+		queues:  make(map[string][]chan struct{}),
+	}
+}
+
+// acquire waits for a slot to forward a request for realm, returning errQueueFull if too many requests
+// are already waiting for the realm or the error from ctx if it is done first. A nil fairQueue always
+// has a free slot.
+func (q *fairQueue) acquire(ctx context.Context, realm string) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	if q.free > 0 && len(q.ring) == 0 {
+		q.free--
+		q.mu.Unlock()
+		return nil
+	}
+	if q.depth > 0 && len(q.queues[realm]) >= q.depth {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	ready := make(chan struct{})
+	if len(q.queues[realm]) == 0 {
+		q.ring = append(q.ring, realm)
+	}
+	q.queues[realm] = append(q.queues[realm], ready)
+	q.waiting.Inc()
+	q.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, c := range q.queues[realm] {
+		if c == ready {
+			q.remove(realm, i)
+			return ctx.Err()
+		}
+	}
+
+	// the slot was handed over while giving up, so pass it on
+	q.handOff()
+
+	return ctx.Err()
+}
+
+// release frees the slot taken by acquire, handing it to the next waiting request if any
+func (q *fairQueue) release() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.handOff()
+}
+
+// handOff gives a slot to the first request waiting for the next realm in turn, or returns it to the
+// pool if none are waiting. q.mu must be held.
+func (q *fairQueue) handOff() {
+	if len(q.ring) == 0 {
+		q.free++
+		return
+	}
+
+	if q.next >= len(q.ring) {
+		q.next = 0
+	}
+	realm := q.ring[q.next]
+	close(q.queues[realm][0])
+	if !q.remove(realm, 0) {
+		q.next++
+	}
+}
+
+// remove removes the i'th waiting request for realm, returning true if no more requests are waiting
+// for the realm so it has left the ring. q.mu must be held.
+func (q *fairQueue) remove(realm string, i int) bool {
+	q.waiting.Dec()
+	waiting := q.queues[realm]
+	if len(waiting) > 1 {
+		q.queues[realm] = append(waiting[:i:i], waiting[i+1:]...)
+		return false
+	}
+
+	delete(q.queues, realm)
+	for pos, r := range q.ring {
+		if r != realm {
+			continue
+		}
+		q.ring = append(q.ring[:pos], q.ring[pos+1:]...)
+		if pos < q.next {
+			q.next--
+		}
+		break
+	}
+
+	return true
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFairQueue(t *testing.T) {
+	waiting := prometheus.NewGauge(prometheus.GaugeOpts{Name: "waiting"})
+	q := newFairQueue(1, 3, waiting)
+	ctx := context.Background()
+
+	// take the only slot so further requests wait
+	if err := q.acquire(ctx, "BIG.COM"); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	served := make(chan string)
+	enqueue := func(name, realm string) {
+		want := testutil.ToFloat64(waiting) + 1
+		go func() {
+			if err := q.acquire(ctx, realm); err != nil {
+				t.Errorf("acquire(%s) error = %v", name, err)
+				return
+			}
+			served <- name
+		}()
+
+		// wait for the request to be queued so the order is known
+		for testutil.ToFloat64(waiting) != want {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue("big1", "BIG.COM")
+	enqueue("big2", "BIG.COM")
+	enqueue("big3", "BIG.COM")
+	enqueue("small1", "SMALL.COM")
+
+	// the queue for a realm is limited
+	if err := q.acquire(ctx, "BIG.COM"); !errors.Is(err, errQueueFull) {
+		t.Errorf("acquire() with full queue error = %v, want %v", err, errQueueFull)
+	}
+
+	// a waiting request that gives up leaves the queue
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := q.acquire(cancelled, "SMALL.COM"); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		q.release()
+		order = append(order, <-served)
+	}
+
+	want := []string{"big1", "small1", "big2", "big3"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("served = %v, want %v", order, want)
+	}
+	if got := testutil.ToFloat64(waiting); got != 0 {
+		t.Errorf("waiting = %v, want 0", got)
+	}
+
+	// with nothing waiting the slot is free again
+	q.release()
+	if err := q.acquire(ctx, "SMALL.COM"); err != nil {
+		t.Errorf("acquire() error = %v", err)
+	}
+}
+
+func TestWithFairQueue(t *testing.T) {
+	if _, err := NewKdcProxy(WithFairQueue(-1, 0)); err == nil {
+		t.Error("WithFairQueue(-1, 0) did not return an error")
+	}
+
+	k, err := NewKdcProxy(WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	if k.queue != nil {
+		t.Error("queue enabled by default")
+	}
+
+	k, err = NewKdcProxy(WithRegistry(prometheus.NewRegistry()), WithFairQueue(2, 10))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	if k.queue == nil || k.queue.free != 2 || k.queue.depth != 10 {
+		t.Errorf("queue = %+v, want 2 slots and depth 10", k.queue)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package proxy
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fastOpenControl enables TCP Fast Open on outgoing TCP sockets. Failure, such as on kernels
+// without support, is ignored so the connection proceeds with a normal handshake.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, protoTcp) {
+		return nil
+	}
+
+	return c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+}
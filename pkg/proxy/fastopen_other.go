@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "syscall"
+
+// fastOpenControl does nothing as TCP Fast Open is not supported on this OS
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Faults injected by WithFaultInjection
+const (
+	faultLatency  = "latency"
+	faultDrop     = "drop"
+	faultTruncate = "truncate"
+)
+
+// FaultInjection sets the percentage, from 0 to 100, of exchanges with KDC's affected by each fault.
+// Each fault is applied independently, so an exchange may be both delayed and then dropped.
+type FaultInjection struct {
+	// LatencyPercent of exchanges are delayed by Latency before being sent
+	LatencyPercent float64
+	Latency        time.Duration
+
+	// DropPercent of exchanges are not sent, so time out as if the KDC did not answer
+	DropPercent float64
+
+	// TruncatePercent of exchanges fail once sent as if the reply was truncated
+	TruncatePercent float64
+}
+
+// validate returns an error if a percentage is out of range
+func (f FaultInjection) validate() error {
+	for _, p := range []float64{f.LatencyPercent, f.DropPercent, f.TruncatePercent} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("fault percentage must be between 0 and 100")
+		}
+	}
+	if f.Latency < 0 {
+		return fmt.Errorf("fault latency cannot be negative")
+	}
+
+	return nil
+}
+
+// faultTransport is a Transport that injects faults into exchanges made by another Transport
+type faultTransport struct {
+	next     Transport
+	faults   FaultInjection
+	injected *prometheus.CounterVec
+
+	// roll returns a random percentage, replaced in tests
+	roll func() float64
+}
+
+func newFaultTransport(next Transport, faults FaultInjection, injected *prometheus.CounterVec) *faultTransport {
+	return &faultTransport{
+		next:     next,
+		faults:   faults,
+		injected: injected,
+		roll:     func() float64 { return rand.Float64() * 100 },
+	}
+}
+
+// hit returns true if an exchange should be affected by a fault applied to percent of exchanges
+func (t *faultTransport) hit(ctx context.Context, fault string, percent float64) bool {
+	if percent <= 0 || t.roll() >= percent {
+		return false
+	}
+	t.injected.WithLabelValues(fault).Inc()
+	attemptLog(ctx).DebugContext(ctx, "injecting fault", "fault", fault)
+
+	return true
+}
+
+// Exchange implements Transport
+func (t *faultTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	if t.hit(ctx, faultLatency, t.faults.LatencyPercent) {
+		timer := time.NewTimer(t.faults.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, t.timeout(ctx)
+		case <-timer.C:
+		}
+	}
+
+	// a dropped request is never answered
+	if t.hit(ctx, faultDrop, t.faults.DropPercent) {
+		<-ctx.Done()
+		return nil, t.timeout(ctx)
+	}
+
+	resp, err := t.next.Exchange(ctx, proto, kdc, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// truncation is reported as it would be by NetTransport
+	if t.hit(ctx, faultTruncate, t.faults.TruncatePercent) {
+		if proto == protoUdp {
+			return nil, fmt.Errorf("%w: truncated by fault injection", errInvalidReply)
+		}
+		return nil, fmt.Errorf("%w: truncated by fault injection", io.ErrUnexpectedEOF)
+	}
+
+	return resp, nil
+}
+
+// timeout returns the error for an exchange that did not complete before ctx was done, which is a
+// network timeout unless the caller gave up
+func (t *faultTransport) timeout(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: dropped by fault injection", os.ErrDeadlineExceeded)
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithFaultInjection(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+
+	tests := []struct {
+		name      string
+		faults    FaultInjection
+		proto     string
+		wantErr   error
+		wantCalls int
+		wantFault string
+		wantSlow  bool
+	}{
+		{"none", FaultInjection{}, protoTcp, nil, 1, "", false},
+		{"latency", FaultInjection{LatencyPercent: 100, Latency: 50 * time.Millisecond}, protoTcp, nil, 1, faultLatency, true},
+		{"latency beyond timeout", FaultInjection{LatencyPercent: 100, Latency: time.Second}, protoTcp, ErrUpstreamTimeout, 0, faultLatency, true},
+		{"drop", FaultInjection{DropPercent: 100}, protoUdp, ErrUpstreamTimeout, 0, faultDrop, true},
+		{"truncate tcp", FaultInjection{TruncatePercent: 100}, protoTcp, ErrUpstreamUnavailable, 1, faultTruncate, false},
+		{"truncate udp", FaultInjection{TruncatePercent: 100}, protoUdp, ErrUpstreamUnavailable, 1, faultTruncate, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(transport),
+				WithProtocols(tt.proto),
+				WithTimeout(100*time.Millisecond),
+				WithFaultInjection(tt.faults),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			start := time.Now()
+			_, err = k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Forward() error = %v, want %v", err, tt.wantErr)
+			}
+			if slow := time.Since(start) >= 50*time.Millisecond; slow != tt.wantSlow {
+				t.Errorf("Forward() took %v", time.Since(start))
+			}
+			if len(transport.kdcs) != tt.wantCalls {
+				t.Errorf("transport exchanges = %v, want %d", transport.kdcs, tt.wantCalls)
+			}
+			if tt.wantFault != "" {
+				if got := testutil.ToFloat64(k.metrics.faultsInjected.WithLabelValues(tt.wantFault)); got != 1 {
+					t.Errorf("%s faults injected = %v, want 1", tt.wantFault, got)
+				}
+			}
+		})
+	}
+
+	for _, faults := range []FaultInjection{{DropPercent: 101}, {LatencyPercent: -1}, {LatencyPercent: 10, Latency: -time.Second}} {
+		if _, err := NewKdcProxy(WithRegistry(prometheus.NewRegistry()), WithFaultInjection(faults)); err == nil {
+			t.Errorf("NewKdcProxy() with %+v did not return an error", faults)
+		}
+	}
+}
+
+func TestFaultTransportPercent(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+	injected := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "faults"}, []string{"fault"})
+	ft := newFaultTransport(transport, FaultInjection{TruncatePercent: 25}, injected)
+
+	// only rolls below the percentage are affected
+	for _, tt := range []struct {
+		roll    float64
+		wantErr error
+	}{
+		{0, io.ErrUnexpectedEOF},
+		{24.9, io.ErrUnexpectedEOF},
+		{25, nil},
+		{99.9, nil},
+	} {
+		ft.roll = func() float64 { return tt.roll }
+		if _, err := ft.Exchange(context.Background(), protoTcp, "kdc.example.com:88", nil); !errors.Is(err, tt.wantErr) {
+			t.Errorf("roll %v: Exchange() error = %v, want %v", tt.roll, err, tt.wantErr)
+		}
+	}
+	if got := testutil.ToFloat64(injected.WithLabelValues(faultTruncate)); got != 2 {
+		t.Errorf("faults injected = %v, want 2", got)
+	}
+}
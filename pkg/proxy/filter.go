@@ -0,0 +1,48 @@
+package proxy
+
+import "strings"
+
+// realmFilter restricts the realms that requests are forwarded for
+type realmFilter struct {
+	allowed map[string]struct{}
+	denied  map[string]struct{}
+}
+
+func newRealmFilter(allowed, denied []string) *realmFilter {
+	f := &realmFilter{
+		allowed: make(map[string]struct{}, len(allowed)),
+		denied:  make(map[string]struct{}, len(denied)),
+	}
+	for _, realm := range allowed {
+		f.allowed[strings.ToUpper(realm)] = struct{}{}
+	}
+	for _, realm := range denied {
+		f.denied[strings.ToUpper(realm)] = struct{}{}
+	}
+
+	return f
+}
+
+// allow returns true if requests for the realm may be forwarded. A denied realm is never
+// allowed and when no allowed realms are set all other realms are allowed.
+func (f *realmFilter) allow(realm string) bool {
+	realm = strings.ToUpper(realm)
+
+	if _, ok := f.denied[realm]; ok {
+		return false
+	}
+
+	if len(f.allowed) == 0 {
+		return true
+	}
+
+	_, ok := f.allowed[realm]
+
+	return ok
+}
+
+// SetRealmFilter atomically replaces the lists of allowed and denied realms. Realm names are
+// matched case-insensitively and an empty allowed list permits all realms that are not denied.
+func (k *KerberosProxy) SetRealmFilter(allowed, denied []string) {
+	k.filter.Store(newRealmFilter(allowed, denied))
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import "testing"
+
+func TestRealmFilterAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		realm   string
+		want    bool
+	}{
+		{"no lists", nil, nil, "EXAMPLE.COM", true},
+		{"allowed", []string{"EXAMPLE.COM"}, nil, "EXAMPLE.COM", true},
+		{"allowed case insensitive", []string{"example.com"}, nil, "EXAMPLE.COM", true},
+		{"not allowed", []string{"EXAMPLE.COM"}, nil, "OTHER.COM", false},
+		{"denied", nil, []string{"EXAMPLE.COM"}, "EXAMPLE.COM", false},
+		{"not denied", nil, []string{"EXAMPLE.COM"}, "OTHER.COM", true},
+		{"denied takes precedence", []string{"EXAMPLE.COM"}, []string{"EXAMPLE.COM"}, "EXAMPLE.COM", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newRealmFilter(tt.allowed, tt.denied).allow(tt.realm); got != tt.want {
+				t.Errorf("allow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
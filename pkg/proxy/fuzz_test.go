@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x30, 0x00})
+	f.Add([]byte{0x30, 0x84, 0xff, 0xff, 0xff, 0xff})
+	f.Add(testProxyMessage(f, testASReq(f), "EXAMPLE.COM"))
+	f.Add(testProxyMessage(f, testKRBError(f), "EXAMPLE.COM"))
+
+	k := &KerberosProxy{}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := k.decode(data)
+		if err != nil {
+			return
+		}
+
+		if len(msg.KerbMessage) < 4 {
+			t.Errorf("decode() returned a kerberos message of %d bytes", len(msg.KerbMessage))
+		}
+
+		// a successfully decoded message must survive a round trip
+		b, err := k.encode(msg.KerbMessage)
+		if err != nil {
+			t.Fatalf("encode() error = %v", err)
+		}
+		if _, err := DecodeKdcProxyMessage(b); err != nil {
+			t.Errorf("DecodeKdcProxyMessage() of re-encoded message error = %v", err)
+		}
+	})
+}
+
+func FuzzUnmarshalKerbLength(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x00, 0x00, 0x01, 0x00, 0x6a})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		n, err := UnmarshalKerbLength(b)
+		if len(b) < 4 {
+			if err == nil {
+				t.Errorf("UnmarshalKerbLength(%x) did not return an error", b)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("UnmarshalKerbLength(%x) error = %v", b, err)
+		}
+
+		if n < 0 {
+			t.Errorf("UnmarshalKerbLength(%x) = %d, want non-negative length", b, n)
+		}
+
+		if got := MarshalKerbLength(n); !bytes.Equal(got, b[:4]) {
+			t.Errorf("MarshalKerbLength(%d) = %x, want %x", n, got, b[:4])
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import "net/http"
+
+// HandlerOption configures a handler returned by NewHandler
+type HandlerOption func(*handler)
+
+// handler exposes a KerberosProxy with settings specific to a single route
+type handler struct {
+	k      *KerberosProxy
+	filter *realmFilter
+	auth   func(*http.Request) bool
+}
+
+// NewHandler returns a KDC Proxy endpoint with its own settings, allowing the same KerberosProxy
+// to be exposed differently on multiple routes. Restrictions set here are applied in addition to
+// those of the KerberosProxy itself.
+func (k *KerberosProxy) NewHandler(opts ...HandlerOption) http.Handler {
+	h := &handler{k: k}
+	for _, o := range opts {
+		o(h)
+	}
+
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.k.serveHTTP(w, r, h)
+}
+
+// WithHandlerRealms restricts the realms this handler forwards requests for. Realm names are matched
+// case-insensitively, a denied realm is never allowed and an empty allowed list permits all realms that
+// are not denied.
+func WithHandlerRealms(allowed, denied []string) HandlerOption {
+	return func(h *handler) {
+		h.filter = newRealmFilter(allowed, denied)
+	}
+}
+
+// WithHandlerAuth requires that auth returns true for a request before it is processed. Requests
+// that fail authentication receive a 401 Unauthorized response.
+func WithHandlerAuth(auth func(*http.Request) bool) HandlerOption {
+	return func(h *handler) {
+		h.auth = auth
+	}
+}
+
+// WithHandlerClientCert requires that requests were made using a verified TLS client certificate
+func WithHandlerClientCert() HandlerOption {
+	return WithHandlerAuth(func(r *http.Request) bool {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	})
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewHandler(t *testing.T) {
+	reply := testKRBError(t)
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   []HandlerOption
+		header string
+		want   int
+	}{
+		{"no options", nil, "", http.StatusOK},
+		{"allowed realm", []HandlerOption{WithHandlerRealms([]string{"example.com"}, nil)}, "", http.StatusOK},
+		{"realm not allowed", []HandlerOption{WithHandlerRealms([]string{"OTHER.COM"}, nil)}, "", http.StatusForbidden},
+		{"realm denied", []HandlerOption{WithHandlerRealms(nil, []string{"EXAMPLE.COM"})}, "", http.StatusForbidden},
+		{"auth passed", []HandlerOption{WithHandlerAuth(func(r *http.Request) bool { return r.Header.Get("X-Auth") == "ok" })}, "ok", http.StatusOK},
+		{"auth failed", []HandlerOption{WithHandlerAuth(func(r *http.Request) bool { return r.Header.Get("X-Auth") == "ok" })}, "", http.StatusUnauthorized},
+		{"client cert required", []HandlerOption{WithHandlerClientCert()}, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+			if tt.header != "" {
+				req.Header.Set("X-Auth", tt.header)
+			}
+			w := httptest.NewRecorder()
+			k.NewHandler(tt.opts...).ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("ServeHTTP() status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
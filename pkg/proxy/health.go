@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultHoldDown is the time a KDC is avoided after it fails when sharing health with other
+// instances without setting a hold down period
+const DefaultHoldDown = 30 * time.Second
+
+// KDCObservation is a change in the health of a KDC observed by a proxy instance
+type KDCObservation struct {
+	KDC   string `json:"kdc"`
+	Proto string `json:"proto"`
+	Up    bool   `json:"up"`
+	// Until is the time the KDC should be avoided until when it is down
+	Until time.Time `json:"until,omitempty"`
+}
+
+// HealthShare exchanges KDC health observations with other proxy instances, so that a KDC found to be
+// down by one instance is avoided by all of them. Observations received from other instances are
+// applied with ObserveKDC.
+type HealthShare interface {
+	// Publish sends an observation made by this instance to other instances and must not block
+	Publish(KDCObservation)
+}
+
+// health tracks KDC's that have recently failed so they are tried last
+type health struct {
+	holdDown time.Duration
+	share    HealthShare
+
+	mu   sync.RWMutex
+	down map[kdcKey]time.Time
+}
+
+func newHealth(holdDown time.Duration, share HealthShare) *health {
+	return &health{
+		holdDown: holdDown,
+		share:    share,
+		down:     make(map[kdcKey]time.Time),
+	}
+}
+
+// exchange records the result of an exchange with a KDC, publishing any change in its health
+func (h *health) exchange(kdc, proto string, err error) {
+	if h == nil {
+		return
+	}
+
+	key := kdcKey{kdc, proto}
+	now := time.Now()
+
+	h.mu.Lock()
+	until, wasDown := h.down[key]
+	wasDown = wasDown && now.Before(until)
+	var o *KDCObservation
+	if err != nil {
+		until = now.Add(h.holdDown)
+		h.down[key] = until
+		if !wasDown {
+			o = &KDCObservation{KDC: kdc, Proto: proto, Until: until}
+		}
+	} else {
+		delete(h.down, key)
+		if wasDown {
+			o = &KDCObservation{KDC: kdc, Proto: proto, Up: true}
+		}
+	}
+	h.mu.Unlock()
+
+	if o != nil && h.share != nil {
+		h.share.Publish(*o)
+	}
+}
+
+// observe applies an observation from another instance
+func (h *health) observe(o KDCObservation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := kdcKey{o.KDC, o.Proto}
+	if o.Up {
+		delete(h.down, key)
+		return
+	}
+
+	// never hold a kdc down for longer than this instance would
+	until := o.Until
+	if limit := time.Now().Add(h.holdDown); until.IsZero() || until.After(limit) {
+		until = limit
+	}
+	if until.After(h.down[key]) {
+		h.down[key] = until
+	}
+}
+
+// order returns kdcs with any that are down moved to the end, otherwise keeping their order, so
+// they are still tried if all others fail
+func (h *health) order(kdcs []string, proto string) []string {
+	if h == nil {
+		return kdcs
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.down) == 0 {
+		return kdcs
+	}
+
+	now := time.Now()
+	up := make([]string, 0, len(kdcs))
+	var down []string
+	for _, kdc := range kdcs {
+		if until, ok := h.down[kdcKey{kdc, proto}]; ok && now.Before(until) {
+			down = append(down, kdc)
+			continue
+		}
+		up = append(up, kdc)
+	}
+
+	return append(up, down...)
+}
+
+// coolDown returns the time until the first KDC that is held down may be tried again, or
+// DefaultRetryAfter if none are
+func (h *health) coolDown(now time.Time) time.Duration {
+	if h == nil {
+		return DefaultRetryAfter
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var soonest time.Duration
+	for _, until := range h.down {
+		if d := until.Sub(now); d > 0 && (soonest == 0 || d < soonest) {
+			soonest = d
+		}
+	}
+	if soonest == 0 {
+		return DefaultRetryAfter
+	}
+
+	return soonest
+}
+
+// ObserveKDC applies a KDC health observation received from another instance. It has no effect
+// unless a hold down period or HealthShare is configured.
+func (k *KerberosProxy) ObserveKDC(o KDCObservation) {
+	if k.health == nil || o.KDC == "" {
+		return
+	}
+
+	k.metrics.kdcObservations.WithLabelValues(observationState(o)).Inc()
+	k.health.observe(o)
+}
+
+func observationState(o KDCObservation) string {
+	if o.Up {
+		return "up"
+	}
+
+	return "down"
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// failTransport fails exchanges with the KDC's in fail and returns resp from all others
+type failTransport struct {
+	mockTransport
+	fail map[string]bool
+}
+
+func (f *failTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	resp, err := f.mockTransport.Exchange(ctx, proto, kdc, req)
+	if f.fail[kdc] {
+		return nil, errors.New("connection refused")
+	}
+
+	return resp, err
+}
+
+// recordShare records published observations
+type recordShare struct {
+	mu           sync.Mutex
+	observations []KDCObservation
+}
+
+func (r *recordShare) Publish(o KDCObservation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	o.Until = time.Time{}
+	r.observations = append(r.observations, o)
+}
+
+func TestHealth(t *testing.T) {
+	share := &recordShare{}
+	h := newHealth(time.Minute, share)
+	kdcs := []string{"kdc1:88", "kdc2:88", "kdc3:88"}
+
+	// repeated failures are only published once
+	h.exchange("kdc1:88", protoTcp, errors.New("timeout"))
+	h.exchange("kdc1:88", protoTcp, errors.New("timeout"))
+	if got, want := h.order(kdcs, protoTcp), []string{"kdc2:88", "kdc3:88", "kdc1:88"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order() = %v, want %v", got, want)
+	}
+
+	// health is per protocol
+	if got := h.order(kdcs, protoUdp); !reflect.DeepEqual(got, kdcs) {
+		t.Errorf("order(udp) = %v, want %v", got, kdcs)
+	}
+
+	// recovery is published
+	h.exchange("kdc1:88", protoTcp, nil)
+	h.exchange("kdc2:88", protoTcp, nil)
+	if got := h.order(kdcs, protoTcp); !reflect.DeepEqual(got, kdcs) {
+		t.Errorf("order() after recovery = %v, want %v", got, kdcs)
+	}
+
+	want := []KDCObservation{
+		{KDC: "kdc1:88", Proto: protoTcp},
+		{KDC: "kdc1:88", Proto: protoTcp, Up: true},
+	}
+	if !reflect.DeepEqual(share.observations, want) {
+		t.Errorf("published = %v, want %v", share.observations, want)
+	}
+
+	// observations from peers are capped at the local hold down
+	h.observe(KDCObservation{KDC: "kdc3:88", Proto: protoTcp, Until: time.Now().Add(time.Hour)})
+	if until := h.down[kdcKey{"kdc3:88", protoTcp}]; until.After(time.Now().Add(time.Minute)) {
+		t.Errorf("peer hold down until %v was not capped", until)
+	}
+	if got, want := h.order(kdcs, protoTcp), []string{"kdc1:88", "kdc2:88", "kdc3:88"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order() after peer observation = %v, want %v", got, want)
+	}
+
+	// expired observations are ignored
+	h.observe(KDCObservation{KDC: "kdc1:88", Proto: protoTcp, Until: time.Now().Add(-time.Second)})
+	if got := h.order(kdcs, protoTcp)[0]; got != "kdc1:88" {
+		t.Errorf("order()[0] = %s after expired observation", got)
+	}
+}
+
+func TestWithHoldDown(t *testing.T) {
+	if _, err := NewKdcProxy(WithHoldDown(-time.Second)); err == nil {
+		t.Error("WithHoldDown(-1s) did not return an error")
+	}
+	if _, err := NewKdcProxy(WithHealthShare(nil)); err == nil {
+		t.Error("WithHealthShare(nil) did not return an error")
+	}
+
+	reply := testKRBError(t)
+	req := testASReq(t)
+	transport := &failTransport{
+		mockTransport: mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)},
+		fail:          map[string]bool{"kdc1.example.com:88": true},
+	}
+	share := &recordShare{}
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc1.example.com:88\n  kdc = kdc2.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithStrategy(StrategyRoundRobin),
+		WithProtocols(protoTcp),
+		WithHealthShare(share),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	if k.health.holdDown != DefaultHoldDown {
+		t.Errorf("hold down = %v, want %v", k.health.holdDown, DefaultHoldDown)
+	}
+
+	// the third request would start at kdc1 but it is held down
+	for i := 0; i < 3; i++ {
+		if _, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); err != nil {
+			t.Fatalf("Forward() error = %v", err)
+		}
+	}
+
+	want := []string{"tcp/kdc1.example.com:88", "tcp/kdc2.example.com:88", "tcp/kdc2.example.com:88", "tcp/kdc2.example.com:88"}
+	if !reflect.DeepEqual(transport.kdcs, want) {
+		t.Errorf("transport exchanges = %v, want %v", transport.kdcs, want)
+	}
+	if len(share.observations) != 1 || share.observations[0].Up {
+		t.Errorf("published = %v, want kdc1 down", share.observations)
+	}
+
+	// a peer reporting kdc1 up makes it preferred again
+	k.ObserveKDC(KDCObservation{KDC: "kdc1.example.com:88", Proto: protoTcp, Up: true})
+	if got := k.health.order([]string{"kdc1.example.com:88", "kdc2.example.com:88"}, protoTcp)[0]; got != "kdc1.example.com:88" {
+		t.Errorf("order()[0] = %s after peer observation", got)
+	}
+}
+
+func TestHealthCoolDown(t *testing.T) {
+	var nilHealth *health
+	if got := nilHealth.coolDown(time.Now()); got != DefaultRetryAfter {
+		t.Errorf("coolDown() without health = %v, want %v", got, DefaultRetryAfter)
+	}
+
+	h := newHealth(time.Minute, nil)
+	now := time.Now()
+	if got := h.coolDown(now); got != DefaultRetryAfter {
+		t.Errorf("coolDown() with no kdcs down = %v, want %v", got, DefaultRetryAfter)
+	}
+
+	h.down[kdcKey{"kdc1.example.com:88", protoTcp}] = now.Add(time.Minute)
+	h.down[kdcKey{"kdc2.example.com:88", protoTcp}] = now.Add(20 * time.Second)
+	h.down[kdcKey{"kdc3.example.com:88", protoTcp}] = now.Add(-time.Second)
+	if got := h.coolDown(now); got != 20*time.Second {
+		t.Errorf("coolDown() = %v, want 20s", got)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errHedgeLost is the cause of cancelling an exchange because another KDC answered first
+var errHedgeLost = errors.New("another kdc answered first")
+
+type hedgeResult struct {
+	resp []byte
+	kdc  string
+	err  error
+}
+
+// tryKDCs sends the request to each of kdcs in turn until one answers, returning the response and
+// the KDC that answered or the last error. With hedging enabled the request is also sent to the next
+// KDC whenever none of those already sent the request have answered within the hedge delay.
+func (k *KerberosProxy) tryKDCs(ctx context.Context, realm, proto string, kdcs []string, req []byte, timeout time.Duration) ([]byte, string, error) {
+	if k.hedgeDelay <= 0 || len(kdcs) < 2 {
+		var lastErr error
+		for _, kdc := range kdcs {
+			// give up once the caller has
+			if err := ctx.Err(); err != nil {
+				return nil, "", err
+			}
+
+			resp, err := k.attempt(ctx, realm, proto, kdc, req, timeout)
+			if err != nil {
+				// for an error try next kdc
+				lastErr = err
+				continue
+			}
+
+			return resp, kdc, nil
+		}
+
+		return nil, "", lastErr
+	}
+
+	// exchanges still running once a kdc has answered are abandoned
+	hedgeCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(errHedgeLost)
+
+	results := make(chan hedgeResult, len(kdcs))
+	next := 0
+	var hedge <-chan time.Time
+	start := func() {
+		kdc := kdcs[next]
+		next++
+		hedge = time.After(k.hedgeDelay)
+		go func() {
+			resp, err := k.attempt(hedgeCtx, realm, proto, kdc, req, timeout)
+			results <- hedgeResult{resp: resp, kdc: kdc, err: err}
+		}()
+	}
+
+	start()
+	var lastErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-hedge:
+			if next < len(kdcs) {
+				k.metrics.hedges.WithLabelValues(proto).Inc()
+				k.log(ctx).DebugContext(ctx, "hedging request", "realm", realm, "kdc", kdcs[next], "proto", proto)
+				start()
+				pending++
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.resp, r.kdc, nil
+			}
+			lastErr = r.err
+
+			// for an error try next kdc without waiting
+			if next < len(kdcs) && ctx.Err() == nil {
+				start()
+				pending++
+			}
+		}
+	}
+
+	// give up once the caller has
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return nil, "", lastErr
+}
+
+// attempt exchanges the request with a single KDC
+func (k *KerberosProxy) attempt(ctx context.Context, realm, proto, kdc string, req []byte, timeout time.Duration) ([]byte, error) {
+	// metrics
+	if proto == protoTcp {
+		k.metrics.kerbReqTcp.WithLabelValues(k.realmLabel(realm)).Inc()
+	} else {
+		k.metrics.kerbReqUdp.WithLabelValues(k.realmLabel(realm)).Inc()
+	}
+
+	return k.exchange(ctx, realm, proto, kdc, req, timeout)
+}
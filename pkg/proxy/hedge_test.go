@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowTransport does not answer for the slow KDC until the exchange is cancelled
+type slowTransport struct {
+	resp []byte
+	slow string
+}
+
+func (s *slowTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	if kdc == s.slow {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return s.resp, nil
+}
+
+func TestHedging(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &slowTransport{resp: append(MarshalKerbLength(len(reply)), reply...), slow: "kdc1.example.com:88"}
+
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wantErr bool
+		hedges  float64
+	}{
+		{"hedged", 10 * time.Millisecond, false, 1},
+		{"not hedged", 0, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc1.example.com:88\n  kdc = kdc2.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(transport),
+				WithStrategy(StrategyRoundRobin),
+				WithProtocols(protoTcp),
+				WithHedging(tt.delay),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			// without hedging the slow kdc uses up the time available for the request
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			msg := &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(reply)), reply...), TargetDomain: "EXAMPLE.COM"}
+			if _, err := k.Forward(ctx, msg); (err != nil) != tt.wantErr {
+				t.Fatalf("Forward() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := testutil.ToFloat64(k.metrics.hedges.WithLabelValues(protoTcp)); got != tt.hedges {
+				t.Errorf("hedges = %v, want %v", got, tt.hedges)
+			}
+			if !tt.wantErr {
+				// the abandoned exchange is not a failure of the slow kdc
+				time.Sleep(10 * time.Millisecond)
+				if got := testutil.ToFloat64(k.metrics.kdcFailures.WithLabelValues("kdc1.example.com:88", protoTcp)); got != 0 {
+					t.Errorf("slow kdc failures = %v, want 0", got)
+				}
+			}
+		})
+	}
+
+	if _, err := NewKdcProxy(WithHedging(-time.Second)); err == nil {
+		t.Error("NewKdcProxy() with a negative hedge delay did not return an error")
+	}
+}
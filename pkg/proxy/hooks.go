@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ForwardEvent describes an attempt to forward a request to a single KDC
+type ForwardEvent struct {
+	Realm    string
+	Type     MessageType
+	KDC      string
+	Proto    string
+	Duration time.Duration
+	Err      error
+}
+
+// hooks holds the callbacks registered by embedding applications
+type hooks struct {
+	mu             sync.RWMutex
+	requestDecoded []func(context.Context, *KdcProxyMsg)
+	forwardAttempt []func(context.Context, ForwardEvent)
+	forwardError   []func(context.Context, ForwardEvent)
+	forwardDone    []func(context.Context, ForwardEvent)
+}
+
+// OnRequestDecoded registers a callback that is run after each request is successfully decoded
+func (k *KerberosProxy) OnRequestDecoded(f func(ctx context.Context, msg *KdcProxyMsg)) {
+	k.hooks.mu.Lock()
+	defer k.hooks.mu.Unlock()
+
+	k.hooks.requestDecoded = append(k.hooks.requestDecoded, f)
+}
+
+// OnForwardAttempt registers a callback that is run before each attempt to forward a request to a KDC
+func (k *KerberosProxy) OnForwardAttempt(f func(ctx context.Context, ev ForwardEvent)) {
+	k.hooks.mu.Lock()
+	defer k.hooks.mu.Unlock()
+
+	k.hooks.forwardAttempt = append(k.hooks.forwardAttempt, f)
+}
+
+// OnForwardError registers a callback that is run after each failed attempt to forward a request to a KDC
+func (k *KerberosProxy) OnForwardError(f func(ctx context.Context, ev ForwardEvent)) {
+	k.hooks.mu.Lock()
+	defer k.hooks.mu.Unlock()
+
+	k.hooks.forwardError = append(k.hooks.forwardError, f)
+}
+
+// OnForwardComplete registers a callback that is run after each attempt to forward a request to a
+// KDC, whether or not it succeeded, other than attempts abandoned because another KDC answered first
+func (k *KerberosProxy) OnForwardComplete(f func(ctx context.Context, ev ForwardEvent)) {
+	k.hooks.mu.Lock()
+	defer k.hooks.mu.Unlock()
+
+	k.hooks.forwardDone = append(k.hooks.forwardDone, f)
+}
+
+func (h *hooks) runRequestDecoded(ctx context.Context, msg *KdcProxyMsg) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, f := range h.requestDecoded {
+		f(ctx, msg)
+	}
+}
+
+func (h *hooks) runForwardAttempt(ctx context.Context, ev ForwardEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, f := range h.forwardAttempt {
+		f(ctx, ev)
+	}
+}
+
+func (h *hooks) runForwardError(ctx context.Context, ev ForwardEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, f := range h.forwardError {
+		f(ctx, ev)
+	}
+}
+
+func (h *hooks) runForwardComplete(ctx context.Context, ev ForwardEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, f := range h.forwardDone {
+		f(ctx, ev)
+	}
+}
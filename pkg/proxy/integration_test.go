@@ -0,0 +1,180 @@
+//go:build integration
+
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testKDCImage is the image built from testdata/kdc
+const testKDCImage = "kdcproxy-test-kdc"
+
+// docker runs the docker CLI and returns its trimmed output
+func docker(t *testing.T, args ...string) string {
+	t.Helper()
+
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("docker %s: %v: %s", args[0], err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// testKDC starts an MIT Kerberos KDC for EXAMPLE.COM in a container and returns the host addresses
+// of its TCP and UDP ports. The test is skipped if docker is not available.
+func testKDC(t *testing.T) (tcp, udp string) {
+	t.Helper()
+
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("docker is not available")
+	}
+
+	docker(t, "build", "-t", testKDCImage, "testdata/kdc")
+	id := docker(t, "run", "-d", "-p", "127.0.0.1::88/tcp", "-p", "127.0.0.1::88/udp", testKDCImage)
+	t.Cleanup(func() {
+		if t.Failed() {
+			out, _ := exec.Command("docker", "logs", id).CombinedOutput()
+			t.Logf("kdc logs:\n%s", out)
+		}
+		exec.Command("docker", "rm", "-f", id).Run()
+	})
+
+	// docker may list an IPv6 mapping as well
+	port := func(p string) string {
+		return strings.Split(docker(t, "port", id, p), "\n")[0]
+	}
+
+	return port("88/tcp"), port("88/udp")
+}
+
+// testExchange sends a Kerberos message through the proxy handler and returns the decoded reply,
+// which is nil if the proxy did not return one
+func testExchange(t *testing.T, k *KerberosProxy, kerb []byte) *Message {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	k.Handler(w, httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, kerb, "EXAMPLE.COM"))))
+	if w.Code != http.StatusOK {
+		return nil
+	}
+
+	msg, err := DecodeKdcProxyMessage(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeKdcProxyMessage() error = %v", err)
+	}
+
+	return msg
+}
+
+func TestIntegration(t *testing.T) {
+	tcp, udp := testKDC(t)
+
+	cfg := krb5config.New()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "user")
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, "host/service.example.com")
+	creds := credentials.New("user", "EXAMPLE.COM").WithPassword("password")
+
+	for proto, address := range map[string]string{"tcp": tcp, "udp": udp} {
+		t.Run(proto, func(t *testing.T) {
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = "+address+"\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithProtocols(proto),
+				WithTimeout(2*time.Second),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			asReq, err := messages.NewASReqForTGT("EXAMPLE.COM", cfg, cname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := asReq.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the kdc is ready once the first exchange succeeds
+			reply := testExchange(t, k, b)
+			for deadline := time.Now().Add(time.Minute); reply == nil; reply = testExchange(t, k, b) {
+				if time.Now().After(deadline) {
+					t.Fatal("kdc not ready")
+				}
+				time.Sleep(time.Second)
+			}
+
+			// AS exchange
+			if reply.Type != MessageTypeASRep {
+				t.Fatalf("AS-REQ reply type = %s", reply.Type)
+			}
+			var asRep messages.ASRep
+			if err := asRep.Unmarshal(reply.KerbMessage[4:]); err != nil {
+				t.Fatalf("ASRep.Unmarshal() error = %v", err)
+			}
+			sessionKey, err := asRep.DecryptEncPart(creds)
+			if err != nil {
+				t.Fatalf("ASRep.DecryptEncPart() error = %v", err)
+			}
+			if got := asRep.Ticket.SName.PrincipalNameString(); got != "krbtgt/EXAMPLE.COM" {
+				t.Errorf("TGT service = %s", got)
+			}
+
+			// TGS exchange using the TGT
+			tgsReq, err := messages.NewTGSReq(cname, "EXAMPLE.COM", cfg, asRep.Ticket, sessionKey, sname, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err = tgsReq.Marshal(); err != nil {
+				t.Fatal(err)
+			}
+			if reply = testExchange(t, k, b); reply == nil || reply.Type != MessageTypeTGSRep {
+				t.Fatalf("TGS-REQ reply = %+v", reply)
+			}
+			var tgsRep messages.TGSRep
+			if err := tgsRep.Unmarshal(reply.KerbMessage[4:]); err != nil {
+				t.Fatalf("TGSRep.Unmarshal() error = %v", err)
+			}
+			if err := tgsRep.DecryptEncPart(sessionKey); err != nil {
+				t.Fatalf("TGSRep.DecryptEncPart() error = %v", err)
+			}
+			if got := tgsRep.Ticket.SName.PrincipalNameString(); got != "host/service.example.com" {
+				t.Errorf("ticket service = %s", got)
+			}
+
+			// errors from the kdc are passed back to the client
+			unknown, err := messages.NewASReqForTGT("EXAMPLE.COM", cfg, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "missing"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, err = unknown.Marshal(); err != nil {
+				t.Fatal(err)
+			}
+			if reply = testExchange(t, k, b); reply == nil || reply.Type != MessageTypeKRBError {
+				t.Fatalf("AS-REQ reply = %+v", reply)
+			}
+			var krbErr messages.KRBError
+			if err := krbErr.Unmarshal(reply.KerbMessage[4:]); err != nil {
+				t.Fatalf("KRBError.Unmarshal() error = %v", err)
+			}
+			if krbErr.ErrorCode != errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN {
+				t.Errorf("error code = %d", krbErr.ErrorCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// ForwardFunc forwards a request to a KDC and returns the response (including the leading 4-byte length)
+type ForwardFunc func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error)
+
+// Interceptor wraps the forwarding of a request after it has been decoded and before the response is
+// encoded. An Interceptor may inspect or rewrite the request before calling next, inspect or rewrite
+// the response returned by next, or return an error without calling next to reject the request.
+type Interceptor func(next ForwardFunc) ForwardFunc
+
+// chain returns a ForwardFunc that runs the interceptors in order before forwarding
+func (k *KerberosProxy) chain() ForwardFunc {
+	f := ForwardFunc(func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+		return k.forward(ctx, msg, k.policy(msg.TargetDomain))
+	})
+	if k.dryRun {
+		f = dryRun
+	}
+
+	for i := len(k.interceptors) - 1; i >= 0; i-- {
+		f = k.interceptors[i](f)
+	}
+
+	return f
+}
+
+// dryRun returns a synthetic KDC_ERR_SVC_UNAVAILABLE KRB-ERROR for the target realm without
+// contacting a KDC
+func dryRun(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+	sname := types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", msg.TargetDomain},
+	}
+	krbError := messages.NewKRBError(sname, msg.TargetDomain, errorcode.KDC_ERR_SVC_UNAVAILABLE, "kdc proxy dry run")
+
+	b, err := krbError.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(MarshalKerbLength(len(b)), b...), nil
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInterceptors(t *testing.T) {
+	var order []string
+	record := func(name string) Interceptor {
+		return func(next ForwardFunc) ForwardFunc {
+			return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+				order = append(order, name)
+				return next(ctx, msg)
+			}
+		}
+	}
+	rewrite := func(next ForwardFunc) ForwardFunc {
+		return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+			if _, err := next(ctx, msg); err != nil {
+				return nil, err
+			}
+			return []byte("rewritten"), nil
+		}
+	}
+	reject := func(next ForwardFunc) ForwardFunc {
+		return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+			return nil, fmt.Errorf("rejected")
+		}
+	}
+
+	msg := &KdcProxyMsg{KerbMessage: []byte{0, 0, 0, 1, 0}, TargetDomain: "EXAMPLE.COM"}
+
+	tests := []struct {
+		name         string
+		interceptors []Interceptor
+		want         []byte
+		wantErr      bool
+		wantOrder    []string
+	}{
+		{"ordering", []Interceptor{record("first"), record("second")}, []byte("response"), false, []string{"first", "second"}},
+		{"rewrite response", []Interceptor{record("first"), rewrite}, []byte("rewritten"), false, []string{"first"}},
+		{"reject", []Interceptor{reject, record("first")}, nil, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order = nil
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(&mockTransport{resp: []byte("response")}),
+				WithInterceptors(tt.interceptors...),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			got, err := k.Forward(context.Background(), msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Forward() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Forward() = %s, want %s", got, tt.want)
+			}
+			if fmt.Sprint(order) != fmt.Sprint(tt.wantOrder) {
+				t.Errorf("interceptor order = %v, want %v", order, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestWithDryRun(t *testing.T) {
+	transport := &mockTransport{err: errors.New("should not be called")}
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithDryRun(),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+	w := httptest.NewRecorder()
+	k.Handler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Handler() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	m, err := DecodeKdcProxyMessage(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeKdcProxyMessage() error = %v", err)
+	}
+
+	if m.Type != MessageTypeKRBError || m.Realm != "EXAMPLE.COM" {
+		t.Errorf("response = %v for %v, want %v for EXAMPLE.COM", m.Type, m.Realm, MessageTypeKRBError)
+	}
+
+	if len(transport.kdcs) != 0 {
+		t.Errorf("transport exchanges = %v, want none", transport.kdcs)
+	}
+}
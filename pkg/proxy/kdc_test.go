@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// Behaviours of a fakeKDC
+const (
+	kdcReply       = "reply"
+	kdcTruncated   = "truncated"
+	kdcWrongLength = "wrong length"
+	kdcTooLarge    = "too large"
+	kdcSilent      = "silent"
+)
+
+// fakeKDC is a loopback KDC listening on the same port for TCP and UDP that answers each request
+// according to its behaviour
+type fakeKDC struct {
+	addr      string
+	tcp       net.Listener
+	udp       net.PacketConn
+	reply     []byte
+	behaviour string
+
+	// accepted counts the tcp connections accepted
+	accepted atomic.Int64
+}
+
+func newFakeKDC(t *testing.T, reply []byte) *fakeKDC {
+	t.Helper()
+
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			continue
+		}
+		t.Cleanup(func() {
+			ln.Close()
+			conn.Close()
+		})
+
+		return &fakeKDC{addr: ln.Addr().String(), tcp: ln, udp: conn, reply: reply}
+	}
+	t.Fatal("unable to listen on the same tcp and udp port")
+
+	return nil
+}
+
+// startFakeKDC starts a fakeKDC answering each request according to behaviour
+func startFakeKDC(t *testing.T, reply []byte, behaviour string) *fakeKDC {
+	t.Helper()
+
+	f := newFakeKDC(t, reply)
+	f.behaviour = behaviour
+	f.serve()
+
+	return f
+}
+
+// raw returns what is sent in reply to a request over proto, or nil to send nothing
+func (f *fakeKDC) raw(proto string) []byte {
+	framed := append(MarshalKerbLength(len(f.reply)), f.reply...)
+
+	switch f.behaviour {
+	case kdcReply:
+		if proto == protoUdp {
+			return f.reply
+		}
+		return framed
+	case kdcTruncated:
+		if proto == protoUdp {
+			return f.reply[:len(f.reply)/2]
+		}
+		return framed[:len(framed)/2]
+	case kdcWrongLength:
+		// udp replies have no length
+		if proto == protoUdp {
+			return framed
+		}
+		return append(MarshalKerbLength(len(f.reply)-10), f.reply...)
+	case kdcTooLarge:
+		return []byte{0xff, 0xff, 0xff, 0xff}
+	}
+
+	return nil
+}
+
+func (f *fakeKDC) serve() {
+	go func() {
+		for {
+			conn, err := f.tcp.Accept()
+			if err != nil {
+				return
+			}
+			f.accepted.Add(1)
+
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				n, _ := UnmarshalKerbLength(buf)
+				io.ReadFull(conn, make([]byte, n))
+				if raw := f.raw(protoTcp); raw != nil {
+					conn.Write(raw)
+					return
+				}
+				// wait for the client to give up
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_, addr, err := f.udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if raw := f.raw(protoUdp); raw != nil {
+				f.udp.WriteTo(raw, addr)
+			}
+		}
+	}()
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+)
+
+// krb5Section matches the header of a section of a krb5 configuration
+var krb5Section = regexp.MustCompile(`^\s*\[(.*)\]\s*$`)
+
+// maxIncludeDepth is the number of nested include directives followed, as in MIT Kerberos
+const maxIncludeDepth = 5
+
+// LoadConfigs loads and merges the provided "krb5.conf" files, along with any files they include,
+// and atomically replaces the current configuration. As with MIT Kerberos, where a setting or realm
+// appears in more than one file the earliest file takes precedence. No paths reverts to looking up
+// KDC's via DNS.
+func (k *KerberosProxy) LoadConfigs(paths ...string) error {
+	cfg, err := ParseConfigs(paths...)
+	if err != nil {
+		return err
+	}
+	k.storeKrb5Config(cfg)
+
+	return nil
+}
+
+// ParseConfigs loads and merges the provided "krb5.conf" files as LoadConfigs does, but returns
+// the configuration rather than replacing the current one, such as for ReloadConfig
+func ParseConfigs(paths ...string) (*krb5config.Config, error) {
+	if len(paths) == 0 {
+		return dnsConfig(), nil
+	}
+
+	docs := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		included, err := readKrb5File(path, 0)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, included...)
+	}
+
+	return parseKrb5Docs(docs)
+}
+
+// ParseConfigFromReader reads a krb5 configuration from r as LoadConfigFromReader does, but
+// returns the configuration rather than replacing the current one, such as for ReloadConfig
+func ParseConfigFromReader(r io.Reader) (*krb5config.Config, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := expandIncludes(b, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKrb5Docs(docs)
+}
+
+// parseKrb5Docs parses and merges the krb5 configurations in docs, where the earliest takes
+// precedence
+func parseKrb5Docs(docs [][]byte) (*krb5config.Config, error) {
+	data := docs[0]
+	if len(docs) > 1 {
+		data = mergeKrb5Configs(docs...)
+	}
+
+	return krb5config.NewFromReader(bytes.NewReader(data))
+}
+
+// readKrb5File reads a krb5 configuration file and returns it along with the files it includes, in
+// order of precedence
+func readKrb5File(path string, depth int) ([][]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return expandIncludes(b, filepath.Dir(path), depth)
+}
+
+// expandIncludes splits a krb5 configuration at its "include" and "includedir" directives, which
+// gokrb5 ignores, and returns the parts along with the included files in the order MIT Kerberos
+// would read them. The part following a directive continues the section the directive appeared in.
+// Relative paths are resolved against dir, so must be absolute when dir is empty.
+func expandIncludes(data []byte, dir string, depth int) ([][]byte, error) {
+	var docs [][]byte
+	var buf bytes.Buffer
+	section := ""
+	braces := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if directive, target, ok := includeDirective(line); ok && braces == 0 {
+			if depth >= maxIncludeDepth {
+				return nil, fmt.Errorf("krb5 configuration includes nested too deeply at %s", target)
+			}
+			if !filepath.IsAbs(target) {
+				if dir == "" {
+					return nil, fmt.Errorf("krb5 configuration %s must be an absolute path: %s", directive, target)
+				}
+				target = filepath.Join(dir, target)
+			}
+
+			files := []string{target}
+			if directive == "includedir" {
+				var err error
+				if files, err = ConfigDirFiles(target); err != nil {
+					return nil, err
+				}
+			}
+
+			docs = append(docs, bytes.Clone(buf.Bytes()))
+			buf.Reset()
+			for _, file := range files {
+				included, err := readKrb5File(file, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				docs = append(docs, included...)
+			}
+
+			if section != "" {
+				buf.WriteString(section + "\n")
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case krb5Section.MatchString(line):
+			section = line
+		case strings.HasSuffix(trimmed, "{"):
+			braces++
+		case strings.HasPrefix(trimmed, "}") && braces > 0:
+			braces--
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return append(docs, buf.Bytes()), nil
+}
+
+// includeDirective returns the directive and its path if line is an "include" or "includedir"
+// directive, which must be at the start of the line
+func includeDirective(line string) (directive, path string, ok bool) {
+	for _, d := range []string{"includedir", "include"} {
+		if rest, found := strings.CutPrefix(line, d); found && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			return d, strings.TrimSpace(rest), true
+		}
+	}
+
+	return "", "", false
+}
+
+// ConfigPathFiles splits a list of "krb5.conf" files separated by the OS path list separator, as
+// used by the MIT Kerberos KRB5_CONFIG environment variable, and returns those that exist. As with
+// MIT Kerberos missing files are skipped, however it is an error if none of the files exist.
+func ConfigPathFiles(list string) ([]string, error) {
+	var files []string
+	for _, path := range filepath.SplitList(list) {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, path)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no krb5.conf found in %q", list)
+	}
+
+	return files, nil
+}
+
+// ConfigDirFiles returns the files in dir that MIT Kerberos would load from an "includedir", in
+// lexical order. These are files with names consisting only of letters, digits, dashes and
+// underscores, or ending in ".conf".
+func ConfigDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.IsDir() || !includedName(e.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// includedName returns true if the file name is one that MIT Kerberos loads from an "includedir"
+func includedName(name string) bool {
+	if strings.HasSuffix(name, ".conf") && !strings.HasPrefix(name, ".") {
+		return true
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+
+	return name != ""
+}
+
+// mergeKrb5Configs combines krb5 configurations into one with each section appearing once. gokrb5
+// applies the last value of a setting and the last definition of a realm, so the contents of each
+// section are written in reverse order so earlier configurations take precedence.
+func mergeKrb5Configs(docs ...[]byte) []byte {
+	var order []string
+	sections := make(map[string][][]string)
+	for _, doc := range docs {
+		parsed := make(map[string][]string)
+		section := ""
+		scanner := bufio.NewScanner(bytes.NewReader(doc))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if m := krb5Section.FindStringSubmatch(line); m != nil {
+				section = strings.TrimSpace(m[1])
+				if _, ok := sections[section]; !ok {
+					order = append(order, section)
+					sections[section] = nil
+				}
+				continue
+			}
+			if section != "" {
+				parsed[section] = append(parsed[section], line)
+			}
+		}
+		for name, lines := range parsed {
+			sections[name] = append(sections[name], lines)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, name := range order {
+		buf.WriteString("[" + name + "]\n")
+		for i := len(sections[name]) - 1; i >= 0; i-- {
+			for _, line := range sections[name][i] {
+				buf.WriteString(line + "\n")
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// storeKrb5Config replaces the current configuration with cfg, after replacing the KDC's of any realms
+// set by WithKDCs so they apply to every configuration that is loaded
+func (k *KerberosProxy) storeKrb5Config(cfg *krb5config.Config) {
+	if len(k.staticKDCs) > 0 {
+		cfg = withStaticKDCs(cfg, k.staticKDCs)
+	}
+	k.krb5Config.Store(cfg)
+}
+
+// withStaticKDCs returns a copy of cfg with the KDC's of each realm in kdcs replaced, adding realms
+// that are not configured
+func withStaticKDCs(cfg *krb5config.Config, kdcs map[string][]string) *krb5config.Config {
+	c := *cfg
+	c.Realms = make([]krb5config.Realm, 0, len(cfg.Realms)+len(kdcs))
+	seen := make(map[string]bool, len(kdcs))
+	for _, r := range cfg.Realms {
+		if static, ok := kdcs[r.Realm]; ok {
+			r.KDC = static
+			seen[r.Realm] = true
+		}
+		c.Realms = append(c.Realms, r)
+	}
+
+	realms := make([]string, 0, len(kdcs))
+	for realm := range kdcs {
+		if !seen[realm] {
+			realms = append(realms, realm)
+		}
+	}
+	sort.Strings(realms)
+	for _, realm := range realms {
+		c.Realms = append(c.Realms, krb5config.Realm{Realm: realm, KDC: kdcs[realm]})
+	}
+
+	return &c
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadConfigs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	team := write("team.conf", "[libdefaults]\n udp_preference_limit = 1\n[realms]\n TEAM.COM = {\n  kdc = kdc.team.com:88\n }\n EXAMPLE.COM = {\n  kdc = override.example.com:88\n }\n[domain_realm]\n .team.com = TEAM.COM\n")
+	base := write("krb5.conf", "[libdefaults]\n dns_lookup_kdc = false\n udp_preference_limit = 1465\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n")
+
+	k, err := NewKdcProxy(WithConfigs(team, base), WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	cfg := k.Krb5Config()
+
+	tests := []struct {
+		realm string
+		want  string
+	}{
+		{"TEAM.COM", "kdc.team.com:88"},
+		{"EXAMPLE.COM", "override.example.com:88"},
+	}
+	for _, tt := range tests {
+		if _, kdcs, err := cfg.GetKDCs(tt.realm, true); err != nil || kdcs[1] != tt.want {
+			t.Errorf("GetKDCs(%s) = %v, %v, want %s", tt.realm, kdcs, err, tt.want)
+		}
+	}
+
+	if cfg.LibDefaults.DNSLookupKDC {
+		t.Error("dns_lookup_kdc from the base file was not applied")
+	}
+	if cfg.LibDefaults.UDPPreferenceLimit != 1 {
+		t.Errorf("udp_preference_limit = %d, want 1 from the earlier file", cfg.LibDefaults.UDPPreferenceLimit)
+	}
+	if got := cfg.ResolveRealm("host.team.com"); got != "TEAM.COM" {
+		t.Errorf("ResolveRealm(host.team.com) = %s, want TEAM.COM", got)
+	}
+
+	if err := k.LoadConfigs(team, filepath.Join(dir, "missing.conf")); err == nil {
+		t.Error("LoadConfigs() with a missing file did not return an error")
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("krb5.conf.d/team.conf", "[realms]\n TEAM.COM = {\n  kdc = kdc.team.com:88\n }\n EXAMPLE.COM = {\n  kdc = dropin.example.com:88\n }\n")
+	write("krb5.conf.d/ignored.bak", "[realms]\n IGNORED.COM = {\n  kdc = kdc.ignored.com:88\n }\n")
+	write("extra.conf", "[libdefaults]\n udp_preference_limit = 1\n")
+	base := write("krb5.conf", "[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\nincludedir "+filepath.Join(dir, "krb5.conf.d")+"\n OTHER.COM = {\n  kdc = kdc.other.com:88\n }\ninclude extra.conf\n[libdefaults]\n dns_lookup_kdc = false\n udp_preference_limit = 1465\n")
+
+	k, err := NewKdcProxy(WithConfig(base), WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	cfg := k.Krb5Config()
+
+	// the part after a directive continues the realms section, and the including file takes precedence
+	tests := []struct {
+		realm string
+		want  string
+	}{
+		{"EXAMPLE.COM", "kdc.example.com:88"},
+		{"TEAM.COM", "kdc.team.com:88"},
+		{"OTHER.COM", "kdc.other.com:88"},
+	}
+	for _, tt := range tests {
+		if _, kdcs, err := cfg.GetKDCs(tt.realm, true); err != nil || kdcs[1] != tt.want {
+			t.Errorf("GetKDCs(%s) = %v, %v, want %s", tt.realm, kdcs, err, tt.want)
+		}
+	}
+	if _, _, err := cfg.GetKDCs("IGNORED.COM", true); err == nil {
+		t.Error("file not named as MIT Kerberos expects was included")
+	}
+	if cfg.LibDefaults.UDPPreferenceLimit != 1 {
+		t.Errorf("udp_preference_limit = %d, want 1 from the included file", cfg.LibDefaults.UDPPreferenceLimit)
+	}
+	if cfg.LibDefaults.DNSLookupKDC {
+		t.Error("dns_lookup_kdc from after the directive was not applied")
+	}
+
+	// errors
+	loop := write("loop.conf", "include loop.conf\n")
+	if err := k.LoadConfig(loop); err == nil {
+		t.Error("LoadConfig() with an include loop did not return an error")
+	}
+	if err := k.LoadConfig(write("missing.conf", "include nothing.conf\n")); err == nil {
+		t.Error("LoadConfig() with a missing include did not return an error")
+	}
+	if err := k.LoadConfigFromReader(strings.NewReader("include extra.conf\n")); err == nil {
+		t.Error("LoadConfigFromReader() with a relative include did not return an error")
+	}
+}
+
+func TestWithKDCs(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithRegistry(prometheus.NewRegistry()),
+		WithKDCs("EXAMPLE.COM", "kdc1.example.com", "kdc2.example.com:750"),
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = conf.example.com:88\n }\n OTHER.COM = {\n  kdc = kdc.other.com:88\n }\n"),
+		WithKDCs("STATIC.COM", "kdc.static.com:88"),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	check := func(realm string, want []string) {
+		t.Helper()
+		for _, r := range k.Krb5Config().Realms {
+			if r.Realm == realm {
+				if !reflect.DeepEqual(r.KDC, want) {
+					t.Errorf("%s kdcs = %v, want %v", realm, r.KDC, want)
+				}
+				return
+			}
+		}
+		t.Errorf("%s not configured", realm)
+	}
+	check("EXAMPLE.COM", []string{"kdc1.example.com:88", "kdc2.example.com:750"})
+	check("OTHER.COM", []string{"kdc.other.com:88"})
+	check("STATIC.COM", []string{"kdc.static.com:88"})
+
+	// the kdcs are kept when the configuration is reloaded
+	if err := k.LoadConfig(""); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	check("STATIC.COM", []string{"kdc.static.com:88"})
+	if !k.Krb5Config().LibDefaults.DNSLookupKDC {
+		t.Error("other realms are not looked up via DNS")
+	}
+
+	for _, opt := range []Option{WithKDCs(""), WithKDCs("EXAMPLE.COM"), WithKDCs("EXAMPLE.COM", "")} {
+		if _, err := NewKdcProxy(WithRegistry(prometheus.NewRegistry()), opt); err == nil {
+			t.Error("NewKdcProxy() with invalid kdcs did not return an error")
+		}
+	}
+}
+
+func TestConfigDirFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.conf", "a_realm", "c-realm", ".hidden.conf", "backup~", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ConfigDirFiles(dir)
+	if err != nil {
+		t.Fatalf("ConfigDirFiles() error = %v", err)
+	}
+
+	want := []string{filepath.Join(dir, "a_realm"), filepath.Join(dir, "b.conf"), filepath.Join(dir, "c-realm")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfigDirFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestConfigPathFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.conf")
+	second := filepath.Join(dir, "second.conf")
+	missing := filepath.Join(dir, "missing.conf")
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sep := string(os.PathListSeparator)
+
+	tests := []struct {
+		name    string
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"single", first, []string{first}, false},
+		{"multiple", first + sep + second, []string{first, second}, false},
+		{"skip missing", missing + sep + second + sep, []string{second}, false},
+		{"none exist", missing, nil, true},
+		{"empty", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ConfigPathFiles(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigPathFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ConfigPathFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
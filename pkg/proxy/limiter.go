@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultRetryAfter is the Retry-After sent with 429 and 503 responses when the proxy cannot estimate
+// when a retry would succeed
+const DefaultRetryAfter = time.Second
+
+// Limiter limits the rate of requests sent to the KDC. A *rate.Limiter from golang.org/x/time/rate
+// satisfies this interface and is used by default.
+type Limiter interface {
+	// AllowN reports whether n events may happen at time t
+	AllowN(t time.Time, n int) bool
+
+	// Wait blocks until an event is permitted or ctx is done
+	Wait(ctx context.Context) error
+}
+
+// limiterDelay returns how long until l permits another request, which is only known for the
+// built-in limiter
+func limiterDelay(l Limiter, now time.Time) time.Duration {
+	rl, ok := l.(*rate.Limiter)
+	if !ok || rl.Limit() <= 0 || rl.Limit() == rate.Inf {
+		return DefaultRetryAfter
+	}
+
+	missing := 1 - rl.TokensAt(now)
+	if missing <= 0 {
+		return DefaultRetryAfter
+	}
+
+	return time.Duration(missing / float64(rl.Limit()) * float64(time.Second))
+}
+
+// setRetryAfter sets the Retry-After header to d rounded up to whole seconds, as required by the
+// header, and no less than one second
+func setRetryAfter(h http.Header, d time.Duration) {
+	secs := (d + time.Second - 1) / time.Second
+	if secs < 1 {
+		secs = 1
+	}
+	h.Set("Retry-After", strconv.Itoa(int(secs)))
+}
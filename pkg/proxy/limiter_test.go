@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+// denyLimiter never permits a request
+type denyLimiter struct {
+	calls int
+}
+
+func (d *denyLimiter) AllowN(t time.Time, n int) bool {
+	d.calls++
+	return false
+}
+
+func (d *denyLimiter) Wait(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWithRateLimiter(t *testing.T) {
+	if _, err := NewKdcProxy(WithRateLimiter(nil)); err == nil {
+		t.Errorf("WithRateLimiter(nil) did not return an error")
+	}
+
+	l := &denyLimiter{}
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithRateLimiter(l),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+	w := httptest.NewRecorder()
+	k.Handler(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Handler() status = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	if l.calls != 1 {
+		t.Errorf("limiter calls = %v, want 1", l.calls)
+	}
+
+	if err := k.SetLimit(50); err == nil {
+		t.Errorf("SetLimit() with custom limiter did not return an error")
+	}
+
+	if got := k.Stats().Limiter; got != (LimiterStats{}) {
+		t.Errorf("Stats().Limiter = %+v, want empty", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+		want  string
+	}{
+		{"zero", 0, "1"},
+		{"sub second", 200 * time.Millisecond, "1"},
+		{"whole seconds", 2 * time.Second, "2"},
+		{"rounded up", 2*time.Second + time.Millisecond, "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			setRetryAfter(h, tt.delay)
+			if got := h.Get("Retry-After"); got != tt.want {
+				t.Errorf("Retry-After = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// one request every 10 seconds leaves the second request waiting up to 10 seconds
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{err: errors.New("unreachable")}),
+		WithRateLimiter(rate.NewLimiter(rate.Every(10*time.Second), 1)),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	for i, want := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+		w := httptest.NewRecorder()
+		k.Handler(w, req)
+
+		if w.Code != want {
+			t.Fatalf("request %d status = %v, want %v", i, w.Code, want)
+		}
+		secs, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		if err != nil {
+			t.Fatalf("request %d Retry-After = %q", i, w.Header().Get("Retry-After"))
+		}
+		if want == http.StatusTooManyRequests && (secs < 9 || secs > 10) {
+			t.Errorf("Retry-After = %d, want 9-10", secs)
+		}
+	}
+
+	// a custom limiter uses the default
+	if got := limiterDelay(&denyLimiter{}, time.Now()); got != DefaultRetryAfter {
+		t.Errorf("limiterDelay() = %v, want %v", got, DefaultRetryAfter)
+	}
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &countTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithLimit(1),
+		WithBurst(10),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	// only the burst is allowed as the limit is too low for tokens to be added during the test
+	const requests = 50
+	var ok, limited atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			w := httptest.NewRecorder()
+			k.Handler(w, httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM"))))
+			switch w.Code {
+			case http.StatusOK:
+				ok.Add(1)
+			case http.StatusTooManyRequests:
+				limited.Add(1)
+			default:
+				t.Errorf("status = %d", w.Code)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if ok.Load() < 10 || ok.Load() > 11 || ok.Load()+limited.Load() != requests {
+		t.Errorf("allowed %d and limited %d of %d requests", ok.Load(), limited.Load(), requests)
+	}
+	if got := transport.n.Load(); got != ok.Load() {
+		t.Errorf("exchanges = %d, want %d", got, ok.Load())
+	}
+	if got := testutil.ToFloat64(k.metrics.httpRespOK); got != float64(ok.Load()) {
+		t.Errorf("ok responses metric = %v, want %d", got, ok.Load())
+	}
+	if got := testutil.ToFloat64(k.metrics.httpRespTooManyRequests); got != float64(limited.Load()) {
+		t.Errorf("rate limited responses metric = %v, want %d", got, limited.Load())
+	}
+}
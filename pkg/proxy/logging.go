@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardLogger drops all records
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler that drops all records, used when no logger is configured
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
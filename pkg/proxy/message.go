@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/messages"
+)
+
+// MessageType is the type of Kerberos message carried by a KDC-PROXY-MESSAGE
+type MessageType string
+
+// Kerberos message types
+const (
+	MessageTypeASReq    MessageType = "AS-REQ"
+	MessageTypeASRep    MessageType = "AS-REP"
+	MessageTypeTGSReq   MessageType = "TGS-REQ"
+	MessageTypeTGSRep   MessageType = "TGS-REP"
+	MessageTypeAPReq    MessageType = "AP-REQ"
+	MessageTypeAPRep    MessageType = "AP-REP"
+	MessageTypeKRBError MessageType = "KRB-ERROR"
+	MessageTypeUnknown  MessageType = "unknown"
+)
+
+// IsRequest returns true if the message type is one that may be sent to a KDC
+func (t MessageType) IsRequest() bool {
+	return t == MessageTypeASReq || t == MessageTypeTGSReq || t == MessageTypeAPReq
+}
+
+// Message is a decoded KDC-PROXY-MESSAGE along with details from the Kerberos message it carries
+type Message struct {
+	KdcProxyMsg
+
+	// Type of the Kerberos message
+	Type MessageType
+	// Realm from the Kerberos message, which may differ from the TargetDomain
+	Realm string
+	// ClientPrincipal is the client principal name, when present in the clear
+	ClientPrincipal string
+	// ServicePrincipal is the service principal name, when present in the clear
+	ServicePrincipal string
+}
+
+// DecodeKdcProxyMessage decodes a KDC-PROXY-MESSAGE as per MS-KKDCP along with the Kerberos message it
+// carries. An error is returned if the framing is invalid or the Kerberos message is not recognised.
+func DecodeKdcProxyMessage(data []byte) (msg *Message, err error) {
+	var m KdcProxyMsg
+
+	// gokrb5 can panic when unmarshalling some malformed messages
+	defer func() {
+		if r := recover(); r != nil {
+			msg, err = nil, fmt.Errorf("%w: %v", ErrMalformedMessage, r)
+		}
+	}()
+
+	// unmarshal KDC-PROXY-MESSAGE
+	rest, err := asn1.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+
+	// make sure no trailing data exists
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrMalformedMessage)
+	}
+
+	// the kerberos message must include its length
+	if len(m.KerbMessage) < 4 {
+		return nil, fmt.Errorf("%w: kerberos message too short", ErrMalformedMessage)
+	}
+
+	msg = &Message{KdcProxyMsg: m, Type: MessageTypeUnknown}
+	inner := m.KerbMessage[4:]
+
+	// only the message type matching the application tag is unmarshalled
+	tag, ok := applicationTag(inner)
+	if !ok {
+		return nil, fmt.Errorf("%w: unrecognised kerberos message", ErrMalformedMessage)
+	}
+
+	switch tag {
+	case asnAppTag.ASREQ:
+		asReq := messages.ASReq{}
+		if err := asReq.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid AS-REQ: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeASReq
+		msg.Realm = asReq.ReqBody.Realm
+		msg.ClientPrincipal = asReq.ReqBody.CName.PrincipalNameString()
+		msg.ServicePrincipal = asReq.ReqBody.SName.PrincipalNameString()
+	case asnAppTag.TGSREQ:
+		tgsReq := messages.TGSReq{}
+		if err := tgsReq.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid TGS-REQ: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeTGSReq
+		msg.Realm = tgsReq.ReqBody.Realm
+		msg.ServicePrincipal = tgsReq.ReqBody.SName.PrincipalNameString()
+	case asnAppTag.APREQ:
+		apReq := messages.APReq{}
+		if err := apReq.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid AP-REQ: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeAPReq
+		msg.Realm = apReq.Ticket.Realm
+		msg.ServicePrincipal = apReq.Ticket.SName.PrincipalNameString()
+	case asnAppTag.ASREP:
+		asRep := messages.ASRep{}
+		if err := asRep.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid AS-REP: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeASRep
+		msg.Realm = asRep.CRealm
+		msg.ClientPrincipal = asRep.CName.PrincipalNameString()
+	case asnAppTag.TGSREP:
+		tgsRep := messages.TGSRep{}
+		if err := tgsRep.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid TGS-REP: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeTGSRep
+		msg.Realm = tgsRep.CRealm
+		msg.ClientPrincipal = tgsRep.CName.PrincipalNameString()
+	case asnAppTag.APREP:
+		apRep := messages.APRep{}
+		if err := apRep.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid AP-REP: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeAPRep
+	case asnAppTag.KRBError:
+		krbError := messages.KRBError{}
+		if err := krbError.Unmarshal(inner); err != nil {
+			return nil, fmt.Errorf("%w: invalid KRB-ERROR: %w", ErrMalformedMessage, err)
+		}
+		msg.Type = MessageTypeKRBError
+		msg.Realm = krbError.Realm
+		msg.ServicePrincipal = krbError.SName.PrincipalNameString()
+	default:
+		return nil, fmt.Errorf("%w: unexpected kerberos message with application tag %d", ErrMalformedMessage, tag)
+	}
+
+	return msg, nil
+}
+
+// requestType returns the type of the Kerberos request b from its application tag, or
+// MessageTypeUnknown if it is not a request
+func requestType(b []byte) MessageType {
+	tag, _ := applicationTag(b)
+	switch tag {
+	case asnAppTag.ASREQ:
+		return MessageTypeASReq
+	case asnAppTag.TGSREQ:
+		return MessageTypeTGSReq
+	case asnAppTag.APREQ:
+		return MessageTypeAPReq
+	}
+
+	return MessageTypeUnknown
+}
+
+// applicationTag returns the ASN.1 application tag number of the Kerberos message b, which must be
+// a constructed application type using the low tag number form as all Kerberos messages do
+func applicationTag(b []byte) (int, bool) {
+	if len(b) == 0 || b[0]&0xe0 != 0x60 || b[0]&0x1f == 0x1f {
+		return 0, false
+	}
+
+	return int(b[0] & 0x1f), true
+}
+
+// EncodeKdcProxyMessage encodes msg as a KDC-PROXY-MESSAGE as per MS-KKDCP
+func EncodeKdcProxyMessage(msg *KdcProxyMsg) ([]byte, error) {
+	return asn1.Marshal(*msg)
+}
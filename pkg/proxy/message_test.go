@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"testing"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// testASReq returns a marshalled AS-REQ for user@EXAMPLE.COM
+func testASReq(t testing.TB) []byte {
+	t.Helper()
+
+	cfg := krb5config.New()
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "user")
+	req, err := messages.NewASReqForTGT("EXAMPLE.COM", cfg, cname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// testKRBError returns a marshalled KRB-ERROR for EXAMPLE.COM
+func testKRBError(t testing.TB) []byte {
+	t.Helper()
+
+	sname := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/EXAMPLE.COM")
+	krbErr := messages.NewKRBError(sname, "EXAMPLE.COM", errorcode.KDC_ERR_PREAUTH_REQUIRED, "preauth required")
+
+	b, err := krbErr.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// testProxyMessage wraps the Kerberos message in a KDC-PROXY-MESSAGE
+func testProxyMessage(t testing.TB, kerb []byte, realm string) []byte {
+	t.Helper()
+
+	b, err := EncodeKdcProxyMessage(&KdcProxyMsg{
+		KerbMessage:  append(MarshalKerbLength(len(kerb)), kerb...),
+		TargetDomain: realm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestDecodeKdcProxyMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		wantType      MessageType
+		wantRealm     string
+		wantClient    string
+		wantService   string
+		wantTarget    string
+		wantErr       bool
+		wantIsRequest bool
+	}{
+		{"as-req", testProxyMessage(t, testASReq(t), "EXAMPLE.COM"), MessageTypeASReq, "EXAMPLE.COM", "user", "krbtgt/EXAMPLE.COM", "EXAMPLE.COM", false, true},
+		{"as-req without target", testProxyMessage(t, testASReq(t), ""), MessageTypeASReq, "EXAMPLE.COM", "user", "krbtgt/EXAMPLE.COM", "", false, true},
+		{"krb-error", testProxyMessage(t, testKRBError(t), ""), MessageTypeKRBError, "EXAMPLE.COM", "", "krbtgt/EXAMPLE.COM", "", false, false},
+		{"garbage kerberos message", testProxyMessage(t, []byte{1, 2, 3}, ""), "", "", "", "", "", true, false},
+		{"unexpected application tag", testProxyMessage(t, []byte{0x61, 0x00}, ""), "", "", "", "", "", true, false},
+		{"truncated as-req", testProxyMessage(t, testASReq(t)[:20], ""), "", "", "", "", "", true, false},
+		{"garbage", []byte{1, 2, 3}, "", "", "", "", "", true, false},
+		{"trailing data", append(testProxyMessage(t, testASReq(t), ""), 0), "", "", "", "", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeKdcProxyMessage(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeKdcProxyMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Type != tt.wantType || got.Realm != tt.wantRealm || got.ClientPrincipal != tt.wantClient || got.ServicePrincipal != tt.wantService || got.TargetDomain != tt.wantTarget {
+				t.Errorf("DecodeKdcProxyMessage() = %+v", got)
+			}
+			if got.Type.IsRequest() != tt.wantIsRequest {
+				t.Errorf("IsRequest() = %v, want %v", got.Type.IsRequest(), tt.wantIsRequest)
+			}
+		})
+	}
+}
+
+func TestApplicationTag(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		want   int
+		wantOk bool
+	}{
+		{"as-req", testASReq(t), 10, true},
+		{"krb-error", testKRBError(t), 30, true},
+		{"empty", nil, 0, false},
+		{"universal sequence", []byte{0x30, 0x00}, 0, false},
+		{"high tag number form", []byte{0x7f, 0x81, 0x00}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := applicationTag(tt.b)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("applicationTag() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -2,79 +2,289 @@ package proxy
 
 import (
 	"net/http"
+	"strconv"
 
+	"github.com/andrewheberle/kdcproxy/internal/metricsutil"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Metrics for HTTP service
-var (
-	httpReqs = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_requests_total",
-		Help: "The total number of HTTP requests handled",
-	})
-	httpRespOK = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_200",
-		Help: "The total number of 200 OK HTTP responses",
-	})
-	httpRespBadRequest = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_400",
-		Help: "The total number of 400 Bad Request HTTP responses",
-	})
-	httpRespMethodNotAllowed = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_405",
-		Help: "The total number of 405 Not Allowed HTTP responses",
-	})
-	httpRespLengthRequired = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_411",
-		Help: "The total number of 411 Length Required HTTP responses",
-	})
-	httpRespRequestEntityTooLarge = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_413",
-		Help: "The total number of 413 Request Entity Too Large HTTP responses",
-	})
-	httpRespTooManyRequests = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_429",
-		Help: "The total number of 429 Too Many Requests HTTP responses",
-	})
-	httpRespInternalServerError = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_500",
-		Help: "The total number of 500 Internal Server Error HTTP responses",
-	})
-	httpRespServiceUnavailable = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_http_responses_503",
-		Help: "The total number of 503 Service Unavailable HTTP responses",
-	})
-	httpRespTimeHistogram = promauto.NewHistogram(
-		prometheus.HistogramOpts{
+// unknownRealm is the realm label used when no KDC's could be found for the requested realm,
+// which avoids unbounded label cardinality from arbitrary client supplied realms
+const unknownRealm = "unknown"
+
+// deniedRealm is the realm label used for realms that are not allowed, such as a realm set by an
+// interceptor, so only permitted realms appear as labels
+const deniedRealm = "denied"
+
+// realmLabel returns the realm label for metrics of a realm known to have KDC's
+func (k *KerberosProxy) realmLabel(realm string) string {
+	if !k.filter.Load().allow(realm) {
+		return deniedRealm
+	}
+
+	return realm
+}
+
+// metrics holds the Prometheus metrics for a KerberosProxy
+type metrics struct {
+	// Metrics for HTTP service
+	httpReqs                      prometheus.Counter
+	httpReqsInFlight              prometheus.Gauge
+	httpReqsQueued                prometheus.Gauge
+	httpRespOK                    prometheus.Counter
+	httpRespBadRequest            prometheus.Counter
+	httpRespUnauthorized          prometheus.Counter
+	httpRespForbidden             prometheus.Counter
+	httpRespMethodNotAllowed      prometheus.Counter
+	httpRespLengthRequired        prometheus.Counter
+	httpRespRequestEntityTooLarge prometheus.Counter
+	httpRespTooManyRequests       prometheus.Counter
+	httpRespInternalServerError   prometheus.Counter
+	httpRespServiceUnavailable    prometheus.Counter
+	httpRespOther                 *prometheus.CounterVec
+	httpRespTimeHistogram         prometheus.Histogram
+
+	// Metrics for Kerberos side
+	kerbReqTcp               *prometheus.CounterVec
+	kerbResTcp               *prometheus.CounterVec
+	kerbReqUdp               *prometheus.CounterVec
+	kerbResUdp               *prometheus.CounterVec
+	kerbErrors               *prometheus.CounterVec
+	kerbMessages             *prometheus.CounterVec
+	kerbForwardTimeHistogram *prometheus.HistogramVec
+	realmRejections          prometheus.Counter
+	accessDecisions          *prometheus.CounterVec
+	authzDecisions           *prometheus.CounterVec
+	duplicates               prometheus.Counter
+	affinityHits             prometheus.Counter
+	hedges                   *prometheus.CounterVec
+	faultsInjected           *prometheus.CounterVec
+	kdcDiscoveryFailures     *prometheus.CounterVec
+
+	// Metrics per KDC
+	kdcAttempts     *prometheus.CounterVec
+	kdcFailures     *prometheus.CounterVec
+	kdcTimeouts     *prometheus.CounterVec
+	kdcDuration     *prometheus.HistogramVec
+	kdcUp           *prometheus.GaugeVec
+	kdcObservations *prometheus.CounterVec
+	kdcErrors       *prometheus.CounterVec
+	dcPings         *prometheus.CounterVec
+	kdcFailureScore *prometheus.GaugeVec
+}
+
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	r := metricsutil.NewRegistrar(reg)
+	m := &metrics{
+		httpReqs: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_requests_total",
+			Help: "The total number of HTTP requests handled",
+		})),
+		httpReqsInFlight: metricsutil.Register(r, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kdc_proxy_http_requests_in_flight",
+			Help: "The number of HTTP requests currently being processed",
+		})),
+		httpReqsQueued: metricsutil.Register(r, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kdc_proxy_http_requests_queued",
+			Help: "The number of HTTP requests waiting to be forwarded to a KDC",
+		})),
+		httpRespOK: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_200",
+			Help: "The total number of 200 OK HTTP responses",
+		})),
+		httpRespBadRequest: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_400",
+			Help: "The total number of 400 Bad Request HTTP responses",
+		})),
+		httpRespUnauthorized: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_401",
+			Help: "The total number of 401 Unauthorized HTTP responses",
+		})),
+		httpRespForbidden: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_403",
+			Help: "The total number of 403 Forbidden HTTP responses",
+		})),
+		httpRespMethodNotAllowed: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_405",
+			Help: "The total number of 405 Not Allowed HTTP responses",
+		})),
+		httpRespLengthRequired: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_411",
+			Help: "The total number of 411 Length Required HTTP responses",
+		})),
+		httpRespRequestEntityTooLarge: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_413",
+			Help: "The total number of 413 Request Entity Too Large HTTP responses",
+		})),
+		httpRespTooManyRequests: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_429",
+			Help: "The total number of 429 Too Many Requests HTTP responses",
+		})),
+		httpRespInternalServerError: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_500",
+			Help: "The total number of 500 Internal Server Error HTTP responses",
+		})),
+		httpRespServiceUnavailable: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_503",
+			Help: "The total number of 503 Service Unavailable HTTP responses",
+		})),
+		httpRespOther: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_http_responses_other",
+			Help: "The total number of HTTP responses with a status code changed using WithStatusCodes that is not counted by another metric",
+		}, []string{"code"})),
+		httpRespTimeHistogram: metricsutil.Register(r, prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name:    "kdc_proxy_http_request_duration_seconds",
 			Help:    "Histogram of response time for the KDC Proxy in seconds",
 			Buckets: prometheus.DefBuckets,
-		})
-)
+		})),
+		kerbReqTcp: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_request_tcp",
+			Help: "The total number Kerberos requests sent via TCP",
+		}, []string{"realm"})),
+		kerbResTcp: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_response_tcp",
+			Help: "The total number Kerberos responses via TCP",
+		}, []string{"realm"})),
+		kerbReqUdp: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_request_udp",
+			Help: "The total number Kerberos requests sent via UDP",
+		}, []string{"realm"})),
+		kerbResUdp: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_response_udp",
+			Help: "The total number Kerberos responses via UDP",
+		}, []string{"realm"})),
+		kerbErrors: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_errors_total",
+			Help: "The total number of Kerberos requests that could not be forwarded to any KDC",
+		}, []string{"realm"})),
+		kerbForwardTimeHistogram: metricsutil.Register(r, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kdc_proxy_kerberos_forward_duration_seconds",
+			Help:    "Histogram of time taken to forward requests to a KDC in seconds",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"realm"})),
+		kerbMessages: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_messages_total",
+			Help: "The total number of Kerberos messages received by type, where unknown includes malformed messages",
+		}, []string{"type"})),
+		realmRejections: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_realm_rejections_total",
+			Help: "The total number of Kerberos requests rejected as the realm is not allowed",
+		})),
+		accessDecisions: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_access_decisions_total",
+			Help: "The total number of access rule decisions by the rule that matched and its action",
+		}, []string{"rule", "action"})),
+		authzDecisions: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_authz_decisions_total",
+			Help: "The total number of decisions by the external authorizer, including cached decisions, by result",
+		}, []string{"decision"})),
+		duplicates: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_kerberos_duplicates_total",
+			Help: "The total number of duplicate Kerberos requests served without contacting a KDC",
+		})),
+		kdcFailureScore: metricsutil.Register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kdc_proxy_kdc_failure_score",
+			Help: "Moving average of failed exchanges with a KDC, from 0 to 1, used to demote unreliable KDC's",
+		}, []string{"kdc", "proto"})),
+		dcPings: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_dc_pings_total",
+			Help: "The total number of CLDAP pings sent to domain controllers by result",
+		}, []string{"result"})),
+		affinityHits: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_affinity_hits_total",
+			Help: "The total number of requests sent first to the KDC that answered the last AS exchange of the client",
+		})),
+		hedges: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_hedged_requests_total",
+			Help: "The total number of requests also sent to the next KDC because the first had not answered in time",
+		}, []string{"proto"})),
+		faultsInjected: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_faults_injected_total",
+			Help: "The total number of faults injected into exchanges with KDC's by type of fault",
+		}, []string{"fault"})),
+		kdcAttempts: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_attempts_total",
+			Help: "The total number of attempts to exchange a message with a KDC",
+		}, []string{"kdc", "proto"})),
+		kdcFailures: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_failures_total",
+			Help: "The total number of failed attempts to exchange a message with a KDC",
+		}, []string{"kdc", "proto"})),
+		kdcTimeouts: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_timeouts_total",
+			Help: "The total number of attempts to exchange a message with a KDC that timed out",
+		}, []string{"kdc", "proto"})),
+		kdcDuration: metricsutil.Register(r, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kdc_proxy_kdc_exchange_duration_seconds",
+			Help:    "Histogram of time taken to exchange a message with a KDC in seconds",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"kdc", "proto"})),
+		kdcUp: metricsutil.Register(r, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kdc_proxy_kdc_up",
+			Help: "Whether the last attempt to exchange a message with a KDC succeeded (1) or failed (0)",
+		}, []string{"kdc", "proto"})),
+		kdcErrors: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_errors_total",
+			Help: "The total number of failed attempts to exchange a message with a KDC by type of error",
+		}, []string{"proto", "error_type"})),
+		kdcDiscoveryFailures: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_discovery_failures_total",
+			Help: "The total number of times no KDC's could be found for a realm, such as due to missing DNS SRV records",
+		}, []string{"proto"})),
+		kdcObservations: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_kdc_peer_observations_total",
+			Help: "The total number of KDC health observations received from other proxy instances by state",
+		}, []string{"state"})),
+	}
 
-// Metrics for Kerberos side
-var (
-	kerbReqTcp = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_kerberos_request_tcp",
-		Help: "The total number Kerberos requests sent via TCP",
-	})
-	kerbResTcp = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_kerberos_response_tcp",
-		Help: "The total number Kerberos responses via TCP",
-	})
-	kerbReqUdp = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_kerberos_request_udp",
-		Help: "The total number Kerberos requests sent via UDP",
-	})
-	kerbResUdp = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "kdc_proxy_kerberos_response_udp",
-		Help: "The total number Kerberos responses via UDP",
-	})
-)
+	// export every message type from the start so rates can be compared
+	for _, t := range []MessageType{MessageTypeASReq, MessageTypeTGSReq, MessageTypeAPReq, MessageTypeUnknown} {
+		m.kerbMessages.WithLabelValues(string(t))
+	}
+
+	return m, r.Err()
+}
+
+// response returns the counter of HTTP responses with status code
+func (m *metrics) response(code int) prometheus.Counter {
+	switch code {
+	case http.StatusOK:
+		return m.httpRespOK
+	case http.StatusBadRequest:
+		return m.httpRespBadRequest
+	case http.StatusUnauthorized:
+		return m.httpRespUnauthorized
+	case http.StatusForbidden:
+		return m.httpRespForbidden
+	case http.StatusMethodNotAllowed:
+		return m.httpRespMethodNotAllowed
+	case http.StatusLengthRequired:
+		return m.httpRespLengthRequired
+	case http.StatusRequestEntityTooLarge:
+		return m.httpRespRequestEntityTooLarge
+	case http.StatusTooManyRequests:
+		return m.httpRespTooManyRequests
+	case http.StatusInternalServerError:
+		return m.httpRespInternalServerError
+	case http.StatusServiceUnavailable:
+		return m.httpRespServiceUnavailable
+	}
+
+	return m.httpRespOther.WithLabelValues(strconv.Itoa(code))
+}
+
+// Registerer returns the registry the proxy's metrics are registered with, so that an application
+// serving the proxy can register its own metrics alongside them
+func (k *KerberosProxy) Registerer() prometheus.Registerer {
+	return k.registry
+}
 
 // Prometheus metrics handler
 func (k *KerberosProxy) Metrics() http.Handler {
+	if g, ok := k.registry.(prometheus.Gatherer); ok && k.registry != prometheus.DefaultRegisterer {
+		return promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	}
+
 	return promhttp.Handler()
 }
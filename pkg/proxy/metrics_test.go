@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRealmMetrics(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+	msg := func(realm string) *KdcProxyMsg {
+		return &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: realm}
+	}
+
+	// realms set by an interceptor bypass the allow and deny lists
+	rewrite := func(next ForwardFunc) ForwardFunc {
+		return func(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+			if msg.TargetDomain == "REWRITE.COM" {
+				m := *msg
+				m.TargetDomain = "DENIED.COM"
+				msg = &m
+			}
+			return next(ctx, msg)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		realm   string
+		err     error
+		label   string
+		wantErr bool
+	}{
+		{"forwarded", "EXAMPLE.COM", nil, "EXAMPLE.COM", false},
+		{"kdc failed", "EXAMPLE.COM", errors.New("connection refused"), "EXAMPLE.COM", true},
+		{"denied realm", "REWRITE.COM", nil, deniedRealm, false},
+		{"unknown realm", "UNKNOWN.INVALID", nil, unknownRealm, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			k, err := NewKdcProxy(
+				WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n"),
+				WithKDCs("EXAMPLE.COM", "kdc.example.com"),
+				WithKDCs("DENIED.COM", "kdc.denied.com"),
+				WithDeniedRealms("DENIED.COM"),
+				WithProtocols(protoUdp),
+				WithInterceptors(rewrite),
+				WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...), err: tt.err}),
+				WithRegistry(reg),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			if _, err := k.Forward(context.Background(), msg(tt.realm)); (err != nil) != tt.wantErr {
+				t.Fatalf("Forward() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// every realm labelled counter uses the same label
+			var expected strings.Builder
+			counters := []struct {
+				name, help string
+				value      int
+			}{
+				{"kdc_proxy_kerberos_errors_total", "The total number of Kerberos requests that could not be forwarded to any KDC", 0},
+				{"kdc_proxy_kerberos_request_udp", "The total number Kerberos requests sent via UDP", 1},
+				{"kdc_proxy_kerberos_response_udp", "The total number Kerberos responses via UDP", 0},
+			}
+			if tt.label == unknownRealm {
+				counters[1].value = 0
+			}
+			if tt.wantErr {
+				counters[0].value = 1
+			} else {
+				counters[2].value = 1
+			}
+			var names []string
+			for _, c := range counters {
+				names = append(names, c.name)
+				if c.value == 0 {
+					continue
+				}
+				fmt.Fprintf(&expected, "# HELP %s %s\n# TYPE %s counter\n%s{realm=%q} %d\n", c.name, c.help, c.name, c.name, tt.label, c.value)
+			}
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(expected.String()), names...); err != nil {
+				t.Error(err)
+			}
+
+			// as is the forward duration
+			if got := testutil.CollectAndCount(k.metrics.kerbForwardTimeHistogram); got != 1 {
+				t.Errorf("forward duration series = %d, want 1", got)
+			}
+			if !k.metrics.kerbForwardTimeHistogram.DeleteLabelValues(tt.label) {
+				t.Errorf("forward duration not labelled with realm %q", tt.label)
+			}
+		})
+	}
+}
+
+func TestKDCMetrics(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+
+	tests := []struct {
+		name      string
+		proto     string
+		behaviour string
+		failures  float64
+		timeouts  float64
+		up        float64
+	}{
+		{"tcp reply", protoTcp, kdcReply, 0, 0, 1},
+		{"udp reply", protoUdp, kdcReply, 0, 0, 1},
+		{"tcp bad response", protoTcp, kdcTruncated, 1, 0, 0},
+		{"udp timeout", protoUdp, kdcSilent, 1, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kdc := newFakeKDC(t, reply)
+			kdc.behaviour = tt.behaviour
+			kdc.serve()
+
+			k, err := NewKdcProxy(
+				WithKDCs("EXAMPLE.COM", kdc.addr),
+				WithRegistry(prometheus.NewRegistry()),
+				WithProtocols(tt.proto),
+				WithTimeout(200*time.Millisecond),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"})
+
+			for name, c := range map[string]struct {
+				vec  *prometheus.CounterVec
+				want float64
+			}{
+				"attempts": {k.metrics.kdcAttempts, 1},
+				"failures": {k.metrics.kdcFailures, tt.failures},
+				"timeouts": {k.metrics.kdcTimeouts, tt.timeouts},
+			} {
+				if got := testutil.ToFloat64(c.vec.WithLabelValues(kdc.addr, tt.proto)); got != c.want {
+					t.Errorf("%s = %v, want %v", name, got, c.want)
+				}
+			}
+			if got := testutil.ToFloat64(k.metrics.kdcUp.WithLabelValues(kdc.addr, tt.proto)); got != tt.up {
+				t.Errorf("up = %v, want %v", got, tt.up)
+			}
+
+			// only the kdc and protocol used have an exchange duration
+			if got := testutil.CollectAndCount(k.metrics.kdcDuration); got != 1 {
+				t.Errorf("exchange duration series = %d, want 1", got)
+			}
+			h, ok := k.metrics.kdcDuration.WithLabelValues(kdc.addr, tt.proto).(prometheus.Histogram)
+			if !ok {
+				t.Fatal("exchange duration is not a histogram")
+			}
+			var m dto.Metric
+			if err := h.Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.GetHistogram().GetSampleCount(); got != 1 {
+				t.Errorf("exchange duration count = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMetricsRegistration(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	// proxies with identical metrics share a registry
+	for i := 0; i < 2; i++ {
+		if _, err := NewKdcProxy(WithRegistry(reg), WithLatencyObjectives(LatencyObjective{0.95, time.Second})); err != nil {
+			t.Fatalf("NewKdcProxy() error = %v", err)
+		}
+	}
+
+	// a conflicting metric is an error rather than a panic
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kdc_proxy_http_requests_total",
+		Help: "A conflicting metric",
+	}))
+	if _, err := NewKdcProxy(WithRegistry(reg)); err == nil {
+		t.Error("NewKdcProxy() with a conflicting metric did not return an error")
+	}
+}
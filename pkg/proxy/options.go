@@ -0,0 +1,610 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures a KerberosProxy
+type Option func(*KerberosProxy) error
+
+// WithConfig loads the provided "krb5.conf" file rather than looking up KDC's via DNS
+func WithConfig(config string) Option {
+	return func(k *KerberosProxy) error {
+		return k.LoadConfig(config)
+	}
+}
+
+// WithConfigs loads and merges the provided "krb5.conf" files, where the earliest file takes
+// precedence, rather than looking up KDC's via DNS
+func WithConfigs(paths ...string) Option {
+	return func(k *KerberosProxy) error {
+		return k.LoadConfigs(paths...)
+	}
+}
+
+// WithKDCs sets the KDC's, as "host:port" with the port defaulting to 88, for realm regardless of
+// the krb5 configuration, including any loaded later. This allows KDC's to be given without a
+// krb5.conf, with other realms still looked up via DNS. Repeating the option for a realm adds KDC's.
+func WithKDCs(realm string, kdcs ...string) Option {
+	return func(k *KerberosProxy) error {
+		if realm == "" {
+			return fmt.Errorf("kdc realm cannot be empty")
+		}
+		if len(kdcs) == 0 {
+			return fmt.Errorf("no kdcs provided for realm %s", realm)
+		}
+		if k.staticKDCs == nil {
+			k.staticKDCs = make(map[string][]string)
+		}
+		for _, kdc := range kdcs {
+			if kdc == "" {
+				return fmt.Errorf("kdc for realm %s cannot be empty", realm)
+			}
+			if !strings.Contains(kdc, ":") {
+				kdc += ":88"
+			}
+			k.staticKDCs[realm] = append(k.staticKDCs[realm], kdc)
+		}
+
+		// the krb5 configuration may already be loaded
+		k.storeKrb5Config(k.krb5Config.Load())
+
+		return nil
+	}
+}
+
+// WithKrb5ConfString uses the provided krb5 configuration rather than looking up KDC's via DNS
+func WithKrb5ConfString(config string) Option {
+	return WithKrb5ConfReader(strings.NewReader(config))
+}
+
+// WithKrb5ConfReader reads the krb5 configuration from r rather than looking up KDC's via DNS
+func WithKrb5ConfReader(r io.Reader) Option {
+	return func(k *KerberosProxy) error {
+		return k.LoadConfigFromReader(r)
+	}
+}
+
+// WithLimit sets the number of requests per second to the KDC allowed
+func WithLimit(limit int) Option {
+	return func(k *KerberosProxy) error {
+		if limit < 1 {
+			return fmt.Errorf("rate limit must be at least 1")
+		}
+		k.limit = limit
+
+		return nil
+	}
+}
+
+// WithBurst sets the number of requests to the KDC allowed in a burst above the rate set by
+// WithLimit. The default of 0 allows a burst equal to the rate limit.
+func WithBurst(burst int) Option {
+	return func(k *KerberosProxy) error {
+		if burst < 0 {
+			return fmt.Errorf("rate limit burst cannot be negative")
+		}
+		k.burst = burst
+
+		return nil
+	}
+}
+
+// WithRateLimiter uses l, such as an adaptive or distributed limiter, to limit the requests sent to
+// the KDC rather than the built-in limiter configured by WithLimit
+func WithRateLimiter(l Limiter) Option {
+	return func(k *KerberosProxy) error {
+		if l == nil {
+			return fmt.Errorf("limiter cannot be nil")
+		}
+		k.limiter = l
+
+		return nil
+	}
+}
+
+// WithMaxInFlight sets the maximum number of requests that may be processed concurrently.
+// A value of 0 disables the cap.
+func WithMaxInFlight(n int) Option {
+	return func(k *KerberosProxy) error {
+		if n < 0 {
+			return fmt.Errorf("maximum in-flight requests cannot be negative")
+		}
+		k.maxInFlight = n
+
+		return nil
+	}
+}
+
+// WithAccessRules sets rules that allow or deny forwarding requests based on the realm, Kerberos
+// message type and client, as per SetAccessRules
+func WithAccessRules(defaultAction AccessAction, rules ...AccessRule) Option {
+	return func(k *KerberosProxy) error {
+		k.accessDefault = defaultAction
+		k.accessRules = rules
+
+		return nil
+	}
+}
+
+// WithAuthorizer asks a, such as a WebhookAuthorizer, whether each request may be forwarded after the
+// realm restrictions and access rules allow it. Denied requests receive 403 Forbidden, while requests
+// that cannot be authorized due to an error receive 503 Service Unavailable.
+func WithAuthorizer(a Authorizer) Option {
+	return func(k *KerberosProxy) error {
+		if a == nil {
+			return fmt.Errorf("authorizer cannot be nil")
+		}
+		k.authorizer = a
+
+		return nil
+	}
+}
+
+// WithFairQueue limits the number of requests forwarded to KDC's at once to concurrency. Further
+// requests wait in a queue per realm, of up to depth requests or unlimited if depth is 0, and the
+// queues are served in turn so a burst of requests for one realm cannot starve the others. Waiting
+// requests count towards WithMaxInFlight.
+func WithFairQueue(concurrency, depth int) Option {
+	return func(k *KerberosProxy) error {
+		if concurrency < 0 || depth < 0 {
+			return fmt.Errorf("fair queue concurrency and depth cannot be negative")
+		}
+		k.queueConcurrency = concurrency
+		k.queueDepth = depth
+
+		return nil
+	}
+}
+
+// WithRegistry registers the proxy's metrics with the provided registry instead of the global
+// Prometheus registry. If the registry is also a prometheus.Gatherer it is used by Metrics.
+func WithRegistry(reg prometheus.Registerer) Option {
+	return func(k *KerberosProxy) error {
+		if reg == nil {
+			return fmt.Errorf("registry cannot be nil")
+		}
+		k.registry = reg
+
+		return nil
+	}
+}
+
+// WithLogger sets the logger used for diagnostic output. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(k *KerberosProxy) error {
+		if logger == nil {
+			return fmt.Errorf("logger cannot be nil")
+		}
+		k.logger = logger
+
+		return nil
+	}
+}
+
+// WithTracerProvider sets the trace provider used for spans. By default the global trace provider
+// is used.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(k *KerberosProxy) error {
+		if tp == nil {
+			return fmt.Errorf("tracer provider cannot be nil")
+		}
+		k.tracing = tp
+
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout for each exchange with a KDC
+func WithTimeout(timeout time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be greater than zero")
+		}
+		k.timeout = timeout
+
+		return nil
+	}
+}
+
+// WithUDPTimeout sets the timeout for each exchange with a KDC over UDP, which is usually shorter as
+// lost datagrams are not retransmitted. The default of 0 uses the timeout set by WithTimeout.
+func WithUDPTimeout(timeout time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if timeout < 0 {
+			return fmt.Errorf("udp timeout cannot be negative")
+		}
+		k.udpTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithTCPTimeout sets the timeout for each exchange with a KDC over TCP. The default of 0 uses the
+// timeout set by WithTimeout.
+func WithTCPTimeout(timeout time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if timeout < 0 {
+			return fmt.Errorf("tcp timeout cannot be negative")
+		}
+		k.tcpTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithMaxKDCs limits the number of different KDC's tried for each request, which bounds the time
+// taken to fail in realms with many unreachable KDC's. A KDC tried over UDP may also be tried over
+// TCP. The default of 0 tries every KDC.
+func WithMaxKDCs(n int) Option {
+	return func(k *KerberosProxy) error {
+		if n < 0 {
+			return fmt.Errorf("maximum kdcs cannot be negative")
+		}
+		k.maxKDCs = n
+
+		return nil
+	}
+}
+
+// WithMaxAttempts limits the total number of exchanges with KDC's, over all protocols, for each
+// request. The default of 0 is unlimited.
+func WithMaxAttempts(n int) Option {
+	return func(k *KerberosProxy) error {
+		if n < 0 {
+			return fmt.Errorf("maximum attempts cannot be negative")
+		}
+		k.maxAttempts = n
+
+		return nil
+	}
+}
+
+// WithRealmConfig sets overrides of the proxy wide settings for a single realm
+func WithRealmConfig(realm string, config RealmConfig) Option {
+	return func(k *KerberosProxy) error {
+		if k.realmConfigs == nil {
+			k.realmConfigs = make(map[string]RealmConfig)
+		}
+		k.realmConfigs[realm] = config
+
+		return nil
+	}
+}
+
+// WithAllowedRealms restricts forwarding to only the provided realms
+func WithAllowedRealms(realms ...string) Option {
+	return func(k *KerberosProxy) error {
+		k.allowedRealms = append(k.allowedRealms, realms...)
+
+		return nil
+	}
+}
+
+// WithDeniedRealms prevents forwarding for the provided realms
+func WithDeniedRealms(realms ...string) Option {
+	return func(k *KerberosProxy) error {
+		k.deniedRealms = append(k.deniedRealms, realms...)
+
+		return nil
+	}
+}
+
+// WithUDPPreferenceLimit sets the message size in bytes above which TCP is tried before UDP to contact the
+// KDC, overriding the "udp_preference_limit" from the krb5 configuration. As with MIT Kerberos a limit of 1
+// only uses TCP and 0 always keeps the configured protocol order. When TCP is not enabled by WithProtocols
+// or the realm settings UDP is still used with a limit of 1.
+func WithUDPPreferenceLimit(n int) Option {
+	return func(k *KerberosProxy) error {
+		if n < 0 {
+			return fmt.Errorf("udp preference limit cannot be negative")
+		}
+		k.udpLimit = n
+
+		return nil
+	}
+}
+
+// WithStatusCodes changes the HTTP status code returned by the KDC Proxy handler for classes of
+// failure, such as FailureUpstreamUnavailable, which must be between 400 and 599. Classes that are
+// not given keep their default status code. Metrics count responses by the status code sent, and a
+// Retry-After header is only sent with a 429 or 503.
+func WithStatusCodes(codes map[string]int) Option {
+	return func(k *KerberosProxy) error {
+		for failure, code := range codes {
+			if _, ok := defaultStatusCodes[failure]; !ok {
+				return fmt.Errorf("unknown failure class: %s", failure)
+			}
+			if code < 400 || code > 599 {
+				return fmt.Errorf("invalid status code for %s: %d", failure, code)
+			}
+			if k.statusCodes == nil {
+				k.statusCodes = make(map[string]int)
+			}
+			k.statusCodes[failure] = code
+		}
+
+		return nil
+	}
+}
+
+// WithTransport sets the Transport used to exchange messages with KDC's
+func WithTransport(t Transport) Option {
+	return func(k *KerberosProxy) error {
+		if t == nil {
+			return fmt.Errorf("transport cannot be nil")
+		}
+		k.transport = t
+
+		return nil
+	}
+}
+
+// WithInterceptors adds interceptors that are run, in order, around the forwarding of each request
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(k *KerberosProxy) error {
+		k.interceptors = append(k.interceptors, interceptors...)
+
+		return nil
+	}
+}
+
+// WithCapture writes each request forwarded to a KDC and the response, as raw DER plus a JSON file of
+// metadata, to dir for offline troubleshooting. The directory is created if it does not exist.
+// Captures contain Kerberos tickets and should be treated as sensitive.
+func WithCapture(dir string) Option {
+	return func(k *KerberosProxy) error {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("could not create capture directory: %w", err)
+		}
+		c := &capture{dir: dir}
+		k.interceptors = append(k.interceptors, c.interceptor(k))
+
+		return nil
+	}
+}
+
+// WithMessageDump logs the Kerberos request and response of each exchange at debug level, encoded as
+// DumpFormatHex or DumpFormatBase64 and truncated to max bytes, for debugging interoperability
+// problems. Like captures, dumps contain Kerberos tickets and should be treated as sensitive.
+func WithMessageDump(format string, max int) Option {
+	return func(k *KerberosProxy) error {
+		if format != DumpFormatHex && format != DumpFormatBase64 {
+			return fmt.Errorf("message dump format must be %q or %q", DumpFormatHex, DumpFormatBase64)
+		}
+		if max <= 0 {
+			max = DefaultDumpMaxBytes
+		}
+		d := &dump{format: format, max: max}
+		k.interceptors = append(k.interceptors, d.interceptor(k))
+
+		return nil
+	}
+}
+
+// WithDryRun decodes and validates requests as normal but returns a synthetic KRB-ERROR of
+// KDC_ERR_SVC_UNAVAILABLE instead of contacting a KDC. This allows client configuration and any
+// load balancers to be tested before the proxy has network access to the KDC's.
+func WithDryRun() Option {
+	return func(k *KerberosProxy) error {
+		k.dryRun = true
+
+		return nil
+	}
+}
+
+// WithFaultInjection injects artificial latency, dropped requests and truncated replies into a
+// percentage of exchanges with KDC's, so degraded KDC's and the retry behaviour of clients can be
+// rehearsed. This deliberately causes requests to fail so must not be used in production.
+func WithFaultInjection(faults FaultInjection) Option {
+	return func(k *KerberosProxy) error {
+		if err := faults.validate(); err != nil {
+			return err
+		}
+		k.faults = &faults
+
+		return nil
+	}
+}
+
+// WithDiagnosticHeaders adds X-KdcProxy-Realm, X-KdcProxy-Kdc, X-KdcProxy-Protocol and
+// X-KdcProxy-Attempts headers to responses so clients can see how a request was handled. This
+// exposes internal addresses so should only be enabled when troubleshooting.
+func WithDiagnosticHeaders() Option {
+	return func(k *KerberosProxy) error {
+		k.diagnostics = true
+
+		return nil
+	}
+}
+
+// WithTimeoutHeader bounds forwarding of each request by the timeout in seconds, or as a duration
+// such as "1500ms", passed by clients or load balancers in header, such as DefaultTimeoutHeader.
+// The timeout is clamped to max so a client cannot hold resources for longer. Requests without the
+// header are unaffected.
+func WithTimeoutHeader(header string, max time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if header == "" {
+			return fmt.Errorf("timeout header cannot be empty")
+		}
+		if max <= 0 {
+			return fmt.Errorf("maximum timeout must be positive")
+		}
+		k.deadline = &deadlineHint{header: header, max: max}
+
+		return nil
+	}
+}
+
+// WithDedupe serves duplicate requests, identified by a hash of the realm and Kerberos message, with
+// the result of the original request while it is in-flight and for window after it completes, so
+// client retransmissions do not each reach a KDC
+func WithDedupe(window time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if window < 0 {
+			return fmt.Errorf("dedupe window cannot be negative")
+		}
+		k.interceptors = append(k.interceptors, newDedupe(window).interceptor(k))
+
+		return nil
+	}
+}
+
+// WithHoldDown tries a KDC after all others for d after an exchange with it fails, rather than
+// waiting for it to time out on every request while it is down
+func WithHoldDown(d time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if d < 0 {
+			return fmt.Errorf("hold down cannot be negative")
+		}
+		k.holdDown = d
+
+		return nil
+	}
+}
+
+// WithHealthShare publishes changes in KDC health to other proxy instances via s, so that a KDC found
+// to be down by one instance is avoided by all of them. If no hold down is set DefaultHoldDown is used.
+func WithHealthShare(s HealthShare) Option {
+	return func(k *KerberosProxy) error {
+		if s == nil {
+			return fmt.Errorf("health share cannot be nil")
+		}
+		k.healthShare = s
+
+		return nil
+	}
+}
+
+// WithStrategy sets the default strategy, from StrategyOrdered, StrategyRandom and StrategyRoundRobin,
+// used to order the KDC's tried for a realm
+func WithStrategy(strategy string) Option {
+	return func(k *KerberosProxy) error {
+		if err := validateStrategy(strategy); err != nil {
+			return err
+		}
+		k.strategy = strategy
+
+		return nil
+	}
+}
+
+// WithSite sets the Active Directory site whose domain controllers are tried first, before the other
+// KDC's of a realm, when KDC's are looked up via DNS
+func WithSite(site string) Option {
+	return func(k *KerberosProxy) error {
+		k.site = site
+
+		return nil
+	}
+}
+
+// WithAffinity sends requests from a client for a realm to the KDC that answered its last AS
+// exchange first, for window after that exchange, so follow-up TGS requests reach a domain
+// controller that does not depend on replication. Clients are identified by their certificate, or
+// otherwise their IP address.
+func WithAffinity(window time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if window < 0 {
+			return fmt.Errorf("affinity window cannot be negative")
+		}
+		k.affinityTTL = window
+
+		return nil
+	}
+}
+
+// WithHedging sends a request to the next KDC as well when the KDC it was sent to has not answered
+// within delay, using whichever response arrives first. The request is also sent to the next KDC
+// straight away if an exchange fails. A delay of 0 disables hedging.
+func WithHedging(delay time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if delay < 0 {
+			return fmt.Errorf("hedge delay cannot be negative")
+		}
+		k.hedgeDelay = delay
+
+		return nil
+	}
+}
+
+// WithRecentErrors keeps the last n errors forwarding requests, rather than DefaultRecentErrors, for
+// RecentErrors. A value of 0 disables keeping recent errors.
+func WithRecentErrors(n int) Option {
+	return func(k *KerberosProxy) error {
+		if n < 0 {
+			return fmt.Errorf("number of recent errors cannot be negative")
+		}
+		k.recentSize = n
+
+		return nil
+	}
+}
+
+// WithLatencyObjectives exports quantiles of the time taken to forward requests along with counts of
+// the requests that failed or were slower than the threshold of each objective, and the error budget
+// those requests used, so alerts can be raised on the burn rate of each objective
+func WithLatencyObjectives(objectives ...LatencyObjective) Option {
+	return func(k *KerberosProxy) error {
+		for _, o := range objectives {
+			if err := o.validate(); err != nil {
+				return fmt.Errorf("invalid latency objective %s: %w", o, err)
+			}
+		}
+		k.objectives = append(k.objectives, objectives...)
+
+		return nil
+	}
+}
+
+// WithAdaptiveOrdering keeps a moving average of failed exchanges with each KDC and tries KDC's that
+// fail intermittently after the others, while still occasionally trying them first so they are
+// promoted again once they recover
+func WithAdaptiveOrdering() Option {
+	return func(k *KerberosProxy) error {
+		k.adaptiveOrder = true
+
+		return nil
+	}
+}
+
+// WithDCPing sends a CLDAP ping, as used by the Windows DC locator, to the KDC's of a realm so that
+// domain controllers confirmed to be running a KDC for the realm, and in the site set by WithSite,
+// are tried first. The ping waits up to timeout, which defaults to DefaultDCPingTimeout when 0, and
+// results are cached for DefaultDCPingTTL.
+func WithDCPing(timeout time.Duration) Option {
+	return func(k *KerberosProxy) error {
+		if timeout < 0 {
+			return fmt.Errorf("dc ping timeout cannot be negative")
+		}
+		if timeout == 0 {
+			timeout = DefaultDCPingTimeout
+		}
+		k.dcPingTimeout = timeout
+
+		return nil
+	}
+}
+
+// WithProtocols sets the protocols, from "udp" and "tcp", used to contact KDC's in the order they are tried
+func WithProtocols(protocols ...string) Option {
+	return func(k *KerberosProxy) error {
+		if len(protocols) == 0 {
+			return fmt.Errorf("at least one protocol is required")
+		}
+		if err := validateProtocols(protocols); err != nil {
+			return err
+		}
+		k.protocols = protocols
+
+		return nil
+	}
+}
@@ -1,29 +1,49 @@
 package proxy
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/jcmturner/gofork/encoding/asn1"
 	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
 	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/time/rate"
 )
 
 const (
 	maxLength = 128 * 1024
-	timeout   = 2 * time.Second
 	protoUdp  = "udp"
 	protoTcp  = "tcp"
+
+	// hardUDPLimit is the largest udp_preference_limit used, as in MIT Kerberos
+	hardUDPLimit = 32700
 )
 
+// DefaultTimeout is the default timeout for each exchange with a KDC
+const DefaultTimeout = 2 * time.Second
+
 // DefaultRateLimit is the default number of requests per second to allow
 const DefaultRateLimit = 10
 
+// DefaultMaxInFlight is the default number of requests that may be processed concurrently
+const DefaultMaxInFlight = 100
+
 // KdcProxyMsg represents a KDC_PROXY_MESSAGE as per https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-kkdcp/5778aff5-b182-4b97-a970-29c7f911eef2
 type KdcProxyMsg struct {
 	KerbMessage   []byte `asn1:"tag:0,explicit"`
@@ -33,330 +53,791 @@ type KdcProxyMsg struct {
 
 // KerberosProxy is a KDC Proxy
 type KerberosProxy struct {
-	krb5Config *krb5config.Config
-	limiter    *rate.Limiter
+	krb5Config  atomic.Pointer[krb5config.Config]
+	staticKDCs  map[string][]string
+	limiter     Limiter
+	limit       int
+	burst       int
+	maxInFlight int
+	timeout     time.Duration
+	udpTimeout  time.Duration
+	tcpTimeout  time.Duration
+	hedgeDelay  time.Duration
+	maxKDCs     int
+	maxAttempts int
+	udpLimit    int
+	protocols   []string
+	strategy    string
+	site        string
+	lookupSRV   srvLookup
+	roundRobin  sync.Map
+	dryRun      bool
+	diagnostics bool
+	deadline    *deadlineHint
+	inFlight    chan struct{}
+	queue       *fairQueue
+	registry    prometheus.Registerer
+	metrics     *metrics
+	logger      *slog.Logger
+	tracing     trace.TracerProvider
+	stats       *stats
+	hooks       hooks
+	transport   Transport
+	forwarder   ForwardFunc
+	health      *health
+	dcPing      *dcPinger
+	adaptive    *adaptive
+	affinity    *affinity
+	slo         *slo
+	recent      *recentErrors
+	realms      atomic.Pointer[map[string]*realmPolicy]
+	realmsMu    sync.Mutex
+	filter      atomic.Pointer[realmFilter]
+	access      atomic.Pointer[accessPolicy]
+	authorizer  Authorizer
+	statusCodes map[string]int
+
+	// only used during construction
+	interceptors  []Interceptor
+	realmConfigs  map[string]RealmConfig
+	allowedRealms []string
+	deniedRealms  []string
+	accessDefault AccessAction
+	accessRules   []AccessRule
+	holdDown      time.Duration
+	healthShare   HealthShare
+	dcPingTimeout time.Duration
+	adaptiveOrder bool
+	affinityTTL   time.Duration
+	objectives    []LatencyObjective
+	recentSize    int
+	faults        *FaultInjection
+
+	queueConcurrency int
+	queueDepth       int
+
+	inFlightCount atomic.Int64
+}
+
+// NewKdcProxy creates a KerberosProxy with the provided options applied. Without any options
+// KDC's are looked up via DNS and the default rate limit applies.
+func NewKdcProxy(opts ...Option) (*KerberosProxy, error) {
+	k := &KerberosProxy{
+		limit:       DefaultRateLimit,
+		maxInFlight: DefaultMaxInFlight,
+		timeout:     DefaultTimeout,
+		udpLimit:    -1,
+		protocols:   []string{protoUdp, protoTcp},
+		strategy:    StrategyOrdered,
+		registry:    prometheus.DefaultRegisterer,
+		logger:      discardLogger,
+		stats:       newStats(),
+		transport:   &NetTransport{},
+		lookupSRV:   net.DefaultResolver.LookupSRV,
+		recentSize:  DefaultRecentErrors,
+	}
+
+	// with no config rely on DNS to find KDC
+	k.storeKrb5Config(dnsConfig())
+
+	for _, o := range opts {
+		if err := o(k); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := k.SetRealmConfigs(k.realmConfigs); err != nil {
+		return nil, err
+	}
+	k.SetRealmFilter(k.allowedRealms, k.deniedRealms)
+	if err := k.SetAccessRules(k.accessDefault, k.accessRules); err != nil {
+		return nil, err
+	}
+
+	k.forwarder = k.chain()
+	metrics, err := newMetrics(k.registry)
+	if err != nil {
+		return nil, err
+	}
+	k.metrics = metrics
+	if k.healthShare != nil && k.holdDown == 0 {
+		k.holdDown = DefaultHoldDown
+	}
+	if k.holdDown > 0 {
+		k.health = newHealth(k.holdDown, k.healthShare)
+	}
+	if k.affinityTTL > 0 {
+		k.affinity = newAffinity(k.affinityTTL, k.metrics.affinityHits)
+	}
+	if k.adaptiveOrder {
+		k.adaptive = newAdaptive(k.metrics.kdcFailureScore)
+	}
+	if k.recentSize > 0 {
+		k.recent = newRecentErrors(k.recentSize)
+	}
+	if len(k.objectives) > 0 {
+		if k.slo, err = newSLO(k.registry, k.objectives); err != nil {
+			return nil, err
+		}
+	}
+	if k.dcPingTimeout > 0 {
+		k.dcPing = newDCPinger(k.dcPingTimeout, k.metrics.dcPings)
+	}
+	if k.faults != nil {
+		k.transport = newFaultTransport(k.transport, *k.faults, k.metrics.faultsInjected)
+	}
+	if k.limiter == nil {
+		k.limiter = rate.NewLimiter(rate.Limit(k.limit), burstOrLimit(k.burst, k.limit))
+	}
+	if k.maxInFlight > 0 {
+		k.inFlight = make(chan struct{}, k.maxInFlight)
+	}
+	if k.queueConcurrency > 0 {
+		k.queue = newFairQueue(k.queueConcurrency, k.queueDepth, k.metrics.httpReqsQueued)
+	}
+
+	return k, nil
+}
+
+// dnsConfig returns a krb5 configuration that looks up KDC's via DNS
+func dnsConfig() *krb5config.Config {
+	cfg := krb5config.New()
+	cfg.LibDefaults.DNSLookupKDC = true
+
+	return cfg
+}
+
+// LoadConfig loads the provided "krb5.conf" file, along with any files it includes, and atomically
+// replaces the current configuration. An empty path reverts to looking up KDC's via DNS.
+func (k *KerberosProxy) LoadConfig(config string) error {
+	if config == "" {
+		k.storeKrb5Config(dnsConfig())
+		return nil
+	}
+
+	return k.LoadConfigs(config)
+}
+
+// LoadConfigFromReader reads a krb5 configuration from r and atomically replaces the current
+// configuration. Any files included must be given as absolute paths.
+func (k *KerberosProxy) LoadConfigFromReader(r io.Reader) error {
+	cfg, err := ParseConfigFromReader(r)
+	if err != nil {
+		return err
+	}
+	k.storeKrb5Config(cfg)
+
+	return nil
+}
+
+// SetKrb5Config atomically replaces the current krb5 configuration, such as one from ParseConfigs
+func (k *KerberosProxy) SetKrb5Config(cfg *krb5config.Config) {
+	k.storeKrb5Config(cfg)
+}
+
+// Krb5Config returns the current krb5 configuration
+func (k *KerberosProxy) Krb5Config() *krb5config.Config {
+	return k.krb5Config.Load()
+}
+
+// SetLimit changes the number of requests per second to the KDC allowed, with a burst equal to the
+// limit. An error is returned when a custom Limiter was provided using WithRateLimiter.
+func (k *KerberosProxy) SetLimit(limit int) error {
+	return k.SetRateLimit(limit, 0)
+}
+
+// SetRateLimit changes the number of requests per second to the KDC allowed and the burst above
+// that rate, where a burst of 0 is equal to the limit. An error is returned when a custom Limiter
+// was provided using WithRateLimiter.
+func (k *KerberosProxy) SetRateLimit(limit, burst int) error {
+	l, err := k.rateLimiter(limit, burst)
+	if err != nil {
+		return err
+	}
+	l.SetLimit(rate.Limit(limit))
+	l.SetBurst(burstOrLimit(burst, limit))
+
+	return nil
+}
+
+// rateLimiter validates a change of the proxy wide rate limit and returns the limiter to change
+func (k *KerberosProxy) rateLimiter(limit, burst int) (*rate.Limiter, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("rate limit must be at least 1")
+	}
+	if burst < 0 {
+		return nil, fmt.Errorf("rate limit burst cannot be negative")
+	}
+	l, ok := k.limiter.(*rate.Limiter)
+	if !ok {
+		return nil, fmt.Errorf("rate limit cannot be changed for a custom limiter")
+	}
+
+	return l, nil
+}
+
+// RateLimits are the rate limits applied to requests to the KDC
+type RateLimits struct {
+	// Limit and Burst are the proxy wide limit, which are 0 when a custom Limiter is used
+	Limit int `json:"limit"`
+	Burst int `json:"burst"`
+	// Realms is the limit for each realm that has one, in requests per second
+	Realms map[string]int `json:"realms"`
+}
+
+// RateLimits returns the rate limits currently applied
+func (k *KerberosProxy) RateLimits() RateLimits {
+	limits := RateLimits{Realms: make(map[string]int)}
+	if l, ok := k.limiter.(*rate.Limiter); ok {
+		limits.Limit = int(l.Limit())
+		limits.Burst = l.Burst()
+	}
+	if realms := k.realms.Load(); realms != nil {
+		for realm, p := range *realms {
+			if p.limiter != nil {
+				limits.Realms[realm] = int(p.limiter.Limit())
+			}
+		}
+	}
+
+	return limits
+}
+
+// burstOrLimit returns burst, or limit when burst is 0
+func burstOrLimit(burst, limit int) int {
+	if burst > 0 {
+		return burst
+	}
+
+	return limit
 }
 
 // InitKdcProxy creates a KerberosProxy using the defaults of looking up KDC's via DNS
 func InitKdcProxy() (*KerberosProxy, error) {
-	return initproxy("", DefaultRateLimit)
+	return NewKdcProxy()
 }
 
 // InitKdcProxyWithConfig creates a KerberosProxy based on the configured "krb5.conf" file
 func InitKdcProxyWithConfig(config string) (*KerberosProxy, error) {
-	return initproxy(config, DefaultRateLimit)
+	return NewKdcProxy(WithConfig(config))
 }
 
 // InitKdcProxyWithLimit creates a KerberosProxy using the defaults of looking up KDC's via DNS
 func InitKdcProxyWithLimit(limit int) (*KerberosProxy, error) {
-	return initproxy("", limit)
+	return NewKdcProxy(WithLimit(limit))
 }
 
 // InitKdcProxyWithConfigAndLimit creates a KerberosProxy based on the configured "krb5.conf" file
 func InitKdcProxyWithConfigAndLimit(config string, limit int) (*KerberosProxy, error) {
-	return initproxy(config, limit)
-}
-
-func initproxy(config string, limit int) (*KerberosProxy, error) {
-	// with no config rely on DNS to find KDC
-	if config == "" {
-		cfg := krb5config.New()
-		cfg.LibDefaults.DNSLookupKDC = true
-
-		return &KerberosProxy{cfg, rate.NewLimiter(rate.Limit(limit), limit)}, nil
-	}
-
-	// load config from file
-	cfg, err := krb5config.Load(config)
-	if err != nil {
-		return nil, err
-	}
-
-	return &KerberosProxy{cfg, rate.NewLimiter(rate.Limit(limit), limit)}, nil
+	return NewKdcProxy(WithConfig(config), WithLimit(limit))
 }
 
 // Handler implements a KDC Proxy endpoint over HTTP
 func (k *KerberosProxy) Handler(w http.ResponseWriter, r *http.Request) {
+	k.serveHTTP(w, r, &handler{k: k})
+}
+
+// serveHTTP handles a KDC Proxy request applying any restrictions from h
+func (k *KerberosProxy) serveHTTP(w http.ResponseWriter, r *http.Request, h *handler) {
 	// metrics
-	httpReqs.Inc()
+	k.metrics.httpReqs.Inc()
 	start := time.Now()
 	defer func() {
 		duration := time.Since(start)
-		httpRespTimeHistogram.Observe(duration.Seconds())
+		k.metrics.httpRespTimeHistogram.Observe(duration.Seconds())
 	}()
 
+	// tracing
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := k.tracer().Start(ctx, "KdcProxy", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	if id, ok := RequestIDFromContext(ctx); ok {
+		span.SetAttributes(attribute.String("request.id", id))
+	}
+
 	// ensure content type is always "application/kerberos"
 	w.Header().Set("Content-Type", "application/kerberos")
 
 	// we only handle POST's
 	if r.Method != http.MethodPost {
-		httpRespMethodNotAllowed.Inc()
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		k.fail(ctx, w, FailureMethodNotAllowed, "Method not allowed", 0)
+		return
+	}
+
+	// check any authentication required for this handler
+	if h.auth != nil && !h.auth(r) {
+		k.fail(ctx, w, FailureUnauthorized, "Unauthorized", 0)
 		return
 	}
 
 	// check content length is valid
 	length := r.ContentLength
 	if length == -1 {
-		httpRespLengthRequired.Inc()
-		http.Error(w, "Content length required", http.StatusLengthRequired)
+		k.fail(ctx, w, FailureLengthRequired, "Content length required", 0)
 		return
 	}
 
 	if length > maxLength {
-		httpRespRequestEntityTooLarge.Inc()
-		http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+		k.fail(ctx, w, FailureTooLarge, "Request entity too large", 0)
 		return
 	}
 
-	// read data from request body
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		httpRespInternalServerError.Inc()
-		http.Error(w, "Error reading from stream", http.StatusInternalServerError)
+	// bound the number of requests buffered in memory at once
+	if k.inFlight != nil {
+		select {
+		case k.inFlight <- struct{}{}:
+			defer func() { <-k.inFlight }()
+		default:
+			k.fail(ctx, w, FailureOverloaded, "Service unavailable", DefaultRetryAfter)
+			return
+		}
+	}
+	k.metrics.httpReqsInFlight.Inc()
+	k.inFlightCount.Add(1)
+	defer func() {
+		k.metrics.httpReqsInFlight.Dec()
+		k.inFlightCount.Add(-1)
+	}()
+
+	// read data from request body into a buffer of the known size, never reading beyond the
+	// content length even if the body is longer
+	data := make([]byte, length)
+	if _, err := io.ReadFull(http.MaxBytesReader(w, r.Body, length), data); err != nil {
+		k.fail(ctx, w, FailureMalformed, "Error reading from stream", 0)
 		return
 	}
 	defer r.Body.Close()
 
 	// check rate limit to avoid DDoS of KDC
-	if !k.limiter.Allow() {
-		httpRespTooManyRequests.Inc()
-		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	if now := time.Now(); !k.limiter.AllowN(now, 1) {
+		k.fail(ctx, w, FailureRateLimited, "Rate limit exceeded", limiterDelay(k.limiter, now))
 		return
 	}
 
 	// decode the message
+	_, decodeSpan := k.tracer().Start(ctx, "decode")
 	msg, err := k.decode(data)
 	if err != nil {
-		httpRespBadRequest.Inc()
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		decodeSpan.RecordError(err)
+		decodeSpan.SetStatus(codes.Error, "invalid request")
+	}
+	decodeSpan.End()
+	if err != nil {
+		k.metrics.kerbMessages.WithLabelValues(string(MessageTypeUnknown)).Inc()
+		k.fail(ctx, w, FailureMalformed, "Invalid request", 0)
 		return
 	}
+	k.metrics.kerbMessages.WithLabelValues(string(requestType(msg.KerbMessage[4:]))).Inc()
+	msg.TargetDomain = k.resolveRealm(msg.TargetDomain)
+
+	span.SetAttributes(attribute.String("kerberos.realm", msg.TargetDomain))
+	k.hooks.runRequestDecoded(ctx, msg)
 
 	// fail if no realm is specified
 	if msg.TargetDomain == "" {
-		httpRespBadRequest.Inc()
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		k.fail(ctx, w, FailureMalformed, "Invalid request", 0)
+		return
+	}
+
+	// only forward for permitted realms
+	if !k.filter.Load().allow(msg.TargetDomain) || (h.filter != nil && !h.filter.allow(msg.TargetDomain)) {
+		k.metrics.realmRejections.Inc()
+		k.log(ctx).InfoContext(ctx, "realm not allowed", "realm", msg.TargetDomain)
+		k.fail(ctx, w, FailureRealmDenied, "Forbidden", 0)
+		return
+	}
+
+	// only forward what the access rules allow for the client
+	client, ok := ClientFromContext(ctx)
+	if !ok {
+		client = requestClient(r)
+		ctx = ContextWithClient(ctx, client)
+	}
+	if err := k.checkAccess(ctx, msg, client); err != nil {
+		k.fail(ctx, w, FailureAccessDenied, "Forbidden", 0)
+		return
+	}
+	if err := k.authorize(ctx, msg, client); errors.Is(err, ErrAccessDenied) {
+		k.fail(ctx, w, FailureAccessDenied, "Forbidden", 0)
+		return
+	} else if err != nil {
+		k.fail(ctx, w, FailureAuthzUnavailable, "Service unavailable", DefaultRetryAfter)
 		return
 	}
 
-	// forward to kdc(s)
-	resp, err := k.forward(msg)
+	// apply any realm specific limits
+	policy := k.policy(msg.TargetDomain)
+	if policy.maxMessageSize > 0 && len(msg.KerbMessage)-4 > policy.maxMessageSize {
+		k.fail(ctx, w, FailureTooLarge, "Request entity too large", 0)
+		return
+	}
+	if now := time.Now(); policy.limiter != nil && !policy.limiter.AllowN(now, 1) {
+		k.fail(ctx, w, FailureRateLimited, "Rate limit exceeded", limiterDelay(policy.limiter, now))
+		return
+	}
+
+	// forward to kdc(s), giving up when the client would
+	ctx, cancel := k.deadline.context(ctx, r)
+	defer cancel()
+
+	// wait for a turn to forward when busy, with each realm served in turn
+	if err := k.queue.acquire(ctx, msg.TargetDomain); err != nil {
+		k.log(ctx).DebugContext(ctx, "request not queued", "realm", msg.TargetDomain, "error", err)
+		k.fail(ctx, w, FailureOverloaded, "Service unavailable", DefaultRetryAfter)
+		return
+	}
+	diag := diagnosticsFromContext(ctx)
+	if diag == nil && k.diagnostics {
+		diag = &diagnostics{}
+		ctx = context.WithValue(ctx, diagnosticsKey, diag)
+	}
+	resp, err := k.forwarder(ctx, msg)
+	k.queue.release()
+	if k.diagnostics {
+		diag.setHeaders(w.Header(), msg.TargetDomain)
+	}
+	if errors.Is(err, ErrRealmNotAllowed) {
+		k.fail(ctx, w, FailureRealmDenied, "Forbidden", 0)
+		return
+	}
 	if err != nil {
-		httpRespServiceUnavailable.Inc()
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		k.log(ctx).WarnContext(ctx, "unable to forward request", "realm", msg.TargetDomain, "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "service unavailable")
+		k.fail(ctx, w, forwardFailure(err), "Service unavailable", k.health.coolDown(time.Now()))
 		return
 	}
 
 	// encode response
 	reply, err := k.encode(resp)
 	if err != nil {
-		httpRespInternalServerError.Inc()
-		http.Error(w, "encoding error", http.StatusInternalServerError)
+		k.fail(ctx, w, FailureInternal, "encoding error", 0)
 		return
 	}
 
 	// metrics
-	httpRespOK.Inc()
+	k.metrics.httpRespOK.Inc()
 
-	// send back to client
-	w.Write(reply)
+	// send back to client in a single write with a known length
+	w.Header().Set("Content-Length", strconv.Itoa(len(reply)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(reply); err != nil {
+		k.log(ctx).DebugContext(ctx, "unable to write response", "error", err)
+	}
 }
 
-func (k *KerberosProxy) forward(msg *KdcProxyMsg) ([]byte, error) {
-	// use both udp and tcp
-	protocols := []string{protoUdp, protoTcp}
-	// if message is too large only use TCP
-	if len(msg.KerbMessage)-4 > k.krb5Config.LibDefaults.UDPPreferenceLimit {
-		protocols = []string{protoTcp}
+// Forward sends the Kerberos message to a KDC for its target realm and returns the response (including
+// the leading 4-byte length). The realm allow and deny lists, access rules and authorizer (using the
+// client from ContextWithClient) and per-realm settings are applied, however rate limits are not.
+// Forwarding is abandoned if ctx is cancelled or its deadline is exceeded. A target given as a DNS
+// domain is mapped to a realm using the [domain_realm] section of the krb5 configuration.
+func (k *KerberosProxy) Forward(ctx context.Context, msg *KdcProxyMsg) ([]byte, error) {
+	if msg == nil || len(msg.KerbMessage) < 4 || msg.TargetDomain == "" {
+		return nil, ErrMalformedMessage
 	}
 
-	// try protocol options
+	// resolve the realm without modifying the caller's message
+	if realm := k.resolveRealm(msg.TargetDomain); realm != msg.TargetDomain {
+		m := *msg
+		m.TargetDomain = realm
+		msg = &m
+	}
+
+	if !k.filter.Load().allow(msg.TargetDomain) {
+		return nil, fmt.Errorf("%w: %s", ErrRealmNotAllowed, msg.TargetDomain)
+	}
+
+	client, _ := ClientFromContext(ctx)
+	if err := k.checkAccess(ctx, msg, client); err != nil {
+		return nil, err
+	}
+	if err := k.authorize(ctx, msg, client); err != nil {
+		return nil, err
+	}
+
+	return k.forwarder(ctx, msg)
+}
+
+func (k *KerberosProxy) forward(ctx context.Context, msg *KdcProxyMsg, policy *realmPolicy) (resp []byte, err error) {
+	// use a consistent configuration for the whole request
+	cfg := k.krb5Config.Load()
+
+	// number the kdc exchanges for the request in logs
+	ctx = contextWithAttempts(ctx)
+	diagnosticsFromContext(ctx).forwarding(msg.TargetDomain, requestType(msg.KerbMessage[4:]))
+
+	// metrics are only labelled with the realm once it is known to have KDC's
+	realm := unknownRealm
+	label := unknownRealm
+	start := time.Now()
+	defer func() {
+		k.metrics.kerbForwardTimeHistogram.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		k.slo.observe(label, time.Since(start), err)
+		if err != nil {
+			k.metrics.kerbErrors.WithLabelValues(label).Inc()
+		}
+	}()
+
+	// large messages try TCP first
+	udpLimit := cfg.LibDefaults.UDPPreferenceLimit
+	if k.udpLimit >= 0 {
+		udpLimit = k.udpLimit
+	}
+	protocols := udpPreference(policy.protocols, len(msg.KerbMessage)-4, udpLimit)
+
+	client, _ := ClientFromContext(ctx)
+	asReq := k.affinity != nil && requestType(msg.KerbMessage[4:]) == MessageTypeASReq
+
+	// try protocol options, within any limits on the kdcs tried and total attempts
+	var lastErr error
+	var discoveryErrs []error
+	attempts := 0
+	tried := make(map[string]bool)
 	for _, proto := range protocols {
 		// get kdcs
-		c, kdcs, err := k.krb5Config.GetKDCs(msg.TargetDomain, proto == protoTcp)
-		if err != nil || c < 1 {
+		groups, err := k.kdcs(ctx, cfg, msg.TargetDomain, proto, policy.site)
+		if err != nil {
+			k.metrics.kdcDiscoveryFailures.WithLabelValues(proto).Inc()
+			k.log(ctx).DebugContext(ctx, "kdc discovery failed", "realm", msg.TargetDomain, "proto", proto, "error", err)
+			discoveryErrs = append(discoveryErrs, fmt.Errorf("%s: %w", proto, err))
+			k.recentError(ctx, msg.TargetDomain, "", proto, errorTypeDiscovery, err)
 			continue
 		}
-
-		// try each kdc
-		for _, kdc := range kdcs {
-			// metrics
-			if proto == protoTcp {
-				kerbReqTcp.Inc()
-			} else {
-				kerbReqUdp.Inc()
+		if realm == unknownRealm {
+			realm = msg.TargetDomain
+			label = k.realmLabel(realm)
+			k.stats.request(realm)
+
+			// each request starts from the next kdc
+			if policy.strategy == StrategyRoundRobin {
+				policy.offset = k.counter(realm).Add(1) - 1
 			}
+		}
 
-			// connect to kdc
-			conn, err := net.Dial(proto, kdc)
-			if err != nil {
-				continue
-			}
-			conn.SetDeadline(time.Now().Add(timeout))
-
-			req := msg.KerbMessage
-			// for udp trim off length
-			if proto == protoUdp {
-				req = msg.KerbMessage[4:]
+		// try each kdc
+		var kdcs []string
+		for _, g := range groups {
+			kdcs = append(kdcs, policy.order(g)...)
+		}
+		kdcs = k.dcPing.order(ctx, msg.TargetDomain, policy.site, kdcs)
+		kdcs = k.affinity.order(client, realm, k.adaptive.order(kdcs, proto), time.Now())
+
+		// choose the kdcs to try, within any limits on the kdcs tried and total attempts
+		var candidates []string
+		limited := false
+		for _, kdc := range k.health.order(kdcs, proto) {
+			if policy.maxAttempts > 0 && attempts >= policy.maxAttempts {
+				limited = true
+				break
 			}
-
-			// send message
-			n, err := conn.Write(req)
-			if err != nil {
-				conn.Close()
+			if policy.maxKDCs > 0 && !tried[kdc] && len(tried) >= policy.maxKDCs {
 				continue
 			}
+			attempts++
+			tried[kdc] = true
+			candidates = append(candidates, kdc)
+		}
 
-			// check that all the data was sent
-			if n != len(req) {
-				conn.Close()
-				continue
+		if len(candidates) > 0 {
+			resp, kdc, err := k.tryKDCs(ctx, realm, proto, candidates, msg.KerbMessage, policy.timeoutFor(proto))
+			if err == nil {
+				// follow-up requests from the client go to the same kdc
+				if asReq {
+					k.affinity.record(client, realm, kdc, time.Now())
+				}
+
+				// metrics
+				if proto == protoTcp {
+					k.metrics.kerbResTcp.WithLabelValues(label).Inc()
+				} else {
+					k.metrics.kerbResUdp.WithLabelValues(label).Inc()
+				}
+
+				return resp, nil
 			}
 
-			// get Kerberos response
-			resp, err := getresponse(conn)
-			if err != nil {
-				// for an error try next kdc
-				continue
+			// give up once the caller has
+			if err == ctx.Err() {
+				return nil, err
 			}
+			lastErr = err
+		}
 
-			return resp, nil
+		if limited {
+			k.log(ctx).DebugContext(ctx, "maximum attempts reached", "realm", realm, "attempts", attempts)
+			break
 		}
 	}
 
-	return nil, fmt.Errorf("no kdcs found for realm %s", msg.TargetDomain)
-}
-
-func (k *KerberosProxy) decode(data []byte) (*KdcProxyMsg, error) {
-	var m KdcProxyMsg
-
-	// unamrshal KDC-PROXY-MESSAGE
-	rest, err := asn1.Unmarshal(data, &m)
-	if err != nil {
-		return nil, err
+	if lastErr == nil {
+		return nil, fmt.Errorf("%w for realm %s: %w", ErrNoKDCFound, msg.TargetDomain, errors.Join(discoveryErrs...))
 	}
 
-	// make sure no trailing data exists
-	if len(rest) > 0 {
-		return nil, fmt.Errorf("trailing data in request")
+	if classifyError(lastErr) == errorTypeTimeout {
+		return nil, fmt.Errorf("%w for realm %s: %w", ErrUpstreamTimeout, msg.TargetDomain, lastErr)
 	}
 
-	// is it a AS_REQ
-	asReq := messages.ASReq{}
-	if err := asReq.Unmarshal(m.KerbMessage[4:]); err == nil {
-		return &KdcProxyMsg{
-			KerbMessage:  m.KerbMessage,
-			TargetDomain: asReq.ReqBody.Realm,
-		}, nil
+	return nil, fmt.Errorf("%w for realm %s: %w", ErrUpstreamUnavailable, msg.TargetDomain, lastErr)
+}
+
+// udpPreference returns the order to try protocols for a message of size bytes following MIT Kerberos
+// handling of udp_preference_limit. A limit of 1 only uses TCP, unless TCP is not enabled when UDP is
+// used rather than no protocol at all, and 0 keeps the configured order, otherwise messages larger
+// than the limit try TCP before UDP, with UDP still tried if TCP fails.
+func udpPreference(protocols []string, size, limit int) []string {
+	switch {
+	case limit == 0:
+		return protocols
+	case limit == 1:
+		var tcp []string
+		for _, p := range protocols {
+			if p == protoTcp {
+				tcp = append(tcp, p)
+			}
+		}
+		if len(tcp) == 0 {
+			return protocols
+		}
+		return tcp
+	case limit > hardUDPLimit:
+		limit = hardUDPLimit
 	}
 
-	// TGS_REQ
-	tgsReq := messages.TGSReq{}
-	if err := tgsReq.Unmarshal(m.KerbMessage[4:]); err == nil {
-		return &KdcProxyMsg{
-			KerbMessage:  m.KerbMessage,
-			TargetDomain: tgsReq.ReqBody.Realm,
-		}, nil
+	if size <= limit {
+		return protocols
 	}
 
-	// AP_REQ
-	apReq := messages.APReq{}
-	if err := apReq.Unmarshal(m.KerbMessage[4:]); err == nil {
-		return &KdcProxyMsg{
-			KerbMessage:  m.KerbMessage,
-			TargetDomain: apReq.Ticket.Realm,
-		}, nil
+	ordered := make([]string, 0, len(protocols))
+	for _, p := range protocols {
+		if p == protoTcp {
+			ordered = append(ordered, p)
+		}
+	}
+	for _, p := range protocols {
+		if p != protoTcp {
+			ordered = append(ordered, p)
+		}
 	}
 
-	return nil, fmt.Errorf("message was not valid")
+	return ordered
 }
 
-func getresponse(conn net.Conn) ([]byte, error) {
-	// close connection once done
-	defer conn.Close()
+// exchange sends the request to a single KDC and returns its response
+func (k *KerberosProxy) exchange(ctx context.Context, realm, proto, kdc string, req []byte, timeout time.Duration) (resp []byte, err error) {
+	// tracing
+	_, span := k.tracer().Start(ctx, "exchange", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("kerberos.kdc", kdc),
+		attribute.String("network.transport", proto),
+	))
+	defer span.End()
 
-	// handle udp and tcp responses differently
-	if conn.LocalAddr().Network() == protoUdp {
-		// for udp just read response
-		msg, err := io.ReadAll(conn)
-		if err != nil {
-			return nil, err
-		}
+	// each phase of the exchange is logged with the attempt so slow requests can be traced
+	log := k.log(ctx).With("attempt", nextAttempt(ctx), "kdc", kdc, "proto", proto)
+	ctx = contextWithAttemptLog(ctx, log)
 
-		// metrics
-		kerbResUdp.Inc()
+	// metrics
+	k.metrics.kdcAttempts.WithLabelValues(kdc, proto).Inc()
+	start := time.Now()
+	log.DebugContext(ctx, "sending request to kdc", "size", len(req))
+	k.hooks.runForwardAttempt(ctx, ForwardEvent{Realm: realm, Type: requestType(req[4:]), KDC: kdc, Proto: proto})
+	defer func() {
+		diagnosticsFromContext(ctx).exchange(kdc, proto, err)
 
-		// validate response
-		if !validReply(msg) {
-			return nil, fmt.Errorf("reply message was not valid")
+		// an exchange abandoned because another kdc answered first is not a failure of this kdc
+		if err != nil && errors.Is(context.Cause(ctx), errHedgeLost) {
+			log.DebugContext(ctx, "kdc exchange abandoned", "duration", time.Since(start))
+			return
+		}
+		k.stats.exchange(kdc, proto, time.Since(start), err)
+		k.metrics.kdcDuration.WithLabelValues(kdc, proto).Observe(time.Since(start).Seconds())
+		k.hooks.runForwardComplete(ctx, ForwardEvent{Realm: realm, Type: requestType(req[4:]), KDC: kdc, Proto: proto, Duration: time.Since(start), Err: err})
+		if !errors.Is(err, context.Canceled) {
+			k.health.exchange(kdc, proto, err)
+			k.adaptive.exchange(kdc, proto, err)
 		}
+		if err != nil {
+			k.hooks.runForwardError(ctx, ForwardEvent{Realm: realm, Type: requestType(req[4:]), KDC: kdc, Proto: proto, Duration: time.Since(start), Err: err})
+			log.WarnContext(ctx, "kdc exchange failed", "duration", time.Since(start), "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "exchange failed")
+			k.metrics.kdcFailures.WithLabelValues(kdc, proto).Inc()
+			errorType := classifyError(err)
+			k.recentError(ctx, realm, kdc, proto, errorType, err)
+			if errorType == errorTypeTimeout {
+				k.metrics.kdcTimeouts.WithLabelValues(kdc, proto).Inc()
+			}
+			k.metrics.kdcErrors.WithLabelValues(proto, errorType).Inc()
+			k.metrics.kdcUp.WithLabelValues(kdc, proto).Set(0)
+			return
+		}
+		k.metrics.kdcUp.WithLabelValues(kdc, proto).Set(1)
+		log.DebugContext(ctx, "received response from kdc", "duration", time.Since(start), "size", len(resp))
+	}()
 
-		// return message with length added
-		return append(MarshalKerbLength(len(msg)), msg...), nil
-	}
+	// the exchange must complete within the timeout and before any deadline of the caller
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	// read initial 4 bytes to get length of response
-	buf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return nil, err
-	}
+	return k.transport.Exchange(ctx, proto, kdc, req)
+}
+
+// recentError records a forwarding error for RecentErrors
+func (k *KerberosProxy) recentError(ctx context.Context, realm, kdc, proto, class string, err error) {
+	id, _ := RequestIDFromContext(ctx)
+	k.recent.add(RecentError{Time: time.Now(), RequestID: id, Realm: realm, KDC: kdc, Proto: proto, Class: class, Error: err.Error()})
+}
 
-	// work out length of message
-	length, err := UnmarshalKerbLength(buf[:])
+// decode returns the request with the target realm set from the Kerberos message
+func (k *KerberosProxy) decode(data []byte) (*KdcProxyMsg, error) {
+	m, err := DecodeKdcProxyMessage(data)
 	if err != nil {
 		return nil, err
 	}
 
-	// read rest of message
-	msg := make([]byte, length)
-	if _, err := io.ReadFull(conn, msg); err != nil {
-		return nil, err
+	// only requests may be forwarded
+	if !m.Type.IsRequest() {
+		return nil, fmt.Errorf("%w: %s is not a request", ErrMalformedMessage, m.Type)
 	}
 
-	// metrics
-	kerbResTcp.Inc()
-
-	// return response (including length)
-	return append(buf, msg...), nil
+	return &KdcProxyMsg{
+		KerbMessage:   m.KerbMessage,
+		TargetDomain:  m.Realm,
+		DcLocatorHint: m.DcLocatorHint,
+	}, nil
 }
 
 // Encodes the provided bytes as a KDC-PROXY-MESSAGE
 func (k *KerberosProxy) encode(data []byte) (r []byte, err error) {
-	msg := KdcProxyMsg{KerbMessage: data}
-	enc, err := asn1.Marshal(msg)
-	if err != nil {
-		return nil, err
-	}
-	return enc, nil
+	return EncodeKdcProxyMessage(&KdcProxyMsg{KerbMessage: data})
 }
 
 func validReply(msg []byte) bool {
-	// AS_REP
-	asRep := messages.ASRep{}
-	if err := asRep.Unmarshal(msg); err == nil {
-		return true
-	}
-
-	// TGS_REP
-	tgsRep := messages.TGSRep{}
-	if err := tgsRep.Unmarshal(msg); err == nil {
-		return true
+	tag, ok := applicationTag(msg)
+	if !ok {
+		return false
 	}
 
-	// AP_REP
-	apRep := messages.APRep{}
-	if err := apRep.Unmarshal(msg); err == nil {
-		return true
+	var err error
+	switch tag {
+	case asnAppTag.ASREP:
+		err = (&messages.ASRep{}).Unmarshal(msg)
+	case asnAppTag.TGSREP:
+		err = (&messages.TGSRep{}).Unmarshal(msg)
+	case asnAppTag.APREP:
+		err = (&messages.APRep{}).Unmarshal(msg)
+	case asnAppTag.KRBError:
+		err = (&messages.KRBError{}).Unmarshal(msg)
+	default:
+		return false
 	}
 
-	return false
+	return err == nil
 }
 
 // UnmarshalKerbLength returns the length of a kerberos message based on the leading 4-bytes
 func UnmarshalKerbLength(b []byte) (int, error) {
 	if len(b) < 4 {
-		return 0, fmt.Errorf("invalid length")
+		return 0, fmt.Errorf("%w: invalid length", ErrMalformedMessage)
 	}
 	n := binary.BigEndian.Uint32(b)
 
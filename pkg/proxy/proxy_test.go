@@ -2,7 +2,27 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestUnmarshalKerbLength(t *testing.T) {
@@ -53,3 +73,638 @@ func TestMarshalKerbLength(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerMaxInFlight(t *testing.T) {
+	k, err := NewKdcProxy(WithMaxInFlight(1))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	// occupy the only slot
+	k.inFlight <- struct{}{}
+
+	req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader([]byte{0}))
+	w := httptest.NewRecorder()
+	k.Handler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Handler() status = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestNewKdcProxyRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"default registry", nil},
+		{"default registry again", nil},
+		{"custom registry", []Option{WithRegistry(prometheus.NewRegistry())}},
+		{"second custom registry", []Option{WithRegistry(prometheus.NewRegistry())}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKdcProxy(tt.opts...); err != nil {
+				t.Errorf("NewKdcProxy() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	k, err := NewKdcProxy()
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	if !k.krb5Config.Load().LibDefaults.DNSLookupKDC {
+		t.Errorf("default config does not use DNS lookup of KDCs")
+	}
+
+	config := filepath.Join(t.TempDir(), "krb5.conf")
+	if err := os.WriteFile(config, []byte("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := k.LoadConfig(config); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if _, kdcs, err := k.krb5Config.Load().GetKDCs("EXAMPLE.COM", true); err != nil || kdcs[1] != "kdc.example.com:88" {
+		t.Errorf("GetKDCs() = %v, %v, want kdc.example.com:88", kdcs, err)
+	}
+
+	if err := k.LoadConfig(filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Errorf("LoadConfig() of missing file did not return an error")
+	}
+}
+
+func TestSetLimit(t *testing.T) {
+	k, err := NewKdcProxy()
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	if err := k.SetLimit(0); err == nil {
+		t.Errorf("SetLimit(0) did not return an error")
+	}
+
+	if err := k.SetLimit(50); err != nil {
+		t.Fatalf("SetLimit(50) error = %v", err)
+	}
+
+	if got := k.Stats().Limiter; got.Limit != 50 || got.Burst != 50 {
+		t.Errorf("limiter = %+v, want limit and burst of 50", got)
+	}
+
+	if err := k.SetRateLimit(50, -1); err == nil {
+		t.Errorf("SetRateLimit(50, -1) did not return an error")
+	}
+
+	if err := k.SetRateLimit(20, 100); err != nil {
+		t.Fatalf("SetRateLimit(20, 100) error = %v", err)
+	}
+
+	if got := k.Stats().Limiter; got.Limit != 20 || got.Burst != 100 {
+		t.Errorf("limiter = %+v, want limit of 20 and burst of 100", got)
+	}
+}
+
+func TestWithBurst(t *testing.T) {
+	if _, err := NewKdcProxy(WithBurst(-1)); err == nil {
+		t.Error("WithBurst(-1) did not return an error")
+	}
+
+	k, err := NewKdcProxy(WithLimit(5), WithBurst(25))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	if got := k.Stats().Limiter; got.Limit != 5 || got.Burst != 25 {
+		t.Errorf("limiter = %+v, want limit of 5 and burst of 25", got)
+	}
+}
+
+func TestWithKrb5ConfString(t *testing.T) {
+	k, err := NewKdcProxy(WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	if _, kdcs, err := k.Krb5Config().GetKDCs("EXAMPLE.COM", true); err != nil || kdcs[1] != "kdc.example.com:88" {
+		t.Errorf("GetKDCs() = %v, %v, want kdc.example.com:88", kdcs, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = 127.0.0.1:1\n }\n"),
+		WithDeniedRealms("DENIED.COM"),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		msg     *KdcProxyMsg
+		wantErr error
+	}{
+		{"nil message", context.Background(), nil, ErrMalformedMessage},
+		{"short message", context.Background(), &KdcProxyMsg{KerbMessage: []byte{0}, TargetDomain: "EXAMPLE.COM"}, ErrMalformedMessage},
+		{"no realm", context.Background(), &KdcProxyMsg{KerbMessage: []byte{0, 0, 0, 1, 0}}, ErrMalformedMessage},
+		{"denied realm", context.Background(), &KdcProxyMsg{KerbMessage: []byte{0, 0, 0, 1, 0}, TargetDomain: "DENIED.COM"}, ErrRealmNotAllowed},
+		{"unknown realm", context.Background(), &KdcProxyMsg{KerbMessage: []byte{0, 0, 0, 1, 0}, TargetDomain: "UNKNOWN.COM"}, ErrNoKDCFound},
+		{"cancelled", cancelled, &KdcProxyMsg{KerbMessage: []byte{0, 0, 0, 1, 0}, TargetDomain: "EXAMPLE.COM"}, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := k.Forward(tt.ctx, tt.msg); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Forward() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForwardDiscoveryErrors(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n"),
+		WithRegistry(prometheus.NewRegistry()),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	_, err = k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: []byte{0, 0, 0, 1, 0}, TargetDomain: "UNKNOWN.COM"})
+	if !errors.Is(err, ErrNoKDCFound) {
+		t.Fatalf("Forward() error = %v, want %v", err, ErrNoKDCFound)
+	}
+
+	// the cause for each protocol is included
+	for _, want := range []string{"udp: ", "tcp: "} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Forward() error = %v, want it to contain %q", err, want)
+		}
+	}
+
+	for _, proto := range []string{protoUdp, protoTcp} {
+		if got := testutil.ToFloat64(k.metrics.kdcDiscoveryFailures.WithLabelValues(proto)); got != 1 {
+			t.Errorf("discovery failures for %s = %v, want 1", proto, got)
+		}
+	}
+}
+
+func TestForwardFakeKDC(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+
+	tests := []struct {
+		name      string
+		protocols []string
+		kdcs      []string
+		want      []string
+		wantErr   error
+	}{
+		{"tcp reply", []string{protoTcp}, []string{kdcReply}, []string{""}, nil},
+		{"tcp truncated", []string{protoTcp}, []string{kdcTruncated, kdcReply}, []string{errorTypeBadResponse, ""}, nil},
+		{"tcp wrong length", []string{protoTcp}, []string{kdcWrongLength, kdcReply}, []string{errorTypeBadResponse, ""}, nil},
+		{"tcp too large", []string{protoTcp}, []string{kdcTooLarge, kdcReply}, []string{errorTypeBadResponse, ""}, nil},
+		{"tcp timeout", []string{protoTcp}, []string{kdcSilent, kdcReply}, []string{errorTypeTimeout, ""}, nil},
+		{"tcp all bad", []string{protoTcp}, []string{kdcSilent, kdcTruncated}, []string{errorTypeTimeout, errorTypeBadResponse}, ErrUpstreamUnavailable},
+		{"tcp all timeout", []string{protoTcp}, []string{kdcTruncated, kdcSilent}, []string{errorTypeBadResponse, errorTypeTimeout}, ErrUpstreamTimeout},
+		{"udp reply", []string{protoUdp}, []string{kdcReply}, []string{""}, nil},
+		{"udp truncated", []string{protoUdp}, []string{kdcTruncated, kdcReply}, []string{errorTypeBadResponse, ""}, nil},
+		{"udp wrong length", []string{protoUdp}, []string{kdcWrongLength, kdcReply}, []string{errorTypeBadResponse, ""}, nil},
+		{"udp timeout", []string{protoUdp}, []string{kdcSilent}, []string{errorTypeTimeout}, ErrUpstreamTimeout},
+		{"udp then tcp", []string{protoUdp, protoTcp}, []string{kdcTruncated}, []string{errorTypeBadResponse, errorTypeBadResponse}, ErrUpstreamUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// kdcs are tried in order of address with the round robin strategy
+			kdcs := make([]*fakeKDC, len(tt.kdcs))
+			for i := range kdcs {
+				kdcs[i] = newFakeKDC(t, reply)
+			}
+			sort.Slice(kdcs, func(i, j int) bool { return kdcs[i].addr < kdcs[j].addr })
+
+			conf := "[realms]\n EXAMPLE.COM = {\n"
+			for i, kdc := range kdcs {
+				kdc.behaviour = tt.kdcs[i]
+				kdc.serve()
+				conf += "  kdc = " + kdc.addr + "\n"
+			}
+			conf += " }\n"
+
+			k, err := NewKdcProxy(
+				WithKrb5ConfString(conf),
+				WithRegistry(prometheus.NewRegistry()),
+				WithProtocols(tt.protocols...),
+				WithStrategy(StrategyRoundRobin),
+				WithTimeout(200*time.Millisecond),
+			)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+			var got []string
+			k.OnForwardComplete(func(ctx context.Context, ev ForwardEvent) {
+				class := ""
+				if ev.Err != nil {
+					class = classifyError(ev.Err)
+				}
+				got = append(got, class)
+			})
+
+			resp, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Forward() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(resp, append(MarshalKerbLength(len(reply)), reply...)) {
+				t.Errorf("Forward() = %x", resp)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("exchanges = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// mockTransport returns a fixed response for each exchange
+type mockTransport struct {
+	resp []byte
+	err  error
+	kdcs []string
+	req  []byte
+}
+
+func (m *mockTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	m.kdcs = append(m.kdcs, proto+"/"+kdc)
+	m.req = req
+	return m.resp, m.err
+}
+
+// countTransport returns a fixed response for each exchange, failing those with any KDC in fail, and
+// is safe for concurrent use
+type countTransport struct {
+	resp []byte
+	fail map[string]bool
+	n    atomic.Int64
+}
+
+func (c *countTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	c.n.Add(1)
+	if c.fail[kdc] {
+		return nil, errors.New("unreachable")
+	}
+
+	return c.resp, nil
+}
+
+func TestHandlerConcurrent(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &countTransport{
+		resp: append(MarshalKerbLength(len(reply)), reply...),
+		fail: map[string]bool{"kdc1.example.com:88": true, "kdc1.other.com:88": true},
+	}
+
+	// enable the options that keep state between requests
+	objective, _ := ParseLatencyObjective("99%:1s")
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc1.example.com:88\n  kdc = kdc2.example.com:88\n }\n OTHER.COM = {\n  kdc = kdc1.other.com:88\n  kdc = kdc2.other.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithProtocols("tcp"),
+		WithStrategy(StrategyRoundRobin),
+		WithLimit(1000000),
+		WithMaxInFlight(1000),
+		WithFairQueue(4, 0),
+		WithDedupe(time.Second),
+		WithAffinity(time.Minute),
+		WithAdaptiveOrdering(),
+		WithHoldDown(time.Minute),
+		WithRecentErrors(10),
+		WithLatencyObjectives(objective),
+		WithDiagnosticHeaders(),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	want, err := EncodeKdcProxyMessage(&KdcProxyMsg{KerbMessage: transport.resp})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each message is sent twice so duplicates are served from the dedupe cache
+	const requests = 200
+	bodies := make([][]byte, requests)
+	for i := range bodies {
+		realm := "EXAMPLE.COM"
+		if i%4 >= 2 {
+			realm = "OTHER.COM"
+		}
+		if i%2 == 1 {
+			bodies[i] = bodies[i-1]
+			continue
+		}
+		cfg := krb5config.New()
+		req, err := messages.NewASReqForTGT(realm, cfg, types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "user"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := req.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[i] = testProxyMessage(t, b, realm)
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i, body := range bodies {
+		wg.Add(1)
+		go func(i int, body []byte) {
+			defer wg.Done()
+			<-start
+			r := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(body))
+			r.RemoteAddr = "192.0.2." + strconv.Itoa(i%8) + ":1234"
+			w := httptest.NewRecorder()
+			k.Handler(w, r)
+			if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want) {
+				t.Errorf("status = %d, body = %x", w.Code, w.Body.Bytes())
+			}
+		}(i, body)
+	}
+
+	// read and change state while requests are handled
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := 0; i < 20; i++ {
+			k.Stats()
+			k.RecentErrors()
+			if err := k.SetRateLimit(1000000, 10); err != nil {
+				t.Errorf("SetRateLimit() error = %v", err)
+			}
+			k.SetRealmFilter(nil, []string{"DENIED.COM"})
+		}
+	}()
+	close(start)
+	wg.Wait()
+
+	if got := testutil.ToFloat64(k.metrics.httpReqs); got != requests {
+		t.Errorf("requests metric = %v, want %d", got, requests)
+	}
+	if got := testutil.ToFloat64(k.metrics.httpRespOK); got != requests {
+		t.Errorf("ok responses metric = %v, want %d", got, requests)
+	}
+	if got := k.Stats().InFlight; got != 0 {
+		t.Errorf("in flight = %d after all requests completed", got)
+	}
+	if len(k.RecentErrors()) == 0 {
+		t.Error("no recent errors recorded for the failing kdcs")
+	}
+}
+
+func TestHandlerWithTransport(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+	w := httptest.NewRecorder()
+	k.Handler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Handler() status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	m, err := DecodeKdcProxyMessage(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeKdcProxyMessage() error = %v", err)
+	}
+
+	if m.Type != MessageTypeKRBError {
+		t.Errorf("response type = %v, want %v", m.Type, MessageTypeKRBError)
+	}
+
+	if got, want := w.Header().Get("Content-Length"), strconv.Itoa(w.Body.Len()); got != want {
+		t.Errorf("Content-Length = %v, want %v", got, want)
+	}
+
+	if len(transport.kdcs) != 1 || transport.kdcs[0] != "udp/kdc.example.com:88" {
+		t.Errorf("transport exchanges = %v, want [udp/kdc.example.com:88]", transport.kdcs)
+	}
+}
+
+func TestForwardLimits(t *testing.T) {
+	conf := "[realms]\n EXAMPLE.COM = {\n  kdc = kdc1.example.com:88\n  kdc = kdc2.example.com:88\n  kdc = kdc3.example.com:88\n }\n"
+	req := testASReq(t)
+
+	// gokrb5 shuffles kdcs of the same priority, so only the number tried is checked
+	tests := []struct {
+		name     string
+		opts     []Option
+		wantUDP  int
+		wantTCP  int
+		wantKDCs int
+	}{
+		{"unlimited", nil, 3, 3, 3},
+		{"max kdcs", []Option{WithMaxKDCs(2)}, 2, 2, 2},
+		{"max attempts", []Option{WithMaxAttempts(4)}, 3, 1, 3},
+		{"both", []Option{WithMaxKDCs(1), WithMaxAttempts(3)}, 1, 1, 1},
+		{"realm override", []Option{WithMaxAttempts(4), WithRealmConfig("example.com", RealmConfig{MaxAttempts: 1})}, 1, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &mockTransport{err: errors.New("unreachable")}
+			k, err := NewKdcProxy(append([]Option{
+				WithKrb5ConfString(conf),
+				WithRegistry(prometheus.NewRegistry()),
+				WithTransport(transport),
+			}, tt.opts...)...)
+			if err != nil {
+				t.Fatalf("NewKdcProxy() error = %v", err)
+			}
+
+			if _, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); !errors.Is(err, ErrUpstreamUnavailable) {
+				t.Errorf("Forward() error = %v, want %v", err, ErrUpstreamUnavailable)
+			}
+
+			protos := make(map[string]int)
+			kdcs := make(map[string]bool)
+			for _, exchange := range transport.kdcs {
+				proto, kdc, _ := strings.Cut(exchange, "/")
+				protos[proto]++
+				kdcs[kdc] = true
+			}
+			if protos[protoUdp] != tt.wantUDP || protos[protoTcp] != tt.wantTCP || len(kdcs) != tt.wantKDCs {
+				t.Errorf("transport exchanges = %v, want %d udp, %d tcp and %d kdcs", transport.kdcs, tt.wantUDP, tt.wantTCP, tt.wantKDCs)
+			}
+		})
+	}
+
+	for _, opt := range []Option{WithMaxKDCs(-1), WithMaxAttempts(-1)} {
+		if _, err := NewKdcProxy(opt); err == nil {
+			t.Error("NewKdcProxy() with negative limit did not return an error")
+		}
+	}
+}
+
+func TestUDPPreference(t *testing.T) {
+	both := []string{protoUdp, protoTcp}
+	tests := []struct {
+		name      string
+		protocols []string
+		size      int
+		limit     int
+		want      []string
+	}{
+		{"small", both, 100, 1465, both},
+		{"at limit", both, 1465, 1465, both},
+		{"large", both, 1466, 1465, []string{protoTcp, protoUdp}},
+		{"large udp only", []string{protoUdp}, 1466, 1465, []string{protoUdp}},
+		{"always udp first", both, 100000, 0, both},
+		{"tcp only", both, 1, 1, []string{protoTcp}},
+		{"tcp only without tcp", []string{protoUdp}, 1, 1, []string{protoUdp}},
+		{"hard limit", both, 40000, 100000, []string{protoTcp, protoUdp}},
+		{"tcp configured first", []string{protoTcp, protoUdp}, 100, 1465, []string{protoTcp, protoUdp}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := udpPreference(tt.protocols, tt.size, tt.limit); !slices.Equal(got, tt.want) {
+				t.Errorf("udpPreference() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// large messages fall back to udp when tcp fails
+	transport := &mockTransport{err: errors.New("unreachable")}
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithUDPPreferenceLimit(10),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	req := testASReq(t)
+	if _, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Errorf("Forward() error = %v, want %v", err, ErrUpstreamUnavailable)
+	}
+	if want := []string{"tcp/kdc.example.com:88", "udp/kdc.example.com:88"}; !slices.Equal(transport.kdcs, want) {
+		t.Errorf("transport exchanges = %v, want %v", transport.kdcs, want)
+	}
+
+	// a limit of 1 still uses udp when tcp is not enabled
+	transport = &mockTransport{err: errors.New("unreachable")}
+	k, err = NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithProtocols(protoUdp),
+		WithUDPPreferenceLimit(1),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	if _, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Errorf("Forward() error = %v, want %v", err, ErrUpstreamUnavailable)
+	}
+	if want := []string{"udp/kdc.example.com:88"}; !slices.Equal(transport.kdcs, want) {
+		t.Errorf("transport exchanges = %v, want %v", transport.kdcs, want)
+	}
+}
+
+func TestValidReply(t *testing.T) {
+	if !validReply(testKRBError(t)) {
+		t.Errorf("validReply(KRB-ERROR) = false, want true")
+	}
+
+	if validReply(testASReq(t)) {
+		t.Errorf("validReply(AS-REQ) = true, want false")
+	}
+}
+
+func TestHandlerContentLength(t *testing.T) {
+	reply := testKRBError(t)
+	body := testProxyMessage(t, testASReq(t), "EXAMPLE.COM")
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		length int64
+		want   int
+	}{
+		{"exact", int64(len(body)), http.StatusOK},
+		{"body shorter than content length", int64(len(body) + 10), http.StatusBadRequest},
+		{"body longer than content length", int64(len(body) - 10), http.StatusBadRequest},
+		{"missing", -1, http.StatusLengthRequired},
+		{"too large", maxLength + 1, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(body))
+			req.ContentLength = tt.length
+			w := httptest.NewRecorder()
+			k.Handler(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("Handler() status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageTypeMetrics(t *testing.T) {
+	reply := testKRBError(t)
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	for _, body := range [][]byte{
+		testProxyMessage(t, testASReq(t), "EXAMPLE.COM"),
+		testProxyMessage(t, testASReq(t), "EXAMPLE.COM"),
+		testProxyMessage(t, reply, "EXAMPLE.COM"),
+		{0x30, 0x00},
+	} {
+		k.Handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(body)))
+	}
+
+	for typ, want := range map[MessageType]float64{
+		MessageTypeASReq:   2,
+		MessageTypeTGSReq:  0,
+		MessageTypeAPReq:   0,
+		MessageTypeUnknown: 2,
+	} {
+		if got := testutil.ToFloat64(k.metrics.kerbMessages.WithLabelValues(string(typ))); got != want {
+			t.Errorf("messages of type %s = %v, want %v", typ, got, want)
+		}
+	}
+}
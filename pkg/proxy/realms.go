@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// KDC selection strategies
+const (
+	// StrategyOrdered tries KDC's in the priority order returned by the krb5 configuration or DNS
+	StrategyOrdered = "ordered"
+	// StrategyRandom tries KDC's in a random order for each request
+	StrategyRandom = "random"
+	// StrategyRoundRobin starts each request at the next KDC, rotating through the KDC's by address
+	StrategyRoundRobin = "round-robin"
+)
+
+// RealmConfig overrides the proxy wide settings for a single realm. Zero values inherit the proxy
+// wide setting.
+type RealmConfig struct {
+	// Timeout for each exchange with a KDC, over either protocol unless set by UDPTimeout or TCPTimeout
+	Timeout time.Duration
+	// UDPTimeout for each exchange with a KDC over UDP
+	UDPTimeout time.Duration
+	// TCPTimeout for each exchange with a KDC over TCP
+	TCPTimeout time.Duration
+	// RateLimit is the number of requests per second for the realm, applied in addition to the proxy wide limit
+	RateLimit int
+	// Protocols to try, in order, from "udp" and "tcp"
+	Protocols []string
+	// MaxMessageSize is the maximum size of the Kerberos message in bytes
+	MaxMessageSize int
+	// Strategy used to order KDC's
+	Strategy string
+	// MaxKDCs is the number of different KDC's tried for each request
+	MaxKDCs int
+	// MaxAttempts is the total number of exchanges with KDC's, over all protocols, for each request
+	MaxAttempts int
+	// Site is the Active Directory site whose domain controllers are tried first when KDC's are looked up via DNS
+	Site string
+}
+
+// realmPolicy is the effective configuration for a realm
+type realmPolicy struct {
+	timeout        time.Duration
+	udpTimeout     time.Duration
+	tcpTimeout     time.Duration
+	limiter        *rate.Limiter
+	protocols      []string
+	maxMessageSize int
+	strategy       string
+	maxKDCs        int
+	maxAttempts    int
+	site           string
+	offset         uint64
+}
+
+func validateProtocols(protocols []string) error {
+	for _, p := range protocols {
+		if p != protoUdp && p != protoTcp {
+			return fmt.Errorf("invalid protocol: %s", p)
+		}
+	}
+
+	return nil
+}
+
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case StrategyOrdered, StrategyRandom, StrategyRoundRobin:
+		return nil
+	}
+
+	return fmt.Errorf("invalid kdc selection strategy: %s", strategy)
+}
+
+func (c RealmConfig) validate() error {
+	if c.Timeout < 0 || c.UDPTimeout < 0 || c.TCPTimeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate limit cannot be negative")
+	}
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("maximum message size cannot be negative")
+	}
+	if c.MaxKDCs < 0 {
+		return fmt.Errorf("maximum kdcs cannot be negative")
+	}
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("maximum attempts cannot be negative")
+	}
+	if err := validateProtocols(c.Protocols); err != nil {
+		return err
+	}
+	if c.Strategy != "" {
+		return validateStrategy(c.Strategy)
+	}
+
+	return nil
+}
+
+// SetRealmConfigs atomically replaces all per-realm configuration. Realm names are matched case-insensitively.
+func (k *KerberosProxy) SetRealmConfigs(realms map[string]RealmConfig) error {
+	policies, err := newRealmPolicies(realms)
+	if err != nil {
+		return err
+	}
+
+	k.realmsMu.Lock()
+	defer k.realmsMu.Unlock()
+
+	k.realms.Store(&policies)
+
+	return nil
+}
+
+// newRealmPolicies validates the per-realm configuration and returns the policy of each realm
+func newRealmPolicies(realms map[string]RealmConfig) (map[string]*realmPolicy, error) {
+	policies := make(map[string]*realmPolicy, len(realms))
+	for realm, c := range realms {
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("realm %s: %w", realm, err)
+		}
+
+		p := &realmPolicy{
+			timeout:        c.Timeout,
+			udpTimeout:     c.UDPTimeout,
+			tcpTimeout:     c.TCPTimeout,
+			protocols:      c.Protocols,
+			maxMessageSize: c.MaxMessageSize,
+			strategy:       c.Strategy,
+			maxKDCs:        c.MaxKDCs,
+			maxAttempts:    c.MaxAttempts,
+			site:           c.Site,
+		}
+		if c.RateLimit > 0 {
+			p.limiter = rate.NewLimiter(rate.Limit(c.RateLimit), c.RateLimit)
+		}
+		policies[strings.ToUpper(realm)] = p
+	}
+
+	return policies, nil
+}
+
+// SetRealmRateLimit changes the number of requests per second allowed for a realm, in addition to the
+// proxy wide limit, leaving its other settings unchanged. A limit of 0 removes the limit for the
+// realm. The change lasts until the per-realm configuration is replaced by SetRealmConfigs.
+func (k *KerberosProxy) SetRealmRateLimit(realm string, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("rate limit cannot be negative")
+	}
+	realm = strings.ToUpper(realm)
+
+	k.realmsMu.Lock()
+	defer k.realmsMu.Unlock()
+
+	current := *k.realms.Load()
+
+	// an existing limiter is changed in place so its tokens carry over
+	existing, ok := current[realm]
+	if ok && existing.limiter != nil && limit > 0 {
+		existing.limiter.SetLimit(rate.Limit(limit))
+		existing.limiter.SetBurst(limit)
+		return nil
+	}
+
+	p := &realmPolicy{}
+	if ok {
+		*p = *existing
+	}
+	p.limiter = nil
+	if limit > 0 {
+		p.limiter = rate.NewLimiter(rate.Limit(limit), limit)
+	}
+
+	policies := make(map[string]*realmPolicy, len(current)+1)
+	for r, existing := range current {
+		policies[r] = existing
+	}
+	policies[realm] = p
+	k.realms.Store(&policies)
+
+	return nil
+}
+
+// policy returns the effective configuration for the realm
+func (k *KerberosProxy) policy(realm string) *realmPolicy {
+	p := &realmPolicy{
+		timeout:     k.timeout,
+		udpTimeout:  k.udpTimeout,
+		tcpTimeout:  k.tcpTimeout,
+		protocols:   k.protocols,
+		strategy:    k.strategy,
+		maxKDCs:     k.maxKDCs,
+		maxAttempts: k.maxAttempts,
+		site:        k.site,
+	}
+
+	if realms := k.realms.Load(); realms != nil {
+		if override, ok := (*realms)[strings.ToUpper(realm)]; ok {
+			p.apply(override)
+		}
+	}
+
+	return p
+}
+
+// apply overrides the settings of p with those set for a realm
+func (p *realmPolicy) apply(override *realmPolicy) {
+	// a realm timeout replaces the proxy wide timeouts for both protocols
+	if override.timeout > 0 {
+		p.timeout = override.timeout
+		p.udpTimeout, p.tcpTimeout = 0, 0
+	}
+	if override.udpTimeout > 0 {
+		p.udpTimeout = override.udpTimeout
+	}
+	if override.tcpTimeout > 0 {
+		p.tcpTimeout = override.tcpTimeout
+	}
+	if len(override.protocols) > 0 {
+		p.protocols = override.protocols
+	}
+	if override.strategy != "" {
+		p.strategy = override.strategy
+	}
+	if override.maxKDCs > 0 {
+		p.maxKDCs = override.maxKDCs
+	}
+	if override.maxAttempts > 0 {
+		p.maxAttempts = override.maxAttempts
+	}
+	if override.site != "" {
+		p.site = override.site
+	}
+	p.limiter = override.limiter
+	p.maxMessageSize = override.maxMessageSize
+}
+
+// timeoutFor returns the timeout for each exchange with a KDC using proto
+func (p *realmPolicy) timeoutFor(proto string) time.Duration {
+	switch {
+	case proto == protoUdp && p.udpTimeout > 0:
+		return p.udpTimeout
+	case proto == protoTcp && p.tcpTimeout > 0:
+		return p.tcpTimeout
+	}
+
+	return p.timeout
+}
+
+// resolveRealm maps a target domain given as a DNS domain, such as "corp.example.com", to a realm
+// using the [domain_realm] section of the krb5 configuration. Realms are conventionally upper case,
+// so targets without lower case letters, or that are configured realms, are returned unchanged as
+// are domains without a mapping.
+func (k *KerberosProxy) resolveRealm(target string) string {
+	if target == strings.ToUpper(target) {
+		return target
+	}
+
+	cfg := k.krb5Config.Load()
+	for _, r := range cfg.Realms {
+		if r.Realm == target {
+			return target
+		}
+	}
+
+	if realm := cfg.ResolveRealm(strings.ToLower(target)); realm != "" {
+		return realm
+	}
+
+	return target
+}
+
+// counter returns the round-robin position for the realm
+func (k *KerberosProxy) counter(realm string) *atomic.Uint64 {
+	c, _ := k.roundRobin.LoadOrStore(strings.ToUpper(realm), &atomic.Uint64{})
+
+	return c.(*atomic.Uint64)
+}
+
+// order returns the KDC's in the order they should be tried
+func (p *realmPolicy) order(kdcs map[int]string) []string {
+	keys := make([]int, 0, len(kdcs))
+	for i := range kdcs {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+
+	ordered := make([]string, 0, len(keys))
+	for _, i := range keys {
+		ordered = append(ordered, kdcs[i])
+	}
+
+	switch p.strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case StrategyRoundRobin:
+		// the order from gokrb5 is not stable between calls, so rotate through the kdcs by address
+		if len(ordered) > 1 {
+			sort.Strings(ordered)
+			start := int(p.offset % uint64(len(ordered)))
+			rotated := make([]string, 0, len(ordered))
+			rotated = append(rotated, ordered[start:]...)
+			ordered = append(rotated, ordered[:start]...)
+		}
+	}
+
+	return ordered
+}
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPolicy(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithTimeout(time.Second),
+		WithRealmConfig("example.com", RealmConfig{
+			Timeout:        5 * time.Second,
+			RateLimit:      1,
+			Protocols:      []string{protoTcp},
+			MaxMessageSize: 1024,
+			Strategy:       StrategyRandom,
+		}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	p := k.policy("EXAMPLE.COM")
+	if p.timeout != 5*time.Second || p.limiter == nil || !reflect.DeepEqual(p.protocols, []string{protoTcp}) || p.maxMessageSize != 1024 || p.strategy != StrategyRandom {
+		t.Errorf("policy(EXAMPLE.COM) = %+v, want realm overrides", p)
+	}
+
+	p = k.policy("OTHER.COM")
+	if p.timeout != time.Second || p.limiter != nil || !reflect.DeepEqual(p.protocols, []string{protoUdp, protoTcp}) || p.maxMessageSize != 0 || p.strategy != StrategyOrdered {
+		t.Errorf("policy(OTHER.COM) = %+v, want proxy defaults", p)
+	}
+}
+
+func TestPolicyTimeouts(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithTimeout(2*time.Second),
+		WithUDPTimeout(500*time.Millisecond),
+		WithRealmConfig("example.com", RealmConfig{Timeout: 5 * time.Second, TCPTimeout: 10 * time.Second}),
+		WithRealmConfig("udp.example.com", RealmConfig{UDPTimeout: 200 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	tests := []struct {
+		realm   string
+		wantUDP time.Duration
+		wantTCP time.Duration
+	}{
+		{"OTHER.COM", 500 * time.Millisecond, 2 * time.Second},
+		{"EXAMPLE.COM", 5 * time.Second, 10 * time.Second},
+		{"UDP.EXAMPLE.COM", 200 * time.Millisecond, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		p := k.policy(tt.realm)
+		if udp, tcp := p.timeoutFor(protoUdp), p.timeoutFor(protoTcp); udp != tt.wantUDP || tcp != tt.wantTCP {
+			t.Errorf("policy(%s) timeouts = %v udp, %v tcp, want %v udp, %v tcp", tt.realm, udp, tcp, tt.wantUDP, tt.wantTCP)
+		}
+	}
+
+	for _, opt := range []Option{WithUDPTimeout(-time.Second), WithTCPTimeout(-time.Second)} {
+		if _, err := NewKdcProxy(opt); err == nil {
+			t.Error("NewKdcProxy() with negative timeout did not return an error")
+		}
+	}
+}
+
+func TestSetRealmRateLimit(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithRegistry(prometheus.NewRegistry()),
+		WithLimit(20),
+		WithRealmConfig("example.com", RealmConfig{RateLimit: 1, Strategy: StrategyRandom}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	limiter := k.policy("EXAMPLE.COM").limiter
+
+	// an existing limit is changed in place and other settings are kept
+	if err := k.SetRealmRateLimit("example.com", 5); err != nil {
+		t.Fatalf("SetRealmRateLimit() error = %v", err)
+	}
+	if p := k.policy("EXAMPLE.COM"); p.limiter != limiter || p.limiter.Limit() != 5 || p.strategy != StrategyRandom {
+		t.Errorf("policy(EXAMPLE.COM) = %+v", p)
+	}
+
+	// realms without a limit are given one
+	if err := k.SetRealmRateLimit("OTHER.COM", 2); err != nil {
+		t.Fatalf("SetRealmRateLimit() error = %v", err)
+	}
+	want := RateLimits{Limit: 20, Burst: 20, Realms: map[string]int{"EXAMPLE.COM": 5, "OTHER.COM": 2}}
+	if got := k.RateLimits(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RateLimits() = %+v, want %+v", got, want)
+	}
+
+	// a limit of 0 removes the limit
+	if err := k.SetRealmRateLimit("EXAMPLE.COM", 0); err != nil {
+		t.Fatalf("SetRealmRateLimit() error = %v", err)
+	}
+	if p := k.policy("EXAMPLE.COM"); p.limiter != nil || p.strategy != StrategyRandom {
+		t.Errorf("policy(EXAMPLE.COM) = %+v", p)
+	}
+
+	if err := k.SetRealmRateLimit("EXAMPLE.COM", -1); err == nil {
+		t.Error("SetRealmRateLimit() with negative limit did not return an error")
+	}
+}
+
+func TestRealmConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RealmConfig
+		wantErr bool
+	}{
+		{"empty", RealmConfig{}, false},
+		{"valid", RealmConfig{Timeout: time.Second, RateLimit: 1, Protocols: []string{protoTcp, protoUdp}, Strategy: StrategyOrdered}, false},
+		{"negative timeout", RealmConfig{Timeout: -time.Second}, true},
+		{"negative udp timeout", RealmConfig{UDPTimeout: -time.Second}, true},
+		{"invalid protocol", RealmConfig{Protocols: []string{"quic"}}, true},
+		{"invalid strategy", RealmConfig{Strategy: "fastest"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyOrder(t *testing.T) {
+	kdcs := map[int]string{3: "kdc3", 1: "kdc1", 2: "kdc2"}
+
+	p := &realmPolicy{strategy: StrategyOrdered}
+	if got := p.order(kdcs); !reflect.DeepEqual(got, []string{"kdc1", "kdc2", "kdc3"}) {
+		t.Errorf("order() = %v, want priority order", got)
+	}
+
+	p = &realmPolicy{strategy: StrategyRandom}
+	if got := p.order(kdcs); len(got) != 3 {
+		t.Errorf("order() = %v, want 3 kdcs", got)
+	}
+
+	p = &realmPolicy{strategy: StrategyRoundRobin, offset: 4}
+	if got := p.order(map[int]string{1: "kdc3", 2: "kdc1", 3: "kdc2"}); !reflect.DeepEqual(got, []string{"kdc2", "kdc3", "kdc1"}) {
+		t.Errorf("order() = %v, want rotated order", got)
+	}
+}
+
+func TestWithStrategy(t *testing.T) {
+	if _, err := NewKdcProxy(WithStrategy("fastest")); err == nil {
+		t.Errorf("WithStrategy(fastest) did not return an error")
+	}
+
+	reply := testKRBError(t)
+	req := testASReq(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc1.example.com:88\n  kdc = kdc2.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithStrategy(StrategyRoundRobin),
+		WithProtocols(protoTcp),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := k.Forward(context.Background(), &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}); err != nil {
+			t.Fatalf("Forward() error = %v", err)
+		}
+	}
+
+	want := []string{"tcp/kdc1.example.com:88", "tcp/kdc2.example.com:88", "tcp/kdc1.example.com:88"}
+	if !reflect.DeepEqual(transport.kdcs, want) {
+		t.Errorf("transport exchanges = %v, want %v", transport.kdcs, want)
+	}
+}
+
+func TestWithProtocols(t *testing.T) {
+	tests := []struct {
+		name      string
+		protocols []string
+		wantErr   bool
+	}{
+		{"tcp only", []string{protoTcp}, false},
+		{"tcp first", []string{protoTcp, protoUdp}, false},
+		{"none", nil, true},
+		{"invalid", []string{"sctp"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := NewKdcProxy(WithProtocols(tt.protocols...))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewKdcProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := k.policy("EXAMPLE.COM").protocols; !reflect.DeepEqual(got, tt.protocols) {
+				t.Errorf("policy().protocols = %v, want %v", got, tt.protocols)
+			}
+		})
+	}
+}
+
+func TestResolveRealm(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n lower.example.com = {\n  kdc = kdc.example.com:88\n }\n[domain_realm]\n .example.com = EXAMPLE.COM\n host.other.com = OTHER.COM\n"),
+		WithRegistry(prometheus.NewRegistry()),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"corp.example.com", "EXAMPLE.COM"},
+		{"Corp.Example.Com", "EXAMPLE.COM"},
+		{"host.other.com", "OTHER.COM"},
+		{"CORP.EXAMPLE.COM", "CORP.EXAMPLE.COM"},
+		{"lower.example.com", "lower.example.com"},
+		{"unmapped.net", "unmapped.net"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if got := k.resolveRealm(tt.target); got != tt.want {
+				t.Errorf("resolveRealm(%s) = %s, want %s", tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardDomainRealm(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n[domain_realm]\n .example.com = EXAMPLE.COM\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	req := testASReq(t)
+	msg := &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "corp.example.com"}
+	if _, err := k.Forward(context.Background(), msg); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+
+	if len(transport.kdcs) != 1 || transport.kdcs[0] != "udp/kdc.example.com:88" {
+		t.Errorf("transport exchanges = %v, want [udp/kdc.example.com:88]", transport.kdcs)
+	}
+	if msg.TargetDomain != "corp.example.com" {
+		t.Errorf("Forward() modified the target domain to %s", msg.TargetDomain)
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultRecentErrors is the default number of recent forwarding errors kept
+const DefaultRecentErrors = 100
+
+// errorTypeDiscovery is the class of errors finding the KDC's for a realm
+const errorTypeDiscovery = "discovery"
+
+// RecentError is a failed attempt to forward a request
+type RecentError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Realm     string    `json:"realm"`
+	KDC       string    `json:"kdc,omitempty"`
+	Proto     string    `json:"proto"`
+	Class     string    `json:"class"`
+	Error     string    `json:"error"`
+}
+
+// recentErrors is a ring buffer of the most recent forwarding errors
+type recentErrors struct {
+	mu      sync.Mutex
+	entries []RecentError
+	next    int
+	full    bool
+}
+
+func newRecentErrors(n int) *recentErrors {
+	return &recentErrors{entries: make([]RecentError, n)}
+}
+
+// add records e, replacing the oldest error once full
+func (r *recentErrors) add(e RecentError) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the recorded errors, most recent first
+func (r *recentErrors) list() []RecentError {
+	if r == nil {
+		return []RecentError{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	list := make([]RecentError, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+
+	return list
+}
+
+// RecentErrors returns the most recent errors forwarding requests, most recent first
+func (k *KerberosProxy) RecentErrors() []RecentError {
+	return k.recent.list()
+}
+
+// RecentErrorsHandler returns a http.Handler that responds with the most recent errors forwarding
+// requests as JSON. The errors include internal KDC addresses so the handler should not be public.
+func (k *KerberosProxy) RecentErrorsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(k.RecentErrors())
+	})
+}
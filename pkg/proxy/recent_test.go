@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRecentErrors(t *testing.T) {
+	r := newRecentErrors(3)
+	if got := r.list(); len(got) != 0 {
+		t.Errorf("list() = %v, want none", got)
+	}
+
+	// the oldest errors are replaced once full
+	for _, kdc := range []string{"kdc1:88", "kdc2:88", "kdc3:88", "kdc4:88"} {
+		r.add(RecentError{KDC: kdc})
+	}
+	got := r.list()
+	want := []string{"kdc4:88", "kdc3:88", "kdc2:88"}
+	if len(got) != len(want) {
+		t.Fatalf("list() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].KDC != want[i] {
+			t.Errorf("list()[%d] = %s, want %s", i, got[i].KDC, want[i])
+		}
+	}
+
+	// disabled
+	var disabled *recentErrors
+	disabled.add(RecentError{})
+	if got := disabled.list(); got == nil || len(got) != 0 {
+		t.Errorf("list() when disabled = %v, want empty", got)
+	}
+}
+
+func TestRecentErrorsForward(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(&mockTransport{err: errInvalidReply}),
+		WithProtocols(protoTcp),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	reply := testKRBError(t)
+	ctx := ContextWithRequestID(context.Background(), "abc123")
+	if _, err := k.Forward(ctx, &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(reply)), reply...), TargetDomain: "EXAMPLE.COM"}); !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Fatalf("Forward() error = %v, want %v", err, ErrUpstreamUnavailable)
+	}
+
+	got := k.RecentErrors()
+	if len(got) != 1 {
+		t.Fatalf("RecentErrors() = %v, want 1 error", got)
+	}
+	want := RecentError{Time: got[0].Time, RequestID: "abc123", Realm: "EXAMPLE.COM", KDC: "kdc.example.com:88", Proto: protoTcp, Class: errorTypeBadResponse, Error: errInvalidReply.Error()}
+	if got[0] != want {
+		t.Errorf("RecentErrors() = %+v, want %+v", got[0], want)
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+	"golang.org/x/time/rate"
+)
+
+// ReloadConfig is the configuration of a KerberosProxy that can be changed while it is running
+type ReloadConfig struct {
+	// Krb5 replaces the krb5 configuration when set, such as from ParseConfigs
+	Krb5 *krb5config.Config
+	// RateLimit and RateBurst replace the proxy wide rate limit as SetRateLimit does
+	RateLimit int
+	RateBurst int
+	// Realms replaces all per-realm configuration as SetRealmConfigs does
+	Realms map[string]RealmConfig
+	// AllowedRealms and DeniedRealms replace the realm filter as SetRealmFilter does
+	AllowedRealms []string
+	DeniedRealms  []string
+	// AccessDefault and AccessRules replace the access rules as SetAccessRules does
+	AccessDefault AccessAction
+	AccessRules   []AccessRule
+}
+
+// PrepareReload validates c and returns a function that applies all of it, so nothing is changed
+// unless the whole configuration is valid. Preparing the reload of several proxies before applying
+// any of them leaves all of them unchanged when any configuration is invalid.
+func (k *KerberosProxy) PrepareReload(c ReloadConfig) (func(), error) {
+	l, err := k.rateLimiter(c.RateLimit, c.RateBurst)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := newRealmPolicies(c.Realms)
+	if err != nil {
+		return nil, err
+	}
+	access, err := accessRules(c.AccessDefault, c.AccessRules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access rules: %w", err)
+	}
+	filter := newRealmFilter(c.AllowedRealms, c.DeniedRealms)
+
+	return func() {
+		if c.Krb5 != nil {
+			k.storeKrb5Config(c.Krb5)
+		}
+		l.SetLimit(rate.Limit(c.RateLimit))
+		l.SetBurst(burstOrLimit(c.RateBurst, c.RateLimit))
+
+		k.realmsMu.Lock()
+		k.realms.Store(&policies)
+		k.realmsMu.Unlock()
+
+		k.filter.Store(filter)
+		k.access.Store(access)
+	}, nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPrepareReload(t *testing.T) {
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithLimit(10),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	krb5, err := ParseConfigFromReader(strings.NewReader("[realms]\n OTHER.COM = {\n  kdc = kdc.other.com:88\n }\n"))
+	if err != nil {
+		t.Fatalf("ParseConfigFromReader() error = %v", err)
+	}
+	valid := ReloadConfig{
+		Krb5:          krb5,
+		RateLimit:     20,
+		Realms:        map[string]RealmConfig{"OTHER.COM": {RateLimit: 5}},
+		DeniedRealms:  []string{"EXAMPLE.COM"},
+		AccessDefault: AccessDeny,
+	}
+
+	invalid := []struct {
+		name   string
+		change func(c *ReloadConfig)
+	}{
+		{"rate limit", func(c *ReloadConfig) { c.RateLimit = 0 }},
+		{"realm config", func(c *ReloadConfig) { c.Realms = map[string]RealmConfig{"OTHER.COM": {Protocols: []string{"sctp"}}} }},
+		{"access rules", func(c *ReloadConfig) { c.AccessDefault = "maybe" }},
+	}
+	before := k.Krb5Config()
+	for _, tt := range invalid {
+		c := valid
+		tt.change(&c)
+		if _, err := k.PrepareReload(c); err == nil {
+			t.Errorf("PrepareReload() with invalid %s did not return an error", tt.name)
+		}
+	}
+	if k.Krb5Config() != before || k.RateLimits().Limit != 10 || len(k.RateLimits().Realms) != 0 || !k.filter.Load().allow("EXAMPLE.COM") || k.access.Load() != nil {
+		t.Fatalf("PrepareReload() changed the configuration without it being applied")
+	}
+
+	apply, err := k.PrepareReload(valid)
+	if err != nil {
+		t.Fatalf("PrepareReload() error = %v", err)
+	}
+	apply()
+	if k.Krb5Config() != krb5 {
+		t.Errorf("krb5 configuration was not replaced")
+	}
+	if limits := k.RateLimits(); limits.Limit != 20 || limits.Burst != 20 || limits.Realms["OTHER.COM"] != 5 {
+		t.Errorf("RateLimits() = %+v, want limit 20, burst 20 and OTHER.COM 5", limits)
+	}
+	if k.filter.Load().allow("EXAMPLE.COM") {
+		t.Errorf("EXAMPLE.COM is allowed, want denied")
+	}
+	if k.access.Load() == nil {
+		t.Errorf("access rules were not replaced")
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	krb5config "github.com/jcmturner/gokrb5/v8/config"
+)
+
+// srvLookup looks up DNS SRV records, as net.Resolver.LookupSRV
+type srvLookup func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+// kdcs returns the KDC's of realm for proto as groups to be tried in turn. When KDC's are looked up
+// via DNS and an Active Directory site is set the domain controllers in that site are returned
+// first, followed by the remaining KDC's of the realm.
+func (k *KerberosProxy) kdcs(ctx context.Context, cfg *krb5config.Config, realm, proto, site string) ([]map[int]string, error) {
+	var local []string
+	if site != "" && cfg.LibDefaults.DNSLookupKDC && !hasConfiguredKDCs(cfg, realm) {
+		local = k.siteKDCs(ctx, realm, site)
+	}
+
+	c, kdcs, err := cfg.GetKDCs(realm, proto == protoTcp)
+	if len(local) == 0 {
+		if err == nil && c < 1 {
+			err = errors.New("no kdcs configured")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return []map[int]string{kdcs}, nil
+	}
+
+	// the site records may be the only ones published
+	groups := []map[int]string{make(map[int]string, len(local)), make(map[int]string, len(kdcs))}
+	seen := make(map[string]bool, len(local))
+	for i, kdc := range local {
+		groups[0][i+1] = kdc
+		seen[kdc] = true
+	}
+	for i, kdc := range kdcs {
+		if !seen[kdc] {
+			groups[1][i] = kdc
+		}
+	}
+
+	return groups, nil
+}
+
+// siteKDCs returns the domain controllers of realm in an Active Directory site from the
+// "_kerberos._tcp.SITE._sites.REALM" SRV records, in priority order. Only TCP records are published
+// for sites, however the domain controllers also accept UDP on the same port.
+func (k *KerberosProxy) siteKDCs(ctx context.Context, realm, site string) []string {
+	_, srvs, err := k.lookupSRV(ctx, "kerberos", protoTcp, site+"._sites."+realm)
+	if err != nil {
+		k.log(ctx).DebugContext(ctx, "site kdc lookup failed", "realm", realm, "site", site, "error", err)
+		return nil
+	}
+
+	kdcs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		kdcs = append(kdcs, net.JoinHostPort(strings.TrimRight(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+
+	return kdcs
+}
+
+// hasConfiguredKDCs returns true if the krb5 configuration lists KDC's for realm, in which case DNS
+// is not used to look them up
+func hasConfiguredKDCs(cfg *krb5config.Config, realm string) bool {
+	for _, r := range cfg.Realms {
+		if r.Realm == realm && len(r.KDC) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
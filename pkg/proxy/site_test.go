@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSiteKDCs(t *testing.T) {
+	reply := testKRBError(t)
+	transport := &mockTransport{resp: append(MarshalKerbLength(len(reply)), reply...)}
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = true\n[realms]\n STATIC.COM = {\n  kdc = kdc.static.com:88\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithTransport(transport),
+		WithSite("Perth"),
+		WithRealmConfig("OTHER.COM", RealmConfig{Site: "Sydney"}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	var lookups []string
+	k.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		lookups = append(lookups, "_"+service+"._"+proto+"."+name)
+		switch name {
+		case "Perth._sites.EXAMPLE.COM":
+			return "", []*net.SRV{{Target: "dc2.example.com.", Port: 88}, {Target: "dc1.example.com.", Port: 88}}, nil
+		case "Sydney._sites.OTHER.COM":
+			return "", []*net.SRV{{Target: "dc9.other.com.", Port: 88}}, nil
+		}
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	tests := []struct {
+		name        string
+		realm       string
+		wantFirst   map[int]string
+		wantLookups []string
+	}{
+		{"site", "EXAMPLE.COM", map[int]string{1: "dc2.example.com:88", 2: "dc1.example.com:88"}, []string{"_kerberos._tcp.Perth._sites.EXAMPLE.COM"}},
+		{"realm site", "OTHER.COM", map[int]string{1: "dc9.other.com:88"}, []string{"_kerberos._tcp.Sydney._sites.OTHER.COM"}},
+		{"configured kdcs", "STATIC.COM", map[int]string{1: "kdc.static.com:88"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups = nil
+			groups, err := k.kdcs(context.Background(), k.krb5Config.Load(), tt.realm, protoUdp, k.policy(tt.realm).site)
+			if err != nil {
+				t.Fatalf("kdcs() error = %v", err)
+			}
+			if !reflect.DeepEqual(groups[0], tt.wantFirst) {
+				t.Errorf("kdcs() first group = %v, want %v", groups[0], tt.wantFirst)
+			}
+			if !reflect.DeepEqual(lookups, tt.wantLookups) {
+				t.Errorf("lookups = %v, want %v", lookups, tt.wantLookups)
+			}
+		})
+	}
+
+	// requests go to the first domain controller in the site
+	req := testASReq(t)
+	msg := &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(req)), req...), TargetDomain: "EXAMPLE.COM"}
+	if _, err := k.Forward(context.Background(), msg); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+	if want := []string{"udp/dc2.example.com:88"}; !reflect.DeepEqual(transport.kdcs, want) {
+		t.Errorf("transport exchanges = %v, want %v", transport.kdcs, want)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/internal/metricsutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LatencyObjective is a service level objective that a Target fraction of requests, such as 0.95,
+// are forwarded successfully within Threshold
+type LatencyObjective struct {
+	Target    float64
+	Threshold time.Duration
+}
+
+// ParseLatencyObjective parses an objective given as target:threshold, where the target is a
+// fraction or a percentage, such as "0.95:500ms" or "95%:500ms"
+func ParseLatencyObjective(s string) (LatencyObjective, error) {
+	target, threshold, ok := strings.Cut(s, ":")
+	if !ok {
+		return LatencyObjective{}, fmt.Errorf("objective must be target:threshold")
+	}
+
+	var o LatencyObjective
+	var err error
+	if percent, ok := strings.CutSuffix(target, "%"); ok {
+		o.Target, err = strconv.ParseFloat(percent, 64)
+		// avoid rounding errors so 99.9% is 0.999 in metric labels
+		o.Target = math.Round(o.Target*1e7) / 1e9
+	} else {
+		o.Target, err = strconv.ParseFloat(target, 64)
+	}
+	if err != nil {
+		return LatencyObjective{}, fmt.Errorf("invalid target: %w", err)
+	}
+	if o.Threshold, err = time.ParseDuration(threshold); err != nil {
+		return LatencyObjective{}, fmt.Errorf("invalid threshold: %w", err)
+	}
+
+	return o, o.validate()
+}
+
+// String returns the objective as target:threshold, which is used as the objective label of metrics
+func (o LatencyObjective) String() string {
+	return strconv.FormatFloat(o.Target, 'f', -1, 64) + ":" + o.Threshold.String()
+}
+
+func (o LatencyObjective) validate() error {
+	if o.Target <= 0 || o.Target >= 1 {
+		return fmt.Errorf("target must be between 0 and 1")
+	}
+	if o.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+
+	return nil
+}
+
+// slo exports metrics for latency objectives, so alerts can be raised when the objectives are at risk
+type slo struct {
+	objectives []LatencyObjective
+	labels     []string
+
+	latency    *prometheus.SummaryVec
+	requests   *prometheus.CounterVec
+	violations *prometheus.CounterVec
+	burn       *prometheus.CounterVec
+}
+
+func newSLO(reg prometheus.Registerer, objectives []LatencyObjective) (*slo, error) {
+	// quantiles for the targets of each objective as well as the median and tail
+	quantiles := map[float64]float64{0.5: 0.05, 0.99: 0.001}
+	labels := make([]string, len(objectives))
+	for i, o := range objectives {
+		quantiles[o.Target] = (1 - o.Target) / 10
+		labels[i] = o.String()
+	}
+
+	r := metricsutil.NewRegistrar(reg)
+	s := &slo{
+		objectives: objectives,
+		labels:     labels,
+		latency: metricsutil.Register(r, prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       "kdc_proxy_kerberos_forward_latency_seconds",
+			Help:       "Quantiles of the time taken to forward requests to a KDC over the last 10 minutes in seconds",
+			Objectives: quantiles,
+		}, []string{"realm"})),
+		requests: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_slo_requests_total",
+			Help: "The total number of requests counted towards a latency objective",
+		}, []string{"objective", "realm"})),
+		violations: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_slo_violations_total",
+			Help: "The total number of requests that failed or were slower than the threshold of a latency objective",
+		}, []string{"objective", "realm"})),
+		burn: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_slo_error_budget_burn_total",
+			Help: "The error budget of a latency objective used by violations, increasing faster than kdc_proxy_slo_requests_total when the budget is being used too quickly",
+		}, []string{"objective", "realm"})),
+	}
+
+	return s, r.Err()
+}
+
+// observe records a forwarded request against each objective
+func (s *slo) observe(realm string, d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+
+	s.latency.WithLabelValues(realm).Observe(d.Seconds())
+	for i, o := range s.objectives {
+		s.requests.WithLabelValues(s.labels[i], realm).Inc()
+		if err == nil && d <= o.Threshold {
+			continue
+		}
+
+		// each violation uses the budget of 1/(1-target) requests, so the rate of the burn counter
+		// over the rate of requests is the burn rate
+		s.violations.WithLabelValues(s.labels[i], realm).Inc()
+		s.burn.WithLabelValues(s.labels[i], realm).Add(1 / (1 - o.Target))
+	}
+}
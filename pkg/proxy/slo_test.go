@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseLatencyObjective(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LatencyObjective
+		wantErr bool
+	}{
+		{"0.95:500ms", LatencyObjective{0.95, 500 * time.Millisecond}, false},
+		{"99.9%:1s", LatencyObjective{0.999, time.Second}, false},
+		{"95%", LatencyObjective{}, true},
+		{"100%:1s", LatencyObjective{}, true},
+		{"0.95:fast", LatencyObjective{}, true},
+		{"0.95:0s", LatencyObjective{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLatencyObjective(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLatencyObjective() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseLatencyObjective() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSLO(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	s, err := newSLO(reg, []LatencyObjective{{0.9, 500 * time.Millisecond}, {0.99, time.Second}})
+	if err != nil {
+		t.Fatalf("newSLO() error = %v", err)
+	}
+
+	s.observe("EXAMPLE.COM", 100*time.Millisecond, nil)
+	s.observe("EXAMPLE.COM", 700*time.Millisecond, nil)
+	s.observe("EXAMPLE.COM", 100*time.Millisecond, errors.New("timeout"))
+
+	tests := []struct {
+		objective  string
+		requests   float64
+		violations float64
+		burn       float64
+	}{
+		{"0.9:500ms", 3, 2, 20},
+		{"0.99:1s", 3, 1, 100},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(s.requests.WithLabelValues(tt.objective, "EXAMPLE.COM")); got != tt.requests {
+			t.Errorf("%s requests = %v, want %v", tt.objective, got, tt.requests)
+		}
+		if got := testutil.ToFloat64(s.violations.WithLabelValues(tt.objective, "EXAMPLE.COM")); got != tt.violations {
+			t.Errorf("%s violations = %v, want %v", tt.objective, got, tt.violations)
+		}
+		if got := testutil.ToFloat64(s.burn.WithLabelValues(tt.objective, "EXAMPLE.COM")); got < tt.burn-0.001 || got > tt.burn+0.001 {
+			t.Errorf("%s burn = %v, want %v", tt.objective, got, tt.burn)
+		}
+	}
+
+	if _, err := NewKdcProxy(WithRegistry(reg), WithLatencyObjectives(LatencyObjective{Target: 1, Threshold: time.Second})); err == nil {
+		t.Error("NewKdcProxy() with an invalid objective did not return an error")
+	}
+}
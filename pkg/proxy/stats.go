@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Stats is a snapshot of the runtime state of a KerberosProxy
+type Stats struct {
+	Started  time.Time         `json:"started"`
+	Uptime   float64           `json:"uptime_seconds"`
+	InFlight int64             `json:"in_flight"`
+	Limiter  LimiterStats      `json:"limiter"`
+	Realms   map[string]uint64 `json:"realms"`
+	KDCs     []KDCStats        `json:"kdcs"`
+}
+
+// LimiterStats is the state of the rate limiter, which is empty when a custom Limiter is used
+type LimiterStats struct {
+	Limit  float64 `json:"limit"`
+	Burst  int     `json:"burst"`
+	Tokens float64 `json:"tokens"`
+}
+
+// KDCStats is the health and latency of a single KDC
+type KDCStats struct {
+	Address        string    `json:"address"`
+	Proto          string    `json:"proto"`
+	Up             bool      `json:"up"`
+	Attempts       uint64    `json:"attempts"`
+	Failures       uint64    `json:"failures"`
+	LastAttempt    time.Time `json:"last_attempt"`
+	LastLatency    float64   `json:"last_latency_seconds"`
+	AverageLatency float64   `json:"average_latency_seconds"`
+}
+
+type kdcKey struct {
+	kdc   string
+	proto string
+}
+
+type kdcState struct {
+	up          bool
+	attempts    uint64
+	failures    uint64
+	lastAttempt time.Time
+	lastLatency time.Duration
+	total       time.Duration
+}
+
+// stats tracks the runtime state that is not otherwise available from the limiter or metrics
+type stats struct {
+	mu      sync.Mutex
+	started time.Time
+	realms  map[string]uint64
+	kdcs    map[kdcKey]*kdcState
+}
+
+func newStats() *stats {
+	return &stats{
+		started: time.Now(),
+		realms:  make(map[string]uint64),
+		kdcs:    make(map[kdcKey]*kdcState),
+	}
+}
+
+func (s *stats) request(realm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.realms[realm]++
+}
+
+func (s *stats) exchange(kdc, proto string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := kdcKey{kdc, proto}
+	st, ok := s.kdcs[key]
+	if !ok {
+		st = &kdcState{}
+		s.kdcs[key] = st
+	}
+
+	st.attempts++
+	st.lastAttempt = time.Now()
+	st.lastLatency = latency
+	if err != nil {
+		st.failures++
+		st.up = false
+		return
+	}
+	st.up = true
+	st.total += latency
+}
+
+// Stats returns a snapshot of the current runtime state
+func (k *KerberosProxy) Stats() Stats {
+	k.stats.mu.Lock()
+	defer k.stats.mu.Unlock()
+
+	s := Stats{
+		Started:  k.stats.started,
+		Uptime:   time.Since(k.stats.started).Seconds(),
+		InFlight: k.inFlightCount.Load(),
+		Realms:   make(map[string]uint64, len(k.stats.realms)),
+		KDCs:     make([]KDCStats, 0, len(k.stats.kdcs)),
+	}
+
+	// limiter state is only available from the built-in limiter
+	if l, ok := k.limiter.(*rate.Limiter); ok {
+		s.Limiter = LimiterStats{
+			Limit:  float64(l.Limit()),
+			Burst:  l.Burst(),
+			Tokens: l.Tokens(),
+		}
+	}
+
+	for realm, n := range k.stats.realms {
+		s.Realms[realm] = n
+	}
+
+	for key, st := range k.stats.kdcs {
+		kdc := KDCStats{
+			Address:     key.kdc,
+			Proto:       key.proto,
+			Up:          st.up,
+			Attempts:    st.attempts,
+			Failures:    st.failures,
+			LastAttempt: st.lastAttempt,
+			LastLatency: st.lastLatency.Seconds(),
+		}
+		if successes := st.attempts - st.failures; successes > 0 {
+			kdc.AverageLatency = (st.total / time.Duration(successes)).Seconds()
+		}
+		s.KDCs = append(s.KDCs, kdc)
+	}
+
+	sort.Slice(s.KDCs, func(i, j int) bool {
+		if s.KDCs[i].Address == s.KDCs[j].Address {
+			return s.KDCs[i].Proto < s.KDCs[j].Proto
+		}
+		return s.KDCs[i].Address < s.KDCs[j].Address
+	})
+
+	return s
+}
+
+// StatsHandler returns a http.Handler that responds with the current runtime state as JSON
+func (k *KerberosProxy) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(k.Stats())
+	})
+}
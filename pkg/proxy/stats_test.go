@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	k, err := NewKdcProxy()
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	k.stats.request("EXAMPLE.COM")
+	k.stats.request("EXAMPLE.COM")
+	k.stats.exchange("kdc1.example.com:88", protoUdp, time.Second, nil)
+	k.stats.exchange("kdc1.example.com:88", protoUdp, 3*time.Second, nil)
+	k.stats.exchange("kdc2.example.com:88", protoTcp, time.Second, fmt.Errorf("failed"))
+
+	s := k.Stats()
+
+	if got := s.Realms["EXAMPLE.COM"]; got != 2 {
+		t.Errorf("Stats().Realms[EXAMPLE.COM] = %v, want %v", got, 2)
+	}
+
+	if len(s.KDCs) != 2 {
+		t.Fatalf("len(Stats().KDCs) = %v, want %v", len(s.KDCs), 2)
+	}
+
+	if !s.KDCs[0].Up || s.KDCs[0].AverageLatency != 2 {
+		t.Errorf("Stats().KDCs[0] = %+v, want up with average latency of 2", s.KDCs[0])
+	}
+
+	if s.KDCs[1].Up || s.KDCs[1].Failures != 1 {
+		t.Errorf("Stats().KDCs[1] = %+v, want down with 1 failure", s.KDCs[1])
+	}
+}
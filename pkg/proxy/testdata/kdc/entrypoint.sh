@@ -0,0 +1,9 @@
+#!/bin/sh
+set -e
+
+# create the realm and the principals used by the tests
+kdb5_util create -s -r EXAMPLE.COM -P masterpassword
+kadmin.local -q "addprinc -pw password -requires_preauth user@EXAMPLE.COM"
+kadmin.local -q "addprinc -randkey host/service.example.com@EXAMPLE.COM"
+
+exec krb5kdc -n
@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer used for all spans created by the proxy
+const tracerName = "github.com/andrewheberle/kdcproxy/pkg/proxy"
+
+// tracer returns the tracer used for all spans created by the proxy, which is looked up for each
+// request so the global trace provider may be set after the proxy is created
+func (k *KerberosProxy) tracer() trace.Tracer {
+	if k.tracing != nil {
+		return k.tracing.Tracer(tracerName)
+	}
+
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	// the first kdc sends a truncated reply so the second is tried
+	reply := testKRBError(t)
+	kdcs := []*fakeKDC{newFakeKDC(t, reply), newFakeKDC(t, reply)}
+	sort.Slice(kdcs, func(i, j int) bool { return kdcs[i].addr < kdcs[j].addr })
+	kdcs[0].behaviour = kdcTruncated
+	kdcs[1].behaviour = kdcReply
+	for _, kdc := range kdcs {
+		kdc.serve()
+	}
+
+	k, err := NewKdcProxy(
+		WithKDCs("EXAMPLE.COM", kdcs[0].addr, kdcs[1].addr),
+		WithRegistry(prometheus.NewRegistry()),
+		WithProtocols(protoTcp),
+		WithStrategy(StrategyRoundRobin),
+		WithTracerProvider(tp),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testProxyMessage(t, testASReq(t), "EXAMPLE.COM")))
+	w := httptest.NewRecorder()
+	k.Handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var server sdktrace.ReadOnlySpan
+	var exchanges []sdktrace.ReadOnlySpan
+	for _, s := range sr.Ended() {
+		switch s.Name() {
+		case "KdcProxy":
+			server = s
+		case "exchange":
+			exchanges = append(exchanges, s)
+		}
+	}
+	if server == nil {
+		t.Fatal("no server span")
+	}
+	if server.SpanKind() != trace.SpanKindServer {
+		t.Errorf("server span kind = %v, want %v", server.SpanKind(), trace.SpanKindServer)
+	}
+	if !hasAttribute(server.Attributes(), attribute.String("kerberos.realm", "EXAMPLE.COM")) {
+		t.Errorf("server span attributes = %v, want the realm", server.Attributes())
+	}
+	if server.Status().Code != codes.Unset {
+		t.Errorf("server span status = %v, want %v", server.Status().Code, codes.Unset)
+	}
+
+	if len(exchanges) != len(kdcs) {
+		t.Fatalf("exchange spans = %d, want %d", len(exchanges), len(kdcs))
+	}
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].StartTime().Before(exchanges[j].StartTime()) })
+	for i, s := range exchanges {
+		if s.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("exchange %d parent = %v, want the server span", i, s.Parent().SpanID())
+		}
+		if s.SpanKind() != trace.SpanKindClient {
+			t.Errorf("exchange %d kind = %v, want %v", i, s.SpanKind(), trace.SpanKindClient)
+		}
+		for _, want := range []attribute.KeyValue{
+			attribute.String("kerberos.kdc", kdcs[i].addr),
+			attribute.String("network.transport", protoTcp),
+		} {
+			if !hasAttribute(s.Attributes(), want) {
+				t.Errorf("exchange %d attributes = %v, want %v", i, s.Attributes(), want)
+			}
+		}
+	}
+	if got := exchanges[0].Status().Code; got != codes.Error {
+		t.Errorf("failed exchange status = %v, want %v", got, codes.Error)
+	}
+	if len(exchanges[0].Events()) == 0 {
+		t.Error("failed exchange did not record the error")
+	}
+	if got := exchanges[1].Status().Code; got != codes.Unset {
+		t.Errorf("successful exchange status = %v, want %v", got, codes.Unset)
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if a == want {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Transport exchanges a Kerberos message with a single KDC.
+//
+// The request and response both include the leading 4-byte length as used by Kerberos over TCP,
+// so implementations using a datagram protocol are responsible for removing and adding it. The
+// exchange should be abandoned once ctx is done.
+type Transport interface {
+	Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error)
+}
+
+// DefaultMaxResponseSize is the default limit on the size of a response from a KDC
+const DefaultMaxResponseSize = maxLength
+
+// maxDatagramSize is the largest possible UDP payload
+const maxDatagramSize = 65535
+
+// NetTransport is the default Transport that contacts KDC's directly via UDP or TCP
+type NetTransport struct {
+	// MaxResponseSize limits the size of a response from a KDC, excluding the 4-byte length. The
+	// default of 0 uses DefaultMaxResponseSize.
+	MaxResponseSize int
+
+	// FastOpen enables TCP Fast Open on connections to KDC's where the OS supports it, currently
+	// Linux only, so that repeat requests are sent with the SYN rather than after the handshake
+	FastOpen bool
+}
+
+// Exchange implements Transport
+func (t *NetTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	// connect to kdc
+	dialer := net.Dialer{}
+	if t.FastOpen {
+		dialer.Control = fastOpenControl
+	}
+	start := time.Now()
+	attemptLog(ctx).DebugContext(ctx, "connecting to kdc")
+	conn, err := dialer.DialContext(ctx, proto, kdc)
+	if err != nil {
+		return nil, err
+	}
+	attemptLog(ctx).DebugContext(ctx, "connected to kdc", "duration", time.Since(start), "local_addr", conn.LocalAddr().String())
+
+	return exchangeConn(ctx, proto, conn, req, t.MaxResponseSize)
+}
+
+// exchangeConn sends req over conn and returns the response, which may be no larger than max
+// bytes, closing conn once done
+func exchangeConn(ctx context.Context, proto string, conn net.Conn, req []byte, max int) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// abort any blocked reads or writes if the caller gives up
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// for udp trim off length
+	if proto == protoUdp {
+		req = req[4:]
+	}
+
+	// send message
+	n, err := conn.Write(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// check that all the data was sent
+	if n != len(req) {
+		conn.Close()
+		return nil, errShortWrite
+	}
+
+	sent := time.Now()
+	attemptLog(ctx).DebugContext(ctx, "request sent to kdc", "size", n)
+
+	// get Kerberos response
+	if max <= 0 {
+		max = DefaultMaxResponseSize
+	}
+	resp, err := getresponse(conn, max)
+	if err != nil {
+		return nil, err
+	}
+	attemptLog(ctx).DebugContext(ctx, "read response from kdc", "wait", time.Since(sent), "size", len(resp))
+
+	return resp, nil
+}
+
+func getresponse(conn net.Conn, max int) ([]byte, error) {
+	// close connection once done
+	defer conn.Close()
+
+	// handle udp and tcp responses differently
+	if conn.LocalAddr().Network() == protoUdp {
+		// for udp read a single datagram
+		buf := make([]byte, min(max, maxDatagramSize)+1)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n > max {
+			return nil, fmt.Errorf("%w: more than %d bytes", errReplyTooLarge, max)
+		}
+		msg := buf[:n]
+
+		// validate response
+		if !validReply(msg) {
+			return nil, errInvalidReply
+		}
+
+		// return message with length added
+		return append(MarshalKerbLength(len(msg)), msg...), nil
+	}
+
+	// read initial 4 bytes to get length of response
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	// work out length of message
+	length, err := UnmarshalKerbLength(buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if length > max {
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d", errReplyTooLarge, length, max)
+	}
+
+	// read rest of message incrementally so a short response does not allocate the claimed length
+	resp := bytes.NewBuffer(buf)
+	if _, err := io.CopyN(resp, conn, int64(length)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	// validate response, which also catches a length that does not match the message
+	if !validReply(resp.Bytes()[4:]) {
+		return nil, errInvalidReply
+	}
+
+	// return response (including length)
+	return resp.Bytes(), nil
+}
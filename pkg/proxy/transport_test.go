@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNetTransport(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+	req = append(MarshalKerbLength(len(req)), req...)
+
+	tests := []struct {
+		name    string
+		proto   string
+		kdc     string
+		max     int
+		want    []byte
+		wantErr error
+	}{
+		{"tcp", protoTcp, startFakeKDC(t, reply, kdcReply).addr, 0, reply, nil},
+		{"tcp claimed length too large", protoTcp, startFakeKDC(t, reply, kdcTooLarge).addr, 0, nil, errReplyTooLarge},
+		{"tcp over configured limit", protoTcp, startFakeKDC(t, reply, kdcReply).addr, len(reply) - 1, nil, errReplyTooLarge},
+		{"tcp truncated", protoTcp, startFakeKDC(t, reply, kdcTruncated).addr, 0, nil, io.ErrUnexpectedEOF},
+		{"udp", protoUdp, startFakeKDC(t, reply, kdcReply).addr, 0, reply, nil},
+		{"udp over configured limit", protoUdp, startFakeKDC(t, reply, kdcReply).addr, len(reply) - 1, nil, errReplyTooLarge},
+		{"udp invalid", protoUdp, startFakeKDC(t, reply, kdcTruncated).addr, 0, nil, errInvalidReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			tr := &NetTransport{MaxResponseSize: tt.max}
+			resp, err := tr.Exchange(ctx, tt.proto, tt.kdc, req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Exchange() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if !bytes.Equal(resp[4:], tt.want) {
+				t.Errorf("Exchange() = %x, want %x", resp[4:], tt.want)
+			}
+			if n, _ := UnmarshalKerbLength(resp); n != len(tt.want) {
+				t.Errorf("Exchange() length = %v, want %v", n, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestNetTransportFastOpen(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+	req = append(MarshalKerbLength(len(req)), req...)
+
+	tr := &NetTransport{FastOpen: true}
+	kdc := startFakeKDC(t, reply, kdcReply)
+	for _, proto := range []string{protoTcp, protoUdp} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := tr.Exchange(ctx, proto, kdc.addr, req)
+		cancel()
+		if err != nil {
+			t.Fatalf("Exchange(%s) error = %v", proto, err)
+		}
+		if !bytes.Equal(resp[4:], reply) {
+			t.Errorf("Exchange(%s) = %x, want %x", proto, resp[4:], reply)
+		}
+	}
+}
+
+func TestAttemptLogging(t *testing.T) {
+	reply := testKRBError(t)
+	kdc := startFakeKDC(t, reply, kdcReply).addr
+
+	var buf bytes.Buffer
+	k, err := NewKdcProxy(
+		WithKrb5ConfString("[libdefaults]\n dns_lookup_kdc = false\n[realms]\n EXAMPLE.COM = {\n  kdc = 127.0.0.1:1\n  kdc = "+kdc+"\n }\n"),
+		WithRegistry(prometheus.NewRegistry()),
+		WithStrategy(StrategyRoundRobin),
+		WithProtocols(protoTcp),
+		WithLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	// the first kdc refuses the connection so the request is answered by the second attempt
+	ctx := ContextWithRequestID(context.Background(), "abc123")
+	if _, err := k.Forward(ctx, &KdcProxyMsg{KerbMessage: append(MarshalKerbLength(len(reply)), reply...), TargetDomain: "EXAMPLE.COM"}); err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+
+	for _, want := range []string{
+		`msg="connecting to kdc" req_id=abc123 attempt=1 kdc=127.0.0.1:1`,
+		`msg="kdc exchange failed" req_id=abc123 attempt=1 kdc=127.0.0.1:1`,
+		`msg="connected to kdc" req_id=abc123 attempt=2 kdc=` + kdc,
+		`msg="request sent to kdc" req_id=abc123 attempt=2 kdc=` + kdc,
+		`msg="read response from kdc" req_id=abc123 attempt=2 kdc=` + kdc,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log missing %s:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultWarmMaxIdle is the default time a pre-warmed connection is kept before it is replaced
+const DefaultWarmMaxIdle = 30 * time.Second
+
+// WarmTransport is a Transport that keeps one pre-established TCP connection to each KDC that has
+// answered, so requests after a quiet period do not pay connection set up latency across a WAN.
+// Each connection is used for a single exchange and is replaced in the background once used or once
+// it has been idle for the maximum idle time, for as long as the KDC accepts connections. UDP
+// exchanges are handled as per NetTransport.
+type WarmTransport struct {
+	// MaxResponseSize limits the size of a response from a KDC, excluding the 4-byte length. The
+	// default of 0 uses DefaultMaxResponseSize.
+	MaxResponseSize int
+
+	maxIdle time.Duration
+	dialer  net.Dialer
+
+	mu     sync.Mutex
+	conns  map[string]*warmConn
+	closed bool
+}
+
+// warmConn is an idle pre-established connection
+type warmConn struct {
+	conn    net.Conn
+	refresh *time.Timer
+}
+
+// NewWarmTransport returns a WarmTransport that replaces idle connections after maxIdle, which
+// should be less than the idle timeout of the KDC's
+func NewWarmTransport(maxIdle time.Duration) *WarmTransport {
+	if maxIdle <= 0 {
+		maxIdle = DefaultWarmMaxIdle
+	}
+
+	return &WarmTransport{
+		maxIdle: maxIdle,
+		conns:   make(map[string]*warmConn),
+	}
+}
+
+// Exchange implements Transport
+func (t *WarmTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	if proto != protoTcp {
+		return (&NetTransport{MaxResponseSize: t.MaxResponseSize}).Exchange(ctx, proto, kdc, req)
+	}
+
+	// use a warm connection if one is available, falling back to a new connection if the KDC has
+	// since closed it
+	if conn := t.take(kdc); conn != nil {
+		attemptLog(ctx).DebugContext(ctx, "using pre-established connection to kdc", "local_addr", conn.LocalAddr().String())
+		if resp, err := exchangeConn(ctx, proto, conn, req, t.MaxResponseSize); err == nil {
+			go t.warm(kdc)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	resp, err := (&NetTransport{MaxResponseSize: t.MaxResponseSize}).Exchange(ctx, proto, kdc, req)
+	if err != nil {
+		return nil, err
+	}
+	go t.warm(kdc)
+
+	return resp, nil
+}
+
+// Close closes all idle connections and stops any further connections being pre-warmed
+func (t *WarmTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for kdc, w := range t.conns {
+		w.refresh.Stop()
+		w.conn.Close()
+		delete(t.conns, kdc)
+	}
+
+	return nil
+}
+
+// take removes and returns the idle connection for kdc, if any
+func (t *WarmTransport) take(kdc string) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	w, ok := t.conns[kdc]
+	if !ok {
+		return nil
+	}
+	delete(t.conns, kdc)
+	w.refresh.Stop()
+
+	return w.conn
+}
+
+// warm establishes an idle connection to kdc if there is not one already. Failure to connect means
+// the KDC is no longer healthy, so no connection is kept.
+func (t *WarmTransport) warm(kdc string) {
+	t.mu.Lock()
+	_, ok := t.conns[kdc]
+	t.mu.Unlock()
+	if ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+
+	conn, err := t.dialer.DialContext(ctx, protoTcp, kdc)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.conns[kdc]; ok || t.closed {
+		conn.Close()
+		return
+	}
+
+	w := &warmConn{conn: conn}
+	w.refresh = time.AfterFunc(t.maxIdle, func() {
+		t.mu.Lock()
+		if t.conns[kdc] != w {
+			t.mu.Unlock()
+			return
+		}
+		delete(t.conns, kdc)
+		t.mu.Unlock()
+
+		conn.Close()
+		t.warm(kdc)
+	})
+	t.conns[kdc] = w
+}
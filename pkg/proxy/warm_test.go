@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWarmTransport(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+	f := startFakeKDC(t, reply, kdcReply)
+	kdc := f.addr
+
+	tr := NewWarmTransport(time.Minute)
+	defer tr.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := tr.Exchange(ctx, protoTcp, kdc, append(MarshalKerbLength(len(req)), req...))
+		cancel()
+		if err != nil {
+			t.Fatalf("Exchange() error = %v", err)
+		}
+		if !bytes.Equal(resp[4:], reply) {
+			t.Fatalf("Exchange() = %x, want %x", resp[4:], reply)
+		}
+
+		// wait for the connection to be replaced
+		deadline := time.Now().Add(time.Second)
+		for {
+			tr.mu.Lock()
+			_, ok := tr.conns[kdc]
+			tr.mu.Unlock()
+			if ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("connection was not pre-warmed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// one connection for the first exchange and one warm connection after each exchange
+	if got := f.accepted.Load(); got != 4 {
+		t.Errorf("accepted connections = %v, want 4", got)
+	}
+
+	tr.Close()
+	if len(tr.conns) != 0 {
+		t.Errorf("idle connections after Close() = %v, want 0", len(tr.conns))
+	}
+}
+
+func TestWarmTransportStale(t *testing.T) {
+	reply := testKRBError(t)
+	req := testASReq(t)
+	kdc := startFakeKDC(t, reply, kdcReply).addr
+
+	tr := NewWarmTransport(time.Minute)
+	defer tr.Close()
+
+	// a connection closed by the KDC must fall back to a new connection
+	client, server := net.Pipe()
+	server.Close()
+	tr.conns[kdc] = &warmConn{conn: client, refresh: time.NewTimer(time.Hour)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := tr.Exchange(ctx, protoTcp, kdc, append(MarshalKerbLength(len(req)), req...))
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if !bytes.Equal(resp[4:], reply) {
+		t.Errorf("Exchange() = %x, want %x", resp[4:], reply)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchConfig watches the provided "krb5.conf" file and reloads it whenever it changes until ctx is
+// cancelled. If the updated file cannot be loaded the current configuration is kept.
+func (k *KerberosProxy) WatchConfig(ctx context.Context, config string) error {
+	return k.WatchConfigs(ctx, config)
+}
+
+// WatchConfigs watches the provided "krb5.conf" files and reloads and merges them, as per
+// LoadConfigs, whenever any of them change until ctx is cancelled. If the updated files cannot be
+// loaded the current configuration is kept.
+func (k *KerberosProxy) WatchConfigs(ctx context.Context, configs ...string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// watch the directories so replacing a file (including via symlink swaps) is detected
+	watched := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		config = filepath.Clean(config)
+		watched[config] = true
+		if err := watcher.Add(filepath.Dir(config)); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			// only care about writes/creates of the configs or a kubernetes style "..data" swap
+			if !watched[filepath.Clean(ev.Name)] && filepath.Base(ev.Name) != "..data" {
+				continue
+			}
+			if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) {
+				continue
+			}
+
+			if err := k.LoadConfigs(configs...); err != nil {
+				k.logger.ErrorContext(ctx, "could not reload krb5 config", "path", ev.Name, "error", err)
+				continue
+			}
+			k.logger.InfoContext(ctx, "reloaded krb5 config", "path", ev.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			k.logger.ErrorContext(ctx, "error watching krb5 config", "error", err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
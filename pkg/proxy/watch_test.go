@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "krb5.conf")
+	if err := os.WriteFile(config, []byte("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := NewKdcProxy(WithConfig(config))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- k.WatchConfig(ctx, config)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("WatchConfig() error = %v", err)
+		}
+	}()
+
+	// wait for the watcher to start then add a realm
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(config, []byte("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n OTHER.COM = {\n  kdc = kdc.other.com:88\n }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, _, err := k.krb5Config.Load().GetKDCs("OTHER.COM", true); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("config was not reloaded after change")
+}
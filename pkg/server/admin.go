@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+)
+
+// AdminLogLevelPath is the endpoint used to view and change the log level at runtime
+const AdminLogLevelPath = "/admin/loglevel"
+
+// logLevel is the request and response body of the log level endpoint
+type logLevel struct {
+	Level string `json:"level"`
+	// Duration is how long the level applies before reverting, when set
+	Duration string `json:"duration,omitempty"`
+}
+
+// logLevelAdmin changes the global log level, optionally reverting to the previous level after a time
+type logLevelAdmin struct {
+	token  string
+	logger zerolog.Logger
+
+	mu       sync.Mutex
+	revert   *time.Timer
+	previous zerolog.Level
+}
+
+// AdminErrorsPath is the endpoint that returns the most recent errors forwarding requests
+const AdminErrorsPath = "/admin/errors"
+
+// AdminRateLimitPath is the endpoint used to view and change the rate limits at runtime
+const AdminRateLimitPath = "/admin/ratelimit"
+
+// rateLimitChange is the request body of the rate limit endpoint
+type rateLimitChange struct {
+	// Realm is the realm to change the limit of, otherwise the proxy wide limit is changed
+	Realm string `json:"realm,omitempty"`
+	Limit int    `json:"limit"`
+	// Burst applies to the proxy wide limit, where 0 is the same as the limit
+	Burst int `json:"burst,omitempty"`
+}
+
+// rateLimitAdmin changes the rate limits of the proxy, or a tenant given by the "tenant" query
+// parameter, until the configuration is next reloaded
+type rateLimitAdmin struct {
+	token   string
+	proxy   *proxy.KerberosProxy
+	tenants map[string]*proxy.KerberosProxy
+	logger  zerolog.Logger
+}
+
+// adminAuthorized returns true if the request has the admin bearer token
+func adminAuthorized(r *http.Request, adminToken string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminHandler only passes GET requests with the admin bearer token to next
+func adminHandler(adminToken string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r, adminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized returns true if the request has the admin bearer token
+func (a *logLevelAdmin) authorized(r *http.Request) bool {
+	return adminAuthorized(r, a.token)
+}
+
+// ServeHTTP returns the current level for GET and sets the level for PUT
+func (a *logLevelAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req logLevel
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		level, err := zerolog.ParseLevel(req.Level)
+		if err != nil || level == zerolog.NoLevel {
+			http.Error(w, "Invalid level", http.StatusBadRequest)
+			return
+		}
+
+		var d time.Duration
+		if req.Duration != "" {
+			if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+
+		a.set(level, d)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevel{Level: zerolog.GlobalLevel().String()})
+}
+
+// ServeHTTP returns the current rate limits for GET and changes a limit for PUT
+func (a *rateLimitAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r, a.token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	k := a.proxy
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" {
+		var ok bool
+		if k, ok = a.tenants[tenant]; !ok {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req rateLimitChange
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		var err error
+		if req.Realm != "" {
+			err = k.SetRealmRateLimit(req.Realm, req.Limit)
+		} else {
+			err = k.SetRateLimit(req.Limit, req.Burst)
+		}
+		if err != nil {
+			http.Error(w, "Invalid rate limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.logger.WithLevel(zerolog.NoLevel).
+			Str("tenant", tenant).
+			Str("realm", req.Realm).
+			Int("limit", req.Limit).
+			Int("burst", req.Burst).
+			Msg("rate limit changed")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k.RateLimits())
+}
+
+// set changes the global log level, reverting to the current level after d if it is not 0
+func (a *logLevelAdmin) set(level zerolog.Level, d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// a pending revert is to the level before it was first changed
+	previous := zerolog.GlobalLevel()
+	if a.revert != nil && a.revert.Stop() {
+		previous = a.previous
+	}
+	a.revert = nil
+
+	zerolog.SetGlobalLevel(level)
+	a.logger.WithLevel(zerolog.NoLevel).Str("level", level.String()).Dur("duration", d).Msg("log level changed")
+
+	if d > 0 {
+		a.previous = previous
+		a.revert = time.AfterFunc(d, func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+
+			zerolog.SetGlobalLevel(previous)
+			a.logger.WithLevel(zerolog.NoLevel).Str("level", previous.String()).Msg("log level reverted")
+		})
+	}
+}
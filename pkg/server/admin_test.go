@@ -0,0 +1,197 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLogLevelAdmin(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	s := testServer(t, Config{AdminToken: "token"})
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		want   int
+		level  zerolog.Level
+	}{
+		{"no token", http.MethodGet, "", "", http.StatusUnauthorized, zerolog.InfoLevel},
+		{"wrong token", http.MethodPut, "wrong", `{"level":"debug"}`, http.StatusUnauthorized, zerolog.InfoLevel},
+		{"get", http.MethodGet, "token", "", http.StatusOK, zerolog.InfoLevel},
+		{"invalid level", http.MethodPut, "token", `{"level":"verbose"}`, http.StatusBadRequest, zerolog.InfoLevel},
+		{"invalid duration", http.MethodPut, "token", `{"level":"debug","duration":"-1m"}`, http.StatusBadRequest, zerolog.InfoLevel},
+		{"post", http.MethodPost, "token", `{"level":"debug"}`, http.StatusMethodNotAllowed, zerolog.InfoLevel},
+		{"set", http.MethodPut, "token", `{"level":"debug"}`, http.StatusOK, zerolog.DebugLevel},
+		{"set back", http.MethodPut, "token", `{"level":"info"}`, http.StatusOK, zerolog.InfoLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, AdminLogLevelPath, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := zerolog.GlobalLevel(); got != tt.level {
+				t.Errorf("level = %s, want %s", got, tt.level)
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"level":"`+tt.level.String()+`"`) {
+				t.Errorf("body = %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestLogLevelAdminRevert(t *testing.T) {
+	defer zerolog.SetGlobalLevel(zerolog.GlobalLevel())
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	a := &logLevelAdmin{logger: zerolog.Nop()}
+	a.set(zerolog.DebugLevel, 50*time.Millisecond)
+
+	// changing again before the revert keeps the original level to revert to
+	a.set(zerolog.TraceLevel, 50*time.Millisecond)
+	if got := zerolog.GlobalLevel(); got != zerolog.TraceLevel {
+		t.Errorf("level = %s, want trace", got)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for zerolog.GlobalLevel() != zerolog.WarnLevel {
+		if time.Now().After(deadline) {
+			t.Fatalf("level = %s, want revert to warn", zerolog.GlobalLevel())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	s := testServer(t, Config{})
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, AdminLogLevelPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminHandlers(t *testing.T) {
+	extra := map[string]http.Handler{
+		"/admin/extra": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		auth  string
+		want  int
+	}{
+		{"disabled", "", "", http.StatusNotFound},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"token", "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t, Config{AdminToken: tt.token, AdminHandlers: extra})
+
+			r := httptest.NewRequest(http.MethodGet, "/admin/extra", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminErrors(t *testing.T) {
+	s := testServer(t, Config{AdminToken: "token"})
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		want   int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"post", http.MethodPost, "token", http.StatusMethodNotAllowed},
+		{"get", http.MethodGet, "token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, AdminErrorsPath, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if w.Code == http.StatusOK && strings.TrimSpace(w.Body.String()) != "[]" {
+				t.Errorf("body = %s, want []", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminRateLimit(t *testing.T) {
+	s := testServer(t, Config{AdminToken: "token"})
+	if err := s.cfg.Proxy.SetRateLimit(10, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+		limits string
+	}{
+		{"no token", http.MethodGet, AdminRateLimitPath, "", "", http.StatusUnauthorized, ""},
+		{"get", http.MethodGet, AdminRateLimitPath, "token", "", http.StatusOK, `{"limit":10,"burst":10,"realms":{}}`},
+		{"post", http.MethodPost, AdminRateLimitPath, "token", `{"limit":50}`, http.StatusMethodNotAllowed, ""},
+		{"invalid body", http.MethodPut, AdminRateLimitPath, "token", `{"limit":"many"}`, http.StatusBadRequest, ""},
+		{"invalid limit", http.MethodPut, AdminRateLimitPath, "token", `{"limit":0}`, http.StatusBadRequest, ""},
+		{"unknown tenant", http.MethodGet, AdminRateLimitPath + "?tenant=missing", "token", "", http.StatusNotFound, ""},
+		{"set", http.MethodPut, AdminRateLimitPath, "token", `{"limit":50,"burst":100}`, http.StatusOK, `{"limit":50,"burst":100,"realms":{}}`},
+		{"set realm", http.MethodPut, AdminRateLimitPath, "token", `{"realm":"example.com","limit":5}`, http.StatusOK, `{"limit":50,"burst":100,"realms":{"EXAMPLE.COM":5}}`},
+		{"remove realm", http.MethodPut, AdminRateLimitPath, "token", `{"realm":"EXAMPLE.COM","limit":0}`, http.StatusOK, `{"limit":50,"burst":100,"realms":{}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.limits != "" && strings.TrimSpace(w.Body.String()) != tt.limits {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.limits)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// auditQueueSize is the number of exchange events buffered while waiting to be published
+	auditQueueSize = 4096
+
+	// auditBatchSize is the maximum number of events published at once
+	auditBatchSize = 100
+
+	// auditTimeout is the time allowed to publish a batch of events
+	auditTimeout = 5 * time.Second
+)
+
+// ExchangeEvent is the record of a single exchange with a KDC published to an AuditSink
+type ExchangeEvent struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"request_id,omitempty"`
+	Client    string            `json:"client,omitempty"`
+	Identity  string            `json:"identity,omitempty"`
+	Realm     string            `json:"realm"`
+	Type      proxy.MessageType `json:"type"`
+	KDC       string            `json:"kdc"`
+	Proto     string            `json:"proto"`
+	Duration  float64           `json:"duration_seconds"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// AuditSink publishes exchange events to a message broker for downstream analytics
+type AuditSink interface {
+	// Publish sends a batch of events, returning once they have been accepted by the broker
+	Publish(ctx context.Context, events []ExchangeEvent) error
+
+	// Close releases any connection to the broker
+	Close() error
+}
+
+// NewAuditSink returns an AuditSink for address, which is either a core NATS URL with a scheme of
+// nats or nats+tls and the subject as the path, such as "nats://nats.example.com:4222/kdcproxy.audit",
+// or the URL of a Kafka REST Proxy with a scheme of kafka-rest+http or kafka-rest+https and the topic
+// as the last element of the path, such as "kafka-rest+https://kafka-rest.example.com/kdcproxy-audit".
+// Kafka brokers cannot be published to directly.
+func NewAuditSink(address string) (AuditSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid audit sink address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "nats", "nats+tls":
+		subject := strings.TrimPrefix(u.Path, "/")
+		if subject == "" || strings.ContainsAny(subject, " \t\r\n/") {
+			return nil, fmt.Errorf("audit sink address must include a nats subject")
+		}
+
+		return newNATSSink(u, subject), nil
+	case "kafka-rest+http", "kafka-rest+https":
+		topic := path.Base(u.Path)
+		if topic == "." || topic == "/" {
+			return nil, fmt.Errorf("audit sink address must include a kafka topic")
+		}
+
+		return newKafkaRESTSink(u, topic), nil
+	case "kafka", "kafka+http", "kafka+https":
+		return nil, fmt.Errorf("audit sink cannot publish to kafka directly, use a kafka rest proxy with kafka-rest+http or kafka-rest+https")
+	}
+
+	return nil, fmt.Errorf("audit sink address must use nats, nats+tls, kafka-rest+http or kafka-rest+https")
+}
+
+// audit queues an event for each exchange with a KDC and publishes them to an AuditSink
+type audit struct {
+	sink    AuditSink
+	metrics *serverMetrics
+	logger  zerolog.Logger
+	events  chan ExchangeEvent
+}
+
+func newAudit(sink AuditSink, metrics *serverMetrics, logger zerolog.Logger) *audit {
+	return &audit{sink: sink, metrics: metrics, logger: logger, events: make(chan ExchangeEvent, auditQueueSize)}
+}
+
+// hooks registers a callback with the proxy that queues an event for each exchange. Events are
+// dropped rather than delaying requests when the queue is full.
+func (a *audit) hooks(k *proxy.KerberosProxy) {
+	k.OnForwardComplete(func(ctx context.Context, fe proxy.ForwardEvent) {
+		ev := ExchangeEvent{
+			Time:     time.Now().Add(-fe.Duration),
+			Realm:    fe.Realm,
+			Type:     fe.Type,
+			KDC:      fe.KDC,
+			Proto:    fe.Proto,
+			Duration: fe.Duration.Seconds(),
+		}
+		ev.RequestID, _ = proxy.RequestIDFromContext(ctx)
+		if c, ok := proxy.ClientFromContext(ctx); ok {
+			ev.Client = c.IP
+			ev.Identity = c.Identity
+		}
+		if fe.Err != nil {
+			ev.Error = fe.Err.Error()
+		}
+
+		select {
+		case a.events <- ev:
+		default:
+			a.metrics.auditDropped.Inc()
+		}
+	})
+}
+
+// Run publishes queued events in batches until ctx is cancelled
+func (a *audit) Run(ctx context.Context) error {
+	defer a.sink.Close()
+
+	batch := make([]ExchangeEvent, 0, auditBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-a.events:
+			batch = append(batch[:0], ev)
+		}
+
+		// include any other queued events
+	queued:
+		for len(batch) < auditBatchSize {
+			select {
+			case ev := <-a.events:
+				batch = append(batch, ev)
+			default:
+				break queued
+			}
+		}
+
+		pctx, cancel := context.WithTimeout(ctx, auditTimeout)
+		err := a.sink.Publish(pctx, batch)
+		cancel()
+		if err != nil {
+			a.metrics.auditDropped.Add(float64(len(batch)))
+			a.logger.Warn().Err(err).Int("events", len(batch)).Msg("unable to publish audit events")
+			continue
+		}
+		a.metrics.auditEvents.Add(float64(len(batch)))
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// kafkaContentType is the content type of JSON records sent to a Kafka REST Proxy
+const kafkaContentType = "application/vnd.kafka.json.v2+json"
+
+// kafkaRESTSink publishes exchange events to a Kafka topic via a Kafka REST Proxy, keyed by realm
+// so the events for each realm stay in order
+type kafkaRESTSink struct {
+	url    string
+	client *http.Client
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string        `json:"key"`
+	Value ExchangeEvent `json:"value"`
+}
+
+func newKafkaRESTSink(u *url.URL, topic string) *kafkaRESTSink {
+	base := *u
+	base.Scheme = strings.TrimPrefix(u.Scheme, "kafka-rest+")
+	base.Path = path.Join(path.Dir(u.Path), "topics", topic)
+	base.RawPath = ""
+
+	return &kafkaRESTSink{url: base.String(), client: &http.Client{}}
+}
+
+// Publish implements AuditSink
+func (s *kafkaRESTSink) Publish(ctx context.Context, events []ExchangeEvent) error {
+	records := kafkaRecords{Records: make([]kafkaRecord, len(events))}
+	for i, ev := range events {
+		records.Records[i] = kafkaRecord{Key: ev.Realm, Value: ev}
+	}
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("kafka rest proxy returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	return nil
+}
+
+// Close implements AuditSink
+func (s *kafkaRESTSink) Close() error {
+	s.client.CloseIdleConnections()
+
+	return nil
+}
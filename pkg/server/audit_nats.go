@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// natsSink publishes exchange events to a NATS subject using the core NATS client protocol, with
+// user and password or token authentication. JetStream acknowledgements, NKeys and credentials
+// files are not supported.
+type natsSink struct {
+	address  string
+	host     string
+	subject  string
+	user     string
+	password string
+	token    string
+	tls      bool
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// natsInfo is the part of the INFO message sent by the server that is used
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// natsConnect is the CONNECT message sent to the server
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+func newNATSSink(u *url.URL, subject string) *natsSink {
+	s := &natsSink{
+		address: u.Host,
+		host:    u.Hostname(),
+		subject: subject,
+		tls:     u.Scheme == "nats+tls",
+	}
+	if u.Port() == "" {
+		s.address = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	// a user without a password is a token
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			s.user, s.password = u.User.Username(), password
+		} else {
+			s.token = u.User.Username()
+		}
+	}
+
+	return s
+}
+
+// Publish implements AuditSink, retrying once on a new connection if the existing connection has
+// been closed by the server
+func (s *natsSink) Publish(ctx context.Context, events []ExchangeEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b strings.Builder
+	for _, ev := range events {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "PUB %s %d\r\n%s\r\n", s.subject, len(payload), payload)
+	}
+	// the server has processed the messages once it answers the ping
+	b.WriteString("PING\r\n")
+
+	reused := s.conn != nil
+	err := s.publish(ctx, b.String())
+	if err != nil && reused && ctx.Err() == nil {
+		err = s.publish(ctx, b.String())
+	}
+
+	return err
+}
+
+func (s *natsSink) publish(ctx context.Context, msgs string) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	}
+	if _, err := s.conn.Write([]byte(msgs)); err != nil {
+		s.close()
+		return err
+	}
+	if err := s.pong(); err != nil {
+		s.close()
+		return err
+	}
+
+	return nil
+}
+
+// connect establishes a connection, upgrading to TLS when required, and sends CONNECT
+func (s *natsSink) connect(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// the server starts with INFO
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if !strings.EqualFold(op, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected nats message %q", op)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		conn.Close()
+		return fmt.Errorf("invalid nats info: %w", err)
+	}
+
+	if s.tls || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: s.host, MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	connect, err := json.Marshal(natsConnect{
+		Name:  "kdcproxy",
+		Lang:  "go",
+		User:  s.user,
+		Pass:  s.password,
+		Token: s.token,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.conn = conn
+	s.reader = reader
+
+	return nil
+}
+
+// pong waits for the server to answer a ping, replying to any pings from the server
+func (s *natsSink) pong() error {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(op) {
+		case "PONG":
+			return nil
+		case "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New("nats: " + strings.Trim(args, "'"))
+		}
+	}
+}
+
+func (s *natsSink) close() {
+	s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+}
+
+// Close implements AuditSink
+func (s *natsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.close()
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+)
+
+// offender tracks the recent errors for a single client
+type offender struct {
+	strikes int
+	first   time.Time
+	until   time.Time
+}
+
+// maxOffenders is the number of clients tracked by a banList, beyond which errors from new clients
+// are not counted until existing entries expire, bounding its memory when errors come from many
+// addresses
+const maxOffenders = 100000
+
+// banList temporarily bans clients that generate too many errors within a window
+type banList struct {
+	mu        sync.Mutex
+	threshold int
+	max       int
+	window    time.Duration
+	duration  time.Duration
+	clients   map[string]*offender
+	lastSweep time.Time
+	metrics   *serverMetrics
+	logger    zerolog.Logger
+}
+
+func newBanList(threshold int, window, duration time.Duration, metrics *serverMetrics, logger zerolog.Logger) *banList {
+	return &banList{
+		threshold: threshold,
+		max:       maxOffenders,
+		window:    window,
+		duration:  duration,
+		clients:   make(map[string]*offender),
+		metrics:   metrics,
+		logger:    logger,
+	}
+}
+
+// Handler rejects banned clients and counts error responses against the client
+func (b *banList) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+
+		if b.banned(ip, time.Now()) {
+			b.metrics.clientBannedRequests.Inc()
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		// the class of failure is needed as the status codes sent for it may have been changed
+		ctx := r.Context()
+		if _, ok := proxy.ForwardInfoFromContext(ctx); !ok {
+			ctx, _ = proxy.ContextWithForwardInfo(ctx)
+			r = r.WithContext(ctx)
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		fi, _ := proxy.ForwardInfoFromContext(ctx)
+		if strikes(fi.Failure, sw.status) {
+			b.strike(ip, time.Now())
+		}
+	})
+}
+
+// strikes reports whether a response counts as an error against the client, which are the failures
+// of the proxy caused by the client whatever status code is sent for them, or the same status codes
+// from other handlers such as client quotas. The proxy wide rate limit is not the fault of any one
+// client, so is not counted.
+func strikes(failure string, status int) bool {
+	switch failure {
+	case proxy.FailureMalformed, proxy.FailureLengthRequired, proxy.FailureTooLarge:
+		return true
+	case "":
+		switch status {
+		case http.StatusBadRequest, http.StatusLengthRequired, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+			return true
+		}
+	}
+
+	return false
+}
+
+// banned reports whether ip is banned at now
+func (b *banList) banned(ip string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.clients[ip]
+	if !ok {
+		return false
+	}
+
+	return now.Before(o.until)
+}
+
+// strike counts an error from ip at now, banning it once the threshold is reached within the window
+func (b *banList) strike(ip string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sweep(now)
+
+	o, ok := b.clients[ip]
+	if !ok && len(b.clients) >= b.max {
+		b.expire(now)
+		if len(b.clients) >= b.max {
+			return
+		}
+	}
+	if !ok || now.Sub(o.first) > b.window {
+		o = &offender{first: now}
+		b.clients[ip] = o
+	}
+	o.strikes++
+
+	if o.strikes >= b.threshold && now.After(o.until) {
+		o.until = now.Add(b.duration)
+		b.metrics.clientBans.Inc()
+		b.logger.Warn().
+			Str("ip", ip).
+			Int("strikes", o.strikes).
+			Time("until", o.until).
+			Msg("banning client")
+	}
+}
+
+// sweep removes expired entries, must be called with the lock held
+func (b *banList) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.window {
+		return
+	}
+	b.lastSweep = now
+	b.expire(now)
+}
+
+// expire removes entries outside the window that are not banned, must be called with the lock held
+func (b *banList) expire(now time.Time) {
+	for ip, o := range b.clients {
+		if now.Sub(o.first) > b.window && now.After(o.until) {
+			delete(b.clients, ip)
+		}
+	}
+}
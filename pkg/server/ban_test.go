@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestBanList(t *testing.T) {
+	const threshold, window, duration = 3, 10 * time.Second, time.Minute
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		strikes []time.Duration
+		at      time.Duration
+		want    bool
+	}{
+		{"no strikes", nil, 0, false},
+		{"below threshold", []time.Duration{0, time.Second}, 2 * time.Second, false},
+		{"threshold within window", []time.Duration{0, time.Second, 2 * time.Second}, 3 * time.Second, true},
+		{"window expired before threshold", []time.Duration{0, 5 * time.Second, 11 * time.Second}, 12 * time.Second, false},
+		{"banned until duration expires", []time.Duration{0, time.Second, 2 * time.Second}, 2*time.Second + duration - time.Nanosecond, true},
+		{"ban expired", []time.Duration{0, time.Second, 2 * time.Second}, 2*time.Second + duration, false},
+	}
+	for _, tt := range tests {
+		b := newBanList(threshold, window, duration, testMetrics(t), zerolog.Nop())
+		for _, offset := range tt.strikes {
+			b.strike("192.0.2.1", start.Add(offset))
+		}
+
+		if got := b.banned("192.0.2.1", start.Add(tt.at)); got != tt.want {
+			t.Errorf("%s: banned = %v, want %v", tt.name, got, tt.want)
+		}
+		if b.banned("192.0.2.2", start.Add(tt.at)) {
+			t.Errorf("%s: other client banned", tt.name)
+		}
+	}
+}
+
+func TestBanListSweep(t *testing.T) {
+	const threshold, window, duration = 3, 10 * time.Second, time.Minute
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		strikes int
+		at      time.Duration
+		want    bool
+	}{
+		{"within window kept", 1, 5 * time.Second, true},
+		{"window expired removed", 1, window + time.Second, false},
+		{"banned kept after window", threshold, window + time.Second, true},
+		{"ban expired removed", threshold, duration + time.Second, false},
+	}
+	for _, tt := range tests {
+		b := newBanList(threshold, window, duration, testMetrics(t), zerolog.Nop())
+		for i := 0; i < tt.strikes; i++ {
+			b.strike("192.0.2.1", start)
+		}
+
+		// a strike from another client triggers the sweep
+		b.strike("192.0.2.2", start.Add(tt.at))
+
+		if _, got := b.clients["192.0.2.1"]; got != tt.want {
+			t.Errorf("%s: entry kept = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBanListMax(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBanList(1, 10*time.Second, time.Minute, testMetrics(t), zerolog.Nop())
+	b.max = 2
+
+	b.strike("192.0.2.1", start)
+	b.strike("192.0.2.2", start)
+	b.strike("192.0.2.3", start)
+	if len(b.clients) != 2 || b.banned("192.0.2.3", start) {
+		t.Errorf("client tracked beyond the maximum")
+	}
+
+	// expired entries make room even before the next sweep, while bans are kept
+	b.clients["192.0.2.2"].until = time.Time{}
+	b.strike("192.0.2.3", start.Add(11*time.Second))
+	if !b.banned("192.0.2.1", start.Add(11*time.Second)) || !b.banned("192.0.2.3", start.Add(11*time.Second)) {
+		t.Errorf("expired entry was not replaced")
+	}
+}
+
+func TestBanListHandler(t *testing.T) {
+	m := testMetrics(t)
+	b := newBanList(2, time.Minute, time.Minute, m, zerolog.Nop())
+	h := b.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(code)
+	}))
+
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{"success", http.StatusOK, http.StatusOK},
+		{"success again", http.StatusOK, http.StatusOK},
+		{"success does not strike", http.StatusOK, http.StatusOK},
+		{"first error", http.StatusBadRequest, http.StatusBadRequest},
+		{"second error bans", http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{"banned", http.StatusOK, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/KdcProxy?status="+strconv.Itoa(tt.status), nil)
+		r.RemoteAddr = "192.0.2.1:12345"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+	if got := testutil.ToFloat64(m.clientBans); got != 1 {
+		t.Errorf("bans = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.clientBannedRequests); got != 1 {
+		t.Errorf("banned requests = %v, want 1", got)
+	}
+}
+
+func TestBanListStatusCodes(t *testing.T) {
+	k, err := proxy.NewKdcProxy(
+		proxy.WithRegistry(prometheus.NewRegistry()),
+		proxy.WithStatusCodes(map[string]int{proxy.FailureMalformed: http.StatusUnprocessableEntity}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	m := testMetrics(t)
+	h := newBanList(2, time.Minute, time.Minute, m, zerolog.Nop()).Handler(http.HandlerFunc(k.Handler))
+
+	for i, want := range []int{http.StatusUnprocessableEntity, http.StatusUnprocessableEntity, http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodPost, "/KdcProxy", strings.NewReader("not a kdc proxy message"))
+		r.RemoteAddr = "192.0.2.1:12345"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, want)
+		}
+	}
+	if got := testutil.ToFloat64(m.clientBans); got != 1 {
+		t.Errorf("bans = %v, want 1", got)
+	}
+}
+
+func TestBanListRateLimited(t *testing.T) {
+	k, err := proxy.NewKdcProxy(
+		proxy.WithRegistry(prometheus.NewRegistry()),
+		proxy.WithRateLimiter(rejectLimiter{}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	m := testMetrics(t)
+	h := newBanList(1, time.Minute, time.Minute, m, zerolog.Nop()).Handler(http.HandlerFunc(k.Handler))
+
+	// the proxy wide rate limit is not counted against the client
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testRequestBody(t)))
+		r.RemoteAddr = "192.0.2.1:12345"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("request %d: status = %d, want %d", i, w.Code, http.StatusTooManyRequests)
+		}
+	}
+	if got := testutil.ToFloat64(m.clientBans); got != 0 {
+		t.Errorf("bans = %v, want 0", got)
+	}
+}
+
+// rejectLimiter rejects every request
+type rejectLimiter struct{}
+
+func (rejectLimiter) AllowN(time.Time, int) bool { return false }
+
+func (rejectLimiter) Wait(ctx context.Context) error {
+	<-ctx.Done()
+
+	return ctx.Err()
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// statusWriter records the status code and number of bytes written to a http.ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+
+	return n, err
+}
+
+// clientIP returns the IP address of the remote client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+type subjectKey struct{}
+
+// contextWithSubject returns a copy of ctx carrying the subject of a validated JWT
+func contextWithSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, subjectKey{}, subject)
+}
+
+// clientIdentity returns the subject of the JWT if one was validated, otherwise the identity of the
+// client certificate if one was presented, which is its common name or first subject alternative
+// name, otherwise the IP address of the remote client
+func clientIdentity(r *http.Request) string {
+	if sub, _ := r.Context().Value(subjectKey{}).(string); sub != "" {
+		return sub
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		if id := proxy.CertificateIdentity(r.TLS.PeerCertificates[0]); id != "" {
+			return id
+		}
+	}
+
+	return clientIP(r)
+}
+
+// requestIDHandler passes the request ID generated by hlog through to the proxy package
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := hlog.IDFromRequest(r); ok {
+			r = r.WithContext(proxy.ContextWithRequestID(r.Context(), id.String()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardInfoHandler adds the realm, the KDC that answered, its protocol and the number of attempts
+// to the access log of requests forwarded by the proxy package, and publishes a summary of each
+// request to the live tail
+func (s *Server) forwardInfoHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, info := proxy.ContextWithForwardInfo(r.Context())
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		fi := info()
+		if s.tail.active() {
+			s.tail.publish(requestSummary{
+				Time:     start,
+				Realm:    fi.Realm,
+				Type:     fi.Type,
+				KDC:      fi.KDC,
+				Proto:    fi.Proto,
+				Attempts: fi.Attempts,
+				Status:   sw.status,
+				Latency:  time.Since(start).Seconds(),
+			})
+		}
+
+		if fi.Realm == "" {
+			return
+		}
+		zerolog.Ctx(r.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+			c = c.Str("realm", fi.Realm).Int("attempts", fi.Attempts)
+			if fi.KDC != "" {
+				c = c.Str("kdc", fi.KDC).Str("proto", fi.Proto)
+			}
+
+			return c
+		})
+	})
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+// clientCAs holds the pool of CAs trusted to issue client certificates, which is reloaded from a PEM
+// bundle whenever the file changes
+type clientCAs struct {
+	path   string
+	logger zerolog.Logger
+	config atomic.Pointer[tls.Config]
+
+	// base is the TLS configuration each reloaded pool is applied to
+	base *tls.Config
+}
+
+// newClientCAs returns clientCAs after loading the initial bundle from path. The TLS configuration
+// for each client is a copy of base that requires a certificate issued by one of the CAs.
+func newClientCAs(path string, base *tls.Config, logger zerolog.Logger) (*clientCAs, error) {
+	c := &clientCAs{path: path, logger: logger, base: base.Clone()}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// load reads the CA bundle and atomically replaces the current pool
+func (c *clientCAs) load() error {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no certificates found in %s", c.path)
+	}
+
+	config := c.base.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = pool
+	c.config.Store(config)
+
+	return nil
+}
+
+// GetConfigForClient returns the TLS configuration with the current pool of client CAs
+func (c *clientCAs) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return c.config.Load(), nil
+}
+
+// Start watches the CA bundle and reloads it whenever it changes until ctx is cancelled. If the
+// updated bundle cannot be loaded the current pool is kept.
+func (c *clientCAs) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// watch the directory so replacing the file (including via symlink swaps) is detected
+	path := filepath.Clean(c.path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			// only care about writes/creates of the bundle or a kubernetes style "..data" swap
+			if filepath.Clean(ev.Name) != path && filepath.Base(ev.Name) != "..data" {
+				continue
+			}
+			if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) {
+				continue
+			}
+
+			if err := c.load(); err != nil {
+				c.logger.Error().Err(err).Str("path", c.path).Msg("could not reload client ca bundle")
+				continue
+			}
+			c.logger.Info().Str("path", c.path).Msg("reloaded client ca bundle")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			c.logger.Error().Err(err).Msg("error watching client ca bundle")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
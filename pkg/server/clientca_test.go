@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestClientCAs(t *testing.T) {
+	first, _ := testCertificate(t, "first-ca", time.Hour)
+	second, _ := testCertificate(t, "second-ca", time.Hour)
+	pool := func(certs ...string) *x509.CertPool {
+		p := x509.NewCertPool()
+		for _, c := range certs {
+			p.AppendCertsFromPEM([]byte(c))
+		}
+		return p
+	}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte(first), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	base := hardenedTLSConfig(0)
+	c, err := newClientCAs(path, base, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("newClientCAs() error = %v", err)
+	}
+
+	config, _ := c.GetConfigForClient(nil)
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want RequireAndVerifyClientCert", config.ClientAuth)
+	}
+	if !config.ClientCAs.Equal(pool(first)) {
+		t.Error("ClientCAs does not contain the initial bundle")
+	}
+	if base.ClientCAs != nil {
+		t.Error("base TLS configuration was modified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Start(ctx) }()
+
+	// an invalid bundle keeps the current pool
+	if err := os.WriteFile(path, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if config, _ := c.GetConfigForClient(nil); !config.ClientCAs.Equal(pool(first)) {
+		t.Error("ClientCAs changed after writing an invalid bundle")
+	}
+
+	if err := os.WriteFile(path, []byte(first+second), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if config, _ := c.GetConfigForClient(nil); config.ClientCAs.Equal(pool(first, second)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ClientCAs were not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Start() error = %v", err)
+	}
+}
+
+func TestClientCAsInvalid(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{empty, filepath.Join(dir, "missing.pem")} {
+		if _, err := newClientCAs(path, hardenedTLSConfig(0), zerolog.Nop()); err == nil {
+			t.Errorf("newClientCAs(%s) did not return an error", path)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+)
+
+// overflowClient is the label used once the number of tracked clients reaches the limit
+const overflowClient = "other"
+
+// clientMetrics records per client metrics while bounding the number of distinct clients
+type clientMetrics struct {
+	mu      sync.Mutex
+	limit   int
+	clients map[string]struct{}
+	metrics *serverMetrics
+}
+
+func newClientMetrics(limit int, metrics *serverMetrics) *clientMetrics {
+	return &clientMetrics{
+		limit:   limit,
+		clients: make(map[string]struct{}),
+		metrics: metrics,
+	}
+}
+
+// Handler records metrics for each request against the client identity
+func (c *clientMetrics) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := c.label(clientIdentity(r))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		c.metrics.clientReqs.WithLabelValues(client).Inc()
+		if r.ContentLength > 0 {
+			c.metrics.clientBytesReceived.WithLabelValues(client).Add(float64(r.ContentLength))
+		}
+		c.metrics.clientBytesSent.WithLabelValues(client).Add(float64(sw.size))
+		if sw.status != http.StatusOK {
+			c.metrics.clientRejections.WithLabelValues(client).Inc()
+		}
+	})
+}
+
+// label returns the label to use for the client, which is the overflow label once the limit is reached
+func (c *clientMetrics) label(client string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.clients[client]; ok {
+		return client
+	}
+
+	if len(c.clients) >= c.limit {
+		return overflowClient
+	}
+	c.clients[client] = struct{}{}
+
+	return client
+}
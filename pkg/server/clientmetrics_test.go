@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientMetricsLabel(t *testing.T) {
+	c := newClientMetrics(2, testMetrics(t))
+
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.2", "192.0.2.2"},
+		{"192.0.2.3", overflowClient},
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.4", overflowClient},
+	}
+	for _, tt := range tests {
+		if got := c.label(tt.client); got != tt.want {
+			t.Errorf("label(%s) = %s, want %s", tt.client, got, tt.want)
+		}
+	}
+	if len(c.clients) != 2 {
+		t.Errorf("tracked %d clients, want the limit of 2", len(c.clients))
+	}
+}
+
+func TestClientMetricsHandler(t *testing.T) {
+	m := testMetrics(t)
+	h := newClientMetrics(2, m).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("reject") != "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("reply"))
+	}))
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "metrics-laptop.example.com"}}
+	tests := []struct {
+		name    string
+		addr    string
+		cert    *x509.Certificate
+		subject string
+		reject  bool
+		want    string
+	}{
+		{"jwt subject preferred over certificate", "192.0.2.10", cert, "metrics-user", false, "metrics-user"},
+		{"certificate preferred over ip", "192.0.2.10", cert, "", true, "metrics-laptop.example.com"},
+		{"ip over the limit", "192.0.2.10", nil, "", false, overflowClient},
+		{"known client after the limit", "192.0.2.11", nil, "metrics-user", true, "metrics-user"},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(m.clientReqs.WithLabelValues(tt.want))
+		beforeSent := testutil.ToFloat64(m.clientBytesSent.WithLabelValues(tt.want))
+		beforeReceived := testutil.ToFloat64(m.clientBytesReceived.WithLabelValues(tt.want))
+		beforeRejected := testutil.ToFloat64(m.clientRejections.WithLabelValues(tt.want))
+
+		url := "/KdcProxy"
+		if tt.reject {
+			url += "?reject=1"
+		}
+		r := httptest.NewRequest(http.MethodPost, url, strings.NewReader("request"))
+		r.RemoteAddr = tt.addr + ":12345"
+		if tt.cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.cert}}
+		}
+		if tt.subject != "" {
+			r = r.WithContext(contextWithSubject(r.Context(), tt.subject))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if got := testutil.ToFloat64(m.clientReqs.WithLabelValues(tt.want)) - before; got != 1 {
+			t.Errorf("%s: requests for %s increased by %v, want 1", tt.name, tt.want, got)
+		}
+		if got := testutil.ToFloat64(m.clientBytesReceived.WithLabelValues(tt.want)) - beforeReceived; got != float64(len("request")) {
+			t.Errorf("%s: received bytes for %s increased by %v, want %d", tt.name, tt.want, got, len("request"))
+		}
+		if got := testutil.ToFloat64(m.clientBytesSent.WithLabelValues(tt.want)) - beforeSent; got != float64(w.Body.Len()) {
+			t.Errorf("%s: sent bytes for %s increased by %v, want %d", tt.name, tt.want, got, w.Body.Len())
+		}
+		wantRejected := 0.0
+		if tt.reject {
+			wantRejected = 1
+		}
+		if got := testutil.ToFloat64(m.clientRejections.WithLabelValues(tt.want)) - beforeRejected; got != wantRejected {
+			t.Errorf("%s: rejections for %s increased by %v, want %v", tt.name, tt.want, got, wantRejected)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Defaults for slow client protection
+const (
+	DefaultReadHeaderTimeout = 5 * time.Second
+	DefaultBodyTimeout       = 10 * time.Second
+)
+
+// connLimitListener closes new connections from a client IP that already has max open connections
+type connLimitListener struct {
+	net.Listener
+	max     int
+	metrics *serverMetrics
+	logger  zerolog.Logger
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newConnLimitListener(ln net.Listener, max int, metrics *serverMetrics, logger zerolog.Logger) *connLimitListener {
+	return &connLimitListener{
+		Listener: ln,
+		max:      max,
+		metrics:  metrics,
+		logger:   logger,
+		conns:    make(map[string]int),
+	}
+}
+
+// Accept waits for the next connection that is within the per client limit
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := addrIP(conn.RemoteAddr())
+		if l.acquire(ip) {
+			return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+		}
+
+		l.metrics.connRejections.Inc()
+		l.logger.Debug().Str("ip", ip).Int("limit", l.max).Msg("too many connections from client")
+		conn.Close()
+	}
+}
+
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// limitedConn releases its slot in the connLimitListener exactly once when closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+
+	return err
+}
+
+// addrIP returns the IP address of addr without the port
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// bodyDeadline limits the time allowed to read the request body, which is applied separately to
+// the time allowed for the request headers so that slow clients cannot hold connections open
+func bodyDeadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// not all response writers support deadlines, in which case the server read timeout applies
+			_ = http.NewResponseController(w).SetReadDeadline(time.Now().Add(timeout))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestConnLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newConnLimitListener(inner, 1, testMetrics(t), zerolog.Nop())
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// first connection is accepted
+	first := dial()
+	defer first.Close()
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first connection not accepted")
+	}
+
+	// second connection from the same ip is closed by the listener
+	second := dial()
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Error("second connection was not closed")
+	}
+	select {
+	case <-accepted:
+		t.Error("second connection accepted over the limit")
+	default:
+	}
+
+	// closing the first connection, more than once, frees a single slot
+	conn.Close()
+	conn.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not accepted after slot was released")
+	}
+
+	if n := ln.conns["127.0.0.1"]; n != 1 {
+		t.Errorf("conns = %d, want 1", n)
+	}
+}
+
+func TestBodyDeadline(t *testing.T) {
+	srv := httptest.NewServer(bodyDeadline(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Body.Read(make([]byte, 1)); err == nil {
+			t.Error("body read did not time out")
+		}
+	})))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// headers promise a body that is never sent
+	if _, err := conn.Write([]byte("POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 512)); err != nil {
+		t.Errorf("no response after body timeout: %v", err)
+	}
+}
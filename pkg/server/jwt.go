@@ -0,0 +1,450 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults for validating JWT's
+const (
+	DefaultJWTLeeway   = time.Minute
+	DefaultJWKSMaxAge  = time.Hour
+	DefaultJWKSTimeout = 10 * time.Second
+
+	// jwksMinRefresh limits how often the JWKS is fetched when a token is signed by an unknown key
+	jwksMinRefresh = time.Minute
+
+	// jwtMinRSABits is the smallest RSA key accepted
+	jwtMinRSABits = 2048
+)
+
+// JWTConfig configures validation of a JWT presented as a bearer token in the Authorization header of
+// each KDC Proxy request, such as one added by an identity-aware proxy or OAuth gateway
+type JWTConfig struct {
+	// Issuer must match the "iss" claim
+	Issuer string
+
+	// Audience must be one of the "aud" claims
+	Audience string
+
+	// JWKSURL is the location of the JSON Web Key Set used to verify signatures. RSA (RS256, RS384,
+	// RS512, PS256, PS384 and PS512) keys of at least 2048 bits and ECDSA (ES256, ES384 and ES512)
+	// keys on the curve of their algorithm are supported.
+	JWKSURL string
+
+	// Leeway allowed for clock skew when checking the "exp" and "nbf" claims, which defaults to
+	// DefaultJWTLeeway
+	Leeway time.Duration
+
+	// MaxAge is the time the key set is used for before it is fetched again in the background, which
+	// defaults to DefaultJWKSMaxAge. The key set is also fetched when a token is signed by an unknown
+	// key.
+	MaxAge time.Duration
+
+	// Client is the HTTP client used to fetch the key set, which defaults to a client with a timeout of
+	// DefaultJWKSTimeout. Fetches other than the first are also limited to DefaultJWKSTimeout.
+	Client *http.Client
+}
+
+// jwtValidator validates JWT's against a key set that is kept up to date
+type jwtValidator struct {
+	cfg     JWTConfig
+	metrics *serverMetrics
+	logger  zerolog.Logger
+
+	refresh singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// jwtClaims are the registered claims that are validated
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   *int64      `json:"exp"`
+	NotBefore *int64      `json:"nbf"`
+}
+
+// jwtAudience is the "aud" claim, which may be a single string or an array
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = jwtAudience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+
+	return nil
+}
+
+// newJWTValidator returns a jwtValidator after fetching the initial key set
+func newJWTValidator(ctx context.Context, cfg JWTConfig, metrics *serverMetrics, logger zerolog.Logger) (*jwtValidator, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" || cfg.JWKSURL == "" {
+		return nil, fmt.Errorf("jwt issuer, audience and jwks url are required")
+	}
+	if cfg.Leeway == 0 {
+		cfg.Leeway = DefaultJWTLeeway
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultJWKSMaxAge
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: DefaultJWKSTimeout}
+	}
+
+	v := &jwtValidator{cfg: cfg, metrics: metrics, logger: logger}
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+
+	return v, nil
+}
+
+// Handler rejects requests without a valid JWT with 401 Unauthorized
+func (v *jwtValidator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			v.metrics.jwtRejections.WithLabelValues("missing").Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kdcproxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := v.validate(token, time.Now())
+		if err != nil {
+			v.metrics.jwtRejections.WithLabelValues("invalid").Inc()
+			v.logger.Debug().Err(err).Msg("invalid jwt")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kdcproxy", error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// attribute the request to the subject in the access log
+		zerolog.Ctx(r.Context()).UpdateContext(func(c zerolog.Context) zerolog.Context {
+			return c.Str("sub", claims.Subject)
+		})
+
+		next.ServeHTTP(w, r.WithContext(contextWithSubject(r.Context(), claims.Subject)))
+	})
+}
+
+// validate verifies the signature and claims of token
+func (v *jwtValidator) validate(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	key, err := v.key(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	if claims.Issuer != v.cfg.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if !containsString(claims.Audience, v.cfg.Audience) {
+		return nil, fmt.Errorf("unexpected audience %q", claims.Audience)
+	}
+	if claims.Expires == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.Add(-v.cfg.Leeway).After(time.Unix(*claims.Expires, 0)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(v.cfg.Leeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	return &claims, nil
+}
+
+// key returns the key with the provided id. The key set is fetched again in the background once it
+// is too old, while an unknown key waits for the key set to be fetched again.
+func (v *jwtValidator) key(kid string, now time.Time) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	age := now.Sub(v.fetched)
+	v.mu.Unlock()
+
+	switch {
+	case ok && age > v.cfg.MaxAge:
+		v.refresh.DoChan("jwks", func() (any, error) { return nil, v.refreshKeys(now) })
+		return key, nil
+	case ok:
+		return key, nil
+	case age < jwksMinRefresh:
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	_, err, _ := v.refresh.Do("jwks", func() (any, error) { return nil, v.refreshKeys(now) })
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// refreshKeys fetches the key set again, independent of any request so a cancelled request does
+// not abort it, and without holding the lock so a slow key set does not hold up requests. The
+// current keys are kept until the key set can be fetched.
+func (v *jwtValidator) refreshKeys(now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultJWKSTimeout)
+	defer cancel()
+
+	keys, err := v.fetch(ctx)
+	if err != nil {
+		v.logger.Error().Err(err).Msg("could not fetch jwks")
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.keys = keys
+	v.fetched = now
+
+	return nil
+}
+
+// jwk is a JSON Web Key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch returns the signing keys from the key set by key id
+func (v *jwtValidator) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.cfg.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch jwks: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			v.logger.Warn().Err(err).Str("kid", k.Kid).Msg("ignoring jwk")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks contains no usable keys")
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the RSA or ECDSA public key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < jwtMinRSABits {
+			return nil, fmt.Errorf("rsa key of %d bits is too small", key.N.BitLen())
+		}
+
+		return key, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid ec point")
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature verifies sig over signed using key and the algorithm from the token header. Only
+// asymmetric algorithms are accepted, so a token cannot be signed using a public key as a secret.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[len(alg)-min(len(alg), 3):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch strings.TrimRight(alg, "0123456789") {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key cannot be used with %s", alg)
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != algCurve(hash) {
+			return fmt.Errorf("key cannot be used with %s", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// algCurve returns the curve of the ECDSA algorithm using hash, as each may only be used with one
+func algCurve(hash crypto.Hash) elliptic.Curve {
+	switch hash {
+	case crypto.SHA384:
+		return elliptic.P384()
+	case crypto.SHA512:
+		return elliptic.P521()
+	}
+
+	return elliptic.P256()
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token into v
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// testJWKS serves a key set containing an RSA key "rsa" and an ECDSA key "ec" and counts fetches
+func testJWKS(t *testing.T) (*httptest.Server, *rsa.PrivateKey, *ecdsa.PrivateKey, *atomic.Int32) {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": enc(rsaKey.N.Bytes()), "e": enc(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": enc(ecKey.X.FillBytes(make([]byte, 32))), "y": enc(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+	}}
+
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, rsaKey, ecKey, &fetches
+}
+
+// testJWT returns a token signed with key using alg
+func testJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := crypto.SHA256
+	switch alg[len(alg)-3:] {
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if alg == "PS256" {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTValidator(t *testing.T) {
+	srv, rsaKey, ecKey, _ := testJWKS(t)
+	v, err := newJWTValidator(context.Background(), JWTConfig{Issuer: "https://idp.example.com", Audience: "kdcproxy", JWKSURL: srv.URL}, testMetrics(t), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("newJWTValidator() error = %v", err)
+	}
+
+	now := time.Now()
+	claims := func(modify func(c map[string]any)) map[string]any {
+		c := map[string]any{"iss": "https://idp.example.com", "aud": "kdcproxy", "sub": "laptop", "exp": now.Add(time.Hour).Unix()}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"rs256", testJWT(t, "RS256", "rsa", rsaKey, claims(nil)), false},
+		{"ps256", testJWT(t, "PS256", "rsa", rsaKey, claims(nil)), false},
+		{"es256", testJWT(t, "ES256", "ec", ecKey, claims(nil)), false},
+		{"audience array", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["aud"] = []string{"other", "kdcproxy"} })), false},
+		{"within leeway", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["exp"] = now.Add(-30 * time.Second).Unix() })), false},
+		{"expired", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() })), true},
+		{"no expiry", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { delete(c, "exp") })), true},
+		{"not yet valid", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() })), true},
+		{"wrong issuer", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), true},
+		{"wrong audience", testJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["aud"] = "other" })), true},
+		{"wrong key", testJWT(t, "ES256", "ec", other, claims(nil)), true},
+		{"rs384", testJWT(t, "RS384", "rsa", rsaKey, claims(nil)), false},
+		{"algorithm mismatch", testJWT(t, "RS256", "ec", rsaKey, claims(nil)), true},
+		{"curve mismatch", testJWT(t, "ES384", "ec", ecKey, claims(nil)), true},
+		{"none", "eyJhbGciOiJub25lIiwia2lkIjoicnNhIn0.eyJpc3MiOiJodHRwczovL2lkcC5leGFtcGxlLmNvbSJ9.", true},
+		{"malformed", "not-a-jwt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.validate(tt.token, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTValidatorRefresh(t *testing.T) {
+	srv, _, ecKey, fetches := testJWKS(t)
+	v, err := newJWTValidator(context.Background(), JWTConfig{Issuer: "iss", Audience: "aud", JWKSURL: srv.URL}, testMetrics(t), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("newJWTValidator() error = %v", err)
+	}
+
+	now := time.Now()
+	token := testJWT(t, "ES256", "rotated", ecKey, map[string]any{"iss": "iss", "aud": "aud", "exp": now.Add(time.Hour).Unix()})
+
+	// an unknown key does not fetch the key set again straight away
+	if _, err := v.validate(token, now); err == nil {
+		t.Error("validate() with unknown key did not return an error")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetches = %d, want 1", got)
+	}
+
+	// but does once the minimum refresh interval has passed
+	v.validate(token, now.Add(jwksMinRefresh+time.Second))
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+
+	// and a known key is fetched again in the background once the key set is too old
+	token = testJWT(t, "ES256", "ec", ecKey, map[string]any{"iss": "iss", "aud": "aud", "exp": now.Add(2 * time.Hour).Unix()})
+	if _, err := v.validate(token, now.Add(jwksMinRefresh+DefaultJWKSMaxAge+2*time.Second)); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); fetches.Load() != 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("fetches = %d, want 3", got)
+	}
+}
+
+func TestJWTValidatorSlowRefresh(t *testing.T) {
+	srv, _, ecKey, _ := testJWKS(t)
+	v, err := newJWTValidator(context.Background(), JWTConfig{Issuer: "iss", Audience: "aud", JWKSURL: srv.URL}, testMetrics(t), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("newJWTValidator() error = %v", err)
+	}
+
+	// the key set no longer answers
+	release := make(chan struct{})
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	t.Cleanup(func() { close(release) })
+
+	now := time.Now()
+	unknown := testJWT(t, "ES256", "rotated", ecKey, map[string]any{"iss": "iss", "aud": "aud", "exp": now.Add(time.Hour).Unix()})
+	go v.validate(unknown, now.Add(jwksMinRefresh+time.Second))
+	time.Sleep(50 * time.Millisecond)
+
+	// a token signed by a known key is not held up by the fetch
+	known := testJWT(t, "ES256", "ec", ecKey, map[string]any{"iss": "iss", "aud": "aud", "exp": now.Add(time.Hour).Unix()})
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.validate(known, now.Add(jwksMinRefresh+time.Second))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("validate() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("validate() of a known key waited for the key set")
+	}
+}
+
+func TestJWKPublicKey(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	for _, tt := range []struct {
+		bits    int
+		wantErr bool
+	}{
+		{1024, true},
+		{2048, false},
+	} {
+		key, err := rsa.GenerateKey(rand.Reader, tt.bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		k := jwk{Kty: "RSA", N: enc(key.N.Bytes()), E: enc(big.NewInt(int64(key.E)).Bytes())}
+		if _, err := k.publicKey(); (err != nil) != tt.wantErr {
+			t.Errorf("publicKey() of %d bit key error = %v, wantErr %v", tt.bits, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJWTHandler(t *testing.T) {
+	srv, _, ecKey, _ := testJWKS(t)
+	v, err := newJWTValidator(context.Background(), JWTConfig{Issuer: "iss", Audience: "aud", JWKSURL: srv.URL}, testMetrics(t), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("newJWTValidator() error = %v", err)
+	}
+	h := v.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	valid := testJWT(t, "ES256", "ec", ecKey, map[string]any{"iss": "iss", "aud": "aud", "exp": time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+		wantChallenge string
+	}{
+		{"valid", "Bearer " + valid, http.StatusOK, ""},
+		{"missing", "", http.StatusUnauthorized, `Bearer realm="kdcproxy"`},
+		{"basic", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, `Bearer realm="kdcproxy"`},
+		{"invalid", "Bearer " + valid + "x", http.StatusUnauthorized, `Bearer realm="kdcproxy", error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/KdcProxy", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantChallenge)
+			}
+		})
+	}
+}
+
+func TestNewJWTValidatorErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		cfg  JWTConfig
+	}{
+		{"no issuer", JWTConfig{Audience: "aud", JWKSURL: srv.URL}},
+		{"no audience", JWTConfig{Issuer: "iss", JWKSURL: srv.URL}},
+		{"no keys", JWTConfig{Issuer: "iss", Audience: "aud", JWKSURL: srv.URL}},
+		{"unreachable", JWTConfig{Issuer: "iss", Audience: "aud", JWKSURL: "http://127.0.0.1:1/jwks"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newJWTValidator(context.Background(), tt.cfg, testMetrics(t), zerolog.Nop()); err == nil {
+				t.Error("newJWTValidator() did not return an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"github.com/andrewheberle/kdcproxy/internal/metricsutil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverMetrics holds the Prometheus metrics for a Server, which are registered with the registry
+// of its proxy so they are served at /metrics
+type serverMetrics struct {
+	// Metrics for client banning
+	clientBans           prometheus.Counter
+	clientBannedRequests prometheus.Counter
+
+	// Metrics per client
+	clientReqs          *prometheus.CounterVec
+	clientBytesReceived *prometheus.CounterVec
+	clientBytesSent     *prometheus.CounterVec
+	clientRejections    *prometheus.CounterVec
+
+	// Metrics for TLS handshakes
+	tlsHandshakeErrors *prometheus.CounterVec
+
+	// Metrics for connection limiting
+	connRejections prometheus.Counter
+
+	// Metrics for SIEM export
+	siemEvents  prometheus.Counter
+	siemDropped prometheus.Counter
+
+	// Metrics for sharing KDC health between peers
+	peerPublishErrors prometheus.Counter
+
+	// Metrics for client quotas
+	clientQuotaRejections prometheus.Counter
+	clientQuotaClients    prometheus.Gauge
+
+	// Metrics for JWT validation
+	jwtRejections *prometheus.CounterVec
+
+	// Metrics for audit sinks
+	auditEvents  prometheus.Counter
+	auditDropped prometheus.Counter
+}
+
+func newServerMetrics(reg prometheus.Registerer) (*serverMetrics, error) {
+	r := metricsutil.NewRegistrar(reg)
+	m := &serverMetrics{
+		clientBans: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_bans_total",
+			Help: "The total number of clients temporarily banned",
+		})),
+		clientBannedRequests: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_banned_requests_total",
+			Help: "The total number of requests rejected from banned clients",
+		})),
+		clientReqs: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_requests_total",
+			Help: "The total number of HTTP requests handled per client",
+		}, []string{"client"})),
+		clientBytesReceived: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_received_bytes_total",
+			Help: "The total number of bytes received per client",
+		}, []string{"client"})),
+		clientBytesSent: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_sent_bytes_total",
+			Help: "The total number of bytes sent per client",
+		}, []string{"client"})),
+		clientRejections: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_rejections_total",
+			Help: "The total number of non-200 HTTP responses per client",
+		}, []string{"client"})),
+		tlsHandshakeErrors: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_tls_handshake_errors_total",
+			Help: "The total number of failed TLS handshakes by reason",
+		}, []string{"reason"})),
+		connRejections: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_connections_rejected_total",
+			Help: "The total number of connections closed because the client exceeded the per client connection limit",
+		})),
+		siemEvents: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_siem_events_total",
+			Help: "The total number of audit events sent to the SIEM",
+		})),
+		siemDropped: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_siem_events_dropped_total",
+			Help: "The total number of audit events dropped because the SIEM was unavailable or too slow",
+		})),
+		peerPublishErrors: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_peer_publish_errors_total",
+			Help: "The total number of failures sending KDC health observations to peers",
+		})),
+		clientQuotaRejections: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_client_quota_rejections_total",
+			Help: "The total number of requests rejected as the client exceeded its quota",
+		})),
+		clientQuotaClients: metricsutil.Register(r, prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "kdc_proxy_client_quota_clients",
+			Help: "The number of clients currently tracked for quotas",
+		})),
+		jwtRejections: metricsutil.Register(r, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kdc_proxy_jwt_rejections_total",
+			Help: "The total number of requests rejected as they did not present a valid JWT by reason",
+		}, []string{"reason"})),
+		auditEvents: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_audit_events_total",
+			Help: "The total number of exchange events published to the audit sink",
+		})),
+		auditDropped: metricsutil.Register(r, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "kdc_proxy_audit_events_dropped_total",
+			Help: "The total number of exchange events dropped because the audit sink was unavailable or too slow",
+		})),
+	}
+
+	return m, r.Err()
+}
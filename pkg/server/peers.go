@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+)
+
+// PeerHealthPath is the endpoint that receives KDC health observations from peers
+const PeerHealthPath = "/peers/kdc-health"
+
+const (
+	// peerQueueSize is the number of observations buffered while waiting to be sent
+	peerQueueSize = 256
+
+	// peerMaxBody is the maximum size of a request from a peer
+	peerMaxBody = 64 << 10
+)
+
+// PeerShare is a proxy.HealthShare that sends KDC health observations to a fixed set of peer
+// instances over HTTP, authenticated with a shared secret, and receives observations from them
+type PeerShare struct {
+	// Client is used to send observations to peers, which defaults to a client with a 5 second timeout
+	Client *http.Client
+
+	peers  []string
+	secret string
+	logger zerolog.Logger
+	queue  chan proxy.KDCObservation
+
+	// metrics are those of the Server the PeerShare is passed to, as it is created before the Server
+	metrics atomic.Pointer[serverMetrics]
+}
+
+// NewPeerShare returns a PeerShare sending to the peers, which are base URLs such as
+// "https://kdcproxy2.example.com:8443"
+func NewPeerShare(peers []string, secret string, logger zerolog.Logger) (*PeerShare, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("a shared secret is required to share kdc health with peers")
+	}
+
+	urls := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer url %q", peer)
+		}
+		urls = append(urls, strings.TrimSuffix(peer, "/")+PeerHealthPath)
+	}
+
+	return &PeerShare{
+		Client: &http.Client{Timeout: 5 * time.Second},
+		peers:  urls,
+		secret: secret,
+		logger: logger,
+		queue:  make(chan proxy.KDCObservation, peerQueueSize),
+	}, nil
+}
+
+// Publish implements proxy.HealthShare. Observations are dropped if the queue is full.
+func (p *PeerShare) Publish(o proxy.KDCObservation) {
+	select {
+	case p.queue <- o:
+	default:
+		p.publishError()
+	}
+}
+
+// publishError counts a failure to send an observation once the PeerShare is used by a Server
+func (p *PeerShare) publishError() {
+	if m := p.metrics.Load(); m != nil {
+		m.peerPublishErrors.Inc()
+	}
+}
+
+// Run sends queued observations to all peers until ctx is cancelled
+func (p *PeerShare) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case o := <-p.queue:
+			b, err := json.Marshal(o)
+			if err != nil {
+				return err
+			}
+
+			for _, peer := range p.peers {
+				if err := p.send(ctx, peer, b); err != nil {
+					p.publishError()
+					p.logger.Warn().Err(err).Str("peer", peer).Msg("unable to send kdc health to peer")
+				}
+			}
+		}
+	}
+}
+
+func (p *PeerShare) send(ctx context.Context, peer string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.secret)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Handler returns a http.Handler that applies observations received from peers to k
+func (p *PeerShare) Handler(k *proxy.KerberosProxy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(p.secret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var o proxy.KDCObservation
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, peerMaxBody)).Decode(&o); err != nil || o.KDC == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		p.logger.Debug().Str("kdc", o.KDC).Str("proto", o.Proto).Bool("up", o.Up).Msg("kdc health from peer")
+		k.ObserveKDC(o)
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
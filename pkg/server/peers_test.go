@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestNewPeerShare(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   []string
+		secret  string
+		wantErr bool
+	}{
+		{"valid", []string{"https://kdcproxy2.example.com:8443/"}, "secret", false},
+		{"no secret", []string{"https://kdcproxy2.example.com"}, "", true},
+		{"invalid peer", []string{"kdcproxy2.example.com"}, "secret", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPeerShare(tt.peers, tt.secret, zerolog.Nop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPeerShare() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && p.peers[0] != "https://kdcproxy2.example.com:8443"+PeerHealthPath {
+				t.Errorf("peer = %s", p.peers[0])
+			}
+		})
+	}
+}
+
+func TestPeerShare(t *testing.T) {
+	// the receiving instance
+	k, err := proxy.NewKdcProxy(proxy.WithRegistry(prometheus.NewRegistry()), proxy.WithHoldDown(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{}, 1)
+	receiver, err := NewPeerShare(nil, "secret", zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := receiver.Handler(k)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		received <- struct{}{}
+	}))
+	defer peer.Close()
+
+	// the sending instance
+	sender, err := NewPeerShare([]string{peer.URL}, "secret", zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sender.Run(ctx)
+
+	sender.Publish(proxy.KDCObservation{KDC: "kdc1.example.com:88", Proto: "tcp", Until: time.Now().Add(time.Minute)})
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("observation not received")
+	}
+
+	// the observation is applied to the receiving proxy
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	k.Metrics().ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `kdc_proxy_kdc_peer_observations_total{state="down"} 1`) {
+		t.Errorf("observation not applied:\n%s", w.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		want   int
+	}{
+		{"wrong secret", http.MethodPost, "wrong", `{"kdc":"kdc1.example.com:88","proto":"tcp","up":true}`, http.StatusUnauthorized},
+		{"get", http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{"invalid", http.MethodPost, "secret", `{}`, http.StatusBadRequest},
+		{"valid", http.MethodPost, "secret", `{"kdc":"kdc1.example.com:88","proto":"tcp","up":true}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, PeerHealthPath, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerSharePublishErrors(t *testing.T) {
+	p, err := NewPeerShare([]string{"https://kdcproxy2.example.com"}, "secret", zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(t, Config{Peers: p})
+
+	// observations are dropped while the queue is full
+	for i := 0; i < peerQueueSize+1; i++ {
+		p.Publish(proxy.KDCObservation{KDC: "kdc1.example.com:88", Proto: "tcp"})
+	}
+
+	if got := testutil.ToFloat64(s.metrics.peerPublishErrors); got != 1 {
+		t.Errorf("peer publish errors = %v, want 1", got)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Responses to GET and HEAD requests to the KDC Proxy endpoints, which load balancers that can only
+// probe with GET use to check the endpoint
+const (
+	// ProbeReject returns 405 Method Not Allowed as for any other method except POST
+	ProbeReject = "reject"
+	// ProbeStatus returns 200 OK with a short status body, or 503 Service Unavailable when not ready
+	ProbeStatus = "status"
+	// ProbeRedirect redirects to /healthz
+	ProbeRedirect = "redirect"
+)
+
+func validateProbeResponse(response string) error {
+	switch response {
+	case "", ProbeReject, ProbeStatus, ProbeRedirect:
+		return nil
+	}
+
+	return fmt.Errorf("probe response must be %q, %q or %q", ProbeReject, ProbeStatus, ProbeRedirect)
+}
+
+// probe answers GET and HEAD requests to a KDC Proxy endpoint as configured, before the middleware
+// so probes are not counted against clients, passing all other requests to next
+func (s *Server) probe(next http.Handler) http.Handler {
+	if s.cfg.ProbeResponse == "" || s.cfg.ProbeResponse == ProbeReject {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.cfg.ProbeResponse == ProbeRedirect {
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+			return
+		}
+
+		s.readyz(w, r)
+	})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
+)
+
+// quotaSweepInterval is how often idle clients are removed from the quota list
+const quotaSweepInterval = time.Minute
+
+// quota is the rate limiter for a single client
+type quota struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// clientQuotas limits the rate of requests from each client, identified by its certificate when one
+// is presented so clients sharing an IP address are limited individually
+type clientQuotas struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	clients   map[string]*quota
+	lastSweep time.Time
+	metrics   *serverMetrics
+	logger    zerolog.Logger
+}
+
+// newClientQuotas returns clientQuotas allowing each client limit requests per second with bursts of
+// up to burst requests, which defaults to limit
+func newClientQuotas(limit, burst int, metrics *serverMetrics, logger zerolog.Logger) *clientQuotas {
+	if burst <= 0 {
+		burst = limit
+	}
+
+	return &clientQuotas{
+		limit:   rate.Limit(limit),
+		burst:   burst,
+		clients: make(map[string]*quota),
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+// Handler rejects requests from clients that have exceeded their quota
+func (q *clientQuotas) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientIdentity(r)
+
+		if delay, ok := q.allow(client, time.Now()); !ok {
+			q.metrics.clientQuotaRejections.Inc()
+			q.logger.Debug().
+				Str("client", client).
+				Dur("retry_after", delay).
+				Msg("client quota exceeded")
+
+			// Retry-After is in whole seconds
+			secs := (delay + time.Second - 1) / time.Second
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+			http.Error(w, "Client quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow returns true if the client is within its quota, otherwise the time until its next request
+// is permitted
+func (q *clientQuotas) allow(client string, now time.Time) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.sweep(now)
+
+	c, ok := q.clients[client]
+	if !ok {
+		c = &quota{limiter: rate.NewLimiter(q.limit, q.burst)}
+		q.clients[client] = c
+		q.metrics.clientQuotaClients.Inc()
+	}
+	c.lastSeen = now
+
+	if c.limiter.AllowN(now, 1) {
+		return 0, true
+	}
+
+	return time.Duration((1 - c.limiter.TokensAt(now)) / float64(q.limit) * float64(time.Second)), false
+}
+
+// sweep removes clients that have been idle long enough for their quota to be full again, must be
+// called with the lock held
+func (q *clientQuotas) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < quotaSweepInterval {
+		return
+	}
+	q.lastSweep = now
+
+	refill := time.Duration(float64(q.burst) / float64(q.limit) * float64(time.Second))
+	for client, c := range q.clients {
+		if now.Sub(c.lastSeen) > refill {
+			delete(q.clients, client)
+			q.metrics.clientQuotaClients.Dec()
+		}
+	}
+}
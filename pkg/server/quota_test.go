@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestClientQuotas(t *testing.T) {
+	h := newClientQuotas(1, 2, testMetrics(t), zerolog.Nop()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// all requests come from the same address, as if behind NAT
+	request := func(cert *x509.Certificate) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/KdcProxy", nil)
+		r.RemoteAddr = "192.0.2.1:12345"
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		return r
+	}
+	laptop := &x509.Certificate{Subject: pkix.Name{CommonName: "laptop.example.com"}}
+	phone := &x509.Certificate{DNSNames: []string{"phone.example.com"}}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want int
+	}{
+		{"laptop first", laptop, http.StatusOK},
+		{"laptop burst", laptop, http.StatusOK},
+		{"laptop over quota", laptop, http.StatusTooManyRequests},
+		{"phone limited separately", phone, http.StatusOK},
+		{"no certificate limited by ip", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request(tt.cert))
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: Retry-After = %q, want 1", tt.name, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestClientQuotasConcurrent(t *testing.T) {
+	h := newClientQuotas(1, 5, testMetrics(t), zerolog.Nop()).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// each client is allowed its burst however its requests are interleaved with others
+	const clients, requests = 10, 20
+	var mu sync.Mutex
+	allowed := make(map[string]int)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < clients*requests; i++ {
+		wg.Add(1)
+		go func(client string) {
+			defer wg.Done()
+			<-start
+			r := httptest.NewRequest(http.MethodPost, "/KdcProxy", nil)
+			r.RemoteAddr = client + ":12345"
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code == http.StatusOK {
+				mu.Lock()
+				allowed[client]++
+				mu.Unlock()
+			}
+		}("192.0.2." + strconv.Itoa(i%clients))
+	}
+	close(start)
+	wg.Wait()
+
+	if len(allowed) != clients {
+		t.Errorf("clients allowed = %d, want %d", len(allowed), clients)
+	}
+	for client, n := range allowed {
+		if n < 5 || n > 6 {
+			t.Errorf("%s allowed %d requests, want 5", client, n)
+		}
+	}
+}
+
+func TestClientQuotasSweep(t *testing.T) {
+	q := newClientQuotas(10, 0, testMetrics(t), zerolog.Nop())
+	if q.burst != 10 {
+		t.Errorf("burst = %d, want the limit of 10", q.burst)
+	}
+
+	now := time.Now()
+	q.allow("first", now)
+	q.allow("second", now.Add(quotaSweepInterval+time.Second))
+
+	if _, ok := q.clients["first"]; ok {
+		t.Error("idle client was not removed")
+	}
+	if _, ok := q.clients["second"]; !ok {
+		t.Error("active client was removed")
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		want string
+	}{
+		{"no certificate", nil, "192.0.2.1"},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "cn"}, DNSNames: []string{"dns"}}, "cn"},
+		{"dns name", &x509.Certificate{DNSNames: []string{"dns"}}, "dns"},
+		{"email", &x509.Certificate{EmailAddresses: []string{"user@example.com"}}, "user@example.com"},
+		{"no names", &x509.Certificate{}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/KdcProxy", nil)
+			r.RemoteAddr = "192.0.2.1:12345"
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.cert}}
+			}
+
+			if got := clientIdentity(r); got != tt.want {
+				t.Errorf("clientIdentity() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecurityHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		method   string
+		tls      bool
+		want     int
+		wantHSTS string
+		wantCT   string
+	}{
+		{"plain", Config{}, http.MethodGet, false, http.StatusOK, "", "nosniff"},
+		{"tls", Config{}, http.MethodGet, true, http.StatusOK, "max-age=31536000", "nosniff"},
+		{"tls custom max-age", Config{HSTSMaxAge: time.Hour}, http.MethodGet, true, http.StatusOK, "max-age=3600", "nosniff"},
+		{"tls hsts disabled", Config{HSTSMaxAge: -1}, http.MethodGet, true, http.StatusOK, "", "nosniff"},
+		{"headers disabled", Config{DisableSecurityHeaders: true}, http.MethodGet, true, http.StatusOK, "", ""},
+		{"trace", Config{}, http.MethodTrace, false, http.StatusMethodNotAllowed, "", "nosniff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t, tt.cfg)
+
+			req := httptest.NewRequest(tt.method, "/healthz", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Strict-Transport-Security"); got != tt.wantHSTS {
+				t.Errorf("Strict-Transport-Security = %q, want %q", got, tt.wantHSTS)
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); tt.want == http.StatusOK && got != tt.wantCT {
+				t.Errorf("X-Content-Type-Options = %q, want %q", got, tt.wantCT)
+			}
+		})
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := ParseTLSVersion(tt.v)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseTLSVersion() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	if got := hardenedTLSConfig(0).MinVersion; got != tls.VersionTLS12 {
+		t.Errorf("hardenedTLSConfig(0).MinVersion = %v, want TLS 1.2", got)
+	}
+}
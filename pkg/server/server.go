@@ -0,0 +1,636 @@
+// Package server provides a production ready HTTP server for a KDC proxy, combining the proxy with
+// TLS certificate reloading, logging and abuse protection middleware, metrics and health endpoints.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/cloudflare/certinel/fswatcher"
+	"github.com/justinas/alice"
+	"github.com/oklog/run"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// DefaultShutdownTimeout is the time allowed for in-flight requests to complete on shutdown
+const DefaultShutdownTimeout = 3 * time.Second
+
+// Config is the configuration for a Server
+type Config struct {
+	// Proxy handles requests to the KDC Proxy endpoint and is required
+	Proxy *proxy.KerberosProxy
+
+	// Tenants are additional proxies served at /KdcProxy/{name}, each with its own realm restrictions,
+	// rate limits and krb5 configuration
+	Tenants map[string]*proxy.KerberosProxy
+
+	// Listen is the address to listen on
+	Listen string
+
+	// AdditionalListen are further addresses, such as on other interfaces, that are served with the
+	// same configuration
+	AdditionalListen []string
+
+	// MetricsListen is the address of a separate plain HTTP listener, such as on an internal
+	// interface, for the /metrics and /stats endpoints along with /healthz and /readyz. When empty
+	// /metrics and /stats are served on Listen behind the AdminToken, so are not served without one,
+	// as they reveal the addresses and health of the KDC's.
+	MetricsListen string
+
+	// CertFile and KeyFile enable TLS when both are set. The certificate is reloaded when the files change.
+	CertFile string
+	KeyFile  string
+
+	// Certificates enables TLS using an alternative source of certificates, such as a VaultSource,
+	// and takes precedence over CertFile and KeyFile
+	Certificates CertificateSource
+
+	// ClientCAFile enables mutual TLS, requiring clients to present a certificate issued by one of the
+	// CAs in this PEM bundle. The bundle is reloaded when the file changes.
+	ClientCAFile string
+
+	// ReadTimeout and WriteTimeout are the timeouts for the underlying http.Server
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// ReadHeaderTimeout is the time allowed to read request headers and BodyTimeout is the time allowed
+	// to read the body of a KDC Proxy request, which default to DefaultReadHeaderTimeout and
+	// DefaultBodyTimeout. A negative value disables the timeout.
+	ReadHeaderTimeout time.Duration
+	BodyTimeout       time.Duration
+
+	// MaxConnsPerIP limits the number of concurrent connections from a single client IP address,
+	// further connections are closed immediately. The default of 0 is unlimited.
+	MaxConnsPerIP int
+
+	// ShutdownTimeout is the time allowed for in-flight requests to complete on shutdown, which
+	// defaults to DefaultShutdownTimeout
+	ShutdownTimeout time.Duration
+
+	// DrainDelay is the time requests continue to be served after shutdown begins, while /readyz reports
+	// the server as not ready, so that load balancers stop sending new requests before the listener is
+	// closed. The default of 0 shuts down immediately.
+	DrainDelay time.Duration
+
+	// Logger is used for access and server logs
+	Logger zerolog.Logger
+
+	// AccessLogSample logs 1 in N successful requests, errors are always logged. The default of 0
+	// logs every request.
+	AccessLogSample int
+
+	// BanThreshold is the number of client errors within BanWindow before a client is banned for
+	// BanDuration, 0 disables banning
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+
+	// TLSMinVersion is the minimum TLS version accepted, which defaults to TLS 1.2. Only AEAD cipher
+	// suites with forward secrecy are offered.
+	TLSMinVersion uint16
+
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header sent over TLS, which defaults to
+	// DefaultHSTSMaxAge. A negative value disables the header.
+	HSTSMaxAge time.Duration
+
+	// DisableSecurityHeaders stops hardening headers such as X-Content-Type-Options and
+	// Strict-Transport-Security being added to responses
+	DisableSecurityHeaders bool
+
+	// TLSFingerprints logs a fingerprint of the TLS ClientHello of each client connection, which can be
+	// used to tell clients apart when investigating handshake failures
+	TLSFingerprints bool
+
+	// ClientQuota limits each client to this many requests per second, with bursts of up to
+	// ClientQuotaBurst requests which defaults to ClientQuota. Clients are identified by their
+	// certificate when one is presented, so clients behind the same NAT are limited individually,
+	// otherwise by IP address. The default of 0 disables quotas.
+	ClientQuota      int
+	ClientQuotaBurst int
+
+	// JWT requires KDC Proxy requests to present a valid JWT as a bearer token, for deployments behind an
+	// identity-aware proxy or OAuth gateway. The key set is fetched immediately so any errors are
+	// returned by NewServer.
+	JWT *JWTConfig
+
+	// ClientMetrics enables per client metrics for up to ClientMetricsLimit distinct clients
+	ClientMetrics      bool
+	ClientMetricsLimit int
+
+	// SIEMAddress enables sending an audit event for each KDC Proxy request to a SIEM via syslog, as a
+	// URL such as "udp://siem.example.com:514" or "tcp://siem.example.com:514"
+	SIEMAddress string
+
+	// SIEMFormat is the format of audit events, either SIEMFormatCEF (the default) or SIEMFormatLEEF
+	SIEMFormat string
+
+	// AuditSink enables publishing an event for each exchange with a KDC, such as to the sinks
+	// returned by NewAuditSink, which is closed when the server stops
+	AuditSink AuditSink
+
+	// Version is the application version included in audit events
+	Version string
+
+	// Peers receives KDC health observations from other instances at PeerHealthPath and sends this
+	// instance's observations to them. The same PeerShare must be passed to proxy.WithHealthShare.
+	Peers *PeerShare
+
+	// AdminToken enables the AdminLogLevelPath endpoint, which requires this bearer token, to view and
+	// change the global log level at runtime, along with the AdminErrorsPath, AdminTailPath and
+	// AdminRateLimitPath endpoints and any AdminHandlers, along with /metrics and /stats unless
+	// MetricsListen is set
+	AdminToken string
+
+	// ProbeResponse is the response to GET and HEAD requests to the KDC Proxy endpoints, such as from
+	// load balancer health probes, of ProbeReject (the default), ProbeStatus or ProbeRedirect. POST
+	// requests are unaffected.
+	ProbeResponse string
+
+	// Handlers are additional routes served alongside the proxy and health endpoints
+	Handlers map[string]http.Handler
+
+	// AdminHandlers are additional routes that require the AdminToken, which are not served when it
+	// is empty
+	AdminHandlers map[string]http.Handler
+}
+
+// Server serves a KDC proxy over HTTP or HTTPS
+type Server struct {
+	cfg      Config
+	srv      *http.Server
+	internal *http.Server
+	sentinel CertificateSource
+	clientCA *clientCAs
+	jwt      *jwtValidator
+	siem     *siem
+	audit    *audit
+	tail     *tail
+	metrics  *serverMetrics
+	ready    atomic.Bool
+}
+
+// NewServer returns a Server for the provided configuration. When TLS is enabled the certificate
+// and key are loaded immediately so any errors are returned here.
+func NewServer(cfg Config) (*Server, error) {
+	if cfg.Proxy == nil {
+		return nil, fmt.Errorf("proxy is required")
+	}
+	for name, t := range cfg.Tenants {
+		if name == "" || strings.Contains(name, "/") || t == nil {
+			return nil, fmt.Errorf("invalid tenant %q", name)
+		}
+	}
+	if cfg.AccessLogSample < 0 {
+		return nil, fmt.Errorf("access log sample rate cannot be negative")
+	}
+	if cfg.AccessLogSample == 0 {
+		cfg.AccessLogSample = 1
+	}
+	if cfg.BanThreshold < 0 {
+		return nil, fmt.Errorf("ban threshold cannot be negative")
+	}
+	if cfg.ClientQuota < 0 || cfg.ClientQuotaBurst < 0 {
+		return nil, fmt.Errorf("client quota cannot be negative")
+	}
+	if cfg.MaxConnsPerIP < 0 {
+		return nil, fmt.Errorf("maximum connections per client cannot be negative")
+	}
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	if cfg.BodyTimeout == 0 {
+		cfg.BodyTimeout = DefaultBodyTimeout
+	}
+	if cfg.DrainDelay < 0 {
+		return nil, fmt.Errorf("drain delay cannot be negative")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if cfg.HSTSMaxAge == 0 {
+		cfg.HSTSMaxAge = DefaultHSTSMaxAge
+	}
+	if err := validateProbeResponse(cfg.ProbeResponse); err != nil {
+		return nil, err
+	}
+	if cfg.TLSMinVersion != 0 && cfg.TLSMinVersion != tls.VersionTLS12 && cfg.TLSMinVersion != tls.VersionTLS13 {
+		return nil, fmt.Errorf("minimum tls version must be TLS 1.2 or TLS 1.3")
+	}
+
+	metrics, err := newServerMetrics(cfg.Proxy.Registerer())
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{cfg: cfg, metrics: metrics}
+
+	if cfg.Peers != nil {
+		cfg.Peers.metrics.Store(metrics)
+	}
+
+	if cfg.SIEMAddress != "" {
+		siem, err := newSIEM(cfg.SIEMAddress, cfg.SIEMFormat, cfg.Version, metrics, cfg.Logger)
+		if err != nil {
+			return nil, err
+		}
+		siem.hooks(cfg.Proxy)
+		for _, t := range cfg.Tenants {
+			siem.hooks(t)
+		}
+		s.siem = siem
+	}
+
+	if cfg.AuditSink != nil {
+		s.audit = newAudit(cfg.AuditSink, metrics, cfg.Logger)
+		s.audit.hooks(cfg.Proxy)
+		for _, t := range cfg.Tenants {
+			s.audit.hooks(t)
+		}
+	}
+
+	if cfg.AdminToken != "" {
+		s.tail = newTail()
+	}
+
+	if cfg.JWT != nil {
+		jwt, err := newJWTValidator(context.Background(), *cfg.JWT, metrics, cfg.Logger)
+		if err != nil {
+			return nil, err
+		}
+		s.jwt = jwt
+	}
+
+	// the metrics listener is set up first so routes knows whether to serve metrics itself
+	errorLog := log.New(&errorLogWriter{metrics: metrics, logger: cfg.Logger}, "", 0)
+	if cfg.MetricsListen != "" {
+		s.internal = &http.Server{
+			Addr:              cfg.MetricsListen,
+			Handler:           s.internalRoutes(),
+			ReadTimeout:       cfg.ReadTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			ErrorLog:          errorLog,
+		}
+	}
+
+	s.srv = &http.Server{
+		Addr:         cfg.Listen,
+		Handler:      s.routes(),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		ErrorLog:     errorLog,
+	}
+	if cfg.ReadHeaderTimeout > 0 {
+		s.srv.ReadHeaderTimeout = cfg.ReadHeaderTimeout
+	}
+
+	if cfg.Certificates == nil && cfg.CertFile != "" && cfg.KeyFile != "" {
+		sentinel, err := fswatcher.New(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read server certificate: %w", err)
+		}
+		cfg.Certificates = sentinel
+	}
+
+	if cfg.Certificates != nil {
+		s.sentinel = cfg.Certificates
+		s.srv.TLSConfig = hardenedTLSConfig(cfg.TLSMinVersion)
+		s.srv.TLSConfig.GetCertificate = cfg.Certificates.GetCertificate
+
+		if cfg.ClientCAFile != "" {
+			clientCA, err := newClientCAs(cfg.ClientCAFile, s.srv.TLSConfig, cfg.Logger)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read client ca bundle: %w", err)
+			}
+			s.clientCA = clientCA
+			s.srv.TLSConfig.GetConfigForClient = clientCA.GetConfigForClient
+		}
+
+		if cfg.TLSFingerprints {
+			next := s.srv.TLSConfig.GetConfigForClient
+			s.srv.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				cfg.Logger.Info().
+					Str("ip", hello.Conn.RemoteAddr().String()).
+					Str("server_name", hello.ServerName).
+					Str("fingerprint", fingerprint(hello)).
+					Msg("tls client hello")
+
+				if next != nil {
+					return next(hello)
+				}
+
+				return nil, nil
+			}
+		}
+	} else if cfg.ClientCAFile != "" {
+		return nil, fmt.Errorf("client certificate authentication requires tls")
+	}
+
+	return s, nil
+}
+
+// Handler returns the http.Handler that serves all routes
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// Ready returns true once the server is listening and until it begins shutting down
+func (s *Server) Ready() bool {
+	return s.ready.Load()
+}
+
+// Run listens on the configured addresses and serves requests until ctx is cancelled or an error
+// occurs. On cancellation in-flight requests are given ShutdownTimeout to complete.
+func (s *Server) Run(ctx context.Context) error {
+	addrs := append([]string{s.srv.Addr}, s.cfg.AdditionalListen...)
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if s.cfg.MaxConnsPerIP > 0 {
+			ln = newConnLimitListener(ln, s.cfg.MaxConnsPerIP, s.metrics, s.cfg.Logger)
+		}
+		listeners = append(listeners, ln)
+	}
+	var internal net.Listener
+	if s.internal != nil {
+		ln, err := net.Listen("tcp", s.internal.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		internal = ln
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g := run.Group{}
+
+	// stop when the context is cancelled
+	g.Add(func() error {
+		<-ctx.Done()
+		return nil
+	}, func(err error) {
+		cancel()
+	})
+
+	// reload the certificate when it changes
+	if s.sentinel != nil {
+		g.Add(func() error {
+			return s.sentinel.Start(ctx)
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	// reload the client ca bundle when it changes
+	if s.clientCA != nil {
+		g.Add(func() error {
+			return s.clientCA.Start(ctx)
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	// all listeners are served by the same server, so it is only shut down once
+	var shutdown sync.Once
+	for _, ln := range listeners {
+		ln := ln
+		g.Add(func() error {
+			s.ready.Store(true)
+
+			var err error
+			if s.sentinel != nil {
+				s.cfg.Logger.Info().
+					Str("listen", ln.Addr().String()).
+					Msg("starting tls server")
+				err = s.srv.ServeTLS(ln, "", "")
+			} else {
+				s.cfg.Logger.Info().
+					Str("listen", ln.Addr().String()).
+					Msg("starting server")
+				err = s.srv.Serve(ln)
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+
+			return err
+		}, func(err error) {
+			shutdown.Do(func() {
+				s.ready.Store(false)
+
+				// live tail streams never complete so would otherwise hold up shutdown
+				if s.tail != nil {
+					s.tail.close()
+				}
+
+				// keep serving until load balancers have seen the server is no longer ready, unless
+				// stopping due to an error
+				if err == nil && s.cfg.DrainDelay > 0 {
+					s.cfg.Logger.Info().Dur("delay", s.cfg.DrainDelay).Msg("draining before shutdown")
+					s.srv.SetKeepAlivesEnabled(false)
+					time.Sleep(s.cfg.DrainDelay)
+				}
+
+				shutdownctx, shutdowncancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+				defer shutdowncancel()
+				s.srv.Shutdown(shutdownctx)
+			})
+		})
+	}
+
+	// serve metrics and stats on their own listener, which is shut down after the server so
+	// readiness is reported while draining
+	if internal != nil {
+		g.Add(func() error {
+			s.cfg.Logger.Info().
+				Str("listen", internal.Addr().String()).
+				Msg("starting metrics server")
+			if err := s.internal.Serve(internal); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+
+			return nil
+		}, func(err error) {
+			shutdownctx, shutdowncancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+			defer shutdowncancel()
+			s.internal.Shutdown(shutdownctx)
+		})
+	}
+
+	// share kdc health with peers
+	if s.cfg.Peers != nil {
+		peerctx, peercancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return s.cfg.Peers.Run(peerctx)
+		}, func(err error) {
+			peercancel()
+		})
+	}
+
+	// send audit events to the siem, which is stopped after the server so events are sent while
+	// draining
+	if s.siem != nil {
+		siemctx, siemcancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return s.siem.Run(siemctx)
+		}, func(err error) {
+			siemcancel()
+		})
+	}
+
+	// publish exchange events to the audit sink, which is also stopped after the server
+	if s.audit != nil {
+		auditctx, auditcancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return s.audit.Run(auditctx)
+		}, func(err error) {
+			auditcancel()
+		})
+	}
+
+	return g.Run()
+}
+
+// routes sets up the middleware chain and all endpoints
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	// tenants share the middleware so clients are banned from all endpoints
+	mw := s.middleware()
+	mux.Handle("/KdcProxy", s.probe(mw.ThenFunc(s.cfg.Proxy.Handler)))
+	for name, t := range s.cfg.Tenants {
+		mux.Handle("/KdcProxy/"+name, s.probe(mw.ThenFunc(t.Handler)))
+	}
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	if s.cfg.AdminToken != "" {
+		if s.internal == nil {
+			mux.Handle("/metrics", adminHandler(s.cfg.AdminToken, s.cfg.Proxy.Metrics()))
+			mux.Handle("/stats", adminHandler(s.cfg.AdminToken, s.cfg.Proxy.StatsHandler()))
+		}
+		mux.Handle(AdminLogLevelPath, &logLevelAdmin{token: s.cfg.AdminToken, logger: s.cfg.Logger})
+		mux.Handle(AdminErrorsPath, adminHandler(s.cfg.AdminToken, s.cfg.Proxy.RecentErrorsHandler()))
+		mux.Handle(AdminTailPath, adminHandler(s.cfg.AdminToken, s.tail))
+		mux.Handle(AdminRateLimitPath, &rateLimitAdmin{token: s.cfg.AdminToken, proxy: s.cfg.Proxy, tenants: s.cfg.Tenants, logger: s.cfg.Logger})
+		for path, h := range s.cfg.AdminHandlers {
+			mux.Handle(path, adminHandler(s.cfg.AdminToken, h))
+		}
+	}
+	if s.cfg.Peers != nil {
+		mux.Handle(PeerHealthPath, s.cfg.Peers.Handler(s.cfg.Proxy))
+	}
+
+	for path, h := range s.cfg.Handlers {
+		mux.Handle(path, h)
+	}
+
+	return s.securityHandler(mux)
+}
+
+// internalRoutes returns the endpoints served on the MetricsListen address
+func (s *Server) internalRoutes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.cfg.Proxy.Metrics())
+	mux.Handle("/stats", s.cfg.Proxy.StatsHandler())
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+
+	return s.securityHandler(mux)
+}
+
+// middleware returns the chain of handlers applied to KDC Proxy requests
+func (s *Server) middleware() alice.Chain {
+	var served atomic.Uint64
+	sample := uint64(s.cfg.AccessLogSample)
+
+	c := alice.New()
+	if s.cfg.BodyTimeout > 0 {
+		c = c.Append(bodyDeadline(s.cfg.BodyTimeout))
+	}
+	c = c.Append(hlog.NewHandler(s.cfg.Logger))
+	c = c.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+		// only log a sample of successful requests
+		if status == http.StatusOK && (served.Add(1)-1)%sample != 0 {
+			return
+		}
+
+		hlog.FromRequest(r).Info().
+			Int("status", status).
+			Int("size", size).
+			Dur("duration", duration).
+			Send()
+	}))
+	c = c.Append(hlog.URLHandler("url"))
+	c = c.Append(hlog.MethodHandler("method"))
+	c = c.Append(hlog.RemoteAddrHandler("ip"))
+	c = c.Append(hlog.UserAgentHandler("user_agent"))
+	c = c.Append(hlog.RefererHandler("referer"))
+	c = c.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
+	c = c.Append(requestIDHandler)
+	c = c.Append(s.forwardInfoHandler)
+
+	// audit events for the siem
+	if s.siem != nil {
+		c = c.Append(s.siem.Handler)
+	}
+
+	// temporarily ban abusive clients
+	if s.cfg.BanThreshold > 0 {
+		c = c.Append(newBanList(s.cfg.BanThreshold, s.cfg.BanWindow, s.cfg.BanDuration, s.metrics, s.cfg.Logger).Handler)
+	}
+
+	// bearer token authentication
+	if s.jwt != nil {
+		c = c.Append(s.jwt.Handler)
+	}
+
+	// per client metrics
+	if s.cfg.ClientMetrics {
+		c = c.Append(newClientMetrics(s.cfg.ClientMetricsLimit, s.metrics).Handler)
+	}
+
+	// per client quotas, after per client metrics so rejections are attributed to the client
+	if s.cfg.ClientQuota > 0 {
+		c = c.Append(newClientQuotas(s.cfg.ClientQuota, s.cfg.ClientQuotaBurst, s.metrics, s.cfg.Logger).Handler)
+	}
+
+	return c
+}
+
+// healthz reports that the process is alive
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyz reports whether the server is accepting requests and has a krb5 configuration
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !s.Ready() || s.cfg.Proxy.Krb5Config() == nil {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,469 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+func testServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+
+	k, err := proxy.NewKdcProxy(proxy.WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	cfg.Proxy = k
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	return s
+}
+
+// testMetrics returns server metrics registered with a new registry
+func testMetrics(t *testing.T) *serverMetrics {
+	t.Helper()
+
+	m, err := newServerMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("newServerMetrics() error = %v", err)
+	}
+
+	return m
+}
+
+// testRequestBody returns a KDC-PROXY-MESSAGE containing an AS-REQ for user@EXAMPLE.COM
+func testRequestBody(t *testing.T) []byte {
+	t.Helper()
+
+	asReq, err := messages.NewASReqForTGT("EXAMPLE.COM", config.New(), types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := asReq.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := proxy.EncodeKdcProxyMessage(&proxy.KdcProxyMsg{KerbMessage: append(proxy.MarshalKerbLength(len(b)), b...), TargetDomain: "EXAMPLE.COM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func TestNewServer(t *testing.T) {
+	k, err := proxy.NewKdcProxy(proxy.WithRegistry(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"defaults", Config{Proxy: k}, false},
+		{"no proxy", Config{}, true},
+		{"negative sample", Config{Proxy: k, AccessLogSample: -1}, true},
+		{"negative ban threshold", Config{Proxy: k, BanThreshold: -1}, true},
+		{"negative client quota", Config{Proxy: k, ClientQuota: -1}, true},
+		{"negative conns per ip", Config{Proxy: k, MaxConnsPerIP: -1}, true},
+		{"negative drain delay", Config{Proxy: k, DrainDelay: -1}, true},
+		{"invalid tenant", Config{Proxy: k, Tenants: map[string]*proxy.KerberosProxy{"a/b": k}}, true},
+		{"nil tenant", Config{Proxy: k, Tenants: map[string]*proxy.KerberosProxy{"acme": nil}}, true},
+		{"missing certificate", Config{Proxy: k, CertFile: "missing.crt", KeyFile: "missing.key"}, true},
+		{"client ca without tls", Config{Proxy: k, ClientCAFile: "ca.pem"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewServer(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("NewServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerRoutes(t *testing.T) {
+	s := testServer(t, Config{
+		Handlers: map[string]http.Handler{
+			"/extra": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		},
+	})
+
+	tests := []struct {
+		path   string
+		method string
+		want   int
+	}{
+		{"/healthz", http.MethodGet, http.StatusOK},
+		{"/readyz", http.MethodGet, http.StatusServiceUnavailable},
+		{"/metrics", http.MethodGet, http.StatusNotFound},
+		{"/stats", http.MethodGet, http.StatusNotFound},
+		{"/extra", http.MethodGet, http.StatusOK},
+		{"/KdcProxy", http.MethodGet, http.StatusMethodNotAllowed},
+		{"/missing", http.MethodGet, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.want {
+				t.Errorf("%s %s status = %v, want %v", tt.method, tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := testServer(t, Config{BanThreshold: 1, BanWindow: time.Minute, BanDuration: time.Minute, MetricsListen: "127.0.0.1:0"})
+
+	// an invalid request bans the client
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/KdcProxy", strings.NewReader("invalid"))
+		s.Handler().ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// server metrics are served alongside those of the proxy
+	w := httptest.NewRecorder()
+	s.internal.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"kdc_proxy_client_bans_total 1", "kdc_proxy_client_banned_requests_total 1", "kdc_proxy_http_requests_total 1"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+
+	// servers may share a registry
+	if _, err := NewServer(Config{Proxy: s.cfg.Proxy}); err != nil {
+		t.Errorf("NewServer() with a shared registry error = %v", err)
+	}
+}
+
+func TestServerMetricsRoutes(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           Config
+		auth          string
+		wantPublic    int
+		wantSeparated bool
+	}{
+		{"not served", Config{}, "", http.StatusNotFound, false},
+		{"no token", Config{AdminToken: "secret"}, "", http.StatusUnauthorized, false},
+		{"token", Config{AdminToken: "secret"}, "Bearer secret", http.StatusOK, false},
+		{"metrics listener", Config{AdminToken: "secret", MetricsListen: "127.0.0.1:0"}, "Bearer secret", http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testServer(t, tt.cfg)
+
+			for _, path := range []string{"/metrics", "/stats"} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				if tt.auth != "" {
+					r.Header.Set("Authorization", tt.auth)
+				}
+				w := httptest.NewRecorder()
+				s.Handler().ServeHTTP(w, r)
+				if w.Code != tt.wantPublic {
+					t.Errorf("%s status = %d, want %d", path, w.Code, tt.wantPublic)
+				}
+
+				if got := s.internal != nil; got != tt.wantSeparated {
+					t.Fatalf("metrics listener = %v, want %v", got, tt.wantSeparated)
+				}
+				if s.internal != nil {
+					w := httptest.NewRecorder()
+					s.internal.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+					if w.Code != http.StatusOK {
+						t.Errorf("%s status on metrics listener = %d, want %d", path, w.Code, http.StatusOK)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProbeResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		method   string
+		ready    bool
+		want     int
+		wantBody string
+	}{
+		{ProbeReject, http.MethodGet, true, http.StatusMethodNotAllowed, ""},
+		{ProbeStatus, http.MethodGet, true, http.StatusOK, "ok\n"},
+		{ProbeStatus, http.MethodHead, true, http.StatusOK, ""},
+		{ProbeStatus, http.MethodGet, false, http.StatusServiceUnavailable, "not ready\n"},
+		{ProbeStatus, http.MethodPut, true, http.StatusMethodNotAllowed, ""},
+		{ProbeRedirect, http.MethodGet, true, http.StatusFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.response+" "+tt.method, func(t *testing.T) {
+			s := testServer(t, Config{ProbeResponse: tt.response})
+			s.ready.Store(tt.ready)
+
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, "/KdcProxy", nil))
+			if w.Code != tt.want {
+				t.Errorf("%s /KdcProxy status = %v, want %v", tt.method, w.Code, tt.want)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("%s /KdcProxy body = %q, want %q", tt.method, w.Body.String(), tt.wantBody)
+			}
+			if tt.response == ProbeRedirect && w.Header().Get("Location") != "/healthz" {
+				t.Errorf("Location = %q, want /healthz", w.Header().Get("Location"))
+			}
+		})
+	}
+
+	// requests are still forwarded
+	s := testServer(t, Config{ProbeResponse: ProbeStatus})
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader([]byte("invalid"))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /KdcProxy status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	if _, err := NewServer(Config{Proxy: s.cfg.Proxy, ProbeResponse: "ignore"}); err == nil {
+		t.Error("NewServer() with invalid probe response did not return an error")
+	}
+}
+
+func TestServerRun(t *testing.T) {
+	s := testServer(t, Config{Listen: "127.0.0.1:0", MetricsListen: "127.0.0.1:0"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+
+	if s.Ready() {
+		t.Errorf("Ready() = true after shutdown")
+	}
+}
+
+func TestServerRunAdditionalListen(t *testing.T) {
+	// reserve two free ports
+	addrs := make([]string, 2)
+	for i := range addrs {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = ln.Addr().String()
+		ln.Close()
+	}
+
+	s := testServer(t, Config{Listen: addrs[0], AdditionalListen: addrs[1:]})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	for _, addr := range addrs {
+		var resp *http.Response
+		var err error
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			resp, err = http.Get("http://" + addr + "/healthz")
+			if err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("GET %s error = %v", addr, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s status = %d, want %d", addr, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+}
+
+func TestServerRunListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the additional address is in use
+	s := testServer(t, Config{Listen: "127.0.0.1:0", AdditionalListen: []string{ln.Addr().String()}})
+	if err := s.Run(context.Background()); err == nil {
+		t.Error("Run() did not return an error")
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	s := testServer(t, Config{Listen: "127.0.0.1:0", DrainDelay: 500 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	cancel()
+
+	// not ready while draining but still running
+	time.Sleep(100 * time.Millisecond)
+	if s.Ready() {
+		t.Error("Ready() = true while draining")
+	}
+	select {
+	case <-done:
+		t.Fatal("Run() returned before the drain delay")
+	default:
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+		if d := time.Since(start); d < 500*time.Millisecond {
+			t.Errorf("Run() returned after %v, want at least the drain delay", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after drain")
+	}
+}
+
+func TestServerTenants(t *testing.T) {
+	// the default endpoint denies the realm while the tenant allows it
+	k, err := proxy.NewKdcProxy(proxy.WithRegistry(prometheus.NewRegistry()), proxy.WithDeniedRealms("EXAMPLE.COM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := proxy.NewKdcProxy(proxy.WithRegistry(prometheus.NewRegistry()), proxy.WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(Config{Proxy: k, Tenants: map[string]*proxy.KerberosProxy{"acme": tenant}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/KdcProxy", http.StatusForbidden},
+		{"/KdcProxy/acme", http.StatusOK},
+		{"/KdcProxy/other", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader(testRequestBody(t))))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// replyTransport answers every exchange with a KRB-ERROR
+type replyTransport struct {
+	reply []byte
+}
+
+func (t *replyTransport) Exchange(ctx context.Context, proto, kdc string, req []byte) ([]byte, error) {
+	return t.reply, nil
+}
+
+func TestServerAccessLog(t *testing.T) {
+	krbErr := messages.NewKRBError(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/EXAMPLE.COM"), "EXAMPLE.COM", errorcode.KDC_ERR_PREAUTH_REQUIRED, "preauth required")
+	reply, err := krbErr.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := proxy.NewKdcProxy(
+		proxy.WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		proxy.WithRegistry(prometheus.NewRegistry()),
+		proxy.WithTransport(&replyTransport{reply: append(proxy.MarshalKerbLength(len(reply)), reply...)}),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	var buf bytes.Buffer
+	s, err := NewServer(Config{Proxy: k, Logger: zerolog.New(&buf)})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testRequestBody(t))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	// the access log shows which kdc served the request
+	for _, want := range []string{`"realm":"EXAMPLE.COM"`, `"attempts":1`, `"kdc":"kdc.example.com:88"`, `"proto":"udp"`, `"status":200`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("access log = %s, missing %s", buf.String(), want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Formats of audit events sent to a SIEM
+const (
+	SIEMFormatCEF  = "cef"
+	SIEMFormatLEEF = "leef"
+)
+
+const (
+	// siemQueueSize is the number of audit events buffered while waiting to be sent
+	siemQueueSize = 1024
+
+	// siemFacility is the syslog facility (security/authorization messages) of audit events
+	siemFacility = 4
+
+	siemVendor  = "andrewheberle"
+	siemProduct = "kdcproxy"
+)
+
+// auditEvent is the record of a single KDC Proxy request sent to a SIEM
+type auditEvent struct {
+	mu sync.Mutex
+
+	Time             time.Time
+	RequestID        string
+	Client           string
+	Identity         string
+	Realm            string
+	Type             proxy.MessageType
+	ClientPrincipal  string
+	ServicePrincipal string
+	KDC              string
+	Proto            string
+	Status           int
+	Duration         time.Duration
+}
+
+type auditKey struct{}
+
+// auditFromContext returns the audit event for the request associated with ctx, if any
+func auditFromContext(ctx context.Context) *auditEvent {
+	ev, _ := ctx.Value(auditKey{}).(*auditEvent)
+
+	return ev
+}
+
+// siem sends audit events in CEF or LEEF format to a syslog receiver over UDP or TCP
+type siem struct {
+	network  string
+	address  string
+	format   string
+	hostname string
+	version  string
+	metrics  *serverMetrics
+	logger   zerolog.Logger
+
+	events chan *auditEvent
+	conn   net.Conn
+}
+
+// newSIEM returns a siem sending to address, which is a URL such as "udp://siem.example.com:514"
+func newSIEM(address, format, version string, metrics *serverMetrics, logger zerolog.Logger) (*siem, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid siem address: %w", err)
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("siem address must use udp or tcp")
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "514")
+	}
+
+	switch format {
+	case "":
+		format = SIEMFormatCEF
+	case SIEMFormatCEF, SIEMFormatLEEF:
+	default:
+		return nil, fmt.Errorf("siem format must be %q or %q", SIEMFormatCEF, SIEMFormatLEEF)
+	}
+
+	if version == "" {
+		version = "unknown"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	return &siem{
+		network:  u.Scheme,
+		address:  u.Host,
+		format:   format,
+		hostname: hostname,
+		version:  version,
+		metrics:  metrics,
+		logger:   logger,
+		events:   make(chan *auditEvent, siemQueueSize),
+	}, nil
+}
+
+// hooks registers callbacks with the proxy that fill in the audit event of each request
+func (s *siem) hooks(k *proxy.KerberosProxy) {
+	k.OnRequestDecoded(func(ctx context.Context, msg *proxy.KdcProxyMsg) {
+		ev := auditFromContext(ctx)
+		if ev == nil {
+			return
+		}
+
+		ev.mu.Lock()
+		defer ev.mu.Unlock()
+
+		ev.Realm = msg.TargetDomain
+
+		// the type and principals are only available by decoding the kerberos message
+		b, err := proxy.EncodeKdcProxyMessage(msg)
+		if err != nil {
+			return
+		}
+		if m, err := proxy.DecodeKdcProxyMessage(b); err == nil {
+			ev.Type = m.Type
+			ev.ClientPrincipal = m.ClientPrincipal
+			ev.ServicePrincipal = m.ServicePrincipal
+		}
+	})
+
+	k.OnForwardAttempt(func(ctx context.Context, fe proxy.ForwardEvent) {
+		ev := auditFromContext(ctx)
+		if ev == nil {
+			return
+		}
+
+		ev.mu.Lock()
+		defer ev.mu.Unlock()
+
+		ev.KDC = fe.KDC
+		ev.Proto = fe.Proto
+	})
+}
+
+// Handler records an audit event for each request and queues it to be sent. Events are dropped
+// rather than delaying requests when the queue is full.
+func (s *siem) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ev := &auditEvent{
+			Time:     time.Now(),
+			Client:   clientIP(r),
+			Identity: clientIdentity(r),
+		}
+		if id, ok := hlog.IDFromRequest(r); ok {
+			ev.RequestID = id.String()
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditKey{}, ev)))
+
+		ev.mu.Lock()
+		ev.Status = sw.status
+		ev.Duration = time.Since(ev.Time)
+		ev.mu.Unlock()
+
+		select {
+		case s.events <- ev:
+		default:
+			s.metrics.siemDropped.Inc()
+		}
+	})
+}
+
+// Run sends queued events until ctx is cancelled
+func (s *siem) Run(ctx context.Context) error {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-s.events:
+			if err := s.send(ev); err != nil {
+				s.metrics.siemDropped.Inc()
+				s.logger.Warn().Err(err).Str("siem", s.address).Msg("unable to send audit event")
+				continue
+			}
+			s.metrics.siemEvents.Inc()
+		}
+	}
+}
+
+// send writes a single event, connecting or reconnecting as required
+func (s *siem) send(ev *auditEvent) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write([]byte(s.message(ev))); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// message returns ev as a syslog message, newline terminated for framing over TCP
+func (s *siem) message(ev *auditEvent) string {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+
+	// informational for success, warning otherwise
+	pri, severity, name := siemFacility*8+6, 3, "KDC proxy request forwarded"
+	if ev.Status != http.StatusOK {
+		pri, severity, name = siemFacility*8+4, 6, "KDC proxy request rejected"
+	}
+
+	var body string
+	switch s.format {
+	case SIEMFormatLEEF:
+		body = s.leef(ev, severity)
+	default:
+		body = s.cef(ev, severity, name)
+	}
+
+	return fmt.Sprintf("<%d>%s %s %s\n", pri, ev.Time.Format(time.Stamp), s.hostname, body)
+}
+
+// cef formats ev in ArcSight Common Event Format
+func (s *siem) cef(ev *auditEvent, severity int, name string) string {
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	value := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+
+	ext := []string{
+		"rt=" + strconv.FormatInt(ev.Time.UnixMilli(), 10),
+		"src=" + value.Replace(ev.Client),
+		"outcome=" + strconv.Itoa(ev.Status),
+		"cn1Label=durationMs",
+		"cn1=" + strconv.FormatInt(ev.Duration.Milliseconds(), 10),
+	}
+	for _, kv := range [][2]string{
+		{"externalId", ev.RequestID},
+		{"suid", ev.Identity},
+		{"suser", ev.ClientPrincipal},
+		{"duser", ev.ServicePrincipal},
+		{"dhost", ev.KDC},
+		{"app", ev.Proto},
+		{"act", string(ev.Type)},
+		{"cs1Label", "realm"},
+		{"cs1", ev.Realm},
+	} {
+		if kv[1] != "" {
+			ext = append(ext, kv[0]+"="+value.Replace(kv[1]))
+		}
+	}
+
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%d|%s|%d|%s",
+		siemVendor, siemProduct, header.Replace(s.version), ev.Status, name, severity, strings.Join(ext, " "))
+}
+
+// leef formats ev in IBM QRadar Log Event Extended Format
+func (s *siem) leef(ev *auditEvent, severity int) string {
+	header := strings.NewReplacer(`|`, `\|`)
+	value := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+	attrs := []string{
+		"devTime=" + strconv.FormatInt(ev.Time.UnixMilli(), 10),
+		"devTimeFormat=epoch",
+		"src=" + value.Replace(ev.Client),
+		"sev=" + strconv.Itoa(severity),
+		"status=" + strconv.Itoa(ev.Status),
+		"durationMs=" + strconv.FormatInt(ev.Duration.Milliseconds(), 10),
+	}
+	for _, kv := range [][2]string{
+		{"requestId", ev.RequestID},
+		{"identity", ev.Identity},
+		{"usrName", ev.ClientPrincipal},
+		{"servicePrincipal", ev.ServicePrincipal},
+		{"dst", ev.KDC},
+		{"proto", ev.Proto},
+		{"messageType", string(ev.Type)},
+		{"realm", ev.Realm},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, kv[0]+"="+value.Replace(kv[1]))
+		}
+	}
+
+	return fmt.Sprintf("LEEF:1.0|%s|%s|%s|%d|%s",
+		siemVendor, siemProduct, header.Replace(s.version), ev.Status, strings.Join(attrs, "\t"))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+func TestNewSIEM(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{"udp", "udp://siem.example.com:514", "", "siem.example.com:514", false},
+		{"tcp default port", "tcp://siem.example.com", SIEMFormatLEEF, "siem.example.com:514", false},
+		{"bad scheme", "http://siem.example.com", "", "", true},
+		{"bad format", "udp://siem.example.com", "json", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSIEM(tt.address, tt.format, "", testMetrics(t), zerolog.Nop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSIEM() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && s.address != tt.want {
+				t.Errorf("address = %s, want %s", s.address, tt.want)
+			}
+		})
+	}
+}
+
+func TestSIEMMessage(t *testing.T) {
+	ev := &auditEvent{
+		Time:            time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Client:          "192.0.2.1",
+		Realm:           "EXAMPLE.COM",
+		Type:            proxy.MessageTypeASReq,
+		ClientPrincipal: "user=admin|x",
+		KDC:             "kdc.example.com:88",
+		Status:          http.StatusForbidden,
+	}
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{SIEMFormatCEF, []string{
+			"<36>Jan  2 03:04:05 ",
+			"CEF:0|andrewheberle|kdcproxy|v1.0\\|x|403|KDC proxy request rejected|6|",
+			"suser=user\\=admin|x",
+			"cs1=EXAMPLE.COM",
+			"dhost=kdc.example.com:88",
+		}},
+		{SIEMFormatLEEF, []string{
+			"LEEF:1.0|andrewheberle|kdcproxy|v1.0\\|x|403|",
+			"\tusrName=user=admin|x",
+			"\trealm=EXAMPLE.COM",
+			"\tsev=6",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			s, err := newSIEM("udp://127.0.0.1", tt.format, "v1.0|x", testMetrics(t), zerolog.Nop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := s.message(ev)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("message() = %q, missing %q", got, want)
+				}
+			}
+			if !strings.HasSuffix(got, "\n") || strings.Count(got, "\n") != 1 {
+				t.Errorf("message() = %q, want a single line", got)
+			}
+		})
+	}
+}
+
+func TestSIEMExport(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	k, err := proxy.NewKdcProxy(proxy.WithRegistry(prometheus.NewRegistry()), proxy.WithDryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(Config{Proxy: k, SIEMAddress: "udp://" + pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.siem.Run(ctx)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/KdcProxy", bytes.NewReader(testRequestBody(t)))
+	s.Handler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no audit event received: %v", err)
+	}
+
+	got := string(buf[:n])
+	for _, want := range []string{"CEF:0|", "|200|KDC proxy request forwarded|3|", "suser=user", "cs1=EXAMPLE.COM", "act=AS-REQ", "src=192.0.2.1"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("event = %q, missing %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+)
+
+// AdminTailPath is the endpoint that streams a summary of each request as server-sent events
+const AdminTailPath = "/admin/tail"
+
+// Live tail settings
+const (
+	// tailBuffer is the number of summaries buffered for each subscriber, beyond which summaries
+	// are dropped rather than slowing down requests
+	tailBuffer = 64
+
+	// tailKeepAlive is how often a comment is sent to keep idle streams open through load balancers
+	tailKeepAlive = 15 * time.Second
+)
+
+// requestSummary is a summary of a request, which excludes the client and principal names
+type requestSummary struct {
+	Time     time.Time         `json:"time"`
+	Realm    string            `json:"realm,omitempty"`
+	Type     proxy.MessageType `json:"type,omitempty"`
+	KDC      string            `json:"kdc,omitempty"`
+	Proto    string            `json:"proto,omitempty"`
+	Attempts int               `json:"attempts"`
+	Status   int               `json:"status"`
+	Latency  float64           `json:"latency_seconds"`
+}
+
+// tail streams request summaries to subscribers
+type tail struct {
+	mu   sync.Mutex
+	subs map[chan requestSummary]struct{}
+
+	// closing is closed when the server shuts down, ending all streams
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newTail() *tail {
+	return &tail{
+		subs:    make(map[chan requestSummary]struct{}),
+		closing: make(chan struct{}),
+	}
+}
+
+// close ends all streams, as they would otherwise hold up shutdown until its timeout
+func (t *tail) close() {
+	t.closeOnce.Do(func() { close(t.closing) })
+}
+
+// active returns true if there are any subscribers
+func (t *tail) active() bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.subs) > 0
+}
+
+// publish sends the summary to each subscriber that is keeping up
+func (t *tail) publish(summary requestSummary) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for sub := range t.subs {
+		select {
+		case sub <- summary:
+		default:
+		}
+	}
+}
+
+func (t *tail) subscribe() chan requestSummary {
+	sub := make(chan requestSummary, tailBuffer)
+
+	t.mu.Lock()
+	t.subs[sub] = struct{}{}
+	t.mu.Unlock()
+
+	return sub
+}
+
+func (t *tail) unsubscribe(sub chan requestSummary) {
+	t.mu.Lock()
+	delete(t.subs, sub)
+	t.mu.Unlock()
+}
+
+// ServeHTTP streams request summaries as server-sent events until the client disconnects or the
+// server shuts down
+func (t *tail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// the stream outlives the write timeout of the server
+	rc.SetWriteDeadline(time.Time{})
+
+	sub := t.subscribe()
+	defer t.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(tailKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.closing:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case summary := <-sub:
+			b, err := json.Marshal(summary)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewheberle/kdcproxy/pkg/proxy"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTail(t *testing.T) {
+	krbErr := messages.NewKRBError(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/EXAMPLE.COM"), "EXAMPLE.COM", errorcode.KDC_ERR_PREAUTH_REQUIRED, "preauth required")
+	reply, err := krbErr.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := proxy.NewKdcProxy(
+		proxy.WithKrb5ConfString("[realms]\n EXAMPLE.COM = {\n  kdc = kdc.example.com:88\n }\n"),
+		proxy.WithRegistry(prometheus.NewRegistry()),
+		proxy.WithTransport(&replyTransport{reply: append(proxy.MarshalKerbLength(len(reply)), reply...)}),
+		proxy.WithProtocols("tcp"),
+	)
+	if err != nil {
+		t.Fatalf("NewKdcProxy() error = %v", err)
+	}
+	s, err := NewServer(Config{Proxy: k, AdminToken: "token"})
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// the admin token is required
+	resp, err := http.Get(ts.URL + AdminTailPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+AdminTailPath, nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %s", ct)
+	}
+
+	// each request is streamed once the tail is connected
+	kdcResp, err := http.Post(ts.URL+"/KdcProxy", "application/kerberos", bytes.NewReader(testRequestBody(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdcResp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var got requestSummary
+		if err := json.Unmarshal([]byte(data), &got); err != nil {
+			t.Fatalf("invalid summary %s: %v", data, err)
+		}
+		want := requestSummary{Time: got.Time, Realm: "EXAMPLE.COM", Type: proxy.MessageTypeASReq, KDC: "kdc.example.com:88", Proto: "tcp", Attempts: 1, Status: http.StatusOK, Latency: got.Latency}
+		if got != want {
+			t.Errorf("summary = %+v, want %+v", got, want)
+		}
+		if strings.Contains(data, "user") {
+			t.Errorf("summary includes the principal: %s", data)
+		}
+		return
+	}
+	t.Fatalf("no summary received: %v", scanner.Err())
+}
+
+func TestTailShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := testServer(t, Config{Listen: addr, AdminToken: "token", ShutdownTimeout: time.Minute, DrainDelay: 100 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !s.Ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("server did not become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+AdminTailPath, nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// an open stream does not hold up shutdown
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return while a tail was streaming")
+	}
+
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("stream did not end cleanly: %v", err)
+	}
+}
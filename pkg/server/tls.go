@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// handshakeReasons maps text found in TLS handshake errors to the reason used in metrics
+var handshakeReasons = []struct {
+	match  string
+	reason string
+}{
+	{"bad certificate", "bad_certificate"},
+	{"unknown certificate authority", "unknown_ca"},
+	{"certificate required", "certificate_required"},
+	{"expired certificate", "expired_certificate"},
+	{"protocol version", "protocol_version"},
+	{"no cipher suite", "no_cipher_suite"},
+	{"does not look like a TLS handshake", "not_tls"},
+	{"i/o timeout", "timeout"},
+	{"EOF", "eof"},
+	{"connection reset", "connection_reset"},
+}
+
+// handshakeReason returns the reason for a TLS handshake error message
+func handshakeReason(msg string) string {
+	for _, r := range handshakeReasons {
+		if strings.Contains(msg, r.match) {
+			return r.reason
+		}
+	}
+
+	return "other"
+}
+
+// errorLogWriter receives the errors logged by the http.Server, recording TLS handshake failures as
+// metrics and passing all messages to the logger
+type errorLogWriter struct {
+	metrics *serverMetrics
+	logger  zerolog.Logger
+}
+
+func (w *errorLogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimSpace(p))
+
+	if strings.Contains(msg, "TLS handshake error") {
+		reason := handshakeReason(msg)
+		w.metrics.tlsHandshakeErrors.WithLabelValues(reason).Inc()
+		w.logger.Debug().Str("reason", reason).Msg(msg)
+
+		return len(p), nil
+	}
+
+	w.logger.Warn().Msg(msg)
+
+	return len(p), nil
+}
+
+// fingerprint returns a hash of the parameters offered by a client in its TLS ClientHello, which
+// is the same for clients using the same TLS stack and configuration
+func fingerprint(hello *tls.ClientHelloInfo) string {
+	h := sha256.New()
+
+	write := func(values ...uint16) {
+		binary.Write(h, binary.BigEndian, uint16(len(values)))
+		binary.Write(h, binary.BigEndian, values)
+	}
+
+	write(hello.SupportedVersions...)
+	write(hello.CipherSuites...)
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	write(curves...)
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	write(points...)
+	schemes := make([]uint16, len(hello.SignatureSchemes))
+	for i, s := range hello.SignatureSchemes {
+		schemes[i] = uint16(s)
+	}
+	write(schemes...)
+	h.Write([]byte(strings.Join(hello.SupportedProtos, ",")))
+
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestHandshakeReason(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"http: TLS handshake error from 127.0.0.1:1234: remote error: tls: bad certificate", "bad_certificate"},
+		{"http: TLS handshake error from 127.0.0.1:1234: tls: client offered only unsupported versions: [302 301]: protocol version not supported", "protocol_version"},
+		{"http: TLS handshake error from 127.0.0.1:1234: tls: first record does not look like a TLS handshake", "not_tls"},
+		{"http: TLS handshake error from 127.0.0.1:1234: EOF", "eof"},
+		{"http: TLS handshake error from 127.0.0.1:1234: something else", "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := handshakeReason(tt.msg); got != tt.want {
+				t.Errorf("handshakeReason() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorLogWriter(t *testing.T) {
+	m := testMetrics(t)
+	w := &errorLogWriter{metrics: m, logger: zerolog.Nop()}
+
+	w.Write([]byte("http: TLS handshake error from 127.0.0.1:1234: tls: first record does not look like a TLS handshake\n"))
+	w.Write([]byte("http: some other error\n"))
+
+	if got := testutil.ToFloat64(m.tlsHandshakeErrors.WithLabelValues("not_tls")); got != 1 {
+		t.Errorf("tls handshake errors = %v, want 1", got)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+		ServerName:        "one.example.com",
+	}
+	b := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+		ServerName:        "two.example.com",
+	}
+	c := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+		SupportedCurves:   []tls.CurveID{tls.X25519},
+	}
+
+	if fingerprint(a) != fingerprint(b) {
+		t.Errorf("fingerprint() differs for the same client parameters")
+	}
+
+	if fingerprint(a) == fingerprint(c) {
+		t.Errorf("fingerprint() is the same for different client parameters")
+	}
+
+	if len(fingerprint(a)) != 32 {
+		t.Errorf("fingerprint() = %v, want 32 characters", fingerprint(a))
+	}
+}
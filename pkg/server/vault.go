@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// CertificateSource provides the server certificate and keeps it up to date until ctx is cancelled.
+// A *fswatcher.Sentinel satisfies this interface.
+type CertificateSource interface {
+	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	Start(ctx context.Context) error
+}
+
+// Defaults for fetching certificates from Vault
+const (
+	DefaultVaultRefresh = time.Hour
+	vaultRetry          = 30 * time.Second
+)
+
+// VaultConfig configures a certificate source using HashiCorp Vault
+type VaultConfig struct {
+	// Address of the Vault server, which defaults to the VAULT_ADDR environment variable
+	Address string
+
+	// Token used to authenticate, which defaults to the VAULT_TOKEN environment variable
+	Token string
+
+	// Path of the secret. When CommonName is set this is a PKI issue endpoint such as "pki/issue/role",
+	// otherwise it is a KV version 2 secret such as "secret/data/kdcproxy" with "certificate" and
+	// "private_key" fields in PEM format.
+	Path string
+
+	// CommonName of the certificate to issue from the PKI secrets engine
+	CommonName string
+
+	// TTL requested for certificates issued by the PKI secrets engine
+	TTL time.Duration
+
+	// Refresh is the maximum interval between reads of a KV secret, which defaults to
+	// DefaultVaultRefresh. Certificates are always renewed after two thirds of their lifetime.
+	Refresh time.Duration
+
+	// Client is the HTTP client used to contact Vault, which defaults to http.DefaultClient
+	Client *http.Client
+
+	// Logger is used to log renewals and failures
+	Logger zerolog.Logger
+}
+
+// VaultSource is a CertificateSource that fetches the certificate and key from Vault and renews them
+// before they expire
+type VaultSource struct {
+	cfg  VaultConfig
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// NewVaultSource returns a VaultSource after fetching the initial certificate
+func NewVaultSource(ctx context.Context, cfg VaultConfig) (*VaultSource, error) {
+	if cfg.Address == "" {
+		cfg.Address = os.Getenv("VAULT_ADDR")
+	}
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if cfg.Address == "" || cfg.Path == "" {
+		return nil, fmt.Errorf("vault address and path are required")
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = DefaultVaultRefresh
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	v := &VaultSource{cfg: cfg}
+	if err := v.fetch(ctx); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// GetCertificate implements CertificateSource
+func (v *VaultSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return v.cert.Load(), nil
+}
+
+// Start implements CertificateSource, renewing the certificate until ctx is cancelled. Failures are
+// logged and retried while the current certificate continues to be used.
+func (v *VaultSource) Start(ctx context.Context) error {
+	timer := time.NewTimer(v.next())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			if err := v.fetch(ctx); err != nil {
+				v.cfg.Logger.Error().Err(err).Msg("unable to renew certificate from vault")
+				timer.Reset(vaultRetry)
+				continue
+			}
+			v.cfg.Logger.Info().Time("not_after", v.cert.Load().Leaf.NotAfter).Msg("renewed certificate from vault")
+			timer.Reset(v.next())
+		}
+	}
+}
+
+// next returns the time until the certificate should be renewed
+func (v *VaultSource) next() time.Duration {
+	leaf := v.cert.Load().Leaf
+	renew := time.Until(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3))
+
+	// kv secrets may be replaced at any time so are read at least every refresh interval
+	if v.cfg.CommonName == "" && renew > v.cfg.Refresh {
+		renew = v.cfg.Refresh
+	}
+
+	return max(renew, 0)
+}
+
+// fetch reads or issues the certificate from Vault
+func (v *VaultSource) fetch(ctx context.Context) error {
+	method, body := http.MethodGet, []byte(nil)
+	if v.cfg.CommonName != "" {
+		req := map[string]string{"common_name": v.cfg.CommonName}
+		if v.cfg.TTL > 0 {
+			req["ttl"] = v.cfg.TTL.String()
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		method, body = http.MethodPost, b
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.cfg.Address, "/")+"/v1/"+strings.TrimPrefix(v.cfg.Path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.cfg.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var secret struct {
+		Data struct {
+			// pki
+			Certificate string   `json:"certificate"`
+			PrivateKey  string   `json:"private_key"`
+			CAChain     []string `json:"ca_chain"`
+			// kv version 2
+			Data struct {
+				Certificate string `json:"certificate"`
+				PrivateKey  string `json:"private_key"`
+			} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return fmt.Errorf("invalid vault response: %w", err)
+	}
+
+	certPEM, keyPEM := secret.Data.Certificate, secret.Data.PrivateKey
+	if v.cfg.CommonName == "" {
+		certPEM, keyPEM = secret.Data.Data.Certificate, secret.Data.Data.PrivateKey
+	} else {
+		certPEM = strings.Join(append([]string{certPEM}, secret.Data.CAChain...), "\n")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return fmt.Errorf("invalid certificate from vault: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("invalid certificate from vault: %w", err)
+		}
+	}
+	v.cert.Store(&cert)
+
+	return nil
+}
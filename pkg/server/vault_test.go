@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate and key in PEM format
+func testCertificate(t *testing.T, cn string, lifetime time.Duration) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestVaultSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		commonName string
+		wantMethod string
+		wantErr    bool
+	}{
+		{"kv", "secret/data/kdcproxy", "", http.MethodGet, false},
+		{"pki", "pki/issue/kdcproxy", "kdcproxy.example.com", http.MethodPost, false},
+		{"forbidden", "secret/data/other", "", http.MethodGet, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, key := testCertificate(t, "kdcproxy.example.com", time.Hour)
+
+			vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Vault-Token") != "token" || r.URL.Path != "/v1/"+tt.path || r.URL.Path == "/v1/secret/data/other" {
+					http.Error(w, "permission denied", http.StatusForbidden)
+					return
+				}
+				if r.Method != tt.wantMethod {
+					t.Errorf("method = %s, want %s", r.Method, tt.wantMethod)
+				}
+
+				data := map[string]any{"certificate": cert, "private_key": key}
+				if r.Method == http.MethodPost {
+					var req map[string]string
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req["common_name"] != tt.commonName {
+						t.Errorf("request = %v, error = %v", req, err)
+					}
+					data["ca_chain"] = []string{}
+				} else {
+					data = map[string]any{"data": data}
+				}
+				json.NewEncoder(w).Encode(map[string]any{"data": data})
+			}))
+			defer vault.Close()
+
+			v, err := NewVaultSource(context.Background(), VaultConfig{
+				Address:    vault.URL,
+				Token:      "token",
+				Path:       tt.path,
+				CommonName: tt.commonName,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewVaultSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got, err := v.GetCertificate(nil)
+			if err != nil || got.Leaf.Subject.CommonName != "kdcproxy.example.com" {
+				t.Errorf("GetCertificate() = %v, %v", got, err)
+			}
+
+			// renewal is due after two thirds of the lifetime, but kv secrets are re-read at least hourly
+			if next := v.next(); next <= 30*time.Minute || next > 41*time.Minute {
+				t.Errorf("next() = %v", next)
+			}
+		})
+	}
+}
+
+func TestVaultSourceRequired(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+
+	if _, err := NewVaultSource(context.Background(), VaultConfig{Path: "secret/data/kdcproxy"}); err == nil {
+		t.Error("NewVaultSource() expected error without address")
+	}
+}